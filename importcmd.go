@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/importer"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// runImport imports every new peer from path, a wg0.conf, wg dump or wg-easy
+// export, and with server set its server settings too, then prints what was
+// and was not carried across. It is the command-line counterpart of the
+// import dialog, for migrating before wg-busy first starts.
+func runImport(out io.Writer, store *config.Store, path string, server bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	src, err := importer.Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var preview importer.Preview
+	store.Read(func(cfg *models.AppConfig) { preview = importer.NewPreview(*cfg, src) })
+	fmt.Fprintf(out, "%s: %s, %d peer(s)\n", path, preview.Format, len(preview.Peers))
+	for _, warning := range preview.Warnings {
+		fmt.Fprintf(out, "  warning: %s\n", warning)
+	}
+	var keys []string
+	for _, row := range preview.Peers {
+		fmt.Fprintf(out, "  %-8s %s\n", row.Status, row.Peer.Name)
+		for _, note := range row.Notes {
+			fmt.Fprintf(out, "           %s\n", note)
+		}
+		if row.Status == importer.StatusNew {
+			keys = append(keys, row.Peer.PublicKey)
+		}
+	}
+	for _, change := range preview.ServerChanges {
+		if server {
+			fmt.Fprintf(out, "  server   %s\n", change)
+		} else {
+			fmt.Fprintf(out, "  skipped  server %s (use -import-server)\n", change)
+		}
+	}
+
+	var added int
+	// Save, not Write: importing prepares config.yaml and wg0.conf for the next
+	// start and must not reload WireGuard or touch routing on the live host.
+	err = store.Save(func(cfg *models.AppConfig) error {
+		var err error
+		added, err = importer.Apply(cfg, src, keys, server, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported %d peer(s)\n", added)
+	return nil
+}
@@ -0,0 +1,304 @@
+// Package alert evaluates the alert rules in config.yaml — a peer not seen for
+// a while, a BGP session down, too few prefixes, wg0 down, ZeroTier offline, a
+// quota nearly used up — and notifies when an alert fires and when it
+// resolves, through the webhooks and a local mail relay. It gives sites
+// without a monitoring stack basic alerting.
+package alert
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/webhook"
+	"github.com/yix/wg-busy/internal/wgstats"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+const (
+	// EvalInterval is how often the rules are evaluated. Config changes are
+	// evaluated at once.
+	EvalInterval = 15 * time.Second
+
+	// ResolvedLogSize is how many resolved alerts the panel keeps.
+	ResolvedLogSize = 50
+)
+
+// Alert states.
+const (
+	StatePending  = "pending"  // the condition holds, but not yet for the rule's For
+	StateFiring   = "firing"   // notified, unless silenced
+	StateResolved = "resolved" // the condition stopped holding after firing
+)
+
+// Alert is one rule holding for one subject.
+type Alert struct {
+	Rule        string    `json:"rule"` // rule ID
+	RuleName    string    `json:"ruleName"`
+	Kind        string    `json:"kind"`
+	Severity    string    `json:"severity"`
+	Subject     string    `json:"subject"` // peer ID, neighbour IP, "wg0" or "zerotier"
+	SubjectName string    `json:"subjectName"`
+	Summary     string    `json:"summary"`
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"` // when the condition started to hold
+	FiredAt     time.Time `json:"firedAt,omitzero"`
+	ResolvedAt  time.Time `json:"resolvedAt,omitzero"`
+	Silenced    bool      `json:"silenced"`
+	// notified records that the firing notification went out, so that the
+	// resolve is sent too.
+	notified bool
+}
+
+// Sources are the live states the rules read besides the config. A nil
+// function is a source that is not running; its rules never hold.
+type Sources struct {
+	InterfaceUp func() bool
+	BGP         func() *models.BGPStats
+	ZeroTier    func() zerotier.Snapshot
+}
+
+// Engine evaluates the alert rules and sends their notifications.
+type Engine struct {
+	store    *config.Store
+	src      Sources
+	notifier *webhook.Notifier
+	host     string
+	mailer   *mailer
+	kick     chan struct{}
+
+	mu       sync.Mutex
+	active   map[string]*Alert // by rule ID and subject
+	resolved []Alert           // newest first
+	onChange func()
+}
+
+// New returns an engine for the store's rules. notifier may be nil, in which
+// case alerts are only mailed.
+func New(store *config.Store, src Sources, notifier *webhook.Notifier) *Engine {
+	host, _ := os.Hostname()
+	return &Engine{
+		store:    store,
+		src:      src,
+		notifier: notifier,
+		host:     host,
+		mailer:   newMailer(host),
+		kick:     make(chan struct{}, 1),
+		active:   make(map[string]*Alert),
+	}
+}
+
+// OnChange registers fn to be called after an evaluation that changed the
+// alerts. It runs on the engine's goroutine and must not block.
+func (e *Engine) OnChange(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onChange = fn
+}
+
+// ConfigChanged is a config.Store OnChange callback: rules and silences take
+// effect at the next evaluation, which it brings forward.
+func (e *Engine) ConfigChanged(*models.AppConfig) {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Start begins evaluating the rules and delivering mail in the background.
+func (e *Engine) Start() {
+	go e.mailer.run()
+	go func() {
+		ticker := time.NewTicker(EvalInterval)
+		defer ticker.Stop()
+
+		for {
+			e.Evaluate(time.Now())
+			select {
+			case <-ticker.C:
+			case <-e.kick:
+			}
+		}
+	}()
+}
+
+// Evaluate evaluates every rule at now and sends the notifications due.
+func (e *Engine) Evaluate(now time.Time) {
+	in := input{now: now}
+	if e.src.InterfaceUp != nil {
+		in.ifaceKnown, in.ifaceUp = true, e.src.InterfaceUp()
+	}
+	if e.src.BGP != nil {
+		in.bgp = e.src.BGP()
+	}
+	if e.src.ZeroTier != nil {
+		in.zt = e.src.ZeroTier()
+	}
+
+	var notify []Alert
+	var changed bool
+	var mail models.AlertMail
+	e.store.Read(func(cfg *models.AppConfig) {
+		in.cfg = cfg
+		e.mu.Lock()
+		notify, changed = e.evaluate(in)
+		e.mu.Unlock()
+		mail = cfg.Alerts.Mail
+		mail.To = slices.Clone(cfg.Alerts.Mail.To)
+	})
+
+	for _, a := range notify {
+		if e.notifier != nil {
+			e.notifier.Notify(e.event(a))
+		}
+		if mail.Wants(a.Severity) {
+			e.mailer.send(mail, a)
+		}
+	}
+	if changed {
+		e.mu.Lock()
+		fn := e.onChange
+		e.mu.Unlock()
+		if fn != nil {
+			fn()
+		}
+	}
+}
+
+// evaluate moves the alerts to the state of in and returns the alerts whose
+// firing or resolve should be notified, and whether anything changed. The
+// caller holds e.mu.
+func (e *Engine) evaluate(in input) (notify []Alert, changed bool) {
+	seen := make(map[string]bool)
+	for i := range in.cfg.Alerts.Rules {
+		rule := &in.cfg.Alerts.Rules[i]
+		if !rule.Enabled {
+			continue
+		}
+		for _, c := range conditions(rule, in) {
+			key := rule.ID + "/" + c.subject
+			seen[key] = true
+			a, ok := e.active[key]
+			if !ok {
+				a = &Alert{Rule: rule.ID, Subject: c.subject, State: StatePending, Since: c.since}
+				if a.Since.IsZero() {
+					a.Since = in.now
+				}
+				e.active[key] = a
+				changed = true
+			}
+			before := *a
+			a.RuleName, a.Kind, a.Severity = rule.Name, rule.Kind, rule.Severity
+			a.SubjectName, a.Summary = c.name, c.summary
+			if a.State == StatePending && in.now.Sub(a.Since) >= rule.For {
+				a.State, a.FiredAt = StateFiring, in.now
+			}
+			a.Silenced = silenced(in.cfg.Alerts.Silences, rule.ID, c.subject, in.now)
+			// An alert silenced when it fired is notified once the silence
+			// ends, if it is still firing then.
+			if a.State == StateFiring && !a.notified && !a.Silenced {
+				a.notified = true
+				notify = append(notify, *a)
+			}
+			changed = changed || *a != before
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(e.active)) {
+		if seen[key] {
+			continue
+		}
+		a := e.active[key]
+		delete(e.active, key)
+		changed = true
+		// Pending alerts never fired, so they go quietly.
+		if a.State != StateFiring {
+			continue
+		}
+		a.State, a.ResolvedAt = StateResolved, in.now
+		e.resolved = slices.Insert(e.resolved, 0, *a)
+		if len(e.resolved) > ResolvedLogSize {
+			e.resolved = e.resolved[:ResolvedLogSize]
+		}
+		if a.notified {
+			notify = append(notify, *a)
+		}
+	}
+	return notify, changed
+}
+
+func silenced(silences []models.AlertSilence, rule, subject string, now time.Time) bool {
+	for i := range silences {
+		if silences[i].Matches(rule, subject, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Alerts returns the pending and firing alerts, most severe and oldest first,
+// and the latest resolved ones, newest first.
+func (e *Engine) Alerts() (active, resolved []Alert) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, a := range e.active {
+		active = append(active, *a)
+	}
+	slices.SortFunc(active, func(a, b Alert) int {
+		if a.State != b.State {
+			if a.State == StateFiring {
+				return -1
+			}
+			return 1
+		}
+		if sa, sb := slices.Index(models.AlertSeverities, a.Severity), slices.Index(models.AlertSeverities, b.Severity); sa != sb {
+			return sb - sa
+		}
+		return a.Since.Compare(b.Since)
+	})
+	return active, slices.Clone(e.resolved)
+}
+
+// MailStatus returns when the last mail was sent or failed, and why it failed.
+func (e *Engine) MailStatus() (time.Time, string) {
+	return e.mailer.status()
+}
+
+// TestMail sends a test message through the relay now.
+func (e *Engine) TestMail(settings models.AlertMail) error {
+	return e.mailer.deliver(settings, "wg-busy test message", fmt.Sprintf("This is a test message from wg-busy on %s.\n", e.host))
+}
+
+// event is the webhook event of a firing or resolved alert.
+func (e *Engine) event(a Alert) webhook.Event {
+	ev := webhook.Event{
+		Time:    a.FiredAt,
+		Subject: webhook.Subject{Kind: subjectKind(a.Kind), ID: a.Subject, Name: a.SubjectName},
+		Details: map[string]any{
+			"rule":     a.RuleName,
+			"ruleId":   a.Rule,
+			"kind":     a.Kind,
+			"severity": a.Severity,
+			"since":    a.Since,
+		},
+	}
+	if a.State == StateResolved {
+		ev.Type, ev.Time, ev.Severity = models.EventAlertResolved, a.ResolvedAt, models.SeverityInfo
+		ev.Summary = fmt.Sprintf("Resolved: %s — %s (after %s)", a.RuleName, a.SubjectName, wgstats.FormatDuration(a.ResolvedAt.Sub(a.Since)))
+		return ev
+	}
+	ev.Type, ev.Severity = models.EventAlertFiring, a.Severity
+	ev.Summary = fmt.Sprintf("%s: %s", a.RuleName, a.Summary)
+	return ev
+}
+
+// logf logs an engine problem.
+func logf(format string, args ...any) {
+	log.Printf("alert: "+format, args...)
+}
@@ -0,0 +1,183 @@
+package alert
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+func TestEvaluateFiresResolvesAndSilences(t *testing.T) {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &models.AppConfig{Alerts: models.AlertConfig{Rules: []models.AlertRule{
+		{ID: "down", Name: "BGP down", Enabled: true, Kind: models.AlertBGPDown, Severity: models.SeverityCritical, For: 2 * time.Minute},
+	}}}
+	session := func(state string) *models.BGPStats {
+		return &models.BGPStats{Peers: []models.BGPPeerStats{{Name: "rr1", IP: "192.0.2.1", ASN: 65001, State: state}}}
+	}
+	e := New(nil, Sources{}, nil)
+	eval := func(at time.Duration, state string) []Alert {
+		t.Helper()
+		notify, _ := e.evaluate(input{now: start.Add(at), cfg: cfg, bgp: session(state)})
+		return notify
+	}
+
+	if n := eval(0, "Active"); len(n) != 0 || e.active["down/192.0.2.1"].State != StatePending {
+		t.Fatalf("first sighting: notify %v, active %+v", n, e.active)
+	}
+	if n := eval(time.Minute, "Connect"); len(n) != 0 {
+		t.Fatalf("notified before For: %v", n)
+	}
+	n := eval(2*time.Minute, "Active")
+	if len(n) != 1 || n[0].State != StateFiring || n[0].Summary != "BGP session with rr1 (AS65001) is Active" {
+		t.Fatalf("firing: %+v", n)
+	}
+	if n := eval(3*time.Minute, "Active"); len(n) != 0 {
+		t.Fatalf("fired twice: %v", n)
+	}
+	n = eval(4*time.Minute, "Established")
+	if len(n) != 1 || n[0].State != StateResolved || len(e.active) != 0 {
+		t.Fatalf("resolve: %+v", n)
+	}
+	if _, resolved := e.Alerts(); len(resolved) != 1 || !resolved[0].ResolvedAt.Equal(start.Add(4*time.Minute)) {
+		t.Errorf("resolved log = %+v", resolved)
+	}
+
+	// A blip shorter than For neither fires nor resolves.
+	eval(5*time.Minute, "Idle")
+	if n := eval(6*time.Minute, "Established"); len(n) != 0 {
+		t.Errorf("pending alert notified its resolve: %v", n)
+	}
+
+	// Silenced when it fires, it is notified once the silence ends.
+	cfg.Alerts.Silences = []models.AlertSilence{{ID: "s", Rule: "down", Until: start.Add(20 * time.Minute)}}
+	eval(10*time.Minute, "Idle")
+	if n := eval(12*time.Minute, "Idle"); len(n) != 0 || !e.active["down/192.0.2.1"].Silenced {
+		t.Fatalf("silenced alert notified: %v", n)
+	}
+	if n := eval(20*time.Minute, "Idle"); len(n) != 1 || n[0].State != StateFiring {
+		t.Fatalf("after the silence: %v", n)
+	}
+
+	// Disabling the rule resolves its alerts.
+	cfg.Alerts.Rules[0].Enabled = false
+	if n := eval(21*time.Minute, "Idle"); len(n) != 1 || n[0].State != StateResolved {
+		t.Errorf("disabled rule: %v", n)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	quota := models.PeerQuota{Limit: 1000}
+	cfg := &models.AppConfig{Peers: []models.Peer{
+		{ID: "a", Name: "alice", Enabled: true, LastSeen: now.Add(-time.Minute)},
+		{ID: "b", Name: "bob", Enabled: true, LastSeen: now.Add(-time.Hour),
+			Quota: quota, Usage: models.PeerUsage{PeriodStart: quota.PeriodStart(now), Rx: 600, Tx: 350}},
+		{ID: "c", Name: "carol", Enabled: true},
+		{ID: "d", Name: "dave", LastSeen: now.Add(-time.Hour)},
+	}}
+	in := input{now: now, cfg: cfg, ifaceKnown: true,
+		bgp: &models.BGPStats{Peers: []models.BGPPeerStats{
+			{IP: "192.0.2.1", State: "Established", Routes: make([]models.BGPRoute, 2)},
+			{IP: "192.0.2.2", State: "Established", Routes: make([]models.BGPRoute, 20)},
+		}},
+		zt: zerotier.Snapshot{Enabled: true, Running: true, Status: &zerotier.Status{}},
+	}
+	subjects := func(rule models.AlertRule) []string {
+		var out []string
+		for _, c := range conditions(&rule, in) {
+			out = append(out, c.subject)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		rule models.AlertRule
+		want string
+	}{
+		{models.AlertRule{Kind: models.AlertPeerUnseen}, "b c"},
+		{models.AlertRule{Kind: models.AlertPeerUnseen, Target: "b"}, "b"},
+		{models.AlertRule{Kind: models.AlertQuotaAbove, Threshold: 90}, "b"},
+		{models.AlertRule{Kind: models.AlertQuotaAbove, Threshold: 96}, ""},
+		{models.AlertRule{Kind: models.AlertBGPDown}, ""},
+		{models.AlertRule{Kind: models.AlertBGPPrefixesBelow, Threshold: 5}, "192.0.2.1"},
+		{models.AlertRule{Kind: models.AlertInterfaceDown}, "wg0"},
+		{models.AlertRule{Kind: models.AlertZeroTierOffline}, "zerotier"},
+	} {
+		if got := strings.Join(subjects(tc.rule), " "); got != tc.want {
+			t.Errorf("%s %q: subjects %q, want %q", tc.rule.Kind, tc.rule.Target, got, tc.want)
+		}
+	}
+
+	// An unseen peer's alert counts from its last handshake.
+	if c := conditions(&models.AlertRule{Kind: models.AlertPeerUnseen, Target: "b"}, in); !c[0].since.Equal(now.Add(-time.Hour)) {
+		t.Errorf("since = %v", c[0].since)
+	}
+}
+
+func TestMailDelivery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	got := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 relay ESMTP")
+		var lines []string
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				body, _ := bufio.NewReader(tp.DotReader()).ReadString(0)
+				lines = append(lines, body)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				got <- lines
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	m := newMailer("vpn1")
+	settings := models.AlertMail{Relay: ln.Addr().String(), From: "wg-busy <wg@example.com>", To: []string{"ops@example.com"}}
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	m.send(settings, Alert{RuleName: "Peer unseen", Kind: models.AlertPeerUnseen, Severity: models.SeverityWarning,
+		SubjectName: "alice", Summary: "Peer alice has not been seen since 2026-10-01 11:50", State: StateFiring, Since: at})
+	msg := <-m.queue
+	if err := m.deliver(msg.settings, msg.subject, msg.body); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-got
+	conversation := strings.Join(lines, "\n")
+	for _, want := range []string{"EHLO vpn1", "MAIL FROM:<wg@example.com>", "RCPT TO:<ops@example.com>",
+		"Subject: [vpn1] [FIRING] Peer unseen: alice", "Peer alice has not been seen since"} {
+		if !strings.Contains(conversation, want) {
+			t.Errorf("conversation lacks %q:\n%s", want, conversation)
+		}
+	}
+	if when, errText := m.status(); when.IsZero() || errText != "" {
+		t.Errorf("status = %v, %q", when, errText)
+	}
+}
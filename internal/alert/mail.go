@@ -0,0 +1,155 @@
+package alert
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+const (
+	// MailQueueSize bounds the messages waiting for the relay; past it new
+	// ones are dropped and logged.
+	MailQueueSize = 50
+
+	// MailTimeout bounds one conversation with the relay.
+	MailTimeout = 15 * time.Second
+)
+
+type mailMessage struct {
+	settings models.AlertMail
+	subject  string
+	body     string
+}
+
+// mailer hands alert mail to the relay one message at a time, so a slow relay
+// never holds up the evaluation.
+type mailer struct {
+	host  string
+	queue chan mailMessage
+
+	mu       sync.Mutex
+	lastTime time.Time
+	lastErr  string
+}
+
+func newMailer(host string) *mailer {
+	return &mailer{host: host, queue: make(chan mailMessage, MailQueueSize)}
+}
+
+func (m *mailer) run() {
+	for msg := range m.queue {
+		if err := m.deliver(msg.settings, msg.subject, msg.body); err != nil {
+			logf("mailing %q: %v", msg.subject, err)
+		}
+	}
+}
+
+// send queues the notification of a.
+func (m *mailer) send(settings models.AlertMail, a Alert) {
+	state := strings.ToUpper(a.State)
+	subject := fmt.Sprintf("[%s] [%s] %s: %s", m.host, state, a.RuleName, a.SubjectName)
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", a.Summary)
+	fmt.Fprintf(&body, "Rule:     %s (%s)\n", a.RuleName, a.Kind)
+	fmt.Fprintf(&body, "Severity: %s\n", a.Severity)
+	fmt.Fprintf(&body, "Subject:  %s\n", a.SubjectName)
+	fmt.Fprintf(&body, "Since:    %s\n", a.Since.Local().Format(time.DateTime))
+	if a.State == StateResolved {
+		fmt.Fprintf(&body, "Resolved: %s (after %s)\n", a.ResolvedAt.Local().Format(time.DateTime), wgstats.FormatDuration(a.ResolvedAt.Sub(a.Since)))
+	}
+	fmt.Fprintf(&body, "\nSent by wg-busy on %s.\n", m.host)
+
+	select {
+	case m.queue <- mailMessage{settings: settings, subject: subject, body: body.String()}:
+	default:
+		logf("mail queue full, dropping %q", subject)
+	}
+}
+
+// status returns when the last message was handed over or failed, and why it
+// failed.
+func (m *mailer) status() (time.Time, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastTime, m.lastErr
+}
+
+// deliver hands one message to the relay. The relay is local and trusted, so
+// there is no authentication and no STARTTLS: a relay on localhost rarely has a
+// certificate for that name.
+func (m *mailer) deliver(settings models.AlertMail, subject, body string) error {
+	err := m.converse(settings, subject, body)
+	m.mu.Lock()
+	m.lastTime, m.lastErr = time.Now(), ""
+	if err != nil {
+		m.lastErr = err.Error()
+	}
+	m.mu.Unlock()
+	return err
+}
+
+func (m *mailer) converse(settings models.AlertMail, subject, body string) error {
+	if settings.Relay == "" {
+		return fmt.Errorf("no mail relay configured")
+	}
+	conn, err := net.DialTimeout("tcp", settings.Relay, MailTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(MailTimeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(settings.Relay)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if m.host != "" {
+		if err := c.Hello(m.host); err != nil {
+			return err
+		}
+	}
+	// The settings may hold "Name <addr>"; the envelope takes the bare address.
+	from, err := mail.ParseAddress(settings.From)
+	if err != nil {
+		return fmt.Errorf("sender: %w", err)
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range settings.To {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+		if err := c.Rcpt(rcpt.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\n", settings.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(settings.To, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
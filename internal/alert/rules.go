@@ -0,0 +1,126 @@
+package alert
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+// input is the state one evaluation sees.
+type input struct {
+	now time.Time
+	cfg *models.AppConfig
+	// ifaceKnown is false when no stats collector runs, so interface rules
+	// cannot be evaluated.
+	ifaceKnown bool
+	ifaceUp    bool
+	bgp        *models.BGPStats
+	zt         zerotier.Snapshot
+}
+
+// condition is one subject a rule currently holds for.
+type condition struct {
+	subject string // peer ID, neighbour IP, "wg0" or "zerotier"
+	name    string
+	summary string
+	// since is when the condition started, when the source knows; zero means
+	// from the evaluation that first sees it.
+	since time.Time
+}
+
+// conditions returns the subjects rule holds for in in.
+func conditions(rule *models.AlertRule, in input) []condition {
+	var out []condition
+	switch rule.Kind {
+	case models.AlertPeerUnseen:
+		for _, p := range in.cfg.Peers {
+			if !p.Enabled || (rule.Target != "" && rule.Target != p.ID) {
+				continue
+			}
+			// A peer is offline once its handshake is older than the window
+			// the peers list uses, so the two agree on who is online.
+			if !p.LastSeen.IsZero() && in.now.Sub(p.LastSeen) < wgstats.OnlineWindow {
+				continue
+			}
+			c := condition{subject: p.ID, name: p.Name, since: p.LastSeen}
+			if p.LastSeen.IsZero() {
+				c.summary = fmt.Sprintf("Peer %s has never completed a handshake", p.Name)
+			} else {
+				c.summary = fmt.Sprintf("Peer %s has not been seen since %s", p.Name, p.LastSeen.Local().Format("2006-01-02 15:04"))
+			}
+			out = append(out, c)
+		}
+
+	case models.AlertQuotaAbove:
+		for _, p := range in.cfg.Peers {
+			if !p.Enabled || p.Quota.Limit == 0 || (rule.Target != "" && rule.Target != p.ID) {
+				continue
+			}
+			used := float64(p.Usage.CurrentTotal(p.Quota, in.now)) / float64(p.Quota.Limit) * 100
+			if used < rule.Threshold {
+				continue
+			}
+			out = append(out, condition{subject: p.ID, name: p.Name,
+				summary: fmt.Sprintf("Peer %s has used %.0f%% of its %s %s data quota", p.Name, used, wgstats.FormatBytes(int64(p.Quota.Limit)), p.Quota.PeriodName())})
+		}
+
+	case models.AlertBGPDown, models.AlertBGPPrefixesBelow:
+		if in.bgp == nil {
+			return nil
+		}
+		for _, p := range in.bgp.Peers {
+			if rule.Target != "" && rule.Target != p.IP {
+				continue
+			}
+			name := p.Name
+			if name == "" {
+				name = p.IP
+			}
+			established := p.State == "Established"
+			switch {
+			case rule.Kind == models.AlertBGPDown && !established:
+				out = append(out, condition{subject: p.IP, name: name,
+					summary: fmt.Sprintf("BGP session with %s (AS%d) is %s", name, p.ASN, p.State)})
+			case rule.Kind == models.AlertBGPPrefixesBelow && established && float64(len(p.Routes)) < rule.Threshold:
+				out = append(out, condition{subject: p.IP, name: name,
+					summary: fmt.Sprintf("BGP neighbour %s sends %d prefixes, fewer than %.0f", name, len(p.Routes), rule.Threshold)})
+			}
+		}
+
+	case models.AlertInterfaceDown:
+		if in.ifaceKnown && !in.ifaceUp {
+			out = append(out, condition{subject: "wg0", name: "wg0", summary: "WireGuard interface wg0 is down"})
+		}
+
+	case models.AlertZeroTierOffline:
+		snap := in.zt
+		if !snap.Enabled || (snap.Running && snap.Status != nil && snap.Status.Online) {
+			return nil
+		}
+		reason := "not running"
+		if snap.Running {
+			reason = "cannot reach the ZeroTier roots"
+		}
+		if snap.ServiceErr != "" {
+			reason = snap.ServiceErr
+		}
+		out = append(out, condition{subject: "zerotier", name: "ZeroTier", summary: "ZeroTier is offline: " + reason})
+	}
+	return out
+}
+
+// subjectKind is the webhook subject kind of a rule kind's subjects.
+func subjectKind(kind string) string {
+	switch kind {
+	case models.AlertPeerUnseen, models.AlertQuotaAbove:
+		return "peer"
+	case models.AlertBGPDown, models.AlertBGPPrefixesBelow:
+		return "bgp_peer"
+	case models.AlertZeroTierOffline:
+		return "zerotier"
+	}
+	return "interface"
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -589,17 +590,39 @@ func wantsLocalRoutes(cfg *models.AppConfig) bool {
 	return false
 }
 
+// desiredLocalPrefixes returns the routes wg-busy originates for neighbours
+// that take its local routes: connected networks, and the delegated prefixes
+// peers ask to have announced.
 func desiredLocalPrefixes(cfg *models.AppConfig) ([]string, error) {
 	if wantsLocalRoutes(cfg) {
 		addresses, err := interfaceAddresses()
 		if err != nil {
 			return nil, fmt.Errorf("discover local and connected BGP routes: %w", err)
 		}
-		return localAndConnectedPrefixes(addresses), nil
+		connected := localAndConnectedPrefixes(addresses)
+		return append(connected, announcedDelegations(cfg, connected)...), nil
 	}
 	return nil, nil
 }
 
+// announcedDelegations returns the delegated prefixes of enabled peers that
+// are to be announced, leaving out any already among the connected networks.
+func announcedDelegations(cfg *models.AppConfig, connected []string) []string {
+	var prefixes []string
+	for _, p := range cfg.Peers {
+		if !p.Enabled || !p.AnnounceDelegatedPrefix || p.DelegatedPrefix == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(p.DelegatedPrefix)
+		if err != nil || slices.Contains(connected, network.String()) || slices.Contains(prefixes, network.String()) {
+			continue
+		}
+		prefixes = append(prefixes, network.String())
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
 func applyRuntimeConfig(runtime *bgpRuntime, cfg *models.AppConfig) error {
 	prefixes, err := desiredLocalPrefixes(cfg)
 	if err != nil {
@@ -179,3 +179,24 @@ func (c *managedConn) SetBindToDev(string) error {
 var _ btcp.ListenerManagerI = (*listenerManager)(nil)
 var _ btcp.ListenerI = (*managedListener)(nil)
 var _ btcp.ConnI = (*managedConn)(nil)
+
+// Listeners returns the addresses the BGP runtime is meant to listen on and
+// those it has actually bound, both as host:port. Both are empty while BGP is
+// not running.
+func Listeners() (want, bound []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if active == nil {
+		return nil, nil
+	}
+	m := active.listeners
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, addresses := range m.addresses {
+		want = append(want, addresses...)
+		for _, listener := range m.listeners[name] {
+			bound = append(bound, listener.Addr().String())
+		}
+	}
+	return want, bound
+}
@@ -0,0 +1,466 @@
+// Package cli implements the wg-busy subcommands for day-to-day
+// administration over SSH: listing and changing peers, printing their configs,
+// checking BGP and ZeroTier, and restarting the interface. Each command talks
+// to a running instance over its HTTP API, or, only when asked to with
+// Offline, works on config.yaml directly through config.Store.
+package cli
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/skip2/go-qrcode"
+	"gopkg.in/yaml.v3"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/provision"
+	"github.com/yix/wg-busy/internal/unixsock"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// Options says where the commands find wg-busy.
+type Options struct {
+	// URL is a running instance's base URL. Without it the commands use the
+	// instance answering on the admin Socket.
+	URL    string
+	Socket string
+	// Offline edits ConfigPath directly instead. That is only safe while
+	// wg-busy is stopped: a running instance keeps its own copy and
+	// overwrites the file on its next save. So it is never a fallback, and an
+	// instance answering on Socket refuses it.
+	Offline      bool
+	ConfigPath   string
+	WGConfigPath string
+}
+
+// Usage lists the commands.
+const Usage = `Commands:
+  peer list [-tag TAG]            list peers
+  peer add NAME [-address CIDR] [-tags a,b] [-dns IPS] [-exit-node NAME] [-expires DATE]
+                                  create a peer with fresh keys
+  peer rm PEER                    delete a peer
+  peer enable PEER                enable a peer
+  peer disable PEER               disable a peer
+  peer config PEER [-o FILE]      print a peer's client config
+  peer qr PEER [-o FILE.png]      show a peer's config as a QR code
+  bgp status                      show BGP sessions (needs a running instance)
+  zt status                       show the ZeroTier node and networks (needs a running instance)
+  server apply                    render wg0.conf and restart wg0
+  config validate                 check config.yaml for errors
+
+PEER is a peer name or ID. The commands talk to the instance at -url, else to
+the one serving -socket. With -offline they edit -config directly instead,
+which is only safe while wg-busy is stopped.
+`
+
+// errNeedsInstance is returned by commands that report live state only a
+// running instance has.
+var errNeedsInstance = errors.New("this command reads live state: start wg-busy, or pass -url of a running instance")
+
+// errNoInstance is returned when no instance answers and -offline was not
+// given: editing config.yaml behind a running instance's back loses the edit.
+var errNoInstance = errors.New("no wg-busy answers on -socket: start it, pass -url of a running instance, or pass -offline to edit -config while wg-busy is stopped")
+
+// errInstanceRunning refuses -offline while an instance answers on the socket.
+var errInstanceRunning = errors.New("wg-busy is running on -socket and would overwrite edits to -config: drop -offline")
+
+// warning is a change that was saved but not fully applied live. The command
+// still succeeded; Run prints the message instead of failing.
+type warning struct{ msg string }
+
+func (w *warning) Error() string { return w.msg }
+
+// peerInfo is a peer as the commands show it. A running instance knows a
+// handshake newer than the one last saved, so Seen comes from it.
+type peerInfo struct {
+	models.Peer
+	ExitNodeName string
+	Seen         string
+}
+
+// ztStatus is the part of the ZeroTier tab the zt status command prints.
+type ztStatus struct {
+	Config   models.ZeroTierConfig
+	Snapshot struct {
+		Enabled bool
+		Running bool
+		Status  *struct {
+			Address string `json:"address"`
+			Online  bool   `json:"online"`
+			Version string `json:"version"`
+		}
+		Err        string
+		ServiceErr string
+		Hint       string
+	}
+	Networks []struct {
+		ID                string   `json:"id"`
+		Name              string   `json:"name"`
+		Status            string   `json:"status"`
+		PortDeviceName    string   `json:"portDeviceName"`
+		AssignedAddresses []string `json:"assignedAddresses"`
+		Label             string
+	}
+	Pending []struct{ ID, Name string }
+}
+
+// backend is where the commands read and change state: a running instance or
+// config.yaml.
+type backend interface {
+	peers() ([]peerInfo, error)
+	addPeer(row provision.Row) (models.Peer, error)
+	removePeer(id string) error
+	setPeerEnabled(id string, enabled bool) error
+	clientConfig(id string) (string, error)
+	bgpStatus() (*models.BGPStats, error)
+	ztStatus() (ztStatus, error)
+	applyServer() (string, error)
+}
+
+func newBackend(opts Options) (backend, error) {
+	if opts.URL != "" {
+		return newRemote(opts.URL, &http.Client{Timeout: remoteTimeout}), nil
+	}
+	running := opts.Socket != "" && unixsock.Reachable(opts.Socket)
+	switch {
+	case opts.Offline && running:
+		return nil, errInstanceRunning
+	case opts.Offline:
+		return newLocal(opts.ConfigPath, opts.WGConfigPath)
+	case running:
+		// The host part is never resolved: every request goes to the socket.
+		return newRemote("http://wg-busy", unixsock.Client(opts.Socket, remoteTimeout)), nil
+	}
+	return nil, errNoInstance
+}
+
+// Run executes the command in args, such as ["peer", "list"]. Output goes to
+// stdout; warnings about changes saved but not applied live go to stderr.
+func Run(opts Options, args []string, stdout, stderr io.Writer) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing command\n\n%s", Usage)
+	}
+	name, args := args[0]+" "+args[1], args[2:]
+	if name == "config validate" {
+		return validateConfig(stdout, opts.ConfigPath, args)
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", name, Usage)
+	}
+	b, err := newBackend(opts)
+	if err != nil {
+		return err
+	}
+	err = cmd(b, stdout, args)
+	if w := (*warning)(nil); errors.As(err, &w) {
+		fmt.Fprintln(stderr, "warning:", w.msg)
+		return nil
+	}
+	return err
+}
+
+var commands = map[string]func(b backend, out io.Writer, args []string) error{
+	"peer list":    peerList,
+	"peer add":     peerAdd,
+	"peer rm":      func(b backend, out io.Writer, args []string) error { return peerChange(b, out, args, "deleted") },
+	"peer enable":  func(b backend, out io.Writer, args []string) error { return peerChange(b, out, args, "enabled") },
+	"peer disable": func(b backend, out io.Writer, args []string) error { return peerChange(b, out, args, "disabled") },
+	"peer config":  peerConfig,
+	"peer qr":      peerQR,
+	"bgp status":   bgpStatus,
+	"zt status":    ztStatusCommand,
+	"server apply": serverApply,
+}
+
+// parseArgs parses flags wherever they appear, so both "peer add NAME -tags x"
+// and "peer add -tags x NAME" work, and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(rest) != positional {
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", fs.Name(), positional, len(rest))
+	}
+	return rest, nil
+}
+
+// findPeer resolves a peer by ID, or else by name.
+func findPeer(peers []peerInfo, ref string) (peerInfo, error) {
+	var named []peerInfo
+	for _, p := range peers {
+		if p.ID == ref {
+			return p, nil
+		}
+		if p.Name == ref {
+			named = append(named, p)
+		}
+	}
+	switch len(named) {
+	case 0:
+		return peerInfo{}, fmt.Errorf("peer %q not found", ref)
+	case 1:
+		return named[0], nil
+	}
+	ids := make([]string, len(named))
+	for i, p := range named {
+		ids[i] = p.ID
+	}
+	return peerInfo{}, fmt.Errorf("%d peers are named %q: use an ID (%s)", len(named), ref, strings.Join(ids, ", "))
+}
+
+func resolvePeer(b backend, ref string) (peerInfo, error) {
+	peers, err := b.peers()
+	if err != nil {
+		return peerInfo{}, err
+	}
+	return findPeer(peers, ref)
+}
+
+func peerList(b backend, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("peer list", flag.ContinueOnError)
+	tag := fs.String("tag", "", "only peers with this tag")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	peers, err := b.peers()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tSTATE\tEXIT NODE\tLAST SEEN\tTAGS\tID")
+	for _, p := range peers {
+		if *tag != "" && !p.HasTag(*tag) {
+			continue
+		}
+		state := "enabled"
+		if !p.Enabled {
+			state = "disabled"
+		}
+		if p.StateReason != "" && p.StateReason != models.StateReasonManual {
+			state += " (" + p.StateReason + ")"
+		}
+		exit := p.ExitNodeName
+		if p.IsExitNode {
+			exit = "(is exit node)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.AllowedIPs, state, cmpDash(exit), p.Seen, cmpDash(strings.Join(p.Tags, ",")), p.ID)
+	}
+	return tw.Flush()
+}
+
+func cmpDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func peerAdd(b backend, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("peer add", flag.ContinueOnError)
+	var row provision.Row
+	fs.StringVar(&row.Address, "address", "", "tunnel address; empty allocates the next free one")
+	tags := fs.String("tags", "", "comma-separated tags")
+	fs.StringVar(&row.DNS, "dns", "", "DNS servers for the client config")
+	fs.StringVar(&row.ExitNode, "exit-node", "", "name of the exit node to route through")
+	fs.StringVar(&row.Expires, "expires", "", "last day of access (YYYY-MM-DD) or an RFC 3339 time")
+	rest, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	row.Name = rest[0]
+	row.Tags = models.ParseTags(*tags)
+	peer, err := b.addPeer(row)
+	if peer.ID != "" {
+		fmt.Fprintf(out, "added %s (%s), id %s\n", peer.Name, peer.AllowedIPs, peer.ID)
+	}
+	return err
+}
+
+// peerChange deletes, enables or disables one peer; done names the result.
+func peerChange(b backend, out io.Writer, args []string, done string) error {
+	fs := flag.NewFlagSet("peer", flag.ContinueOnError)
+	rest, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	peer, err := resolvePeer(b, rest[0])
+	if err != nil {
+		return err
+	}
+	switch done {
+	case "deleted":
+		err = b.removePeer(peer.ID)
+	default:
+		err = b.setPeerEnabled(peer.ID, done == "enabled")
+	}
+	if w := (*warning)(nil); err == nil || errors.As(err, &w) {
+		fmt.Fprintf(out, "%s %s\n", done, peer.Name)
+	}
+	return err
+}
+
+// peerClientConfig resolves args to one peer and returns its client config.
+func peerClientConfig(b backend, fs *flag.FlagSet, args []string) (string, error) {
+	rest, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return "", err
+	}
+	peer, err := resolvePeer(b, rest[0])
+	if err != nil {
+		return "", err
+	}
+	if peer.KeyHeld {
+		return "", fmt.Errorf("%s: %w", peer.Name, wireguard.ErrNoPrivateKey)
+	}
+	return b.clientConfig(peer.ID)
+}
+
+func peerConfig(b backend, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("peer config", flag.ContinueOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	content, err := peerClientConfig(b, fs, args)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		// Client configs carry the private key.
+		return os.WriteFile(*output, []byte(content), 0600)
+	}
+	_, err = io.WriteString(out, content)
+	return err
+}
+
+func peerQR(b backend, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("peer qr", flag.ContinueOnError)
+	output := fs.String("o", "", "write a PNG to this file instead of drawing in the terminal")
+	content, err := peerClientConfig(b, fs, args)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		png, err := qrcode.Encode(content, qrcode.Medium, 256)
+		if err != nil {
+			return fmt.Errorf("QR generation failed: %w", err)
+		}
+		return os.WriteFile(*output, png, 0600)
+	}
+	q, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return fmt.Errorf("QR generation failed: %w", err)
+	}
+	_, err = io.WriteString(out, q.ToSmallString(false))
+	return err
+}
+
+func bgpStatus(b backend, out io.Writer, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("bgp status", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	stats, err := b.bgpStatus()
+	if err != nil {
+		return err
+	}
+	if stats == nil || !stats.Running {
+		fmt.Fprintln(out, "BGP is not running")
+		return nil
+	}
+	fmt.Fprintf(out, "BGP running, router ID %s, ASN %d\n", stats.RouterID, stats.ASN)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tIP\tASN\tSTATE\tUPTIME\tRECEIVED\tADVERTISED")
+	for _, p := range stats.Peers {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%d\n", cmpDash(p.Name), p.IP, p.ASN, p.State, cmpDash(p.Uptime), len(p.Routes), len(p.AdvertisedRoutes))
+	}
+	return tw.Flush()
+}
+
+func ztStatusCommand(b backend, out io.Writer, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("zt status", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	zt, err := b.ztStatus()
+	if err != nil {
+		return err
+	}
+	snap := zt.Snapshot
+	switch {
+	case !zt.Config.Enabled:
+		fmt.Fprintln(out, "ZeroTier is disabled")
+		return nil
+	case !snap.Running:
+		fmt.Fprintln(out, "ZeroTier is not running")
+	case snap.Status != nil:
+		online := "offline"
+		if snap.Status.Online {
+			online = "online"
+		}
+		fmt.Fprintf(out, "ZeroTier node %s, %s, version %s\n", snap.Status.Address, online, snap.Status.Version)
+	}
+	for _, msg := range []string{snap.Err, snap.ServiceErr, snap.Hint} {
+		if msg != "" {
+			fmt.Fprintln(out, "  "+msg)
+		}
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tNAME\tSTATUS\tDEVICE\tADDRESSES")
+	for _, n := range zt.Networks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n.ID, cmpDash(cmp.Or(n.Label, n.Name)), n.Status, cmpDash(n.PortDeviceName), cmpDash(strings.Join(n.AssignedAddresses, ", ")))
+	}
+	for _, n := range zt.Pending {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\n", n.ID, cmpDash(n.Name), "NOT JOINED")
+	}
+	return tw.Flush()
+}
+
+func serverApply(b backend, out io.Writer, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("server apply", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	msg, err := b.applyServer()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, msg)
+	return nil
+}
+
+// validateConfig checks config.yaml as wg-busy would load it, and also
+// rejects keys it does not know, which a hand edit most often gets wrong.
+func validateConfig(out io.Writer, path string, args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg models.AppConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if errs := models.ValidateConfig(cfg); len(errs) > 0 {
+		return fmt.Errorf("%s: %w", path, errs)
+	}
+	fmt.Fprintf(out, "%s: ok, %d peer(s), %d BGP peer(s)\n", path, len(cfg.Peers), len(cfg.BGPPeers))
+	return nil
+}
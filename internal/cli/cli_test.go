@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/handlers"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/unixsock"
+)
+
+func writeTestConfig(t *testing.T) Options {
+	t.Helper()
+	dir := t.TempDir()
+	opts := Options{Offline: true, ConfigPath: filepath.Join(dir, "config.yaml"), WGConfigPath: filepath.Join(dir, "wg0.conf")}
+	data, err := yaml.Marshal(models.AppConfig{Server: models.ServerConfig{
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		ListenPort: 51820,
+		Address:    "10.0.0.1/24",
+		Endpoint:   "vpn.example.com:51820",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(opts.ConfigPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func run(t *testing.T, opts Options, args ...string) string {
+	t.Helper()
+	var stdout bytes.Buffer
+	if err := Run(opts, args, &stdout, &bytes.Buffer{}); err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return stdout.String()
+}
+
+// TestPeerCommands runs the same session against config.yaml and against a
+// running instance over HTTP and over its admin socket, which must agree.
+func TestPeerCommands(t *testing.T) {
+	for _, mode := range []string{"local", "remote", "socket"} {
+		t.Run(mode, func(t *testing.T) {
+			opts := writeTestConfig(t)
+			if mode != "local" {
+				store, err := config.Load(opts.ConfigPath, opts.WGConfigPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv := httptest.NewUnstartedServer(handlers.NewRouter(handlers.Deps{Store: store, WebFS: fstest.MapFS{}, Version: "test"}))
+				if mode == "socket" {
+					socket := filepath.Join(filepath.Dir(opts.ConfigPath), "wg-busy.sock")
+					srv.Listener.Close()
+					if srv.Listener, err = unixsock.Listen(socket, 0600); err != nil {
+						t.Fatal(err)
+					}
+					// The file is left alone: the socket answering must win.
+					opts = Options{Socket: socket, ConfigPath: filepath.Join(t.TempDir(), "missing.yaml")}
+				} else {
+					opts = Options{URL: "http://" + srv.Listener.Addr().String()}
+				}
+				srv.Start()
+				defer srv.Close()
+			}
+
+			if out := run(t, opts, "peer", "add", "laptop", "-tags", "staff"); !strings.HasPrefix(out, "added laptop (10.0.0.2/32)") {
+				t.Fatalf("add = %q", out)
+			}
+			run(t, opts, "peer", "add", "-address", "10.0.0.9", "phone")
+			if out := run(t, opts, "peer", "list", "-tag", "staff"); !strings.Contains(out, "laptop") || strings.Contains(out, "phone") {
+				t.Fatalf("list -tag staff =\n%s", out)
+			}
+
+			run(t, opts, "peer", "disable", "laptop")
+			if out := run(t, opts, "peer", "list"); !strings.Contains(out, "disabled") || !strings.Contains(out, "10.0.0.9/32") {
+				t.Fatalf("list after disable =\n%s", out)
+			}
+			if out := run(t, opts, "peer", "config", "laptop"); !strings.Contains(out, "Address = 10.0.0.2/32") || !strings.Contains(out, "Endpoint = vpn.example.com:51820") {
+				t.Fatalf("config =\n%s", out)
+			}
+
+			run(t, opts, "peer", "rm", "phone")
+			if out := run(t, opts, "peer", "list"); strings.Contains(out, "phone") {
+				t.Fatalf("list after rm =\n%s", out)
+			}
+			if err := Run(opts, []string{"peer", "rm", "phone"}, &bytes.Buffer{}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "not found") {
+				t.Fatalf("removing a missing peer: %v", err)
+			}
+		})
+	}
+}
+
+// TestLocalEditsNeedOffline checks that config.yaml is never edited as a
+// fallback, nor behind the back of an instance answering on the socket.
+func TestLocalEditsNeedOffline(t *testing.T) {
+	opts := writeTestConfig(t)
+	before, _ := os.ReadFile(opts.ConfigPath)
+	opts.Offline = false
+	opts.Socket = filepath.Join(filepath.Dir(opts.ConfigPath), "wg-busy.sock")
+	if err := Run(opts, []string{"peer", "add", "laptop"}, &bytes.Buffer{}, &bytes.Buffer{}); !errors.Is(err, errNoInstance) {
+		t.Fatalf("nothing running, no -offline: %v", err)
+	}
+
+	ln, err := unixsock.Listen(opts.Socket, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	opts.Offline = true
+	if err := Run(opts, []string{"peer", "add", "laptop"}, &bytes.Buffer{}, &bytes.Buffer{}); !errors.Is(err, errInstanceRunning) {
+		t.Fatalf("-offline with an instance on the socket: %v", err)
+	}
+	if after, _ := os.ReadFile(opts.ConfigPath); !bytes.Equal(before, after) {
+		t.Error("config.yaml was edited")
+	}
+}
+
+func TestLiveStatusNeedsInstance(t *testing.T) {
+	opts := writeTestConfig(t)
+	for _, args := range [][]string{{"bgp", "status"}, {"zt", "status"}} {
+		if err := Run(opts, args, &bytes.Buffer{}, &bytes.Buffer{}); !errors.Is(err, errNeedsInstance) {
+			t.Errorf("%s: %v", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestConfigValidateRejectsUnknownKeys(t *testing.T) {
+	opts := writeTestConfig(t)
+	if out := run(t, opts, "config", "validate"); !strings.Contains(out, "ok, 0 peer(s)") {
+		t.Fatalf("validate = %q", out)
+	}
+
+	data, _ := os.ReadFile(opts.ConfigPath)
+	typo := strings.Replace(string(data), "listenPort:", "listenport:", 1)
+	if err := os.WriteFile(opts.ConfigPath, []byte(typo), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(opts, []string{"config", "validate"}, &bytes.Buffer{}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "listenport") {
+		t.Fatalf("validate accepted a misspelt key: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/provision"
+	"github.com/yix/wg-busy/internal/wgstats"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// local works on config.yaml through config.Store while wg-busy is stopped.
+// It saves the file and renders wg0.conf but applies nothing live: the next
+// start, or server apply, does that.
+type local struct {
+	store *config.Store
+}
+
+func newLocal(configPath, wgConfigPath string) (*local, error) {
+	store, err := config.Load(configPath, wgConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return &local{store: store}, nil
+}
+
+func (l *local) peers() ([]peerInfo, error) {
+	var peers []peerInfo
+	l.store.Read(func(cfg *models.AppConfig) {
+		for _, p := range cfg.Peers {
+			info := peerInfo{Peer: p, Seen: wgstats.FormatHandshake(p.LastSeen)}
+			if exit := models.FindPeerByID(cfg.Peers, p.ExitNodeID); exit != nil {
+				info.ExitNodeName = exit.Name
+			}
+			peers = append(peers, info)
+		}
+	})
+	return peers, nil
+}
+
+func (l *local) addPeer(row provision.Row) (models.Peer, error) {
+	var created []models.Peer
+	err := l.store.Save(func(cfg *models.AppConfig) error {
+		var err error
+		// Without a running instance there are no ZeroTier or BGP routes to
+		// avoid; the peers' own advertised routes still are.
+		created, err = provision.Create(cfg, []provision.Row{row}, nil, time.Now())
+		return err
+	})
+	if len(created) == 0 {
+		return models.Peer{}, err
+	}
+	return created[0], err
+}
+
+func (l *local) removePeer(id string) error {
+	return l.store.Save(func(cfg *models.AppConfig) error {
+		p := models.FindPeerByID(cfg.Peers, id)
+		if p == nil {
+			return fmt.Errorf("peer not found")
+		}
+		if p.IsExitNode {
+			models.CascadeClearExitNode(cfg.Peers, id)
+		}
+		cfg.Peers = slices.DeleteFunc(cfg.Peers, func(p models.Peer) bool { return p.ID == id })
+		return nil
+	})
+}
+
+func (l *local) setPeerEnabled(id string, enabled bool) error {
+	return l.store.Save(func(cfg *models.AppConfig) error {
+		p := models.FindPeerByID(cfg.Peers, id)
+		if p == nil {
+			return fmt.Errorf("peer not found")
+		}
+		if p.Enabled != enabled {
+			models.SetPeerEnabled(cfg.Peers, id, enabled, models.StateReasonManual, time.Now())
+		}
+		return nil
+	})
+}
+
+func (l *local) clientConfig(id string) (string, error) {
+	var (
+		content string
+		err     error
+	)
+	l.store.Read(func(cfg *models.AppConfig) {
+		p := models.FindPeerByID(cfg.Peers, id)
+		if p == nil {
+			err = fmt.Errorf("peer not found")
+			return
+		}
+		content, err = wireguard.RenderClientConfig(cfg.Server, *p)
+	})
+	return content, err
+}
+
+func (l *local) bgpStatus() (*models.BGPStats, error) { return nil, errNeedsInstance }
+
+func (l *local) ztStatus() (ztStatus, error) { return ztStatus{}, errNeedsInstance }
+
+// applyServer renders wg0.conf and restarts wg0 from it. PostUp installs the
+// routing, so nothing else needs this process to stay around.
+func (l *local) applyServer() (string, error) {
+	if err := l.store.RenderWGConfig(); err != nil {
+		return "", fmt.Errorf("rendering WireGuard config: %w", err)
+	}
+	if err := wireguard.RestartWGConfig(l.store.WGConfigPath()); err != nil {
+		return "", err
+	}
+	return "WireGuard configuration applied successfully.", nil
+}
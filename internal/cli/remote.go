@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/provision"
+)
+
+// remote talks to a running instance over the same endpoints the UI uses.
+// Fragment endpoints answer with the template data as JSON, so the commands
+// read exactly what the UI shows.
+type remote struct {
+	base   string
+	client *http.Client
+}
+
+// remoteTimeout bounds one API request; a server apply restarts wg0 and can
+// take a while.
+const remoteTimeout = time.Minute
+
+func newRemote(base string, client *http.Client) *remote {
+	return &remote{base: strings.TrimRight(base, "/"), client: client}
+}
+
+// page is the JSON envelope of the fragment endpoints.
+type page[T any] struct {
+	Data  T
+	Toast *struct{ Kind, Message string }
+}
+
+// pageError is the data of a rejected fragment request.
+type pageError struct {
+	Error            string
+	ValidationErrors models.ValidationErrors
+}
+
+func (c *remote) do(method, path string, form url.Values) ([]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return data, nil
+	}
+	msg := strings.TrimSpace(string(data))
+	var rejected page[pageError]
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(data, &rejected) == nil {
+		msg = rejected.Data.Error
+		if len(rejected.Data.ValidationErrors) > 0 {
+			msg = rejected.Data.ValidationErrors.Error()
+		}
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, msg)
+}
+
+// fetch decodes a fragment endpoint's data into v. An error toast on a
+// successful response means the change was saved but not applied live.
+func fetch[T any](c *remote, method, path string, form url.Values) (T, error) {
+	var p page[T]
+	data, err := c.do(method, path, form)
+	if err != nil {
+		return p.Data, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p.Data, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if p.Toast != nil && p.Toast.Kind == "error" {
+		return p.Data, &warning{msg: p.Toast.Message}
+	}
+	return p.Data, nil
+}
+
+func (c *remote) peers() ([]peerInfo, error) {
+	var peers []peerInfo
+	for pageNum := 1; ; {
+		list, err := fetch[struct {
+			Peers []struct {
+				Peer         models.Peer
+				ExitNodeName string
+				LastSeen     string
+			}
+			NextPage int
+		}](c, http.MethodGet, "/peers?page="+strconv.Itoa(pageNum), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range list.Peers {
+			peers = append(peers, peerInfo{Peer: row.Peer, ExitNodeName: row.ExitNodeName, Seen: row.LastSeen})
+		}
+		if list.NextPage == 0 {
+			return peers, nil
+		}
+		pageNum = list.NextPage
+	}
+}
+
+// addPeer provisions a one-row list, so a peer is created the same way with
+// or without a running instance. The response is the new config zip; the
+// peer itself is read back from the list.
+func (c *remote) addPeer(row provision.Row) (models.Peer, error) {
+	rows, err := json.Marshal([]provision.Row{row})
+	if err != nil {
+		return models.Peer{}, err
+	}
+	if _, err := c.do(http.MethodPost, "/api/peers/provision", url.Values{"content": {string(rows)}}); err != nil {
+		return models.Peer{}, err
+	}
+	peers, err := c.peers()
+	if err != nil {
+		return models.Peer{}, err
+	}
+	for i := len(peers) - 1; i >= 0; i-- {
+		if peers[i].Name == row.Name {
+			return peers[i].Peer, nil
+		}
+	}
+	return models.Peer{}, fmt.Errorf("peer %q was created but is not listed", row.Name)
+}
+
+func (c *remote) bulk(action, id string) error {
+	_, err := fetch[struct{}](c, http.MethodPost, "/peers/bulk", url.Values{"action": {action}, "ids": {id}})
+	return err
+}
+
+func (c *remote) removePeer(id string) error { return c.bulk("delete", id) }
+
+func (c *remote) setPeerEnabled(id string, enabled bool) error {
+	if enabled {
+		return c.bulk("enable", id)
+	}
+	return c.bulk("disable", id)
+}
+
+func (c *remote) clientConfig(id string) (string, error) {
+	data, err := c.do(http.MethodGet, "/api/peers/"+url.PathEscape(id)+"/config", nil)
+	return string(data), err
+}
+
+func (c *remote) bgpStatus() (*models.BGPStats, error) {
+	tab, err := fetch[struct{ BGPStats *models.BGPStats }](c, http.MethodGet, "/bgp/stats", nil)
+	return tab.BGPStats, err
+}
+
+func (c *remote) ztStatus() (ztStatus, error) {
+	return fetch[ztStatus](c, http.MethodGet, "/zerotier/status", nil)
+}
+
+// applyServer restarts wg0 in the running instance, which then also brings
+// BGP and routing back in line; a failure there comes back as an error toast.
+func (c *remote) applyServer() (string, error) {
+	var p page[struct{}]
+	data, err := c.do(http.MethodPost, "/api/server/apply", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return "", err
+	}
+	if p.Toast == nil {
+		return "", fmt.Errorf("unexpected response from /api/server/apply")
+	}
+	if p.Toast.Kind == "error" {
+		return "", fmt.Errorf("%s", p.Toast.Message)
+	}
+	return p.Toast.Message, nil
+}
@@ -6,11 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
 
 	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/metrics"
 	"github.com/yix/wg-busy/internal/models"
 	"github.com/yix/wg-busy/internal/routing"
 	"github.com/yix/wg-busy/internal/wireguard"
@@ -35,11 +37,23 @@ type Store struct {
 	wgRestartPending bool
 	wgAppliedServer  models.ServerConfig
 	wgHasApplied     bool
-
-	// onChange is notified after a successful write. It must not block: it runs
-	// while the write lock is held, so anything slow (process control, HTTP)
-	// belongs on the receiver's own goroutine.
-	onChange func(*models.AppConfig)
+	// usageSavedAt throttles how often traffic accounting alone rewrites
+	// config.yaml; usageDirty marks counts not yet on disk.
+	usageSavedAt time.Time
+	usageDirty   bool
+
+	// applyFailures counts live applies that did not converge, and
+	// reconcileDuration times every live apply, for /metrics.
+	applyFailures     atomic.Uint64
+	reconcileDuration metrics.Histogram
+
+	// onChange callbacks are notified after a successful write. They must not
+	// block: they run while the write lock is held, so anything slow (process
+	// control, HTTP) belongs on the receiver's own goroutine.
+	onChange []func(*models.AppConfig)
+	// onApplyError callbacks are told of every live apply that did not
+	// converge. Like onChange they run under the store lock and must not block.
+	onApplyError []func(error)
 
 	// ztGateways reports the ZeroTier subnets policy routes may use as gateways.
 	// Called while the store lock is held, so it must only read cached state.
@@ -103,10 +117,28 @@ func cloneAdvertisedRoutes(routes map[string][]string) map[string][]string {
 }
 
 // OnChange registers a callback invoked with the new config after every successful write.
+// Callbacks run in the order they were registered.
 func (s *Store) OnChange(fn func(*models.AppConfig)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.onChange = fn
+	s.onChange = append(s.onChange, fn)
+}
+
+// OnApplyError registers a callback invoked whenever a live apply fails: after
+// a write (with the *ApplyError it returns), a BGP reapply or a routing reapply.
+func (s *Store) OnApplyError(fn func(error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onApplyError = append(s.onApplyError, fn)
+}
+
+// applyFailed counts a failed live apply and reports it. Callers must hold the
+// lock, for reading at least.
+func (s *Store) applyFailed(err error) {
+	s.applyFailures.Add(1)
+	for _, fn := range s.onApplyError {
+		fn(err)
+	}
 }
 
 // Load reads the YAML config file, or initializes defaults if it doesn't exist.
@@ -185,6 +217,51 @@ func (s *Store) RecordPeerLastSeen(seen map[string]time.Time) error {
 	return nil
 }
 
+// UsageSaveInterval bounds how much accumulated traffic accounting a crash can
+// lose, without rewriting config.yaml on every stats poll.
+const UsageSaveInterval = time.Minute
+
+// RecordPeerTransfer adds per-poll traffic deltas, keyed by public key, to each
+// peer's quota-period usage. Like last-seen times this never reapplies
+// configuration; the quota enforcer acts on the totals through Write.
+func (s *Store) RecordPeerTransfer(transfers map[string]models.Transfer, now time.Time) error {
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.config.Peers {
+		peer := &s.config.Peers[i]
+		if t, ok := transfers[peer.PublicKey]; ok {
+			peer.Usage.AddTransfer(peer.Quota, t, now)
+			s.usageDirty = true
+		}
+	}
+	if !s.usageDirty || now.Sub(s.usageSavedAt) < UsageSaveInterval {
+		return nil
+	}
+	return s.saveUsage(now)
+}
+
+// FlushUsage writes any traffic accounting not yet persisted, e.g. at shutdown.
+func (s *Store) FlushUsage() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.usageDirty {
+		return nil
+	}
+	return s.saveUsage(time.Now())
+}
+
+// saveUsage persists the config for accounting's sake. Unlike other saves a
+// failure keeps the in-memory counts: they are still the best record we have.
+func (s *Store) saveUsage(now time.Time) error {
+	s.usageSavedAt = now
+	return s.saveYAML()
+}
+
 // Write executes fn with a write lock, then saves YAML and renders wg0.conf.
 func (s *Store) Write(fn func(cfg *models.AppConfig) error) error {
 	s.mu.Lock()
@@ -227,6 +304,7 @@ func (s *Store) Write(fn func(cfg *models.AppConfig) error) error {
 		return fmt.Errorf("rendering wg config: %w", err)
 	}
 
+	started := time.Now()
 	currentNets := s.gatewayNets()
 	currentBGP := s.advertisedRoutes()
 	var applyErrs []error
@@ -257,17 +335,59 @@ func (s *Store) Write(fn func(cfg *models.AppConfig) error) error {
 		}
 	}
 
+	s.reconcileDuration.Observe(time.Since(started).Seconds())
+
 	// After persistence, so a failure here can never trigger the rollback above.
-	if s.onChange != nil {
-		s.onChange(&s.config)
+	for _, fn := range s.onChange {
+		fn(&s.config)
 	}
 
 	if len(applyErrs) > 0 {
-		return &ApplyError{Err: errors.Join(applyErrs...)}
+		err := &ApplyError{Err: errors.Join(applyErrs...)}
+		s.applyFailed(err)
+		return err
 	}
 	return nil
 }
 
+// Save executes fn with a write lock, then saves YAML and renders wg0.conf
+// like Write, but leaves the live host alone: no WireGuard reload, routing
+// reconcile or BGP change, and no change listeners. It is for one-shot
+// commands such as -import that prepare the config before wg-busy starts.
+func (s *Store) Save(fn func(cfg *models.AppConfig) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backup := s.config.Clone()
+	if err := fn(&s.config); err != nil {
+		s.config = backup
+		return err
+	}
+	if errs := models.ValidateConfig(s.config); len(errs) > 0 {
+		s.config = backup
+		return errs
+	}
+	if err := s.saveYAML(); err != nil {
+		s.config = backup
+		return fmt.Errorf("saving config: %w", err)
+	}
+	if err := s.renderWGConfig(); err != nil {
+		s.config = backup
+		if rollbackErr := s.saveYAML(); rollbackErr != nil {
+			return errors.Join(fmt.Errorf("rendering wg config: %w", err), fmt.Errorf("restoring YAML config: %w", rollbackErr))
+		}
+		return fmt.Errorf("rendering wg config: %w", err)
+	}
+	return nil
+}
+
+// ApplyFailures returns how many live applies have failed since startup.
+func (s *Store) ApplyFailures() uint64 { return s.applyFailures.Load() }
+
+// ReconcileDuration times each live apply: the WireGuard reload, routing
+// reconcile and BGP configuration after a save, and every routing reapply.
+func (s *Store) ReconcileDuration() *metrics.Histogram { return &s.reconcileDuration }
+
 // ReapplyBGP retries the desired BGP state after a WireGuard restart.
 func (s *Store) ReapplyBGP() error {
 	s.mu.RLock()
@@ -275,7 +395,11 @@ func (s *Store) ReapplyBGP() error {
 	if s.wgRestartPending && s.config.Server.BGPEnabled {
 		return wireguard.ErrRestartNeeded
 	}
-	return configureBGP(&s.config)
+	if err := configureBGP(&s.config); err != nil {
+		s.applyFailed(fmt.Errorf("configuring BGP: %w", err))
+		return err
+	}
+	return nil
 }
 
 // ReapplyRouting re-renders wg0.conf and converges the live routing state to it.
@@ -291,9 +415,13 @@ func (s *Store) ReapplyRouting() error {
 	if err := s.renderWGConfig(); err != nil {
 		return err
 	}
+	started := time.Now()
 	nets := s.gatewayNets()
 	advertised := s.advertisedRoutes()
-	if err := routing.Reconcile(s.routingState, s.routingNets, s.routingBGP, s.config, nets, advertised); err != nil {
+	err := routing.Reconcile(s.routingState, s.routingNets, s.routingBGP, s.config, nets, advertised)
+	s.reconcileDuration.Observe(time.Since(started).Seconds())
+	if err != nil {
+		s.applyFailed(fmt.Errorf("applying routing: %w", err))
 		return err
 	}
 	s.routingState = s.config.Clone()
@@ -302,6 +430,35 @@ func (s *Store) ReapplyRouting() error {
 	return nil
 }
 
+// VerifyRouting reports where the kernel's policy rules, routes and iptables
+// rules differ from the routing state last installed. The ip and iptables
+// commands run outside the lock.
+func (s *Store) VerifyRouting() ([]routing.Drift, error) {
+	s.mu.RLock()
+	installed := s.routingState.Clone()
+	nets := append([]models.GatewayNet(nil), s.routingNets...)
+	advertised := cloneAdvertisedRoutes(s.routingBGP)
+	s.mu.RUnlock()
+	return routing.Verify(installed, nets, advertised)
+}
+
+// RepairRouting reinstalls the routing state last installed, putting back
+// whatever VerifyRouting found missing. Unlike ReapplyRouting it does not pick
+// up configuration changes: the intended state is unchanged, only the kernel
+// lost part of it.
+func (s *Store) RepairRouting() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := time.Now()
+	err := routing.Install(s.routingState, s.routingNets, s.routingBGP)
+	s.reconcileDuration.Observe(time.Since(started).Seconds())
+	if err != nil {
+		s.applyFailed(fmt.Errorf("repairing routing: %w", err))
+		return err
+	}
+	return nil
+}
+
 // RenderWGConfig writes the current source-of-truth YAML state to wg0.conf
 // without attempting to touch the live interface. Startup uses this before
 // invoking wg-quick.
@@ -348,6 +505,7 @@ func (s *Store) saveYAML() error {
 	if err := os.Rename(tmpPath, s.configPath); err != nil {
 		return fmt.Errorf("renaming config: %w", err)
 	}
+	s.usageDirty = false
 	return nil
 }
 
@@ -130,6 +130,51 @@ func TestRecordPeerLastSeenPersistsOnlyNewerHandshake(t *testing.T) {
 	}
 }
 
+func TestRecordPeerTransferBatchesSavesAndFlushes(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	s := &Store{
+		configPath: configPath,
+		config:     models.AppConfig{Peers: []models.Peer{{PublicKey: "peer-key"}}},
+	}
+	persisted := func() models.PeerUsage {
+		t.Helper()
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cfg models.AppConfig
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		return cfg.Peers[0].Usage
+	}
+
+	transfer := map[string]models.Transfer{"peer-key": {Rx: 100, Tx: 10}}
+	if err := s.RecordPeerTransfer(transfer, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordPeerTransfer(transfer, now.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := persisted(); got.Total() != 110 {
+		t.Fatalf("first save persisted %d bytes, want 110", got.Total())
+	}
+	s.Read(func(cfg *models.AppConfig) {
+		if got := cfg.Peers[0].Usage.Total(); got != 220 {
+			t.Fatalf("in-memory usage = %d, want 220", got)
+		}
+	})
+
+	if err := s.FlushUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if got := persisted(); got.Total() != 220 {
+		t.Fatalf("flushed usage = %d, want 220", got.Total())
+	}
+}
+
 func TestWriteReportsRestartPendingUntilMarkedApplied(t *testing.T) {
 	stubLiveServices(t, true)
 	dir := t.TempDir()
@@ -0,0 +1,222 @@
+// Package connlog keeps a persisted log of peer connection events. WireGuard
+// has no sessions to report, so wgstats derives them from handshake ages and
+// endpoint changes; this package names them per peer and keeps them, so "it
+// dropped at 3pm" can be checked after the fact.
+package connlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kind is what happened to a peer's connection.
+type Kind string
+
+const (
+	FirstHandshake  Kind = "first_handshake"  // the peer connected for the first time
+	Stale           Kind = "stale"            // no handshake for wgstats.OnlineWindow
+	Returned        Kind = "returned"         // it handshook again after going stale
+	EndpointChanged Kind = "endpoint_changed" // it roamed to another address while connected
+)
+
+// Kinds are every kind, in the order the UI offers them.
+var Kinds = []Kind{FirstHandshake, Stale, Returned, EndpointChanged}
+
+const (
+	// Retention is how long events are kept.
+	Retention = 90 * 24 * time.Hour
+
+	// MaxPerPeer bounds the events kept for one peer, so a peer that roams
+	// all day cannot grow the log without limit.
+	MaxPerPeer = 500
+)
+
+// Event is one entry of the log.
+type Event struct {
+	Peer     string    `json:"peer"` // peer ID
+	Time     time.Time `json:"time"`
+	Kind     Kind      `json:"kind"`
+	Endpoint string    `json:"endpoint,omitempty"` // where the peer connected from or roamed to
+	From     string    `json:"from,omitempty"`     // the endpoint it roamed from
+}
+
+// Filter selects events for Query. Zero fields match everything.
+type Filter struct {
+	Peer  string
+	Kind  Kind
+	Since time.Time
+	Limit int
+}
+
+// Store holds the log in memory and in a JSON-lines file: one event per line,
+// appended as events happen, so a crash loses nothing already recorded.
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	events map[string][]Event // per peer ID, oldest first
+	// appended counts lines written since the file was last rewritten; once
+	// stale lines outnumber live ones the file is compacted.
+	appended int
+	kept     int
+}
+
+// Open loads the log at path, dropping expired events. A missing file starts
+// an empty log. Lines that cannot be decoded are skipped and reported, and the
+// next compaction drops them.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, events: make(map[string][]Event)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("reading connection log: %w", err)
+	}
+
+	var bad int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Peer == "" {
+			bad++
+			continue
+		}
+		s.insert(e)
+		s.appended++
+	}
+	s.prune(time.Now())
+	if bad > 0 {
+		return s, fmt.Errorf("connection log %s: skipped %d unreadable lines", path, bad)
+	}
+	return s, nil
+}
+
+// Record appends events to the log.
+func (s *Store) Record(events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		s.insert(e)
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("encoding connection event: %w", err)
+		}
+	}
+	s.appended += len(events)
+	s.prune(time.Now())
+	if s.appended > 2*s.kept+MaxPerPeer {
+		return s.compact()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("creating connection log dir: %w", err)
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening connection log: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("writing connection log: %w", err)
+	}
+	return f.Close()
+}
+
+// insert adds e to its peer's events, keeping them in time order. Events
+// usually arrive in order, but a drop is dated back to when it happened.
+func (s *Store) insert(e Event) {
+	events := s.events[e.Peer]
+	i := len(events)
+	for i > 0 && events[i-1].Time.After(e.Time) {
+		i--
+	}
+	s.events[e.Peer] = slices.Insert(events, i, e)
+}
+
+// prune drops expired events and any beyond MaxPerPeer, and recounts kept.
+func (s *Store) prune(now time.Time) {
+	cutoff := now.Add(-Retention)
+	s.kept = 0
+	for peer, events := range s.events {
+		i := 0
+		for i < len(events) && events[i].Time.Before(cutoff) {
+			i++
+		}
+		events = events[max(i, len(events)-MaxPerPeer):]
+		if len(events) == 0 {
+			delete(s.events, peer)
+			continue
+		}
+		s.events[peer] = events
+		s.kept += len(events)
+	}
+}
+
+// compact rewrites the file with only the kept events, atomically.
+func (s *Store) compact() error {
+	var all []Event
+	for _, events := range s.events {
+		all = append(all, events...)
+	}
+	slices.SortStableFunc(all, func(a, b Event) int { return a.Time.Compare(b.Time) })
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range all {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("encoding connection event: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("creating connection log dir: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing temp connection log: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("renaming connection log: %w", err)
+	}
+	s.appended = len(all)
+	return nil
+}
+
+// Query returns the events matching f, newest first.
+func (s *Store) Query(f Filter) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Event
+	add := func(events []Event) {
+		for _, e := range events {
+			if (f.Kind == "" || e.Kind == f.Kind) && !e.Time.Before(f.Since) {
+				out = append(out, e)
+			}
+		}
+	}
+	if f.Peer != "" {
+		add(s.events[f.Peer])
+	} else {
+		for _, events := range s.events {
+			add(events)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b Event) int { return b.Time.Compare(a.Time) })
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package connlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSurvivesReopenAndFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if err := s.Record(
+		Event{Peer: "a", Time: now.Add(-3 * time.Hour), Kind: FirstHandshake, Endpoint: "192.0.2.1:1"},
+		Event{Peer: "b", Time: now.Add(-2 * time.Hour), Kind: FirstHandshake},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(Event{Peer: "a", Time: now.Add(-time.Hour), Kind: Stale}); err != nil {
+		t.Fatal(err)
+	}
+	// Expired on the next open.
+	if err := s.Record(Event{Peer: "a", Time: now.Add(-Retention - time.Hour), Kind: Returned}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reopened.Query(Filter{Peer: "a"})
+	if len(got) != 2 || got[0].Kind != Stale || got[1].Endpoint != "192.0.2.1:1" {
+		t.Fatalf("peer a = %+v", got)
+	}
+	if got := reopened.Query(Filter{Kind: FirstHandshake, Since: now.Add(-150 * time.Minute)}); len(got) != 1 || got[0].Peer != "b" {
+		t.Fatalf("filtered = %+v", got)
+	}
+	if got := reopened.Query(Filter{Limit: 1}); len(got) != 1 || got[0].Kind != Stale {
+		t.Fatalf("limit 1 = %+v", got)
+	}
+}
+
+func TestLogCapsPeersAndCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := range 4 * MaxPerPeer {
+		if err := s.Record(Event{Peer: "roamer", Time: start.Add(time.Duration(i) * time.Millisecond), Kind: EndpointChanged}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Query(Filter{Peer: "roamer"}); len(got) != MaxPerPeer || !got[0].Time.Equal(start.Add(time.Duration(4*MaxPerPeer-1)*time.Millisecond)) {
+		t.Fatalf("kept %d events, newest %v", len(got), got[0].Time)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 3*MaxPerPeer {
+		t.Fatalf("file holds %d lines, want it compacted", lines)
+	}
+}
@@ -0,0 +1,477 @@
+// Package declarative applies a desired set of peers and BGP peers, keyed by
+// name, to the config. Apply works out what to create, update and delete, and
+// runs inside the caller's Store.Write, so a state goes in whole or not at
+// all. Applying the same state twice changes nothing the second time.
+package declarative
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yix/wg-busy/internal/ipam"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/routing"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// State is the desired set of peers and BGP peers. Fields are those of
+// config.yaml, except what wg-busy manages itself (see managedPeerFields).
+type State struct {
+	Peers    []PeerSpec    `yaml:"peers"`
+	BGPPeers []BGPPeerSpec `yaml:"bgpPeers"`
+	// Prune deletes the peers and BGP peers the state does not list. Without
+	// it they are left alone.
+	Prune bool `yaml:"prune"`
+}
+
+// PeerSpec is a desired peer. An empty allowedIPs keeps the current address,
+// or allocates one; an empty publicKey or presharedKey keeps the current key,
+// or generates one. A publicKey that differs makes the key device-held.
+type PeerSpec struct {
+	models.Peer `yaml:",inline"`
+	// ExitNode names the exit node to route through.
+	ExitNode string `yaml:"exitNode,omitempty"`
+}
+
+// BGPPeerSpec is a desired standalone BGP peer.
+type BGPPeerSpec struct {
+	models.BGPPeer `yaml:",inline"`
+}
+
+// UnmarshalYAML defaults enabled to true, as it is for a new peer in the UI.
+func (s *PeerSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain PeerSpec
+	spec := plain{Peer: models.Peer{Enabled: true}}
+	if err := decodeStrict(node, &spec); err != nil {
+		return err
+	}
+	*s = PeerSpec(spec)
+	return nil
+}
+
+// UnmarshalYAML defaults enabled to true and the port to BGP's 179.
+func (s *BGPPeerSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain BGPPeerSpec
+	spec := plain{BGPPeer: models.BGPPeer{Enabled: true, PeerPort: 179}}
+	if err := decodeStrict(node, &spec); err != nil {
+		return err
+	}
+	*s = BGPPeerSpec(spec)
+	return nil
+}
+
+// decodeStrict decodes node rejecting unknown fields, which Node.Decode
+// alone does not, so a misspelt setting is an error rather than a no-op.
+func decodeStrict(node *yaml.Node, v any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// Parse reads a state in YAML or JSON.
+func Parse(data []byte) (State, error) {
+	var state State
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&state); err != nil {
+		if errors.Is(err, io.EOF) {
+			return state, fmt.Errorf("empty state")
+		}
+		return state, fmt.Errorf("reading state: %w", err)
+	}
+	return state, nil
+}
+
+// Change actions.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change is one operation Apply made.
+type Change struct {
+	Kind   string `json:"kind"` // "peer" or "bgpPeer"
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Fields lists what an update changed, by config.yaml name.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// managedPeerFields are set by wg-busy, never by a state. Keys are handled
+// separately: a state may pin a public key or PSK, but not a private key.
+var managedPeerFields = []string{
+	"id", "privateKey", "keyHeld", "exitNodeID", "routingTableID", "policyRoutingTableID",
+	"stateReason", "usage", "createdAt", "updatedAt", "lastSeen",
+}
+
+// Apply makes cfg match state and returns what it changed, in order: peers
+// then BGP peers, each in state order with deletions last. Peers it creates or
+// readdresses must stay clear of routed, the networks ZeroTier and BGP know.
+func Apply(cfg *models.AppConfig, state State, routed []ipam.Network, now time.Time) ([]Change, error) {
+	now = now.UTC()
+	peerChanges, err := applyPeers(cfg, state, routed, now)
+	if err != nil {
+		return nil, err
+	}
+	bgpChanges, err := applyBGPPeers(cfg, state, now)
+	if err != nil {
+		return nil, err
+	}
+	return append(peerChanges, bgpChanges...), nil
+}
+
+func applyPeers(cfg *models.AppConfig, state State, routed []ipam.Network, now time.Time) ([]Change, error) {
+	existing := indexByName(cfg.Peers, func(p models.Peer) string { return p.Name })
+	listed := make(map[string]bool, len(state.Peers))
+	for _, spec := range state.Peers {
+		if err := checkPeerSpec(spec, listed); err != nil {
+			return nil, err
+		}
+		if existing[spec.Name] < 0 {
+			return nil, fmt.Errorf("the config has several peers named %q: rename them to apply a state", spec.Name)
+		}
+		listed[spec.Name] = true
+	}
+
+	before := make(map[string]models.Peer, len(cfg.Peers))
+	var (
+		peers   []models.Peer
+		deleted []models.Peer
+	)
+	for _, p := range cfg.Peers {
+		before[p.ID] = p
+		if listed[p.Name] || !state.Prune {
+			peers = append(peers, p)
+		} else {
+			deleted = append(deleted, p)
+		}
+	}
+
+	var created []string
+	for _, spec := range state.Peers {
+		if i, ok := existing[spec.Name]; ok {
+			p := models.FindPeerByID(peers, cfg.Peers[i].ID)
+			setPeerFields(p, spec.Peer)
+			continue
+		}
+		p, err := newPeer(spec.Peer, now)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+		created = append(created, p.ID)
+	}
+
+	// Exit nodes are resolved once every peer exists, so a state may route a
+	// peer through an exit node it creates.
+	for _, spec := range state.Peers {
+		p := findByName(peers, spec.Name)
+		p.ExitNodeID = ""
+		if spec.ExitNode == "" {
+			continue
+		}
+		exit := findByName(peers, spec.ExitNode)
+		if exit == nil || !exit.IsExitNode {
+			return nil, fmt.Errorf("peer %q: exit node %q not found", spec.Name, spec.ExitNode)
+		}
+		p.ExitNodeID = exit.ID
+	}
+	for id, prev := range before {
+		if p := models.FindPeerByID(peers, id); prev.IsExitNode && (p == nil || !p.IsExitNode) {
+			models.CascadeClearExitNode(peers, id)
+		}
+	}
+	assignRoutingTables(peers)
+	// A state asking for a prefix length keeps the prefix of that length the
+	// peer already has, so applying it again changes nothing.
+	for i := range peers {
+		prev, ok := before[peers[i].ID]
+		if prefix, err := netip.ParsePrefix(prev.DelegatedPrefix); ok && err == nil && peers[i].DelegatedPrefix == fmt.Sprintf("/%d", prefix.Bits()) {
+			peers[i].DelegatedPrefix = prev.DelegatedPrefix
+		}
+	}
+	alloc, err := allocateAddresses(cfg.Server, peers, routed)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, spec := range state.Peers {
+		p := findByName(peers, spec.Name)
+		prev, existed := before[p.ID]
+		errs := p.Validate(nil)
+		// Only addressing the state changes is checked for conflicts, so a
+		// state that leaves an old conflict alone still applies.
+		if !existed || prev.AllowedIPs != p.AllowedIPs || !slices.Equal(prev.AdvertisedRoutes, p.AdvertisedRoutes) || prev.DelegatedPrefix != p.DelegatedPrefix {
+			errs = append(errs, alloc.Check(*p)...)
+		}
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("peer %q: %w", p.Name, errs)
+		}
+		if slices.Contains(created, p.ID) {
+			changes = append(changes, Change{Kind: "peer", Name: p.Name, Action: ActionCreate})
+			continue
+		}
+		if fields := changedFields(prev, *p); len(fields) > 0 {
+			if p.Enabled != prev.Enabled {
+				p.StateReason = models.StateReasonManual
+			}
+			p.UpdatedAt = now
+			changes = append(changes, Change{Kind: "peer", Name: p.Name, Action: ActionUpdate, Fields: fields})
+		}
+	}
+	// Peers the state does not mention can still change: an exit node they
+	// used was deleted or demoted.
+	for i := range peers {
+		prev, ok := before[peers[i].ID]
+		if !ok || listed[peers[i].Name] {
+			continue
+		}
+		if fields := changedFields(prev, peers[i]); len(fields) > 0 {
+			peers[i].UpdatedAt = now
+			changes = append(changes, Change{Kind: "peer", Name: peers[i].Name, Action: ActionUpdate, Fields: fields})
+		}
+	}
+	for _, p := range deleted {
+		changes = append(changes, Change{Kind: "peer", Name: p.Name, Action: ActionDelete})
+	}
+	cfg.Peers = peers
+	return changes, nil
+}
+
+func checkPeerSpec(spec PeerSpec, listed map[string]bool) error {
+	if strings.TrimSpace(spec.Name) == "" {
+		return fmt.Errorf("a peer has no name")
+	}
+	if listed[spec.Name] {
+		return fmt.Errorf("peer %q is listed twice", spec.Name)
+	}
+	v := reflect.ValueOf(spec.Peer)
+	for _, name := range managedPeerFields {
+		if !peerField(v, name).IsZero() {
+			return fmt.Errorf("peer %q: %s is managed by wg-busy and cannot be set", spec.Name, name)
+		}
+	}
+	return nil
+}
+
+// setPeerFields copies every field a state controls from spec onto p.
+func setPeerFields(p *models.Peer, spec models.Peer) {
+	dst, src := reflect.ValueOf(p).Elem(), reflect.ValueOf(spec)
+	for i := range dst.NumField() {
+		name := yamlName(dst.Type().Field(i))
+		switch {
+		case slices.Contains(managedPeerFields, name):
+		case name == "allowedIPs" && spec.AllowedIPs == "":
+		case name == "presharedKey" && spec.PresharedKey == "":
+		case name == "publicKey":
+			if spec.PublicKey != "" && spec.PublicKey != p.PublicKey {
+				p.PublicKey, p.PrivateKey, p.KeyHeld = spec.PublicKey, "", true
+			}
+		default:
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+func newPeer(spec models.Peer, now time.Time) (models.Peer, error) {
+	p := models.Peer{}
+	setPeerFields(&p, spec)
+	id, err := models.NewID()
+	if err != nil {
+		return p, fmt.Errorf("ID generation failed: %w", err)
+	}
+	p.ID, p.CreatedAt, p.UpdatedAt = id, now, now
+	if p.PublicKey == "" {
+		if p.PrivateKey, p.PublicKey, err = wireguard.GenerateKeyPair(); err != nil {
+			return p, fmt.Errorf("key generation failed: %w", err)
+		}
+	}
+	if p.PresharedKey == "" {
+		if p.PresharedKey, err = wireguard.GeneratePresharedKey(); err != nil {
+			return p, fmt.Errorf("PSK generation failed: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// assignRoutingTables gives exit nodes and peers with policy routes a table,
+// and takes it back from the rest, as the peer form does.
+func assignRoutingTables(peers []models.Peer) {
+	for i := range peers {
+		p := &peers[i]
+		if !p.IsExitNode {
+			p.RoutingTableID = 0
+		} else if p.RoutingTableID == 0 {
+			p.RoutingTableID = routing.AssignRoutingTableID(peers)
+		}
+		if len(p.PolicyRoutes) == 0 {
+			p.PolicyRoutingTableID = 0
+		} else if p.PolicyRoutingTableID == 0 {
+			p.PolicyRoutingTableID = routing.AssignRoutingTableID(peers)
+		}
+	}
+}
+
+// allocateAddresses gives every peer without an address one, and every peer
+// asking for a delegated prefix length a prefix, and returns the allocator,
+// which knows the results, for conflict checks.
+func allocateAddresses(server models.ServerConfig, peers []models.Peer, routed []ipam.Network) (*ipam.Allocator, error) {
+	alloc, err := ipam.New(&models.AppConfig{Server: server, Peers: peers}, routed)
+	if err != nil {
+		return nil, err
+	}
+	for i := range peers {
+		if peers[i].AllowedIPs != "" {
+			continue
+		}
+		ip, err := alloc.Assign(peers[i], "")
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: auto-assign IP: %w", peers[i].Name, err)
+		}
+		peers[i].AllowedIPs = ip
+	}
+	for i := range peers {
+		if !strings.HasPrefix(peers[i].DelegatedPrefix, "/") {
+			continue
+		}
+		prefix, err := alloc.Delegate(peers[i])
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: delegate prefix: %w", peers[i].Name, err)
+		}
+		peers[i].DelegatedPrefix = prefix
+	}
+	return alloc, nil
+}
+
+func applyBGPPeers(cfg *models.AppConfig, state State, now time.Time) ([]Change, error) {
+	existing := indexByName(cfg.BGPPeers, func(p models.BGPPeer) string { return p.Name })
+	listed := make(map[string]bool, len(state.BGPPeers))
+	var changes []Change
+	var peers []models.BGPPeer
+	for _, p := range cfg.BGPPeers {
+		if !state.Prune || slices.ContainsFunc(state.BGPPeers, func(s BGPPeerSpec) bool { return s.Name == p.Name }) {
+			peers = append(peers, p)
+		}
+	}
+	for _, spec := range state.BGPPeers {
+		switch {
+		case strings.TrimSpace(spec.Name) == "":
+			return nil, fmt.Errorf("a BGP peer has no name")
+		case listed[spec.Name]:
+			return nil, fmt.Errorf("BGP peer %q is listed twice", spec.Name)
+		case spec.ID != "" || !spec.CreatedAt.IsZero() || !spec.UpdatedAt.IsZero():
+			return nil, fmt.Errorf("BGP peer %q: id, createdAt and updatedAt are managed by wg-busy and cannot be set", spec.Name)
+		}
+		if existing[spec.Name] < 0 {
+			return nil, fmt.Errorf("the config has several BGP peers named %q: rename them to apply a state", spec.Name)
+		}
+		listed[spec.Name] = true
+		if errs := spec.Validate(); len(errs) > 0 {
+			return nil, fmt.Errorf("BGP peer %q: %w", spec.Name, errs)
+		}
+
+		if i, ok := existing[spec.Name]; ok {
+			prev := cfg.BGPPeers[i]
+			p := models.FindBGPPeerByID(peers, prev.ID)
+			*p = spec.BGPPeer
+			p.ID, p.CreatedAt, p.UpdatedAt = prev.ID, prev.CreatedAt, prev.UpdatedAt
+			if fields := changedFields(prev, *p); len(fields) > 0 {
+				p.UpdatedAt = now
+				changes = append(changes, Change{Kind: "bgpPeer", Name: p.Name, Action: ActionUpdate, Fields: fields})
+			}
+			continue
+		}
+		id, err := models.NewID()
+		if err != nil {
+			return nil, fmt.Errorf("ID generation failed: %w", err)
+		}
+		p := spec.BGPPeer
+		p.ID, p.CreatedAt, p.UpdatedAt = id, now, now
+		peers = append(peers, p)
+		changes = append(changes, Change{Kind: "bgpPeer", Name: p.Name, Action: ActionCreate})
+	}
+	if state.Prune {
+		for _, p := range cfg.BGPPeers {
+			if !listed[p.Name] {
+				changes = append(changes, Change{Kind: "bgpPeer", Name: p.Name, Action: ActionDelete})
+			}
+		}
+	}
+	cfg.BGPPeers = peers
+	return changes, nil
+}
+
+// indexByName maps names to indexes, or to -1 for a name several items share.
+// Names are not unique in wg-busy, but a state can only address those that are.
+func indexByName[T any](items []T, name func(T) string) map[string]int {
+	index := make(map[string]int, len(items))
+	for i, item := range items {
+		if _, ok := index[name(item)]; ok {
+			index[name(item)] = -1
+		} else {
+			index[name(item)] = i
+		}
+	}
+	return index
+}
+
+func findByName(peers []models.Peer, name string) *models.Peer {
+	for i := range peers {
+		if peers[i].Name == name {
+			return &peers[i]
+		}
+	}
+	return nil
+}
+
+// changedFields lists, by config.yaml name, the fields that differ between
+// two peers or two BGP peers. Values are compared as config.yaml would store
+// them, so an empty list and no list are the same.
+func changedFields[T any](a, b T) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var fields []string
+	for i := range va.NumField() {
+		name := yamlName(va.Type().Field(i))
+		if name == "updatedAt" {
+			continue
+		}
+		x, errX := yaml.Marshal(va.Field(i).Interface())
+		y, errY := yaml.Marshal(vb.Field(i).Interface())
+		if errX != nil || errY != nil || !bytes.Equal(x, y) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return name
+}
+
+func peerField(v reflect.Value, name string) reflect.Value {
+	for i := range v.NumField() {
+		if yamlName(v.Type().Field(i)) == name {
+			return v.Field(i)
+		}
+	}
+	panic("declarative: no peer field " + name)
+}
@@ -0,0 +1,154 @@
+package declarative
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+const stateYAML = `
+peers:
+  - name: gateway
+    isExitNode: true
+    exitNodeAllowAll: true
+  - name: laptop
+    exitNode: gateway
+    tags: [staff]
+  - name: printer
+    allowedIPs: 10.0.0.50/32
+    enabled: false
+bgpPeers:
+  - name: core
+    peerIP: 192.0.2.1
+    peerAsn: 65001
+`
+
+const (
+	serverKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	deviceKey = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+)
+
+var server = models.ServerConfig{PrivateKey: serverKey, ListenPort: 51820, Address: "10.0.0.1/24"}
+
+func mustParse(t *testing.T, doc string) State {
+	t.Helper()
+	state, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func summary(changes []Change) string {
+	var out []string
+	for _, c := range changes {
+		out = append(out, c.Action+" "+c.Name+strings.Join(c.Fields, ","))
+	}
+	return strings.Join(out, "; ")
+}
+
+func TestApplyIsIdempotentAndKeepsKeys(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cfg := models.AppConfig{
+		Server: server,
+		Peers:  []models.Peer{{ID: "old", Name: "legacy", PublicKey: deviceKey, KeyHeld: true, AllowedIPs: "10.0.0.9/32", Enabled: true}},
+	}
+	state := mustParse(t, stateYAML)
+
+	changes, err := Apply(&cfg, state, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summary(changes); got != "create gateway; create laptop; create printer; create core" {
+		t.Fatalf("changes = %s", got)
+	}
+	if errs := models.ValidateConfig(cfg); len(errs) > 0 {
+		t.Fatalf("config invalid: %v", errs)
+	}
+	gateway, laptop := cfg.Peers[1], cfg.Peers[2]
+	if gateway.RoutingTableID == 0 || laptop.ExitNodeID != gateway.ID || laptop.AllowedIPs != "10.0.0.3/32" || laptop.PrivateKey == "" || !laptop.Enabled {
+		t.Fatalf("gateway = %+v, laptop = %+v", gateway, laptop)
+	}
+
+	again := mustParse(t, stateYAML)
+	if changes, err := Apply(&cfg, again, nil, now.Add(time.Hour)); err != nil || len(changes) != 0 {
+		t.Fatalf("second apply: %s, %v", summary(changes), err)
+	}
+	if cfg.Peers[2].PrivateKey != laptop.PrivateKey || !cfg.Peers[2].UpdatedAt.Equal(now) {
+		t.Fatalf("laptop changed on a no-op apply: %+v", cfg.Peers[2])
+	}
+}
+
+func TestApplyUpdatesPrunesAndCascades(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cfg := models.AppConfig{Server: server}
+	if _, err := Apply(&cfg, mustParse(t, stateYAML), nil, now); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Peers = append(cfg.Peers, models.Peer{ID: "manual", Name: "manual", PublicKey: deviceKey, KeyHeld: true, AllowedIPs: "10.0.0.60/32", ExitNodeID: cfg.Peers[0].ID})
+
+	changes, err := Apply(&cfg, mustParse(t, `
+prune: true
+peers:
+  - name: laptop
+    tags: [staff, remote]
+  - name: manual
+    allowedIPs: 10.0.0.60/32
+`), nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "update laptopexitNodeID,tags; update manualexitNodeID,enabled; delete gateway; delete printer; delete core"
+	if got := summary(changes); got != want {
+		t.Fatalf("changes = %s\nwant      %s", got, want)
+	}
+	if len(cfg.Peers) != 2 || len(cfg.BGPPeers) != 0 || cfg.Peers[0].ExitNodeID != "" || !slices.Equal(cfg.Peers[0].Tags, []string{"staff", "remote"}) {
+		t.Fatalf("after prune: %+v", cfg)
+	}
+}
+
+func TestApplyDelegatesPrefixesOnce(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cfg := models.AppConfig{Server: server}
+	cfg.Server.DelegationPool = "2001:db8::/48"
+	const doc = `
+peers:
+  - name: branch-a
+    delegatedPrefix: /56
+  - name: branch-b
+    delegatedPrefix: /56
+    announceDelegatedPrefix: true
+`
+	if _, err := Apply(&cfg, mustParse(t, doc), nil, now); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := cfg.Peers[0].DelegatedPrefix, cfg.Peers[1].DelegatedPrefix; a != "2001:db8::/56" || b != "2001:db8:0:100::/56" {
+		t.Fatalf("delegated %s and %s", a, b)
+	}
+	if changes, err := Apply(&cfg, mustParse(t, doc), nil, now); err != nil || len(changes) != 0 {
+		t.Fatalf("second apply: %s, %v", summary(changes), err)
+	}
+}
+
+func TestParseAndApplyRejectBadStates(t *testing.T) {
+	for _, doc := range []string{
+		"",
+		"peers:\n  - name: a\n    alowedIPs: 10.0.0.2/32\n",
+		"peers:\n  - name: a\n    privateKey: x\n",
+		"peers:\n  - name: a\n  - name: a\n",
+		"peers:\n  - name: a\n    exitNode: nowhere\n",
+		"peers:\n  - name: a\n    allowedIPs: not-an-ip\n",
+	} {
+		state, err := Parse([]byte(doc))
+		if err == nil {
+			cfg := models.AppConfig{Server: server}
+			_, err = Apply(&cfg, state, nil, time.Now())
+		}
+		if err == nil {
+			t.Errorf("state accepted:\n%s", doc)
+		}
+	}
+}
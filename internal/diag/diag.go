@@ -0,0 +1,281 @@
+// Package diag checks the host prerequisites wg-busy depends on but cannot set
+// up itself — forwarding sysctls, the WireGuard module, iptables, the TUN
+// device — and whether what it rendered is actually live: wg0 against
+// wg0.conf, the policy rules, routes and NAT rules, the BGP listeners. Each
+// failed check says what to change, so a broken install is found from the UI
+// instead of from a peer that silently gets nowhere.
+package diag
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/routing"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+// Check results.
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Skip = "skip" // not applicable to this config, or blocked by an earlier failure
+)
+
+// Check is the result of one check.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Hint is the remediation for a failed check.
+	Hint string `json:"hint,omitempty"`
+}
+
+// Input is what the checks compare the host with.
+type Input struct {
+	Config       models.AppConfig
+	WGConfigPath string
+	// VerifyRouting reports the installed routing state the kernel has lost,
+	// as config.Store.VerifyRouting does.
+	VerifyRouting func() ([]routing.Drift, error)
+	// BGPListeners reports the addresses BGP should listen on and those it
+	// has bound, as bgp.Listeners does. Nil skips the check.
+	BGPListeners func() (want, bound []string)
+}
+
+// maxListed bounds the differences a check lists in its detail.
+const maxListed = 5
+
+var (
+	procSys   = "/proc/sys"
+	sysModule = "/sys/module"
+	tunDevice = zerotier.TUNDevice
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return exec.Command(name, args...).CombinedOutput()
+	}
+	lookPath = exec.LookPath
+)
+
+// Run runs every check, in the order the UI lists them.
+func Run(in Input) []Check {
+	wgUp := interfaceExists()
+	return []Check{
+		checkSysctl("IPv4 forwarding", "net/ipv4/ip_forward",
+			"Add `net.ipv4.ip_forward=1` under `sysctls:` in compose.yml, or run `sysctl -w net.ipv4.ip_forward=1` on the host. Without it peers reach the server but nothing behind it."),
+		checkIPv6Forwarding(in.Config),
+		checkSysctl("src_valid_mark", "net/ipv4/conf/all/src_valid_mark",
+			"Add `net.ipv4.conf.all.src_valid_mark=1` under `sysctls:` in compose.yml. wg-quick sets it only when it installs a default route itself, and cannot inside a container."),
+		checkModule(wgUp),
+		checkIPTables(in.Config),
+		checkInterface(in.WGConfigPath, wgUp),
+		checkRouting(in.VerifyRouting, wgUp),
+		checkTUN(in.Config),
+		checkBGP(in.Config, in.BGPListeners),
+	}
+}
+
+// Failed counts the failed checks.
+func Failed(checks []Check) int {
+	n := 0
+	for _, c := range checks {
+		if c.Status == Fail {
+			n++
+		}
+	}
+	return n
+}
+
+func interfaceExists() bool {
+	_, err := runCommand("ip", "link", "show", models.WGDevice)
+	return err == nil
+}
+
+// readSysctl returns a sysctl's value, named by its path under /proc/sys.
+func readSysctl(name string) (string, error) {
+	value, err := os.ReadFile(filepath.Join(procSys, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func checkSysctl(title, name, hint string) Check {
+	key := strings.ReplaceAll(name, "/", ".")
+	value, err := readSysctl(name)
+	switch {
+	case err != nil:
+		return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("cannot read %s: %v", key, err), Hint: hint}
+	case value != "1":
+		return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("%s = %s", key, value), Hint: hint}
+	}
+	return Check{Name: title, Status: Pass, Detail: key + " = 1"}
+}
+
+// usesIPv6 reports whether the server or any peer has an IPv6 address, which
+// makes IPv6 forwarding a requirement.
+func usesIPv6(cfg models.AppConfig) bool {
+	if strings.Contains(cfg.Server.Address, ":") {
+		return true
+	}
+	for _, p := range cfg.Peers {
+		if p.Enabled && strings.Contains(p.AllowedIPs, ":") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkIPv6Forwarding(cfg models.AppConfig) Check {
+	const title = "IPv6 forwarding"
+	if !usesIPv6(cfg) {
+		return Check{Name: title, Status: Skip, Detail: "No IPv6 addresses are configured."}
+	}
+	if _, err := readSysctl("net/ipv6/conf/all/forwarding"); errors.Is(err, os.ErrNotExist) {
+		return Check{Name: title, Status: Fail, Detail: "IPv6 is disabled in this network namespace.",
+			Hint: "Add `net.ipv6.conf.all.disable_ipv6=0` and `net.ipv6.conf.all.forwarding=1` under `sysctls:` in compose.yml."}
+	}
+	return checkSysctl(title, "net/ipv6/conf/all/forwarding",
+		"Add `net.ipv6.conf.all.forwarding=1` under `sysctls:` in compose.yml, or run `sysctl -w net.ipv6.conf.all.forwarding=1` on the host.")
+}
+
+func checkModule(wgUp bool) Check {
+	const title = "WireGuard module"
+	if _, err := os.Stat(filepath.Join(sysModule, "wireguard")); err == nil {
+		return Check{Name: title, Status: Pass, Detail: "The wireguard kernel module is loaded."}
+	}
+	// Built into the kernel, it may have no /sys/module entry.
+	if wgUp {
+		if out, err := runCommand("ip", "-d", "link", "show", models.WGDevice); err == nil && strings.Contains(string(out), "wireguard") {
+			return Check{Name: title, Status: Pass, Detail: models.WGDevice + " is a kernel WireGuard interface."}
+		}
+	}
+	return Check{Name: title, Status: Fail, Detail: "The wireguard kernel module is not loaded.",
+		Hint: "Run `modprobe wireguard` on the host, or mount `/lib/modules:/lib/modules:ro` and add the SYS_MODULE capability so the container can load it. Kernels older than 5.6 need the wireguard package installed on the host first."}
+}
+
+func checkIPTables(cfg models.AppConfig) Check {
+	const title = "iptables"
+	const hint = "Install iptables and ip6tables (`apk add iptables ip6tables`), and give the container the NET_ADMIN capability. On an nftables host, use the iptables-nft variant so rules land in the tables the host uses."
+	tools := []string{"iptables"}
+	if usesIPv6(cfg) {
+		tools = append(tools, "ip6tables")
+	}
+	var versions []string
+	for _, tool := range tools {
+		out, err := runCommand(tool, "-V")
+		if err != nil {
+			return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("%s is not available: %v", tool, err), Hint: hint}
+		}
+		versions = append(versions, strings.TrimSpace(string(out)))
+		// The NAT table is where masquerading goes, and reading it needs
+		// NET_ADMIN as much as writing does.
+		if out, err := runCommand(tool, "-t", "nat", "-S", "POSTROUTING"); err != nil {
+			return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("%s cannot read the nat table: %s", tool, commandError(out, err)), Hint: hint}
+		}
+	}
+	if _, err := lookPath("nft"); err == nil {
+		versions = append(versions, "nft available")
+	}
+	return Check{Name: title, Status: Pass, Detail: strings.Join(versions, "; ")}
+}
+
+func checkInterface(wgConfigPath string, wgUp bool) Check {
+	const title = "wg0 interface"
+	const hint = "Click Apply Config on the Server tab to load wg0.conf into the interface. If the difference comes back, something besides wg-busy changes wg0, such as `wg set`."
+	if !wgUp {
+		return Check{Name: title, Status: Fail, Detail: models.WGDevice + " does not exist.",
+			Hint: "wg-quick up failed; the app log has its output. Fix the cause, then click Apply Config on the Server tab."}
+	}
+	rendered, err := runCommand("wg-quick", "strip", wgConfigPath)
+	if err != nil {
+		return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("cannot read %s: %s", wgConfigPath, commandError(rendered, err)), Hint: hint}
+	}
+	live, err := runCommand("wg", "showconf", models.WGDevice)
+	if err != nil {
+		return Check{Name: title, Status: Fail, Detail: fmt.Sprintf("cannot read %s: %s", models.WGDevice, commandError(live, err)), Hint: hint}
+	}
+	want, have := parseWGConf(string(rendered)), parseWGConf(string(live))
+	if diffs := compareWGConf(want, have); len(diffs) > 0 {
+		return Check{Name: title, Status: Fail, Detail: list(diffs), Hint: hint}
+	}
+	return Check{Name: title, Status: Pass, Detail: fmt.Sprintf("%s matches %s (%d peers).", models.WGDevice, wgConfigPath, len(want.peers))}
+}
+
+func checkRouting(verify func() ([]routing.Drift, error), wgUp bool) Check {
+	const title = "Rules, routes and NAT"
+	switch {
+	case verify == nil:
+		return Check{Name: title, Status: Skip}
+	case !wgUp:
+		return Check{Name: title, Status: Skip, Detail: "Installed with " + models.WGDevice + ", which is not up."}
+	}
+	drift, err := verify()
+	if err != nil {
+		return Check{Name: title, Status: Fail, Detail: err.Error(), Hint: "wg-busy reads the kernel's rules and routes with iproute2's `ip`, and its NAT and filter rules with iptables; install both."}
+	}
+	if len(drift) > 0 {
+		diffs := make([]string, len(drift))
+		for i, d := range drift {
+			diffs[i] = d.String()
+		}
+		return Check{Name: title, Status: Fail, Detail: list(diffs),
+			Hint: "Click Repair now below to reinstall them, or turn on automatic repair in the Server settings. Something outside wg-busy removed them, such as a networking restart, `ip rule flush` or a firewall reload, and exit nodes, policy routes and NAT do not work until then."}
+	}
+	return Check{Name: title, Status: Pass, Detail: "Every generated ip rule, route and iptables rule is installed."}
+}
+
+func checkTUN(cfg models.AppConfig) Check {
+	const title = "TUN device for ZeroTier"
+	if !cfg.ZeroTier.Enabled {
+		return Check{Name: title, Status: Skip, Detail: "ZeroTier is disabled."}
+	}
+	if _, err := os.Stat(tunDevice); err != nil {
+		return Check{Name: title, Status: Fail, Detail: tunDevice + " is not available.", Hint: zerotier.TUNHint}
+	}
+	return Check{Name: title, Status: Pass, Detail: tunDevice + " is available."}
+}
+
+func checkBGP(cfg models.AppConfig, listeners func() (want, bound []string)) Check {
+	const title = "BGP listener"
+	if !cfg.Server.BGPEnabled || listeners == nil {
+		return Check{Name: title, Status: Skip, Detail: "BGP is disabled."}
+	}
+	want, bound := listeners()
+	if len(want) == 0 {
+		return Check{Name: title, Status: Fail, Detail: "BGP is enabled but not running.",
+			Hint: "BGP starts once wg0 is up; the app log says why it did not. Saving the server settings retries."}
+	}
+	var missing []string
+	for _, address := range want {
+		if !slices.Contains(bound, address) {
+			missing = append(missing, address)
+		}
+	}
+	if len(missing) > 0 {
+		return Check{Name: title, Status: Fail, Detail: "Not listening on " + strings.Join(missing, ", "),
+			Hint: fmt.Sprintf("Set the BGP listen address to an address of this host (wg0's, or empty for all), and make sure no other routing daemon holds port %d.", cfg.Server.BGPListenPort)}
+	}
+	return Check{Name: title, Status: Pass, Detail: "Listening on " + strings.Join(bound, ", ")}
+}
+
+// list joins differences for a check's detail, eliding past maxListed.
+func list(diffs []string) string {
+	if len(diffs) <= maxListed {
+		return strings.Join(diffs, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more", strings.Join(diffs[:maxListed], "; "), len(diffs)-maxListed)
+}
+
+// commandError is a failed command's own message, or its exit error.
+func commandError(out []byte, err error) string {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
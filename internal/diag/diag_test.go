@@ -0,0 +1,176 @@
+package diag
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/routing"
+)
+
+const renderedConf = `[Interface]
+PrivateKey = cHJpdmF0ZS1rZXktb2YtdGhlLXNlcnZlci0xMjM0NTY=
+ListenPort = 51820
+
+# alice
+[Peer]
+PublicKey = YWxpY2UtcHVibGljLWtleS0xMjM0NTY3ODkwMTIzNA=
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+PersistentKeepalive = 25
+
+# bob
+[Peer]
+PublicKey = Ym9iLXB1YmxpYy1rZXktMTIzNDU2Nzg5MDEyMzQ1Ng=
+AllowedIPs = 10.0.0.3/32
+`
+
+// What wg showconf prints for the same config after a manual `wg set`: bob
+// lost an address and an unknown peer was added.
+const liveConf = `[Interface]
+ListenPort = 51820
+PrivateKey = cHJpdmF0ZS1rZXktb2YtdGhlLXNlcnZlci0xMjM0NTY=
+
+[Peer]
+PublicKey = YWxpY2UtcHVibGljLWtleS0xMjM0NTY3ODkwMTIzNA=
+AllowedIPs = fd00::2/128, 10.0.0.2/32
+Endpoint = 203.0.113.7:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = Ym9iLXB1YmxpYy1rZXktMTIzNDU2Nzg5MDEyMzQ1Ng=
+
+[Peer]
+PublicKey = c3RyYXktcHVibGljLWtleS0xMjM0NTY3ODkwMTIzNA=
+AllowedIPs = 10.0.0.99/32
+`
+
+func TestCompareWGConf(t *testing.T) {
+	want := parseWGConf(renderedConf)
+	if diffs := compareWGConf(want, want); len(diffs) != 0 {
+		t.Errorf("identical configs differ: %v", diffs)
+	}
+	got := compareWGConf(want, parseWGConf(liveConf))
+	expected := []string{
+		"peer Ym9iLXB1… has allowed IPs (none), wg0.conf has 10.0.0.3/32",
+		"peer c3RyYXkt… is not in wg0.conf",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("diffs = %q, want %q", got, expected)
+	}
+}
+
+// stubHost points the checks at a fake /proc/sys, /sys/module and set of
+// commands, and restores the real ones after the test.
+func stubHost(t *testing.T, sysctls map[string]string, commands map[string]string) {
+	t.Helper()
+	origProc, origModule, origTUN, origRun, origLook := procSys, sysModule, tunDevice, runCommand, lookPath
+	t.Cleanup(func() {
+		procSys, sysModule, tunDevice, runCommand, lookPath = origProc, origModule, origTUN, origRun, origLook
+	})
+	dir := t.TempDir()
+	procSys = filepath.Join(dir, "proc")
+	sysModule = filepath.Join(dir, "module")
+	tunDevice = filepath.Join(dir, "tun")
+	for name, value := range sysctls {
+		path := filepath.Join(procSys, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		out, ok := commands[name+" "+strings.Join(args, " ")]
+		if !ok {
+			return nil, errors.New("exit status 1")
+		}
+		return []byte(out), nil
+	}
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+}
+
+func TestRun(t *testing.T) {
+	stubHost(t, map[string]string{
+		"net/ipv4/ip_forward":              "1",
+		"net/ipv4/conf/all/src_valid_mark": "0",
+		"net/ipv6/conf/all/forwarding":     "0",
+	}, map[string]string{
+		"ip link show wg0":                       "5: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420",
+		"ip -d link show wg0":                    "5: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420\n    wireguard",
+		"iptables -V":                            "iptables v1.8.10 (nf_tables)",
+		"iptables -t nat -S POSTROUTING":         "-P POSTROUTING ACCEPT",
+		"ip6tables -V":                           "ip6tables v1.8.10 (nf_tables)",
+		"ip6tables -t nat -S POSTROUTING":        "-P POSTROUTING ACCEPT",
+		"wg-quick strip /etc/wireguard/wg0.conf": renderedConf,
+		"wg showconf wg0":                        renderedConf,
+	})
+	in := Input{
+		Config: models.AppConfig{
+			Server:   models.ServerConfig{Address: "10.0.0.1/24, fd00::1/64", BGPEnabled: true, BGPListenPort: 179},
+			ZeroTier: models.ZeroTierConfig{Enabled: true},
+		},
+		WGConfigPath: "/etc/wireguard/wg0.conf",
+		VerifyRouting: func() ([]routing.Drift, error) {
+			return []routing.Drift{{Kind: "rule", Want: "ip rule add from 10.0.0.2 table 100 priority 10000"}}, nil
+		},
+		BGPListeners: func() ([]string, []string) { return []string{"[::]:179"}, nil },
+	}
+
+	got := make(map[string]Check)
+	for _, c := range Run(in) {
+		got[c.Name] = c
+		if c.Status == Fail && c.Hint == "" {
+			t.Errorf("%s failed without a hint", c.Name)
+		}
+	}
+	for name, status := range map[string]string{
+		"IPv4 forwarding":         Pass,
+		"IPv6 forwarding":         Fail,
+		"src_valid_mark":          Fail,
+		"WireGuard module":        Pass,
+		"iptables":                Pass,
+		"wg0 interface":           Pass,
+		"Rules, routes and NAT":   Fail,
+		"TUN device for ZeroTier": Fail,
+		"BGP listener":            Fail,
+	} {
+		if got[name].Status != status {
+			t.Errorf("%s: %s (%s), want %s", name, got[name].Status, got[name].Detail, status)
+		}
+	}
+	if detail := got["Rules, routes and NAT"].Detail; detail != "missing: ip rule add from 10.0.0.2 table 100 priority 10000" {
+		t.Errorf("routing detail = %q", detail)
+	}
+	if detail := got["BGP listener"].Detail; detail != "Not listening on [::]:179" {
+		t.Errorf("BGP detail = %q", detail)
+	}
+}
+
+// With wg0 down the interface check fails, and the checks of what it installs
+// are skipped rather than failed a second time.
+func TestRunWithoutInterface(t *testing.T) {
+	stubHost(t, map[string]string{"net/ipv4/ip_forward": "1", "net/ipv4/conf/all/src_valid_mark": "1"}, map[string]string{
+		"iptables -V":                    "iptables v1.8.10 (legacy)",
+		"iptables -t nat -S POSTROUTING": "-P POSTROUTING ACCEPT",
+	})
+	checks := Run(Input{
+		Config:        models.AppConfig{Server: models.ServerConfig{Address: "10.0.0.1/24"}},
+		VerifyRouting: func() ([]routing.Drift, error) { t.Error("routing verified with wg0 down"); return nil, nil },
+	})
+	statuses := make([]string, len(checks))
+	for i, c := range checks {
+		statuses[i] = c.Name + "=" + c.Status
+	}
+	want := "IPv4 forwarding=pass IPv6 forwarding=skip src_valid_mark=pass WireGuard module=fail iptables=pass " +
+		"wg0 interface=fail Rules, routes and NAT=skip TUN device for ZeroTier=skip BGP listener=skip"
+	if got := strings.Join(statuses, " "); got != want {
+		t.Errorf("statuses:\n%s\nwant\n%s", got, want)
+	}
+	if Failed(checks) != 2 {
+		t.Errorf("Failed = %d, want 2", Failed(checks))
+	}
+}
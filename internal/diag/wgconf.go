@@ -0,0 +1,149 @@
+package diag
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// wgConf is the part of a wg(8) config the live interface must match. Peer
+// endpoints are left out: roaming peers change them, and wg showconf prints
+// the last one seen.
+type wgConf struct {
+	listenPort string
+	privateKey string
+	peers      map[string]wgPeer // by public key
+}
+
+type wgPeer struct {
+	allowedIPs   string // normalized and sorted
+	presharedKey string
+	keepalive    string
+}
+
+// parseWGConf reads `wg-quick strip` or `wg showconf` output.
+func parseWGConf(content string) wgConf {
+	conf := wgConf{peers: make(map[string]wgPeer)}
+	var key string
+	var peer *wgPeer
+	flush := func() {
+		if peer != nil && key != "" {
+			conf.peers[key] = *peer
+		}
+		key, peer = "", nil
+	}
+	for line := range strings.Lines(content) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			flush()
+			if strings.EqualFold(line, "[Peer]") {
+				peer = &wgPeer{}
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if peer == nil {
+			switch name {
+			case "listenport":
+				conf.listenPort = value
+			case "privatekey":
+				conf.privateKey = value
+			}
+			continue
+		}
+		switch name {
+		case "publickey":
+			key = value
+		case "allowedips":
+			peer.allowedIPs = normalizeAllowedIPs(value)
+		case "presharedkey":
+			peer.presharedKey = value
+		case "persistentkeepalive":
+			if value != "0" && value != "off" {
+				peer.keepalive = value
+			}
+		}
+	}
+	flush()
+	return conf
+}
+
+// normalizeAllowedIPs writes an AllowedIPs list the way wg prints it.
+func normalizeAllowedIPs(value string) string {
+	var prefixes []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			item = prefix.Masked().String()
+		}
+		prefixes = append(prefixes, item)
+	}
+	slices.Sort(prefixes)
+	return strings.Join(prefixes, ", ")
+}
+
+// shortKey abbreviates a public key for a difference list.
+func shortKey(key string) string {
+	if len(key) > 8 {
+		return key[:8] + "…"
+	}
+	return key
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// compareWGConf lists how the live interface differs from the rendered
+// config. Keys are never printed in full, and private and preshared keys not
+// at all.
+func compareWGConf(want, have wgConf) []string {
+	var diffs []string
+	if want.listenPort != have.listenPort {
+		diffs = append(diffs, fmt.Sprintf("listen port is %s, wg0.conf has %s", have.listenPort, want.listenPort))
+	}
+	if want.privateKey != have.privateKey {
+		diffs = append(diffs, "private key differs from wg0.conf")
+	}
+	keys := make([]string, 0, len(want.peers))
+	for key := range want.peers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		w := want.peers[key]
+		h, ok := have.peers[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("peer %s is missing", shortKey(key)))
+		case w.allowedIPs != h.allowedIPs:
+			diffs = append(diffs, fmt.Sprintf("peer %s has allowed IPs %s, wg0.conf has %s", shortKey(key), orNone(h.allowedIPs), orNone(w.allowedIPs)))
+		case w.presharedKey != h.presharedKey:
+			diffs = append(diffs, fmt.Sprintf("peer %s has a different preshared key", shortKey(key)))
+		case w.keepalive != h.keepalive:
+			diffs = append(diffs, fmt.Sprintf("peer %s has keepalive %s, wg0.conf has %s", shortKey(key), orNone(h.keepalive), orNone(w.keepalive)))
+		}
+	}
+	var extra []string
+	for key := range have.peers {
+		if _, ok := want.peers[key]; !ok {
+			extra = append(extra, fmt.Sprintf("peer %s is not in wg0.conf", shortKey(key)))
+		}
+	}
+	slices.Sort(extra)
+	return append(diffs, extra...)
+}
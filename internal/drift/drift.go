@@ -0,0 +1,165 @@
+// Package drift checks periodically that the kernel still holds the policy
+// rules, routes and NAT rules wg-busy installed. They are lost without wg-busy
+// noticing — a networking restart, an `ip rule flush`, a firewall reload — and
+// until they are back exit nodes and policy routes silently stop working. The
+// watcher reports what is missing and, when the server's RepairRouting is set,
+// reinstalls it.
+package drift
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/routing"
+)
+
+// Interval is how often the live routing state is checked.
+const Interval = time.Minute
+
+// maxLogged bounds the missing entries one log line lists.
+const maxLogged = 3
+
+// Status is the latest check, and the latest repair if there was one.
+type Status struct {
+	CheckedAt time.Time       `json:"checkedAt"`
+	Drift     []routing.Drift `json:"drift"`
+	// Error is why the check itself failed, e.g. ip is not installed.
+	Error       string    `json:"error,omitempty"`
+	RepairedAt  time.Time `json:"repairedAt,omitzero"`
+	RepairError string    `json:"repairError,omitempty"`
+}
+
+// Watcher checks the routing state every Interval.
+type Watcher struct {
+	verify     func() ([]routing.Drift, error)
+	repair     func() error
+	autoRepair func() bool
+
+	mu      sync.Mutex
+	status  Status
+	repairs uint64
+}
+
+// New returns a watcher of the routing state the store installed.
+func New(store *config.Store) *Watcher {
+	return &Watcher{
+		verify: store.VerifyRouting,
+		repair: store.RepairRouting,
+		autoRepair: func() bool {
+			var on bool
+			store.Read(func(cfg *models.AppConfig) { on = cfg.Server.RepairRouting })
+			return on
+		},
+	}
+}
+
+// Start begins checking in the background.
+func (w *Watcher) Start() {
+	go func() {
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+
+		w.Run()
+		for range ticker.C {
+			w.Run()
+		}
+	}()
+}
+
+// Run checks once and, with RepairRouting set, repairs what the check found.
+func (w *Watcher) Run() {
+	drift, err := w.Check()
+	if err != nil || len(drift) == 0 || !w.autoRepair() {
+		return
+	}
+	_ = w.Repair()
+}
+
+// Check compares the kernel with the installed routing state and records the
+// result. A change in what is missing is logged; the same drift found again
+// is not.
+func (w *Watcher) Check() ([]routing.Drift, error) {
+	drift, err := w.verify()
+	w.mu.Lock()
+	previous := w.status
+	w.status.CheckedAt = time.Now()
+	w.status.Drift = drift
+	w.status.Error = ""
+	if err != nil {
+		w.status.Error = err.Error()
+	}
+	w.mu.Unlock()
+
+	switch {
+	case err != nil:
+		if previous.Error != err.Error() {
+			log.Printf("checking routing drift: %v", err)
+		}
+	case len(drift) > 0 && !slices.Equal(drift, previous.Drift):
+		log.Printf("routing drift: %d installed entries missing: %s", len(drift), summarize(drift))
+	case len(drift) == 0 && len(previous.Drift) > 0:
+		log.Printf("routing drift cleared")
+	}
+	return drift, err
+}
+
+// Repair reinstalls the routing state and checks again, so the status shows
+// what the repair left missing rather than what it found.
+func (w *Watcher) Repair() error {
+	err := w.repair()
+	w.mu.Lock()
+	w.repairs++
+	w.status.RepairedAt = time.Now()
+	w.status.RepairError = ""
+	if err != nil {
+		w.status.RepairError = err.Error()
+	}
+	w.mu.Unlock()
+	if err != nil {
+		log.Printf("repairing routing drift: %v", err)
+		return err
+	}
+	log.Printf("reinstalled routing state")
+	_, err = w.Check()
+	return err
+}
+
+// Status returns the latest check. A nil watcher has none.
+func (w *Watcher) Status() Status {
+	if w == nil {
+		return Status{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.status
+	s.Drift = slices.Clone(s.Drift)
+	return s
+}
+
+// Repairs counts the repairs run, automatic and manual.
+func (w *Watcher) Repairs() uint64 {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.repairs
+}
+
+// summarize lists the first few missing entries for a log line.
+func summarize(drift []routing.Drift) string {
+	entries := make([]string, 0, maxLogged)
+	for _, d := range drift[:min(len(drift), maxLogged)] {
+		entries = append(entries, d.String())
+	}
+	s := strings.Join(entries, "; ")
+	if len(drift) > maxLogged {
+		s += "; …"
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package drift
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/yix/wg-busy/internal/routing"
+)
+
+// fakeKernel loses a rule until the repair puts it back.
+type fakeKernel struct {
+	missing bool
+	repairs int
+	fail    error
+}
+
+func (k *fakeKernel) watcher(autoRepair bool) *Watcher {
+	return &Watcher{
+		verify: func() ([]routing.Drift, error) {
+			if k.missing {
+				return []routing.Drift{{Kind: "rule", Want: "ip rule add from 10.0.0.5 table 100 priority 10000"}}, nil
+			}
+			return nil, nil
+		},
+		repair: func() error {
+			k.repairs++
+			if k.fail != nil {
+				return k.fail
+			}
+			k.missing = false
+			return nil
+		},
+		autoRepair: func() bool { return autoRepair },
+	}
+}
+
+func TestRunReportsDriftWithoutRepair(t *testing.T) {
+	k := &fakeKernel{missing: true}
+	w := k.watcher(false)
+	w.Run()
+	if k.repairs != 0 {
+		t.Fatalf("repaired %d times with RepairRouting off", k.repairs)
+	}
+	if s := w.Status(); len(s.Drift) != 1 || s.CheckedAt.IsZero() || !s.RepairedAt.IsZero() {
+		t.Errorf("status = %+v, want the missing rule and no repair", s)
+	}
+}
+
+func TestRunRepairsAndChecksAgain(t *testing.T) {
+	k := &fakeKernel{missing: true}
+	w := k.watcher(true)
+	w.Run()
+	if k.repairs != 1 || w.Repairs() != 1 {
+		t.Fatalf("repairs = %d (counted %d), want 1", k.repairs, w.Repairs())
+	}
+	// The status is the check after the repair, which found nothing missing.
+	if s := w.Status(); len(s.Drift) != 0 || s.RepairedAt.IsZero() || s.RepairError != "" {
+		t.Errorf("status = %+v, want no drift after a repair", s)
+	}
+
+	// Nothing missing, nothing to repair.
+	w.Run()
+	if k.repairs != 1 {
+		t.Errorf("repaired again with no drift")
+	}
+}
+
+func TestRepairFailureIsKept(t *testing.T) {
+	k := &fakeKernel{missing: true, fail: errors.New("RTNETLINK answers: Operation not permitted")}
+	w := k.watcher(true)
+	w.Run()
+	s := w.Status()
+	if s.RepairError != k.fail.Error() || len(s.Drift) != 1 {
+		t.Errorf("status = %+v, want the repair error and the drift still listed", s)
+	}
+}
+
+func TestNilWatcher(t *testing.T) {
+	var w *Watcher
+	if s := w.Status(); !s.CheckedAt.IsZero() || w.Repairs() != 0 {
+		t.Errorf("nil watcher reported %+v", s)
+	}
+}
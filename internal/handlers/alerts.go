@@ -0,0 +1,621 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/alert"
+	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+// alertKindLabels names the rule kinds in the UI.
+var alertKindLabels = map[string]string{
+	models.AlertPeerUnseen:       "Peer not seen",
+	models.AlertBGPDown:          "BGP session down",
+	models.AlertBGPPrefixesBelow: "BGP prefixes below",
+	models.AlertInterfaceDown:    "Interface down",
+	models.AlertZeroTierOffline:  "ZeroTier offline",
+	models.AlertQuotaAbove:       "Quota above",
+}
+
+// silenceDurations are the lengths the silence dialog offers.
+var silenceDurations = []struct {
+	Value string
+	Label string
+}{
+	{"1h", "1 hour"}, {"4h", "4 hours"}, {"12h", "12 hours"}, {"24h", "1 day"}, {"168h", "1 week"},
+}
+
+// alertRow is an active or resolved alert as the panel shows it.
+type alertRow struct {
+	alert.Alert
+	Firing bool
+	For    string // how long the condition has held, or held
+	When   string // when it fired or resolved
+}
+
+// alertRuleRow is one rule in the rules list.
+type alertRuleRow struct {
+	models.AlertRule
+	KindLabel  string
+	TargetName string
+	ForText    string
+}
+
+// alertSilenceRow is one silence in the silences list.
+type alertSilenceRow struct {
+	models.AlertSilence
+	RuleName    string
+	SubjectName string
+	UntilText   string
+	Expired     bool
+}
+
+// alertsActiveData is the template data of the active and resolved alerts,
+// which live updates re-render on their own.
+type alertsActiveData struct {
+	Active   []alertRow
+	Resolved []alertRow
+}
+
+// alertsData is the template data of the Alerts tab.
+type alertsData struct {
+	alertsActiveData
+	Rules            []alertRuleRow
+	Silences         []alertSilenceRow
+	Mail             models.AlertMail
+	MailTo           string
+	MailStatus       string
+	MailFailed       bool
+	Severities       []string
+	Success          string
+	Error            string
+	ValidationErrors models.ValidationErrors
+	OOB              bool
+}
+
+// alertChoice is one option of a select in the alert dialogs.
+type alertChoice struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// alertRuleFormData is the template data of the rule create or edit dialog.
+type alertRuleFormData struct {
+	IsNew      bool
+	Rule       models.AlertRule
+	ForText    string
+	Threshold  string
+	Kinds      []alertChoice
+	Severities []alertChoice
+	Peers      []alertChoice
+	Neighbours []alertChoice
+	// ShowPeers, ShowNeighbours and ShowThreshold are the fields the rule's
+	// kind uses; the dialog hides the others.
+	ShowPeers        bool
+	ShowNeighbours   bool
+	ShowThreshold    bool
+	Error            string
+	ValidationErrors models.ValidationErrors
+}
+
+// alertSilenceFormData is the template data of the silence dialog.
+type alertSilenceFormData struct {
+	Rules            []alertChoice
+	Subject          string
+	SubjectName      string
+	Durations        []alertChoice
+	Comment          string
+	Error            string
+	ValidationErrors models.ValidationErrors
+}
+
+func (h *handler) buildAlertsActiveData() alertsActiveData {
+	var data alertsActiveData
+	if h.alerts == nil {
+		return data
+	}
+	now := time.Now()
+	active, resolved := h.alerts.Alerts()
+	for _, a := range active {
+		row := alertRow{Alert: a, Firing: a.State == alert.StateFiring, For: wgstats.FormatDuration(now.Sub(a.Since))}
+		if row.Firing {
+			row.When = a.FiredAt.Local().Format(historyTimeLayout)
+		}
+		data.Active = append(data.Active, row)
+	}
+	for _, a := range resolved {
+		data.Resolved = append(data.Resolved, alertRow{Alert: a, For: wgstats.FormatDuration(a.ResolvedAt.Sub(a.Since)),
+			When: a.ResolvedAt.Local().Format(historyTimeLayout)})
+	}
+	return data
+}
+
+func (h *handler) buildAlertsData() alertsData {
+	data := alertsData{alertsActiveData: h.buildAlertsActiveData(), Severities: models.AlertSeverities}
+	now := time.Now()
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, rule := range cfg.Alerts.Rules {
+			row := alertRuleRow{AlertRule: rule, KindLabel: alertKindLabels[rule.Kind], TargetName: alertTargetName(cfg, rule), ForText: formatAlertFor(rule.For)}
+			data.Rules = append(data.Rules, row)
+		}
+		for _, s := range cfg.Alerts.Silences {
+			row := alertSilenceRow{AlertSilence: s, RuleName: "all rules", UntilText: s.Until.Local().Format(historyTimeLayout), Expired: !now.Before(s.Until)}
+			if s.Rule != "" {
+				row.RuleName = s.Rule
+				if rule := models.FindAlertRuleByID(cfg.Alerts.Rules, s.Rule); rule != nil {
+					row.RuleName = rule.Name
+				}
+			}
+			row.SubjectName = s.Subject
+			if p := models.FindPeerByID(cfg.Peers, s.Subject); p != nil {
+				row.SubjectName = p.Name
+			}
+			data.Silences = append(data.Silences, row)
+		}
+		data.Mail = cfg.Alerts.Mail
+		data.MailTo = strings.Join(cfg.Alerts.Mail.To, ", ")
+	})
+	if h.alerts != nil {
+		if when, errText := h.alerts.MailStatus(); !when.IsZero() {
+			data.MailStatus = "Last mail " + when.Local().Format(historyTimeLayout+":05") + ": sent"
+			if errText != "" {
+				data.MailStatus = "Last mail " + when.Local().Format(historyTimeLayout+":05") + ": " + errText
+				data.MailFailed = true
+			}
+		}
+	}
+	return data
+}
+
+// alertTargetName describes what a rule watches.
+func alertTargetName(cfg *models.AppConfig, rule models.AlertRule) string {
+	switch {
+	case rule.TargetsPeers() && rule.Target == "":
+		return "all peers"
+	case rule.TargetsPeers():
+		if p := models.FindPeerByID(cfg.Peers, rule.Target); p != nil {
+			return p.Name
+		}
+		return "deleted peer"
+	case rule.TargetsBGP() && rule.Target == "":
+		return "all BGP neighbours"
+	case rule.Kind == models.AlertInterfaceDown:
+		return "wg0"
+	case rule.Kind == models.AlertZeroTierOffline:
+		return "ZeroTier"
+	}
+	return rule.Target
+}
+
+// formatAlertFor renders a rule's For the way the form takes it.
+func formatAlertFor(d time.Duration) string {
+	if d == 0 {
+		return "0"
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// GetAlertsTab handles GET /alerts.
+func (h *handler) GetAlertsTab(w http.ResponseWriter, r *http.Request) {
+	writePageJSON(w, http.StatusOK, "alerts-tab", h.buildAlertsData(), nil)
+}
+
+// GetAlertsJSON handles GET /api/alerts: the pending and firing alerts, and
+// the latest resolved ones.
+func (h *handler) GetAlertsJSON(w http.ResponseWriter, r *http.Request) {
+	active, resolved := []alert.Alert{}, []alert.Alert{}
+	if h.alerts != nil {
+		a, res := h.alerts.Alerts()
+		active, resolved = append(active, a...), append(resolved, res...)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(struct {
+		Active   []alert.Alert `json:"active"`
+		Resolved []alert.Alert `json:"resolved"`
+	}{active, resolved})
+}
+
+func (h *handler) newAlertRuleFormData(isNew bool, rule models.AlertRule) alertRuleFormData {
+	data := alertRuleFormData{IsNew: isNew, Rule: rule, ForText: formatAlertFor(rule.For),
+		ShowPeers: rule.TargetsPeers(), ShowNeighbours: rule.TargetsBGP(),
+		ShowThreshold: rule.Kind == models.AlertBGPPrefixesBelow || rule.Kind == models.AlertQuotaAbove}
+	if rule.Threshold != 0 {
+		data.Threshold = strconv.FormatFloat(rule.Threshold, 'f', -1, 64)
+	}
+	for _, kind := range models.AlertKinds {
+		data.Kinds = append(data.Kinds, alertChoice{Value: kind, Label: alertKindLabels[kind], Selected: kind == rule.Kind})
+	}
+	for _, severity := range models.AlertSeverities {
+		data.Severities = append(data.Severities, alertChoice{Value: severity, Label: severity, Selected: severity == rule.Severity})
+	}
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, p := range cfg.Peers {
+			data.Peers = append(data.Peers, alertChoice{Value: p.ID, Label: p.Name, Selected: rule.TargetsPeers() && p.ID == rule.Target})
+		}
+	})
+	// Neighbours are listed as BGP knows them, which includes peers with BGP
+	// sessions; a target no longer among them stays selectable.
+	var targetListed bool
+	if stats := bgp.GetBGPStats(); stats != nil {
+		for _, p := range stats.Peers {
+			label := p.IP
+			if p.Name != "" {
+				label = p.Name + " (" + p.IP + ")"
+			}
+			selected := rule.TargetsBGP() && p.IP == rule.Target
+			targetListed = targetListed || selected
+			data.Neighbours = append(data.Neighbours, alertChoice{Value: p.IP, Label: label, Selected: selected})
+		}
+	}
+	if rule.TargetsBGP() && rule.Target != "" && !targetListed {
+		data.Neighbours = append(data.Neighbours, alertChoice{Value: rule.Target, Label: rule.Target, Selected: true})
+	}
+	return data
+}
+
+// GetAlertRuleForm returns the rule create or edit dialog.
+func (h *handler) GetAlertRuleForm(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	rule := models.AlertRule{Enabled: true, Kind: models.AlertPeerUnseen, Severity: models.SeverityWarning, For: 10 * time.Minute}
+	if id != "" {
+		var found bool
+		h.store.Read(func(cfg *models.AppConfig) {
+			if p := models.FindAlertRuleByID(cfg.Alerts.Rules, id); p != nil {
+				rule, found = *p, true
+			}
+		})
+		if !found {
+			writePageError(w, http.StatusNotFound, errAlertRuleNotFound)
+			return
+		}
+	}
+	writePageJSON(w, http.StatusOK, "alert-rule-form", h.newAlertRuleFormData(id == "", rule), nil)
+}
+
+// parseAlertRuleForm fills the submitted fields into rule and returns what
+// could not be parsed.
+func parseAlertRuleForm(r *http.Request, rule *models.AlertRule) models.ValidationErrors {
+	var errs models.ValidationErrors
+	rule.Name = strings.TrimSpace(r.FormValue("name"))
+	rule.Enabled = r.FormValue("enabled") == "on"
+	rule.Kind = r.FormValue("alertKind")
+	rule.Severity = r.FormValue("alertSeverity")
+	// The dialog has one target select per kind of target; only the one
+	// matching the kind counts.
+	rule.Target = ""
+	if rule.TargetsPeers() {
+		rule.Target = r.FormValue("alertPeer")
+	} else if rule.TargetsBGP() {
+		rule.Target = r.FormValue("alertNeighbour")
+	}
+	rule.Threshold = 0
+	if value := strings.TrimSpace(r.FormValue("alertThreshold")); value != "" && (rule.Kind == models.AlertBGPPrefixesBelow || rule.Kind == models.AlertQuotaAbove) {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, models.ValidationError{Field: "alertThreshold", Message: "must be a number"})
+		}
+		rule.Threshold = threshold
+	}
+	rule.For = 0
+	if value := strings.TrimSpace(r.FormValue("alertFor")); value != "" && value != "0" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, models.ValidationError{Field: "alertFor", Message: "must be a duration such as 90s, 10m or 2h"})
+		}
+		rule.For = d
+	}
+	rule.UpdatedAt = time.Now().UTC()
+	return errs
+}
+
+// checkAlertRule validates rule against the config it is saved into.
+func checkAlertRule(cfg *models.AppConfig, rule *models.AlertRule, parseErrs models.ValidationErrors) error {
+	errs := slices.Concat(parseErrs, rule.Validate())
+	if rule.TargetsPeers() && rule.Target != "" && models.FindPeerByID(cfg.Peers, rule.Target) == nil {
+		errs = append(errs, models.ValidationError{Field: "alertTarget", Message: "unknown peer"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CreateAlertRule handles POST /alerts/rules.
+func (h *handler) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	id, err := models.NewID()
+	if err != nil {
+		writePageError(w, http.StatusInternalServerError, fmt.Errorf("ID generation failed: %w", err))
+		return
+	}
+	rule := models.AlertRule{ID: id}
+	parseErrs := parseAlertRuleForm(r, &rule)
+	rule.CreatedAt = rule.UpdatedAt
+
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		if err := checkAlertRule(cfg, &rule, parseErrs); err != nil {
+			return err
+		}
+		cfg.Alerts.Rules = append(cfg.Alerts.Rules, rule)
+		return nil
+	})
+	h.finishAlertRuleWrite(w, r, true, rule, writeErr)
+}
+
+// UpdateAlertRule handles PUT /alerts/rules/{id}.
+func (h *handler) UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	var submitted models.AlertRule
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		rule := models.FindAlertRuleByID(cfg.Alerts.Rules, r.PathValue("id"))
+		if rule == nil {
+			return errAlertRuleNotFound
+		}
+		parseErrs := parseAlertRuleForm(r, rule)
+		submitted = *rule
+		return checkAlertRule(cfg, rule, parseErrs)
+	})
+	if errors.Is(writeErr, errAlertRuleNotFound) {
+		writePageError(w, http.StatusNotFound, writeErr)
+		return
+	}
+	h.finishAlertRuleWrite(w, r, false, submitted, writeErr)
+}
+
+var (
+	errAlertRuleNotFound = errors.New("alert rule not found")
+	errSilenceNotFound   = errors.New("silence not found")
+)
+
+// finishAlertRuleWrite answers a create or update: the refreshed tab, or the
+// form again with what was wrong.
+func (h *handler) finishAlertRuleWrite(w http.ResponseWriter, r *http.Request, isNew bool, rule models.AlertRule, writeErr error) {
+	if writeErr == nil {
+		h.alertsTabOOB(w, nil)
+		return
+	}
+	logRejected(r, writeErr)
+	if warning, ok := applyWarning(writeErr); ok {
+		h.alertsTabOOB(w, &warning)
+		return
+	}
+	data := h.newAlertRuleFormData(isNew, rule)
+	if ve, ok := writeErr.(models.ValidationErrors); ok {
+		data.ValidationErrors = ve
+	} else {
+		data.Error = writeErr.Error()
+	}
+	writePageJSON(w, http.StatusUnprocessableEntity, "alert-rule-form", data, nil)
+}
+
+// DeleteAlertRule handles DELETE /alerts/rules/{id}. The rule's silences go
+// with it.
+func (h *handler) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := h.store.Write(func(cfg *models.AppConfig) error {
+		i := slices.IndexFunc(cfg.Alerts.Rules, func(rule models.AlertRule) bool { return rule.ID == id })
+		if i == -1 {
+			return errAlertRuleNotFound
+		}
+		cfg.Alerts.Rules = slices.Delete(cfg.Alerts.Rules, i, i+1)
+		cfg.Alerts.Silences = slices.DeleteFunc(cfg.Alerts.Silences, func(s models.AlertSilence) bool { return s.Rule == id })
+		return nil
+	})
+	h.finishAlertsDelete(w, err, errAlertRuleNotFound)
+}
+
+// GetSilenceForm returns the silence dialog. ?rule= and ?subject= preselect
+// what to silence, as the Silence button of an alert does.
+func (h *handler) GetSilenceForm(w http.ResponseWriter, r *http.Request) {
+	rule, subject := r.URL.Query().Get("rule"), r.URL.Query().Get("subject")
+	writePageJSON(w, http.StatusOK, "alert-silence-form", h.newSilenceFormData(rule, subject, "4h", ""), nil)
+}
+
+func (h *handler) newSilenceFormData(rule, subject, duration, comment string) alertSilenceFormData {
+	data := alertSilenceFormData{Subject: subject, SubjectName: subject, Comment: comment}
+	data.Rules = append(data.Rules, alertChoice{Value: "", Label: "All rules", Selected: rule == ""})
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, r := range cfg.Alerts.Rules {
+			data.Rules = append(data.Rules, alertChoice{Value: r.ID, Label: r.Name, Selected: r.ID == rule})
+		}
+	})
+	if h.alerts != nil && subject != "" {
+		active, _ := h.alerts.Alerts()
+		for _, a := range active {
+			if a.Subject == subject {
+				data.SubjectName = a.SubjectName
+				break
+			}
+		}
+	}
+	for _, d := range silenceDurations {
+		data.Durations = append(data.Durations, alertChoice{Value: d.Value, Label: d.Label, Selected: d.Value == duration})
+	}
+	return data
+}
+
+// CreateSilence handles POST /alerts/silences. Silences that have ended are
+// dropped in the same write.
+func (h *handler) CreateSilence(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	id, err := models.NewID()
+	if err != nil {
+		writePageError(w, http.StatusInternalServerError, fmt.Errorf("ID generation failed: %w", err))
+		return
+	}
+	now := time.Now().UTC()
+	silence := models.AlertSilence{
+		ID:        id,
+		Rule:      r.FormValue("silenceRule"),
+		Subject:   strings.TrimSpace(r.FormValue("silenceSubject")),
+		Comment:   strings.TrimSpace(r.FormValue("silenceComment")),
+		CreatedAt: now,
+	}
+	duration := r.FormValue("silenceFor")
+	var parseErrs models.ValidationErrors
+	if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+		parseErrs = append(parseErrs, models.ValidationError{Field: "silenceFor", Message: "must be a positive duration"})
+	} else {
+		silence.Until = now.Add(d)
+	}
+
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		if errs := slices.Concat(parseErrs, silence.Validate()); len(errs) > 0 {
+			return errs
+		}
+		if silence.Rule != "" && models.FindAlertRuleByID(cfg.Alerts.Rules, silence.Rule) == nil {
+			return models.ValidationErrors{{Field: "silenceRule", Message: "unknown rule"}}
+		}
+		cfg.Alerts.Silences = slices.DeleteFunc(cfg.Alerts.Silences, func(s models.AlertSilence) bool { return !now.Before(s.Until) })
+		cfg.Alerts.Silences = append(cfg.Alerts.Silences, silence)
+		return nil
+	})
+	if writeErr == nil {
+		h.alertsTabOOB(w, nil)
+		return
+	}
+	logRejected(r, writeErr)
+	if warning, ok := applyWarning(writeErr); ok {
+		h.alertsTabOOB(w, &warning)
+		return
+	}
+	data := h.newSilenceFormData(silence.Rule, silence.Subject, duration, silence.Comment)
+	if ve, ok := writeErr.(models.ValidationErrors); ok {
+		data.ValidationErrors = ve
+	} else {
+		data.Error = writeErr.Error()
+	}
+	writePageJSON(w, http.StatusUnprocessableEntity, "alert-silence-form", data, nil)
+}
+
+// DeleteSilence handles DELETE /alerts/silences/{id}.
+func (h *handler) DeleteSilence(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := h.store.Write(func(cfg *models.AppConfig) error {
+		i := slices.IndexFunc(cfg.Alerts.Silences, func(s models.AlertSilence) bool { return s.ID == id })
+		if i == -1 {
+			return errSilenceNotFound
+		}
+		cfg.Alerts.Silences = slices.Delete(cfg.Alerts.Silences, i, i+1)
+		return nil
+	})
+	h.finishAlertsDelete(w, err, errSilenceNotFound)
+}
+
+func (h *handler) finishAlertsDelete(w http.ResponseWriter, err, notFound error) {
+	var warning *toastData
+	if err != nil {
+		if value, ok := applyWarning(err); ok {
+			warning = &value
+		} else if errors.Is(err, notFound) {
+			writePageError(w, http.StatusNotFound, err)
+			return
+		} else {
+			writePageError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	h.alertsTabOOB(w, warning)
+}
+
+// parseAlertMailForm returns the submitted mail settings.
+func parseAlertMailForm(r *http.Request) models.AlertMail {
+	mail := models.AlertMail{
+		Relay:       strings.TrimSpace(r.FormValue("mailRelay")),
+		From:        strings.TrimSpace(r.FormValue("mailFrom")),
+		MinSeverity: r.FormValue("mailMinSeverity"),
+	}
+	for _, to := range strings.Split(r.FormValue("mailTo"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			mail.To = append(mail.To, to)
+		}
+	}
+	return mail
+}
+
+// UpdateAlertMail handles PUT /alerts/mail.
+func (h *handler) UpdateAlertMail(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	mail := parseAlertMailForm(r)
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		if errs := mail.Validate(); len(errs) > 0 {
+			return errs
+		}
+		cfg.Alerts.Mail = mail
+		return nil
+	})
+
+	data := h.buildAlertsData()
+	if writeErr == nil {
+		data.Success = "Mail settings saved."
+		writePageJSON(w, http.StatusOK, "alerts-tab", data, nil)
+		return
+	}
+	logRejected(r, writeErr)
+	data.Mail, data.MailTo = mail, strings.Join(mail.To, ", ")
+	if ve, ok := writeErr.(models.ValidationErrors); ok {
+		data.ValidationErrors = ve
+		writePageJSON(w, http.StatusUnprocessableEntity, "alerts-tab", data, nil)
+		return
+	}
+	data.Error = writeErr.Error()
+	if _, ok := applyError(writeErr); ok {
+		writePageJSON(w, http.StatusOK, "alerts-tab", data, nil)
+		return
+	}
+	writePageJSON(w, http.StatusInternalServerError, "alerts-tab", data, nil)
+}
+
+// TestAlertMail handles POST /alerts/mail/test: it sends a test message
+// through the saved relay now and reports how it went.
+func (h *handler) TestAlertMail(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		writePageError(w, http.StatusServiceUnavailable, errors.New("alerting is not running"))
+		return
+	}
+	var mail models.AlertMail
+	h.store.Read(func(cfg *models.AppConfig) {
+		mail = cfg.Alerts.Mail
+		mail.To = slices.Clone(cfg.Alerts.Mail.To)
+	})
+	toast := toastData{Kind: "success", Message: fmt.Sprintf("Test message handed to %s.", mail.Relay)}
+	if err := h.alerts.TestMail(mail); err != nil {
+		toast = toastData{Kind: "error", Message: "Test message failed: " + err.Error()}
+	}
+	h.alertsTabOOB(w, &toast)
+}
+
+func (h *handler) alertsTabOOB(w http.ResponseWriter, toast *toastData) {
+	data := h.buildAlertsData()
+	data.OOB = true
+	writePageJSON(w, http.StatusOK, "alerts-tab", data, toast)
+}
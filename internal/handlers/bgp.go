@@ -134,7 +134,7 @@ func (h *handler) CreateBGPPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := newPeerID()
+	id, err := models.NewID()
 	if err != nil {
 		writePageError(w, http.StatusInternalServerError, fmt.Errorf("ID generation failed: %w", err))
 		return
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/ipam"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// Bulk actions on the peers tab. Setting a value on every peer with a tag is
+// how group settings work: tags select peers, they carry no settings of their
+// own, so a peer's config never depends on which groups it is in.
+const (
+	bulkEnable           = "enable"
+	bulkDisable          = "disable"
+	bulkDelete           = "delete"
+	bulkExitNode         = "exit-node"
+	bulkRegenerateKeys   = "regenerate-keys"
+	bulkDNS              = "dns"
+	bulkClientAllowedIPs = "client-allowed-ips"
+	bulkAssignAddresses  = "assign-addresses"
+	bulkAddTag           = "add-tag"
+	bulkRemoveTag        = "remove-tag"
+)
+
+// bulkRequest is one bulk action and the value it sets, if any: the exit node
+// ID ("" for none), DNS servers, client allowed IPs, or a tag.
+type bulkRequest struct {
+	Action string
+	Value  string
+	// Routed are the networks assign-addresses keeps new addresses out of.
+	Routed []ipam.Network
+}
+
+// bulkTargets resolves the peers a bulk request applies to: the checked rows,
+// or with scope=tag every peer carrying the tag, including those not listed.
+func bulkTargets(r *http.Request, peers []models.Peer) ([]string, error) {
+	if r.FormValue("scope") != "tag" {
+		return r.Form["ids"], nil
+	}
+	tag := r.FormValue("tag")
+	if tag == "" {
+		return nil, fmt.Errorf("no tag selected")
+	}
+	var ids []string
+	for _, p := range peers {
+		if p.HasTag(tag) {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids, nil
+}
+
+// applyBulk applies req to the peers in ids. It stops at the first error; the
+// caller runs it inside a single Store.Write, which rolls everything back.
+func applyBulk(cfg *models.AppConfig, ids []string, req bulkRequest, now time.Time) error {
+	for _, id := range ids {
+		if models.FindPeerByID(cfg.Peers, id) == nil {
+			return fmt.Errorf("peer %s not found", id)
+		}
+	}
+
+	if req.Action == bulkDelete {
+		for _, id := range ids {
+			if p := models.FindPeerByID(cfg.Peers, id); p.IsExitNode {
+				models.CascadeClearExitNode(cfg.Peers, id)
+			}
+		}
+		cfg.Peers = slices.DeleteFunc(cfg.Peers, func(p models.Peer) bool { return slices.Contains(ids, p.ID) })
+		return nil
+	}
+
+	var alloc *ipam.Allocator
+	if req.Action == bulkAssignAddresses {
+		var err error
+		if alloc, err = ipam.New(cfg, req.Routed); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		p := models.FindPeerByID(cfg.Peers, id)
+		switch req.Action {
+		case bulkEnable, bulkDisable:
+			if enabled := req.Action == bulkEnable; enabled != p.Enabled {
+				models.SetPeerEnabled(cfg.Peers, id, enabled, models.StateReasonManual, now)
+			}
+			continue
+		case bulkExitNode:
+			if p.IsExitNode {
+				return fmt.Errorf("peer %q is an exit node and cannot route through another", p.Name)
+			}
+			p.ExitNodeID = req.Value
+		case bulkRegenerateKeys:
+			privKey, pubKey, err := wireguard.GenerateKeyPair()
+			if err != nil {
+				return fmt.Errorf("key generation: %w", err)
+			}
+			p.PrivateKey = privKey
+			p.PublicKey = pubKey
+			p.KeyHeld = false
+			p.LastSeen = time.Time{}
+		case bulkDNS:
+			p.DNS = req.Value
+		case bulkClientAllowedIPs:
+			p.ClientAllowedIPs = req.Value
+		case bulkAssignAddresses:
+			ips, err := alloc.Assign(*p, p.AllowedIPs)
+			if err != nil {
+				return fmt.Errorf("peer %q: %w", p.Name, err)
+			}
+			p.AllowedIPs = ips
+		case bulkAddTag:
+			if !p.HasTag(req.Value) {
+				p.Tags = append(p.Tags, req.Value)
+			}
+		case bulkRemoveTag:
+			p.Tags = slices.DeleteFunc(p.Tags, func(t string) bool { return strings.EqualFold(t, req.Value) })
+		default:
+			return fmt.Errorf("unknown bulk action %q", req.Action)
+		}
+		p.UpdatedAt = now.UTC()
+	}
+	return nil
+}
+
+// BulkPeers handles POST /peers/bulk. Every change is one store write, so
+// wg0 is reloaded once however many peers are selected.
+func (h *handler) BulkPeers(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	req := bulkRequest{Action: r.FormValue("action"), Value: strings.TrimSpace(r.FormValue("value"))}
+	if req.Action == bulkExitNode {
+		req.Value = r.FormValue("exitNodeID")
+	}
+	if (req.Action == bulkAddTag || req.Action == bulkRemoveTag) && req.Value == "" {
+		writePageError(w, http.StatusUnprocessableEntity, fmt.Errorf("enter a tag"))
+		return
+	}
+	if req.Action == bulkAssignAddresses {
+		req.Routed = h.routedNetworks()
+	}
+
+	var count int
+	err := h.store.Write(func(cfg *models.AppConfig) error {
+		ids, err := bulkTargets(r, cfg.Peers)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("no peers selected")
+		}
+		count = len(ids)
+		return applyBulk(cfg, ids, req, time.Now())
+	})
+
+	toast := &toastData{Kind: "success", Message: fmt.Sprintf("Updated %d peer(s)", count)}
+	if req.Action == bulkDelete {
+		toast.Message = fmt.Sprintf("Deleted %d peer(s)", count)
+	}
+	if err != nil {
+		logRejected(r, err)
+		warning, ok := applyWarning(err)
+		if !ok {
+			writePageError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		toast = &warning
+	}
+
+	data := h.buildPeersListData(peerListQueryFrom(r))
+	writePageJSON(w, http.StatusOK, "peers-list", data, toast)
+}
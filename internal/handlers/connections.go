@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/yix/wg-busy/internal/connlog"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+const (
+	connectionsDefaultLimit = 100
+	connectionsMaxLimit     = 1000
+)
+
+// eventLabels name the connection event kinds in the timeline.
+var eventLabels = map[connlog.Kind]string{
+	connlog.FirstHandshake:  "First handshake",
+	connlog.Stale:           "Went stale",
+	connlog.Returned:        "Came back",
+	connlog.EndpointChanged: "Endpoint changed",
+}
+
+// eventRow is one line of a peer's connection timeline.
+type eventRow struct {
+	Kind   string
+	Label  string
+	Time   string
+	TimeAt string // RFC 3339, for the tooltip
+	Detail string
+}
+
+func newEventRow(e connlog.Event) eventRow {
+	row := eventRow{
+		Kind:   string(e.Kind),
+		Label:  eventLabels[e.Kind],
+		Time:   e.Time.Local().Format(historyTimeLayout),
+		TimeAt: e.Time.Format(time.RFC3339),
+	}
+	switch {
+	case e.Kind == connlog.EndpointChanged:
+		row.Detail = e.From + " → " + e.Endpoint
+	case e.Kind == connlog.Stale && e.Endpoint != "":
+		row.Detail = "last from " + e.Endpoint
+	case e.Endpoint != "":
+		row.Detail = "from " + e.Endpoint
+	}
+	return row
+}
+
+// eventEntry is an event of GET /api/connections with the peer's current name.
+type eventEntry struct {
+	connlog.Event
+	Name string `json:"name,omitempty"`
+}
+
+// connectionsResponse is the JSON reply of GET /api/connections.
+type connectionsResponse struct {
+	Events []eventEntry `json:"events"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// connectionsFilter parses the query of GET /api/connections.
+func (h *handler) connectionsFilter(r *http.Request) (connlog.Filter, int, error) {
+	q := r.URL.Query()
+	f := connlog.Filter{Kind: connlog.Kind(q.Get("kind")), Limit: connectionsDefaultLimit}
+	if f.Kind != "" && !slices.Contains(connlog.Kinds, f.Kind) {
+		return f, http.StatusBadRequest, fmt.Errorf("kind must be one of %v", connlog.Kinds)
+	}
+	if since := q.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil && d > 0 {
+			f.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.Since = t
+		} else {
+			return f, http.StatusBadRequest, errors.New("since must be a duration such as 24h or an RFC 3339 time")
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > connectionsMaxLimit {
+			return f, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", connectionsMaxLimit)
+		}
+		f.Limit = n
+	}
+	if ref := q.Get("peer"); ref != "" {
+		peer, found := h.findPeer(ref)
+		if !found {
+			// A deleted peer's events stay queryable by ID until they expire.
+			peer.ID = ref
+		}
+		f.Peer = peer.ID
+	}
+	return f, http.StatusOK, nil
+}
+
+// GetConnectionsJSON handles GET /api/connections?peer=ID-or-name&kind=stale&since=24h&limit=100:
+// the connection log, newest first.
+func (h *handler) GetConnectionsJSON(w http.ResponseWriter, r *http.Request) {
+	resp := connectionsResponse{Events: []eventEntry{}}
+	f, status, err := h.connectionsFilter(r)
+	if h.events == nil {
+		status, err = http.StatusNotFound, errors.New("the connection log is disabled")
+	}
+	if err == nil {
+		names := make(map[string]string)
+		h.store.Read(func(cfg *models.AppConfig) {
+			for _, p := range cfg.Peers {
+				names[p.ID] = p.Name
+			}
+		})
+		for _, e := range h.events.Query(f) {
+			resp.Events = append(resp.Events, eventEntry{Event: e, Name: names[e.Peer]})
+		}
+	} else {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
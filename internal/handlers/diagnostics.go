@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/diag"
+	"github.com/yix/wg-busy/internal/drift"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// diagnosticsData is the template data of the Diagnostics tab.
+type diagnosticsData struct {
+	Checks    []diag.Check
+	Failed    int
+	CheckedAt string
+	Routing   routingDriftData
+}
+
+// routingDriftData is the drift watcher's state, as the Diagnostics tab shows
+// it under the checks.
+type routingDriftData struct {
+	Watched     bool
+	AutoRepair  bool
+	Missing     int
+	Repairs     uint64
+	RepairedAt  string
+	RepairError string
+}
+
+// runDiagnostics checks the host against the current config. The routing
+// check goes through the drift watcher, so its status and the metrics follow
+// the tab rather than waiting for the next periodic check.
+func (h *handler) runDiagnostics() []diag.Check {
+	in := diag.Input{WGConfigPath: h.store.WGConfigPath(), VerifyRouting: h.store.VerifyRouting, BGPListeners: bgp.Listeners}
+	if h.drifts != nil {
+		in.VerifyRouting = h.drifts.Check
+	}
+	h.store.Read(func(cfg *models.AppConfig) { in.Config = cfg.Clone() })
+	return diag.Run(in)
+}
+
+func (h *handler) buildDiagnosticsData(checks []diag.Check) diagnosticsData {
+	data := diagnosticsData{Checks: checks, Failed: diag.Failed(checks), CheckedAt: time.Now().Format("15:04:05")}
+	h.store.Read(func(cfg *models.AppConfig) { data.Routing.AutoRepair = cfg.Server.RepairRouting })
+	if h.drifts != nil {
+		status := h.drifts.Status()
+		data.Routing.Watched = true
+		data.Routing.Missing = len(status.Drift)
+		data.Routing.Repairs = h.drifts.Repairs()
+		if !status.RepairedAt.IsZero() {
+			data.Routing.RepairedAt = status.RepairedAt.Format("2006-01-02 15:04:05")
+		}
+		data.Routing.RepairError = status.RepairError
+	}
+	return data
+}
+
+// GetDiagnosticsTab handles GET /diagnostics. Every request runs the checks
+// again, so the tab's "Check again" button is just a reload.
+func (h *handler) GetDiagnosticsTab(w http.ResponseWriter, r *http.Request) {
+	writePageJSON(w, http.StatusOK, "diagnostics-tab", h.buildDiagnosticsData(h.runDiagnostics()), nil)
+}
+
+// repairRouting reinstalls the routing state, through the watcher when there
+// is one so it counts the repair and checks again.
+func (h *handler) repairRouting() error {
+	if h.drifts != nil {
+		return h.drifts.Repair()
+	}
+	return h.store.RepairRouting()
+}
+
+// RepairRouting handles POST /diagnostics/repair and re-renders the tab with
+// the checks run after the repair.
+func (h *handler) RepairRouting(w http.ResponseWriter, r *http.Request) {
+	toast := toastData{Kind: "success", Message: "Routing state reinstalled."}
+	if err := h.repairRouting(); err != nil {
+		toast = toastData{Kind: "error", Message: "Repair failed: " + err.Error()}
+	}
+	writePageJSON(w, http.StatusOK, "diagnostics-tab", h.buildDiagnosticsData(h.runDiagnostics()), &toast)
+}
+
+// GetDiagnosticsJSON handles GET /api/diagnostics.
+func (h *handler) GetDiagnosticsJSON(w http.ResponseWriter, r *http.Request) {
+	checks := h.runDiagnostics()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(struct {
+		Checks []diag.Check `json:"checks"`
+		Failed int          `json:"failed"`
+	}{checks, diag.Failed(checks)})
+}
+
+// GetRoutingDriftJSON handles GET /api/routing/drift with the drift watcher's
+// latest check.
+func (h *handler) GetRoutingDriftJSON(w http.ResponseWriter, r *http.Request) {
+	if h.drifts == nil {
+		http.Error(w, "routing drift is not being watched", http.StatusServiceUnavailable)
+		return
+	}
+	writeRoutingDrift(w, http.StatusOK, h.drifts.Status())
+}
+
+// RepairRoutingJSON handles POST /api/routing/repair. It answers with the
+// check run after the repair. A failed repair or check is a 500, with
+// RepairError or Error saying why.
+func (h *handler) RepairRoutingJSON(w http.ResponseWriter, r *http.Request) {
+	if h.drifts == nil {
+		http.Error(w, "routing drift is not being watched", http.StatusServiceUnavailable)
+		return
+	}
+	code := http.StatusOK
+	if err := h.drifts.Repair(); err != nil {
+		code = http.StatusInternalServerError
+	}
+	writeRoutingDrift(w, code, h.drifts.Status())
+}
+
+func writeRoutingDrift(w http.ResponseWriter, code int, status drift.Status) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -31,23 +31,11 @@ func (h *handler) DownloadClientConfig(w http.ResponseWriter, r *http.Request) {
 		if genErr != nil {
 			return
 		}
-
-		// Sanitize name for filename.
-		name := strings.ReplaceAll(peer.Name, " ", "-")
-		name = strings.Map(func(r rune) rune {
-			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
-				return r
-			}
-			return -1
-		}, name)
-		if name == "" {
-			name = peer.ID
-		}
-		filename = name + ".conf"
+		filename = configFileName(*peer) + ".conf"
 	})
 
 	if genErr != nil {
-		http.Error(w, genErr.Error(), http.StatusInternalServerError)
+		writeClientConfigError(w, genErr)
 		return
 	}
 
@@ -56,6 +44,33 @@ func (h *handler) DownloadClientConfig(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(content))
 }
 
+// writeClientConfigError answers a client config that could not be rendered.
+// A peer whose device holds its own key has no config by design: that is a
+// 409 saying so, not a server error.
+func writeClientConfigError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, wireguard.ErrNoPrivateKey) {
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// configFileName is the peer's name made safe for a file name, without an
+// extension.
+func configFileName(peer models.Peer) string {
+	name := strings.ReplaceAll(peer.Name, " ", "-")
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		name = peer.ID
+	}
+	return name
+}
+
 // DownloadServerConfig handles GET /api/server/config.
 func (h *handler) DownloadServerConfig(w http.ResponseWriter, r *http.Request) {
 	var content string
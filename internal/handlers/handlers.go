@@ -12,8 +12,14 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/yix/wg-busy/internal/alert"
 	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/connlog"
+	"github.com/yix/wg-busy/internal/drift"
+	"github.com/yix/wg-busy/internal/history"
 	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/probe"
+	"github.com/yix/wg-busy/internal/webhook"
 	"github.com/yix/wg-busy/internal/wgstats"
 	"github.com/yix/wg-busy/internal/zerotier"
 )
@@ -53,9 +59,16 @@ func writePageError(w http.ResponseWriter, status int, err error) {
 }
 
 type handler struct {
-	store *config.Store
-	stats *wgstats.Collector
-	zt    *zerotier.Supervisor
+	store    *config.Store
+	stats    *wgstats.Collector
+	history  *history.Store
+	events   *connlog.Store
+	notifier *webhook.Notifier
+	alerts   *alert.Engine
+	probes   *probe.Prober
+	drifts   *drift.Watcher
+	zt       *zerotier.Supervisor
+	live     *liveHub
 }
 
 // ztGatewayNets returns the ZeroTier on-link networks, or nil when ZeroTier is
@@ -87,6 +100,10 @@ func (s *statusRecorder) WriteHeader(code int) {
 	s.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush an
+// event stream.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
 func (s *statusRecorder) Write(b []byte) (int, error) {
 	if s.status >= 400 && s.detail == "" {
 		contentType := s.Header().Get("Content-Type")
@@ -153,6 +170,14 @@ func (w *gzipResponseWriter) Write(body []byte) (int, error) {
 	return w.ResponseWriter.Write(body)
 }
 
+// Flush sends what has been written so far, compressed or not.
+func (w *gzipResponseWriter) Flush() {
+	if w.writer != nil {
+		_ = w.writer.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
 func (w *gzipResponseWriter) close() {
 	if w.writer != nil {
 		_ = w.writer.Close()
@@ -202,26 +227,60 @@ func acceptsGzip(values []string) bool {
 
 func isCompressible(contentType string) bool {
 	mediaType, _, err := mime.ParseMediaType(contentType)
-	if err != nil {
+	if err != nil || mediaType == "text/event-stream" {
+		// An event stream must reach the browser event by event.
 		return false
 	}
 	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/javascript" || mediaType == "application/xml" || mediaType == "image/svg+xml"
 }
 
+// Deps are what the router serves. Store and WebFS are required outside
+// tests; the rest may be nil, which turns off the features that need them.
+type Deps struct {
+	Store    *config.Store
+	WebFS    fs.FS
+	Stats    *wgstats.Collector
+	History  *history.Store
+	Events   *connlog.Store
+	Notifier *webhook.Notifier
+	Alerts   *alert.Engine
+	Probes   *probe.Prober
+	Drifts   *drift.Watcher
+	ZeroTier *zerotier.Supervisor
+	Version  string
+}
+
 // NewRouter creates the HTTP mux with all routes registered.
-func NewRouter(store *config.Store, webFS fs.FS, stats *wgstats.Collector, zt *zerotier.Supervisor, version string) http.Handler {
-	h := &handler{store: store, stats: stats, zt: zt}
+func NewRouter(d Deps) http.Handler {
+	h := &handler{store: d.Store, stats: d.Stats, history: d.History, events: d.Events, notifier: d.Notifier, alerts: d.Alerts, probes: d.Probes, drifts: d.Drifts, zt: d.ZeroTier, live: newLiveHub()}
+	if d.Stats != nil {
+		d.Stats.OnPoll(func() { h.live.publish(func(r *liveRevisions) { r.Stats++ }) })
+	}
+	if d.ZeroTier != nil {
+		go h.live.watchZeroTier(d.ZeroTier)
+	}
+	if d.Alerts != nil {
+		d.Alerts.OnChange(func() { h.live.publish(func(r *liveRevisions) { r.Alerts++ }) })
+	}
+	if d.Store != nil {
+		d.Store.OnChange(func(*models.AppConfig) { h.live.publish(func(r *liveRevisions) { r.Config++ }) })
+	}
 
 	mux := http.NewServeMux()
 
 	// Static files (index.html).
-	mux.Handle("GET /", http.FileServerFS(webFS))
+	mux.Handle("GET /", http.FileServerFS(d.WebFS))
 	mux.HandleFunc("GET /version", func(w http.ResponseWriter, _ *http.Request) {
-		writePageJSON(w, http.StatusOK, "version", struct{ Version string }{Version: version}, nil)
+		writePageJSON(w, http.StatusOK, "version", struct{ Version string }{Version: d.Version}, nil)
 	})
 
 	// Stats bar fragment (includes active-tab OOB stats selected by ?kind=).
 	mux.HandleFunc("GET /stats", h.GetCombinedStats)
+	// Live updates for the same views, pushed as they change.
+	mux.HandleFunc("GET /events", h.LiveEvents)
+
+	// Traffic history dialog (?peer= for one peer, else the interface).
+	mux.HandleFunc("GET /history", h.GetHistory)
 
 	// Peer fragment endpoints.
 	mux.HandleFunc("GET /peers", h.ListPeers)
@@ -231,6 +290,12 @@ func NewRouter(store *config.Store, webFS fs.FS, stats *wgstats.Collector, zt *z
 	mux.HandleFunc("PUT /peers/{id}", h.UpdatePeer)
 	mux.HandleFunc("DELETE /peers/{id}", h.DeletePeer)
 	mux.HandleFunc("PUT /peers/{id}/toggle", h.TogglePeer)
+	mux.HandleFunc("POST /peers/bulk", h.BulkPeers)
+	mux.HandleFunc("GET /peers/import", h.GetImportForm)
+	mux.HandleFunc("POST /peers/import/preview", h.PreviewImport)
+	mux.HandleFunc("POST /peers/import", h.ImportPeers)
+	mux.HandleFunc("GET /peers/provision", h.GetProvisionForm)
+	mux.HandleFunc("POST /peers/provision", h.ProvisionPeers)
 
 	// QR code modal (HTML dialog).
 	mux.HandleFunc("GET /peers/{id}/qr", h.QRCodeModal)
@@ -239,6 +304,32 @@ func NewRouter(store *config.Store, webFS fs.FS, stats *wgstats.Collector, zt *z
 	mux.HandleFunc("GET /server", h.GetServerConfig)
 	mux.HandleFunc("PUT /server", h.UpdateServerConfig)
 
+	// Webhook fragment endpoints, listed on the Server tab.
+	mux.HandleFunc("GET /webhooks/new", h.GetWebhookForm)
+	mux.HandleFunc("GET /webhooks/{id}/edit", h.GetWebhookForm)
+	mux.HandleFunc("GET /webhooks/{id}/deliveries", h.GetWebhookDeliveries)
+	mux.HandleFunc("POST /webhooks", h.CreateWebhook)
+	mux.HandleFunc("PUT /webhooks/{id}", h.UpdateWebhook)
+	mux.HandleFunc("DELETE /webhooks/{id}", h.DeleteWebhook)
+	mux.HandleFunc("POST /webhooks/{id}/test", h.TestWebhook)
+
+	// Alerts tab.
+	mux.HandleFunc("GET /alerts", h.GetAlertsTab)
+	mux.HandleFunc("GET /alerts/rules/new", h.GetAlertRuleForm)
+	mux.HandleFunc("GET /alerts/rules/{id}/edit", h.GetAlertRuleForm)
+	mux.HandleFunc("POST /alerts/rules", h.CreateAlertRule)
+	mux.HandleFunc("PUT /alerts/rules/{id}", h.UpdateAlertRule)
+	mux.HandleFunc("DELETE /alerts/rules/{id}", h.DeleteAlertRule)
+	mux.HandleFunc("GET /alerts/silences/new", h.GetSilenceForm)
+	mux.HandleFunc("POST /alerts/silences", h.CreateSilence)
+	mux.HandleFunc("DELETE /alerts/silences/{id}", h.DeleteSilence)
+	mux.HandleFunc("PUT /alerts/mail", h.UpdateAlertMail)
+	mux.HandleFunc("POST /alerts/mail/test", h.TestAlertMail)
+
+	// Diagnostics tab: host prerequisites and whether the rendered state is live.
+	mux.HandleFunc("GET /diagnostics", h.GetDiagnosticsTab)
+	mux.HandleFunc("POST /diagnostics/repair", h.RepairRouting)
+
 	// BGP tab; live data is refreshed through the active-tab /stats request.
 	mux.HandleFunc("GET /bgp/stats", h.GetBGPStatsTab)
 	mux.HandleFunc("PUT /bgp/server", h.UpdateBGPServerConfig)
@@ -260,10 +351,23 @@ func NewRouter(store *config.Store, webFS fs.FS, stats *wgstats.Collector, zt *z
 	// API endpoints.
 	mux.HandleFunc("GET /api/peers/{id}/config", h.DownloadClientConfig)
 	mux.HandleFunc("GET /api/peers/{id}/qr", h.QRCode)
+	mux.HandleFunc("POST /api/peers/configs", h.DownloadConfigsZip)
+	mux.HandleFunc("POST /api/peers/provision", h.ProvisionPeersZip)
+	mux.HandleFunc("POST /api/state", h.ApplyState)
+	mux.HandleFunc("GET /api/history", h.GetHistoryJSON)
+	mux.HandleFunc("GET /api/connections", h.GetConnectionsJSON)
+	mux.HandleFunc("GET /api/webhooks/deliveries", h.GetWebhookDeliveriesJSON)
+	mux.HandleFunc("GET /api/alerts", h.GetAlertsJSON)
+	mux.HandleFunc("GET /api/diagnostics", h.GetDiagnosticsJSON)
+	mux.HandleFunc("GET /api/routing/drift", h.GetRoutingDriftJSON)
+	mux.HandleFunc("POST /api/routing/repair", h.RepairRoutingJSON)
 	mux.HandleFunc("GET /api/server/config", h.DownloadServerConfig)
 	mux.HandleFunc("POST /api/server/apply", h.ApplyConfig)
 	mux.HandleFunc("POST /api/peers/{id}/regenerate-keys", h.RegeneratePeerKeys)
 	mux.HandleFunc("POST /api/zerotier/restart", h.RestartZeroTier)
 
+	// Prometheus scrape endpoint.
+	mux.HandleFunc("GET /metrics", h.Metrics)
+
 	return gzipResponses(logErrors(mux))
 }
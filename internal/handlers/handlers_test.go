@@ -1,21 +1,30 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 	"testing/fstest"
 	"time"
 
+	"github.com/yix/wg-busy/internal/alert"
 	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/connlog"
+	"github.com/yix/wg-busy/internal/history"
 	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/webhook"
 	"github.com/yix/wg-busy/internal/wgstats"
 	"github.com/yix/wg-busy/internal/zerotier"
 )
@@ -174,7 +183,7 @@ func TestPeerStatsLayoutPreventsSparklineWrapping(t *testing.T) {
 }
 
 func TestVersionEndpointReturnsBuildVersion(t *testing.T) {
-	router := NewRouter(nil, fstest.MapFS{"index.html": {Data: []byte("ok")}}, nil, nil, "v0.0.1")
+	router := NewRouter(Deps{WebFS: fstest.MapFS{"index.html": {Data: []byte("ok")}}, Version: "v0.0.1"})
 	recorder := httptest.NewRecorder()
 	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/version", nil))
 
@@ -190,8 +199,274 @@ func TestVersionEndpointReturnsBuildVersion(t *testing.T) {
 	}
 }
 
+func TestMetricsEndpointExposesPeersAndApplyState(t *testing.T) {
+	dir := t.TempDir()
+	yaml := "server:\n  address: 10.0.0.1/24\npeers:\n" +
+		"  - {id: a, name: laptop, publicKey: keyA, enabled: true}\n" +
+		"  - {id: b, name: phone, publicKey: keyB}\n"
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, Version: "test"})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("GET /metrics = %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`wg_busy_peer_enabled{peer="laptop",public_key="keyA"} 1`,
+		`wg_busy_peer_enabled{peer="phone",public_key="keyB"} 0`,
+		`wg_busy_wireguard_up{interface="wg0"} 0`,
+		"wg_busy_bgp_running 0",
+		"wg_busy_apply_failures_total 0",
+		`wg_busy_reconcile_duration_seconds_bucket{le="+Inf"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestHistoryAPIFindsPeerByName(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/config.yaml", []byte("peers:\n  - {id: a, name: site, publicKey: keyA, enabled: true}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist, err := history.Open(dir + "/history.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hist.Record(models.Transfer{Rx: 2048, Tx: 64}, map[string]models.Transfer{"a": {Rx: 1024, Tx: 64}}, time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, History: hist, Version: "test"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/history?peer=site&range=7d", nil))
+	var resp historyResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("GET /api/history = %d %s", recorder.Code, recorder.Body)
+	}
+	if resp.ID != "a" || resp.Rx != 1024 || resp.Tx != 64 || resp.StepSeconds != 3600 || len(resp.Points) != 168 {
+		t.Fatalf("history = %+v", resp)
+	}
+
+	for target, want := range map[string]int{
+		"/api/history?range=1y":         http.StatusBadRequest,
+		"/api/history?peer=gone":        http.StatusNotFound,
+		"/history?peer=a&range=30d":     http.StatusOK,
+		"/history":                      http.StatusOK,
+		"/api/history?peer=a&range=24h": http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != want {
+			t.Errorf("GET %s = %d, want %d: %s", target, recorder.Code, want, recorder.Body)
+		}
+	}
+}
+
+func TestConnectionLogByPeerNameAndInDialog(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/config.yaml", []byte("peers:\n  - {id: a, name: site, publicKey: keyA, enabled: true}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := connlog.Open(dir + "/events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := events.Record(
+		connlog.Event{Peer: "a", Time: now.Add(-2 * time.Hour), Kind: connlog.FirstHandshake, Endpoint: "192.0.2.1:51820"},
+		connlog.Event{Peer: "a", Time: now.Add(-time.Hour), Kind: connlog.EndpointChanged, Endpoint: "198.51.100.7:4500", From: "192.0.2.1:51820"},
+		connlog.Event{Peer: "gone", Time: now, Kind: connlog.Stale},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// Traffic history is off: the dialog still shows the timeline.
+	router := NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, Events: events, Version: "test"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/connections?peer=site&since=3h", nil))
+	var resp connectionsResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("GET /api/connections = %d %s", recorder.Code, recorder.Body)
+	}
+	if len(resp.Events) != 2 || resp.Events[0].Kind != connlog.EndpointChanged || resp.Events[0].Name != "site" {
+		t.Fatalf("events = %+v", resp.Events)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/history?peer=a", nil))
+	var page struct{ Data historyData }
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("GET /history = %d %s", recorder.Code, recorder.Body)
+	}
+	if page.Data.HasChart || len(page.Data.Timeline) != 2 || page.Data.Timeline[0].Detail != "192.0.2.1:51820 → 198.51.100.7:4500" {
+		t.Fatalf("dialog = %+v", page.Data)
+	}
+
+	for target, want := range map[string]int{
+		"/api/connections?kind=bogus":  http.StatusBadRequest,
+		"/api/connections?limit=0":     http.StatusBadRequest,
+		"/api/connections?since=never": http.StatusBadRequest,
+		"/api/connections?peer=gone":   http.StatusOK,
+		"/api/history":                 http.StatusNotFound,
+		"/history":                     http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != want {
+			t.Errorf("GET %s = %d, want %d: %s", target, recorder.Code, want, recorder.Body)
+		}
+	}
+}
+
+func TestLiveEventsStreamRowsAndConfigWrites(t *testing.T) {
+	dir := t.TempDir()
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	yaml := "server: {privateKey: " + key + ", listenPort: 51820, address: 10.0.0.1/24}\npeers:\n" +
+		"  - {id: a, name: site, privateKey: " + key + ", publicKey: " + key + ", allowedIPs: 10.0.0.2/32, enabled: true}\n"
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, Version: "test"}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/events?kind=peers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compressing would buffer the stream.
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("GET /events: Content-Type %q, Content-Encoding %q", got, resp.Header.Get("Content-Encoding"))
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() (event, data string) {
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return "", ""
+	}
+
+	if event, data := next(); event != "stats" || !strings.Contains(data, `"ID":"a"`) {
+		t.Fatalf("first event = %s %s", event, data)
+	}
+	// Applying fails without WireGuard, but the write is saved all the same.
+	err = store.Write(func(cfg *models.AppConfig) error {
+		cfg.Peers[0].Name = "office"
+		return nil
+	})
+	var applyErr *config.ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
+		t.Fatal(err)
+	}
+	if event, _ := next(); event != "config" {
+		t.Fatalf("after a write got %q, want config", event)
+	}
+	if event, data := next(); event != "stats" || !strings.Contains(data, `"ID":"a"`) {
+		t.Fatalf("after config = %s %s", event, data)
+	}
+}
+
+// TestLiveTicksDuringWrites renders the shared live snapshot for two streams
+// while the config is written and usage recorded; run it with -race.
+func TestLiveTicksDuringWrites(t *testing.T) {
+	dir := t.TempDir()
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	yaml := "server: {privateKey: " + key + ", listenPort: 51820, address: 10.0.0.1/24}\npeers:\n" +
+		"  - {id: a, name: site, privateKey: " + key + ", publicKey: " + key + ", allowedIPs: 10.0.0.2/32, enabled: true}\n"
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{store: store, live: newLiveHub()}
+	store.OnChange(func(*models.AppConfig) { h.live.publish(func(r *liveRevisions) { r.Config++ }) })
+
+	done := make(chan error)
+	go func() {
+		for i := range 20 {
+			if err := store.RecordPeerTransfer(map[string]models.Transfer{key: {Rx: 1024, Tx: 64}}, time.Now()); err != nil {
+				done <- err
+				return
+			}
+			err := store.Write(func(cfg *models.AppConfig) error {
+				cfg.Peers[0].Tags = append(cfg.Peers[0].Tags, fmt.Sprintf("t%d", i))
+				return nil
+			})
+			var applyErr *config.ApplyError
+			if err != nil && !errors.As(err, &applyErr) {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	streams := []*liveStream{
+		{kind: "peers", peers: make(map[string][]byte)},
+		{kind: "peers", query: peerListQuery{Search: "site"}, peers: make(map[string][]byte)},
+	}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		h.live.publish(func(r *liveRevisions) { r.Stats++ })
+		revs, _ := h.live.current()
+		for _, s := range streams {
+			if _, err := h.sendLive(io.Discard, s, revs); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
 func TestRouterCompressesJSONWhenGzipIsAccepted(t *testing.T) {
-	router := NewRouter(nil, fstest.MapFS{"index.html": {Data: []byte("ok")}}, nil, nil, "v0.0.1")
+	router := NewRouter(Deps{WebFS: fstest.MapFS{"index.html": {Data: []byte("ok")}}, Version: "v0.0.1"})
 	request := httptest.NewRequest("GET", "/version", nil)
 	request.Header.Set("Accept-Encoding", "gzip")
 	recorder := httptest.NewRecorder()
@@ -265,9 +540,9 @@ func TestActivityPausesWhenPageUnfocusedOrHidden(t *testing.T) {
 		"window.addEventListener('pageshow'",
 		"window.addEventListener('pagehide'",
 		"page-unfocused",
-		"stopStatsPolling",
-		"startStatsPolling",
-		"htmx:beforeRequest",
+		"stopLiveUpdates",
+		"startLiveUpdates",
+		"new EventSource(",
 	} {
 		if !strings.Contains(body, required) {
 			t.Fatalf("index.html is missing energy conservation requirement %q", required)
@@ -397,3 +672,330 @@ func TestZeroTierLongPollReturnsNoDuplicatePayloadWhenCanceled(t *testing.T) {
 		t.Fatalf("HX-Trigger = %q, want zerotier-repoll", got)
 	}
 }
+
+func TestApplyBulkChangesEveryTargetOrNone(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	newConfig := func() models.AppConfig {
+		return models.AppConfig{Peers: []models.Peer{
+			{ID: "exit", Name: "exit", IsExitNode: true, Enabled: true},
+			{ID: "a", Name: "a", Enabled: true, ExitNodeID: "exit", Tags: []string{"Office"}},
+			{ID: "b", Name: "b", Enabled: false, Tags: []string{"office"}},
+			{ID: "c", Name: "c", Enabled: true},
+		}}
+	}
+
+	cfg := newConfig()
+	if err := applyBulk(&cfg, []string{"a", "b"}, bulkRequest{Action: bulkDisable}, now); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Peers[1].Enabled || cfg.Peers[1].StateReason != models.StateReasonManual || !cfg.Peers[2].UpdatedAt.IsZero() {
+		t.Fatalf("disable: %+v / %+v", cfg.Peers[1], cfg.Peers[2])
+	}
+
+	cfg = newConfig()
+	if err := applyBulk(&cfg, []string{"b", "c"}, bulkRequest{Action: bulkAddTag, Value: "OFFICE"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Peers[2].Tags) != 1 || len(cfg.Peers[3].Tags) != 1 || cfg.Peers[3].Tags[0] != "OFFICE" {
+		t.Fatalf("add tag: %q / %q", cfg.Peers[2].Tags, cfg.Peers[3].Tags)
+	}
+	if err := applyBulk(&cfg, []string{"a", "b", "c"}, bulkRequest{Action: bulkRemoveTag, Value: "office"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if models.PeerTags(cfg.Peers) != nil {
+		t.Fatalf("remove tag left %q", models.PeerTags(cfg.Peers))
+	}
+
+	cfg = newConfig()
+	if err := applyBulk(&cfg, []string{"exit", "b"}, bulkRequest{Action: bulkDelete}, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Peers) != 2 || cfg.Peers[0].ExitNodeID != "" {
+		t.Fatalf("delete: %+v", cfg.Peers)
+	}
+
+	cfg = newConfig()
+	if err := applyBulk(&cfg, []string{"c", "exit"}, bulkRequest{Action: bulkExitNode, Value: "exit"}, now); err == nil {
+		t.Fatal("moving an exit node behind an exit node was accepted")
+	}
+	if err := applyBulk(&cfg, []string{"c", "gone"}, bulkRequest{Action: bulkDNS, Value: "1.1.1.1"}, now); err == nil || cfg.Peers[3].DNS != "" {
+		t.Fatalf("unknown peer: err = %v, DNS = %q", err, cfg.Peers[3].DNS)
+	}
+}
+
+func TestBulkAssignAddressesBackfillsIPv6(t *testing.T) {
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{Address: "10.0.0.1/24, fd00::1/64", DeriveIPv6: true},
+		Peers: []models.Peer{
+			{ID: "a", Name: "a", AllowedIPs: "10.0.0.2/32"},
+			{ID: "b", Name: "b", AllowedIPs: "10.0.0.3/32, fd00::2/128"},
+			{ID: "c", Name: "c", AllowedIPs: "192.168.9.1/32"},
+		},
+	}
+	if err := applyBulk(&cfg, []string{"a", "b", "c"}, bulkRequest{Action: bulkAssignAddresses}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// a's derived fd00::2 is taken by b, so it gets the next free address.
+	for i, want := range []string{"10.0.0.2/32, fd00::3/128", "10.0.0.3/32, fd00::2/128", "192.168.9.1/32"} {
+		if got := cfg.Peers[i].AllowedIPs; got != want {
+			t.Errorf("peer %s = %q, want %q", cfg.Peers[i].Name, got, want)
+		}
+	}
+}
+
+func TestBulkTargetsByTagIncludesUnlistedPeers(t *testing.T) {
+	peers := []models.Peer{{ID: "a", Tags: []string{"ops"}}, {ID: "b"}, {ID: "c", Tags: []string{"OPS"}}}
+	request := httptest.NewRequest("POST", "/peers/bulk", strings.NewReader("scope=tag&tag=ops&ids=b"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_ = request.ParseForm()
+	ids, err := bulkTargets(request, peers)
+	if err != nil || len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Fatalf("ids = %q, err = %v", ids, err)
+	}
+}
+
+func TestPeerListQueryFiltersAndSorts(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	peers := []listedPeer{
+		{peer: models.Peer{ID: "1", Name: "bravo", Enabled: true, AllowedIPs: "10.0.0.2/32", ExitNodeID: "3"},
+			stats: wgstats.PeerStats{LatestHandshake: now.Add(-time.Minute), Endpoint: "198.51.100.7:4242", TransferRx: 10}},
+		{peer: models.Peer{ID: "2", Name: "Alpha", Enabled: false, AllowedIPs: "10.0.0.3/32", Tags: []string{"ops"}, LastSeen: now.Add(-time.Hour)},
+			stats: wgstats.PeerStats{TransferRx: 500}},
+		{peer: models.Peer{ID: "3", Name: "charlie", Enabled: true, AllowedIPs: "10.0.0.4/32", IsExitNode: true, PublicKey: "KeyCharlie"},
+			stats: wgstats.PeerStats{LatestHandshake: now.Add(-10 * time.Minute), TransferTx: 90}},
+	}
+	ids := func(q peerListQuery) string {
+		var got []string
+		for _, l := range peers {
+			if q.matches(l.peer, l.stats, now) {
+				got = append(got, l.peer.ID)
+			}
+		}
+		return strings.Join(got, ",")
+	}
+	for _, test := range []struct {
+		query peerListQuery
+		want  string
+	}{
+		{peerListQuery{}, "1,2,3"},
+		{peerListQuery{Search: "198.51.100"}, "1"},
+		{peerListQuery{Search: "keycharlie"}, "3"},
+		{peerListQuery{Search: "10.0.0.3"}, "2"},
+		{peerListQuery{State: "disabled"}, "2"},
+		{peerListQuery{Online: true}, "1"},
+		{peerListQuery{Exit: exitFilterNodes}, "3"},
+		{peerListQuery{Exit: exitFilterDirect}, "2"},
+		{peerListQuery{Exit: "3"}, "1"},
+		{peerListQuery{Tag: "OPS"}, "2"},
+		{peerListQuery{State: "enabled", Search: "a"}, "1,3"},
+	} {
+		if got := ids(test.query); got != test.want {
+			t.Errorf("%+v matched %s, want %s", test.query, got, test.want)
+		}
+	}
+
+	for key, want := range map[string]string{sortName: "2,1,3", sortLastSeen: "1,3,2", sortTraffic: "2,3,1", "": "1,2,3"} {
+		sorted := slices.Clone(peers)
+		sortPeers(sorted, key)
+		var got []string
+		for _, l := range sorted {
+			got = append(got, l.peer.ID)
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("sort %q = %v, want %s", key, got, want)
+		}
+	}
+}
+
+func TestPeersListBuildsOnlyTheRequestedPage(t *testing.T) {
+	dir := t.TempDir()
+	var yaml strings.Builder
+	yaml.WriteString("server:\n  address: 10.0.0.1/24\npeers:\n")
+	for i := range peersPageSize*2 + 5 {
+		fmt.Fprintf(&yaml, "  - id: p%03d\n    name: peer%03d\n    enabled: true\n", i, i)
+	}
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{store: store}
+
+	data := h.buildPeersListData(peerListQuery{Page: 3})
+	if data.Total != peersPageSize*2+5 || data.Pages != 3 || len(data.Peers) != 5 || data.Peers[0].ID != "p100" || data.PrevPage != 2 || data.NextPage != 0 {
+		t.Fatalf("page 3: total %d, pages %d, rows %d, prev %d, next %d", data.Total, data.Pages, len(data.Peers), data.PrevPage, data.NextPage)
+	}
+	if data := h.buildPeersListData(peerListQuery{Page: 99}); data.Query.Page != 3 {
+		t.Fatalf("out-of-range page clamped to %d", data.Query.Page)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.GetCombinedStats(recorder, httptest.NewRequest("GET", "/stats?kind=peers&q=peer01&page=1", nil))
+	var response struct{ Data statsBarData }
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Data.Peers) != 10 || response.Data.Peers[0].ID != "p010" {
+		t.Fatalf("stats refreshed %d peers, want the 10 matching the search", len(response.Data.Peers))
+	}
+}
+
+func TestConfigsZipNamesEveryPeerApart(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	names := make(map[string]bool)
+	for _, peer := range []models.Peer{{ID: "aaaaaaaa", Name: "lab pc"}, {ID: "bbbbbbbb", Name: "lab pc"}} {
+		if err := writeConfigFiles(zw, names, peer, "[Interface]\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, f := range zr.File {
+		files = append(files, f.Name)
+	}
+	if want := []string{"lab-pc.conf", "lab-pc.png", "lab-pc-bbbbbb.conf", "lab-pc-bbbbbb.png"}; !slices.Equal(files, want) {
+		t.Fatalf("files = %q, want %q", files, want)
+	}
+}
+
+func TestWebhookCreateTestAndDeliveryLog(t *testing.T) {
+	dir := t.TempDir()
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	yaml := "server: {privateKey: " + key + ", listenPort: 51820, address: 10.0.0.1/24}\npeers: []\n"
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*http.Request
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got, bodies = append(got, r), append(bodies, body)
+	}))
+	defer receiver.Close()
+	notifier := webhook.New()
+	store.OnChange(notifier.ConfigChanged)
+	router := NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, Notifier: notifier, Version: "test"})
+
+	post := func(method, target string, form string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(form))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if rec := post("POST", "/webhooks", "name=ops&enabled=on&webhookURL=ftp://x&webhookFormat=json"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "webhookURL") {
+		t.Fatalf("invalid URL = %d %s", rec.Code, rec.Body)
+	}
+	rec := post("POST", "/webhooks", "name=ops&enabled=on&webhookURL="+receiver.URL+"&webhookSecret=s3cret&webhookFormat=json&webhookEvents=bgp.session_down&webhookEvents=apply.failed")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"Template":"webhooks-list"`) {
+		t.Fatalf("POST /webhooks = %d %s", rec.Code, rec.Body)
+	}
+	var hook models.Webhook
+	store.Read(func(cfg *models.AppConfig) { hook = cfg.Webhooks[0] })
+	if !hook.Enabled || hook.Secret != "s3cret" || !slices.Equal(hook.Events, []string{models.EventBGPSessionDown, models.EventApplyFailed}) {
+		t.Fatalf("saved webhook = %+v", hook)
+	}
+
+	rec = post("POST", "/webhooks/"+hook.ID+"/test", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Test event delivered") {
+		t.Fatalf("test send = %d %s", rec.Code, rec.Body)
+	}
+	if len(got) != 1 || got[0].Header.Get("X-WG-Busy-Event") != webhook.TestEvent || got[0].Header.Get("X-WG-Busy-Signature") != webhook.Sign("s3cret", bodies[0]) {
+		t.Fatalf("receiver got %d requests: %v", len(got), got)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/webhooks/deliveries?webhook="+hook.ID, nil))
+	var log struct{ Deliveries []webhook.Delivery }
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || len(log.Deliveries) != 1 || log.Deliveries[0].Status != http.StatusOK {
+		t.Fatalf("deliveries = %s", rec.Body)
+	}
+
+	if rec := post("DELETE", "/webhooks/"+hook.ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s", rec.Code, rec.Body)
+	}
+	store.Read(func(cfg *models.AppConfig) {
+		if len(cfg.Webhooks) != 0 {
+			t.Errorf("webhook not deleted: %+v", cfg.Webhooks)
+		}
+	})
+}
+
+func TestAlertRulesSilencesAndPanel(t *testing.T) {
+	dir := t.TempDir()
+	key := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	yaml := "server: {privateKey: " + key + ", listenPort: 51820, address: 10.0.0.1/24}\npeers: []\n"
+	if err := os.WriteFile(dir+"/config.yaml", []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(dir+"/config.yaml", dir+"/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := alert.New(store, alert.Sources{InterfaceUp: func() bool { return false }}, nil)
+	router := NewRouter(Deps{Store: store, WebFS: fstest.MapFS{}, Alerts: engine, Version: "test"})
+
+	post := func(method, target string, form string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(form))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if rec := post("POST", "/alerts/rules", "name=slow&enabled=on&alertKind=peer_unseen&alertSeverity=warning&alertFor=soon"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "alertFor") {
+		t.Fatalf("invalid For = %d %s", rec.Code, rec.Body)
+	}
+	rec := post("POST", "/alerts/rules", "name=wg0 down&enabled=on&alertKind=interface_down&alertSeverity=critical&alertFor=2m&alertPeer=ignored")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"Template":"alerts-tab"`) {
+		t.Fatalf("POST /alerts/rules = %d %s", rec.Code, rec.Body)
+	}
+	var rule models.AlertRule
+	store.Read(func(cfg *models.AppConfig) { rule = cfg.Alerts.Rules[0] })
+	if rule.Target != "" || rule.For != 2*time.Minute || rule.Severity != models.SeverityCritical {
+		t.Fatalf("saved rule = %+v", rule)
+	}
+	saved, _ := os.ReadFile(dir + "/config.yaml")
+	if !strings.Contains(string(saved), "for: 2m0s") {
+		t.Errorf("config.yaml does not hold the duration as text:\n%s", saved)
+	}
+
+	now := time.Now()
+	engine.Evaluate(now)
+	engine.Evaluate(now.Add(2 * time.Minute))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/alerts", nil))
+	var alerts struct{ Active []alert.Alert }
+	if err := json.Unmarshal(rec.Body.Bytes(), &alerts); err != nil || len(alerts.Active) != 1 || alerts.Active[0].State != alert.StateFiring || alerts.Active[0].Silenced {
+		t.Fatalf("alerts = %s", rec.Body)
+	}
+
+	if rec := post("POST", "/alerts/silences", "silenceRule="+rule.ID+"&silenceSubject=wg0&silenceFor=1h&silenceComment=maintenance"); rec.Code != http.StatusOK {
+		t.Fatalf("POST /alerts/silences = %d %s", rec.Code, rec.Body)
+	}
+	engine.Evaluate(now.Add(3 * time.Minute))
+	if active, _ := engine.Alerts(); len(active) != 1 || !active[0].Silenced {
+		t.Fatalf("silence not applied: %+v", active)
+	}
+
+	if rec := post("DELETE", "/alerts/rules/"+rule.ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s", rec.Code, rec.Body)
+	}
+	store.Read(func(cfg *models.AppConfig) {
+		if len(cfg.Alerts.Rules) != 0 || len(cfg.Alerts.Silences) != 0 {
+			t.Errorf("rule or its silence left behind: %+v", cfg.Alerts)
+		}
+	})
+}
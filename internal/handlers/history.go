@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/connlog"
+	"github.com/yix/wg-busy/internal/history"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/probe"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+// historyChartPoints bounds the points drawn in the history chart; the API
+// returns every bucket.
+const historyChartPoints = 360
+
+const historyTimeLayout = "2006-01-02 15:04"
+
+// historyTimelineEvents is how many connection events the dialog lists.
+const historyTimelineEvents = 50
+
+// historyData is the template data of the traffic history dialog, the detail
+// view of a peer: its traffic chart and its connection timeline.
+type historyData struct {
+	PeerID   string
+	Name     string
+	HasChart bool
+	Range    string
+	Ranges   []string
+	Step     string
+	TotalRx  string
+	TotalTx  string
+	PeakRxPS string
+	PeakTxPS string
+	ChartSVG string
+	From     string
+	To       string
+	// HasProbes is set when the range holds reachability probes of the peer;
+	// ProbeSVG charts their round-trip time and loss.
+	HasProbes  bool
+	ProbeRTT   string
+	PeakRTT    string
+	ProbeLoss  string
+	ProbeLossy bool
+	ProbeSVG   string
+	// HasTimeline is set for a peer when the connection log is enabled.
+	HasTimeline bool
+	Timeline    []eventRow
+}
+
+// historyResponse is the JSON reply of GET /api/history.
+type historyResponse struct {
+	ID          string          `json:"id,omitempty"`
+	Peer        string          `json:"peer,omitempty"`
+	Range       string          `json:"range"`
+	StepSeconds int64           `json:"stepSeconds"`
+	Rx          uint64          `json:"rx"`
+	Tx          uint64          `json:"tx"`
+	Points      []history.Point `json:"points"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// historyQuery resolves the peer and range of a history request. The peer may
+// be given by ID or name; none means the interface total.
+func (h *handler) historyQuery(r *http.Request) (peer models.Peer, rng history.Range, status int, err error) {
+	name := r.URL.Query().Get("range")
+	if name == "" {
+		name = "24h"
+	}
+	rng, ok := history.ParseRange(name)
+	if !ok {
+		return peer, rng, http.StatusBadRequest, errors.New("range must be one of 1h, 24h, 7d, 30d")
+	}
+	ref := r.URL.Query().Get("peer")
+	if ref == "" {
+		return peer, rng, http.StatusOK, nil
+	}
+	peer, found := h.findPeer(ref)
+	if !found {
+		return peer, rng, http.StatusNotFound, errors.New("peer not found")
+	}
+	return peer, rng, http.StatusOK, nil
+}
+
+// findPeer looks a peer up by ID or, failing that, by name.
+func (h *handler) findPeer(ref string) (peer models.Peer, found bool) {
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, p := range cfg.Peers {
+			if p.ID == ref || p.Name == ref {
+				peer, found = p, true
+				return
+			}
+		}
+	})
+	return peer, found
+}
+
+// GetHistory handles GET /history: the traffic history dialog for a peer, or
+// for the whole interface without ?peer=. A peer's dialog also lists its
+// latest connection events.
+func (h *handler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	if h.history == nil && (h.events == nil || r.URL.Query().Get("peer") == "") {
+		writePageError(w, http.StatusNotFound, errors.New("traffic history is disabled"))
+		return
+	}
+	peer, rng, status, err := h.historyQuery(r)
+	if err != nil {
+		writePageError(w, status, err)
+		return
+	}
+
+	data := historyData{PeerID: peer.ID, Name: peer.Name, Range: rng.Name}
+	if data.Name == "" {
+		data.Name = models.WGDevice
+	}
+	if h.events != nil && peer.ID != "" {
+		data.HasTimeline = true
+		for _, e := range h.events.Query(connlog.Filter{Peer: peer.ID, Limit: historyTimelineEvents}) {
+			data.Timeline = append(data.Timeline, newEventRow(e))
+		}
+	}
+	if h.history == nil {
+		writePageJSON(w, http.StatusOK, "history-modal", data, nil)
+		return
+	}
+
+	series := h.history.Query(peer.ID, rng.Span, time.Now()).Downsample(historyChartPoints)
+	data.HasChart = true
+	data.Step = wgstats.FormatDuration(series.Step)
+	data.TotalRx = wgstats.FormatBytes(int64(series.Rx))
+	data.TotalTx = wgstats.FormatBytes(int64(series.Tx))
+	for _, choice := range history.Ranges {
+		data.Ranges = append(data.Ranges, choice.Name)
+	}
+
+	// The sparkline renderer draws rates, so each bucket becomes its average.
+	rates := make([]wgstats.HistoryPoint, len(series.Points))
+	var peakRx, peakTx float64
+	for i, p := range series.Points {
+		rates[i] = wgstats.HistoryPoint{
+			Time: p.Time,
+			RxPS: float64(p.Rx) / series.Step.Seconds(),
+			TxPS: float64(p.Tx) / series.Step.Seconds(),
+		}
+		peakRx, peakTx = max(peakRx, rates[i].RxPS), max(peakTx, rates[i].TxPS)
+	}
+	data.PeakRxPS, data.PeakTxPS = wgstats.FormatBytesPerSec(peakRx), wgstats.FormatBytesPerSec(peakTx)
+	data.ChartSVG = wgstats.RenderSparklineSVG(rates, 640, 160)
+
+	var probes history.Point
+	var peakRTT time.Duration
+	for _, p := range series.Points {
+		probes.Add(p)
+		peakRTT = max(peakRTT, p.RTT())
+	}
+	if probes.Probed() {
+		data.HasProbes = true
+		data.ProbeRTT = probe.FormatRTT(probes.RTT())
+		data.PeakRTT = probe.FormatRTT(peakRTT)
+		data.ProbeLoss = fmt.Sprintf("%.1f%%", probes.Loss()*100)
+		data.ProbeLossy = probes.ProbeReceived < probes.ProbeSent
+		data.ProbeSVG = probeChartSVG(series.Points, peakRTT, 640, 80)
+	}
+	if len(series.Points) > 0 {
+		data.From = series.Points[0].Time.Format(historyTimeLayout)
+		data.To = series.Points[len(series.Points)-1].Time.Add(series.Step).Format(historyTimeLayout)
+	}
+
+	writePageJSON(w, http.StatusOK, "history-modal", data, nil)
+}
+
+// probeChartSVG draws the buckets' average probe round-trip time as a line,
+// scaled to peak, over bars of their loss, scaled to 100%. Buckets without
+// probes are skipped, so the line joins the probes either side of them.
+func probeChartSVG(points []history.Point, peak time.Duration, width, height int) string {
+	fW, fH := float64(width), float64(height)
+	var line []string
+	var bars strings.Builder
+	barW := max(fW/float64(max(len(points), 1)), 1)
+	for i, p := range points {
+		if !p.Probed() {
+			continue
+		}
+		x := fW * float64(i) / float64(max(len(points)-1, 1))
+		if loss := p.Loss(); loss > 0 {
+			fmt.Fprintf(&bars, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#f56565" fill-opacity="0.5"/>`, x-barW/2, fH-fH*loss, barW, fH*loss)
+		}
+		if p.ProbeReceived > 0 && peak > 0 {
+			line = append(line, fmt.Sprintf("%.1f,%.1f", x, fH-fH*float64(p.RTT())/float64(peak)))
+		}
+	}
+	return fmt.Sprintf(
+		`<svg width="%d" height="%d" xmlns="http://www.w3.org/2000/svg" class="sparkline">%s`+
+			`<polyline points="%s" fill="none" stroke="#ecc94b" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"/>`+
+			`</svg>`,
+		width, height, bars.String(), strings.Join(line, " "))
+}
+
+// GetHistoryJSON handles GET /api/history?peer=ID-or-name&range=7d: every
+// bucket of the range, in bytes, plus the totals.
+func (h *handler) GetHistoryJSON(w http.ResponseWriter, r *http.Request) {
+	peer, rng, status, err := h.historyQuery(r)
+	if h.history == nil {
+		status, err = http.StatusNotFound, errors.New("traffic history is disabled")
+	}
+	resp := historyResponse{ID: peer.ID, Peer: peer.Name, Range: rng.Name, Points: []history.Point{}}
+	if err == nil {
+		series := h.history.Query(peer.ID, rng.Span, time.Now())
+		resp.StepSeconds = int64(series.Step / time.Second)
+		resp.Rx, resp.Tx, resp.Points = series.Rx, series.Tx, series.Points
+	} else {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yix/wg-busy/internal/importer"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// maxImportSize bounds an uploaded or pasted config or peer list.
+const maxImportSize = 1 << 20
+
+// importFormData is the template data for the import dialog. The preview step
+// carries the source text along in the form, so what is committed is exactly
+// what was previewed, even for a live interface that has changed since.
+type importFormData struct {
+	Preview *importer.Preview
+	Content string
+	Error   string
+}
+
+// readUpload returns the uploaded file, or else the pasted content field; ""
+// when there is neither.
+func readUpload(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", fmt.Errorf("reading upload: %w", err)
+	}
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return "", fmt.Errorf("reading upload: %w", err)
+		}
+		if len(content) > 0 {
+			return string(content), nil
+		}
+	}
+	return r.FormValue("content"), nil
+}
+
+// readImportSource returns the text to import: the live interface, an
+// uploaded file, or the pasted content.
+func readImportSource(w http.ResponseWriter, r *http.Request) (string, error) {
+	content, err := readUpload(w, r)
+	switch {
+	case err != nil:
+		return "", err
+	case r.FormValue("source") == "live":
+		return importer.ReadInterface()
+	case content == "":
+		return "", fmt.Errorf("paste a config or choose a file to import")
+	}
+	return content, nil
+}
+
+// GetImportForm handles GET /peers/import.
+func (h *handler) GetImportForm(w http.ResponseWriter, r *http.Request) {
+	writePageJSON(w, http.StatusOK, "import-form", importFormData{}, nil)
+}
+
+// PreviewImport handles POST /peers/import/preview: it parses the source and
+// shows what importing it would change, without changing anything.
+func (h *handler) PreviewImport(w http.ResponseWriter, r *http.Request) {
+	content, err := readImportSource(w, r)
+	if err != nil {
+		writePageJSON(w, http.StatusUnprocessableEntity, "import-form", importFormData{Error: err.Error()}, nil)
+		return
+	}
+	src, err := importer.Parse(content)
+	if err != nil {
+		writePageJSON(w, http.StatusUnprocessableEntity, "import-form", importFormData{Content: content, Error: err.Error()}, nil)
+		return
+	}
+	var preview importer.Preview
+	h.store.Read(func(cfg *models.AppConfig) {
+		preview = importer.NewPreview(*cfg, src)
+	})
+	writePageJSON(w, http.StatusOK, "import-form", importFormData{Preview: &preview, Content: content}, nil)
+}
+
+// ImportPeers handles POST /peers/import: it adds the peers checked in the
+// preview, and the server settings if chosen, in one store write.
+func (h *handler) ImportPeers(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	content := r.FormValue("content")
+	src, err := importer.Parse(content)
+	if err != nil {
+		writePageJSON(w, http.StatusUnprocessableEntity, "import-form", importFormData{Content: content, Error: err.Error()}, nil)
+		return
+	}
+
+	var added int
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		var err error
+		added, err = importer.Apply(cfg, src, r.Form["keys"], r.FormValue("importServer") == "on", time.Now())
+		return err
+	})
+	if writeErr != nil {
+		logRejected(r, writeErr)
+		if warning, ok := applyWarning(writeErr); ok {
+			h.listPeersOOB(w, r, &warning)
+			return
+		}
+		var preview importer.Preview
+		h.store.Read(func(cfg *models.AppConfig) {
+			preview = importer.NewPreview(*cfg, src)
+		})
+		writePageJSON(w, http.StatusUnprocessableEntity, "import-form", importFormData{Preview: &preview, Content: content, Error: writeErr.Error()}, nil)
+		return
+	}
+
+	h.listPeersOOB(w, r, &toastData{Kind: "success", Message: fmt.Sprintf("Imported %d peer(s)", added)})
+}
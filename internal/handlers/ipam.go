@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/ipam"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// addressUsage is the address utilisation view on the server tab.
+type addressUsage struct {
+	Pools []ipam.PoolUsage
+	// Conflicts are peers already numbered inside a network routed
+	// elsewhere, or advertising one over another peer's address.
+	Conflicts []string
+	// Delegations lists every delegated prefix, in address order.
+	Delegations []delegation
+}
+
+type delegation struct {
+	Prefix    string
+	Peer      string
+	Enabled   bool
+	Announced bool
+}
+
+// routedNetworks returns the networks known only at runtime that no peer
+// address may fall in: joined ZeroTier subnets, and routes accepted from BGP
+// neighbours. Host routes learned over BGP are left out, as a neighbour often
+// announces its own tunnel address. Call it outside the store lock.
+func (h *handler) routedNetworks() []ipam.Network {
+	var networks []ipam.Network
+	for _, n := range h.ztGatewayNets() {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(n.CIDR)); err == nil {
+			networks = append(networks, ipam.Network{Prefix: prefix.Masked(), Source: fmt.Sprintf("ZeroTier network %s on %s", prefix.Masked(), n.Device)})
+		}
+	}
+	stats := bgp.GetBGPStats()
+	if stats == nil {
+		return networks
+	}
+	for _, peer := range stats.Peers {
+		for _, route := range peer.Routes {
+			prefix, err := netip.ParsePrefix(route.Prefix)
+			if err != nil || route.Status != "Accepted" || prefix.IsSingleIP() {
+				continue
+			}
+			networks = append(networks, ipam.Network{Prefix: prefix.Masked(), Source: fmt.Sprintf("BGP route %s from %s", prefix.Masked(), peer.IP)})
+		}
+	}
+	return networks
+}
+
+// buildAddressUsage reports how full each subnet and pool is, and which peer
+// holds each delegated prefix. An invalid server address leaves the pools
+// empty.
+func buildAddressUsage(cfg *models.AppConfig, routed []ipam.Network) addressUsage {
+	var usage addressUsage
+	for _, p := range cfg.Peers {
+		if p.DelegatedPrefix != "" {
+			usage.Delegations = append(usage.Delegations, delegation{Prefix: p.DelegatedPrefix, Peer: p.Name, Enabled: p.Enabled, Announced: p.AnnounceDelegatedPrefix})
+		}
+	}
+	slices.SortFunc(usage.Delegations, func(a, b delegation) int {
+		pa, _ := netip.ParsePrefix(a.Prefix)
+		pb, _ := netip.ParsePrefix(b.Prefix)
+		return pa.Addr().Compare(pb.Addr())
+	})
+
+	alloc, err := ipam.New(cfg, routed)
+	if err != nil {
+		return usage
+	}
+	usage.Pools, usage.Conflicts = alloc.Usage(), alloc.Conflicts(cfg.Peers)
+	return usage
+}
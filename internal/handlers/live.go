@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+// liveKeepAlive is how long a quiet event stream waits before sending a
+// comment, so proxies do not close it as idle.
+const liveKeepAlive = 25 * time.Second
+
+// liveRevisions counts changes to each source the live views depend on.
+type liveRevisions struct {
+	Stats    uint64 // wgstats polls
+	ZeroTier uint64 // ZeroTier snapshot revision
+	Config   uint64 // successful config writes
+	Alerts   uint64 // alert evaluations that changed the alerts
+}
+
+// liveHub wakes every /events stream when one of its sources changes, and
+// holds the snapshot they all diff against. Each stream sends only what its
+// tab shows and what differs from its previous event.
+type liveHub struct {
+	mu   sync.Mutex
+	revs liveRevisions
+	wake chan struct{}
+
+	// snapMu is held while a snapshot is built, so the streams woken by one
+	// poll wait for a single build instead of each reading the config.
+	snapMu sync.Mutex
+	snap   *liveSnapshot
+}
+
+// liveSnapshot is the config and stats at one stats poll and config write.
+// Peer rows are built when a stream first shows them and then shared, so a
+// row costs the same however many streams show it.
+type liveSnapshot struct {
+	stats, config uint64 // the revisions it was built at
+	at            time.Time
+	cfg           models.AppConfig
+	peerStats     map[string]wgstats.PeerStats // by public key
+	bar           statsBarData
+	barJSON       []byte
+
+	mu   sync.Mutex
+	rows map[string]liveRow // by peer ID; absent until first shown
+}
+
+// liveRow is one peer's live data and its encoding, to compare streams by.
+type liveRow struct {
+	data    peerLiveData
+	encoded []byte
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{wake: make(chan struct{})}
+}
+
+// publish applies bump and wakes every stream. It never blocks, so it is safe
+// to call from the stats poll loop and under the config store lock.
+func (l *liveHub) publish(bump func(*liveRevisions)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bump(&l.revs)
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// current returns the revisions and a channel closed on the next publish.
+func (l *liveHub) current() (liveRevisions, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.revs, l.wake
+}
+
+// watchZeroTier publishes every new ZeroTier snapshot revision.
+func (l *liveHub) watchZeroTier(zt *zerotier.Supervisor) {
+	for {
+		_, revision := zt.SnapshotVersion()
+		if zt.WaitForChange(context.Background(), revision, time.Minute) {
+			_, revision = zt.SnapshotVersion()
+			l.publish(func(r *liveRevisions) { r.ZeroTier = revision })
+		}
+	}
+}
+
+// liveStream is what one /events connection shows and what it last sent.
+type liveStream struct {
+	kind    string
+	query   peerListQuery
+	seen    liveRevisions
+	started bool
+	// visible holds the IDs of the peers on the page, on the peers tab. The
+	// filters and sort are applied only when the stream starts and after a
+	// config write, not on every poll.
+	visible []string
+	bar     []byte
+	peers   map[string][]byte
+	bgp     []byte
+}
+
+// liveSnapshot returns the snapshot at revs, building it if the stats were
+// polled or the config written since the last one.
+func (h *handler) liveSnapshot(revs liveRevisions) (*liveSnapshot, error) {
+	l := h.live
+	l.snapMu.Lock()
+	defer l.snapMu.Unlock()
+	if l.snap != nil && l.snap.stats == revs.Stats && l.snap.config == revs.Config {
+		return l.snap, nil
+	}
+
+	snap := &liveSnapshot{stats: revs.Stats, config: revs.Config, at: time.Now(), bar: h.buildStatsBar(), rows: make(map[string]liveRow)}
+	if h.store != nil {
+		h.store.Read(func(cfg *models.AppConfig) { snap.cfg = cfg.Clone() })
+	}
+	if h.stats != nil {
+		snap.peerStats = h.stats.GetAllPeerStats()
+	}
+	var err error
+	if snap.barJSON, err = json.Marshal(snap.bar); err != nil {
+		return nil, err
+	}
+	l.snap = snap
+	return snap, nil
+}
+
+// liveRow returns the live data of peer id, building it on first use. A peer
+// deleted since the stream listed it is reported missing.
+func (h *handler) liveRow(snap *liveSnapshot, id string) (liveRow, bool, error) {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if row, ok := snap.rows[id]; ok {
+		return row, true, nil
+	}
+	peer := models.FindPeerByID(snap.cfg.Peers, id)
+	if peer == nil {
+		return liveRow{}, false, nil
+	}
+	row := liveRow{data: livePeerData(h.buildPeerRow(*peer, "", snap.peerStats[peer.PublicKey]))}
+	var err error
+	if row.encoded, err = json.Marshal(row.data); err != nil {
+		return liveRow{}, false, err
+	}
+	snap.rows[id] = row
+	return row, true, nil
+}
+
+// LiveEvents handles GET /events: a Server-Sent Events stream that replaces
+// polling GET /stats. ?kind= and the peers filter and page select what the tab
+// shows, as for GET /stats. The first events carry everything; later ones only
+// what changed:
+//
+//	stats     stats-bar page JSON with the changed peer rows and BGP stats
+//	zerotier  zerotier-status page JSON, on the ZeroTier tab
+//	alerts    alerts-active page JSON, on the Alerts tab
+//	config    the config was saved, so lists may be stale
+func (h *handler) LiveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers proxied responses unless told otherwise.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	if h.stats != nil {
+		// An open stream is what keeps the stats polled at the fast interval.
+		defer h.stats.Watch()()
+	}
+
+	stream := &liveStream{kind: r.FormValue("kind"), query: peerListQueryFrom(r), peers: make(map[string][]byte)}
+	keepAlive := time.NewTimer(liveKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		revs, wake := h.live.current()
+		sent, err := h.sendLive(w, stream, revs)
+		if err == nil && sent {
+			err = flusher.Flush()
+			keepAlive.Reset(liveKeepAlive)
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil || flusher.Flush() != nil {
+				return
+			}
+			keepAlive.Reset(liveKeepAlive)
+		}
+	}
+}
+
+// sendLive writes the events due at revs and reports whether it wrote any.
+func (h *handler) sendLive(w io.Writer, s *liveStream, revs liveRevisions) (bool, error) {
+	first := !s.started
+	configChanged := s.started && revs.Config != s.seen.Config
+	ztChanged := s.started && revs.ZeroTier != s.seen.ZeroTier
+	alertsChanged := s.started && revs.Alerts != s.seen.Alerts
+	s.started, s.seen = true, revs
+
+	var sent bool
+	if configChanged {
+		if err := writeEvent(w, "config", revs.Config); err != nil {
+			return false, err
+		}
+		sent = true
+	}
+
+	snap, err := h.liveSnapshot(revs)
+	if err != nil {
+		return sent, err
+	}
+	data := snap.bar
+	changed := !bytes.Equal(snap.barJSON, s.bar)
+	s.bar = snap.barJSON
+
+	switch s.kind {
+	case "bgp":
+		stats := bgp.GetBGPStats()
+		encoded, err := json.Marshal(stats)
+		if err != nil {
+			return sent, err
+		}
+		if !bytes.Equal(encoded, s.bgp) {
+			s.bgp, data.BGPStats, changed = encoded, stats, true
+		}
+	case "server", "zerotier", "alerts", "diagnostics":
+		// These tabs need only the interface summary in the title.
+	default:
+		if first || configChanged {
+			// The client may re-render the list, so resend every row.
+			query := s.query
+			page, _, _ := pagePeers(snap.cfg.Peers, snap.peerStats, &query, snap.at)
+			s.visible = s.visible[:0]
+			for _, l := range page {
+				s.visible = append(s.visible, l.peer.ID)
+			}
+			clear(s.peers)
+		}
+		for _, id := range s.visible {
+			row, ok, err := h.liveRow(snap, id)
+			if err != nil {
+				return sent, err
+			}
+			if ok && !bytes.Equal(row.encoded, s.peers[id]) {
+				s.peers[id] = row.encoded
+				data.Peers = append(data.Peers, row.data)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := writeEvent(w, "stats", pageResponse{Template: "stats-bar", Data: data}); err != nil {
+			return sent, err
+		}
+		sent = true
+	}
+
+	if s.kind == "zerotier" && ztChanged && h.zt != nil {
+		if err := writeEvent(w, "zerotier", pageResponse{Template: "zerotier-status", Data: h.buildZeroTierData()}); err != nil {
+			return sent, err
+		}
+		sent = true
+	}
+
+	if s.kind == "alerts" && alertsChanged && h.alerts != nil {
+		if err := writeEvent(w, "alerts", pageResponse{Template: "alerts-active", Data: h.buildAlertsActiveData()}); err != nil {
+			return sent, err
+		}
+		sent = true
+	}
+	return sent, nil
+}
+
+func writeEvent(w io.Writer, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
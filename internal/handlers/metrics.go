@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/metrics"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/probe"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+// bgpStates are the FSM states a session reports, in order; each session gets
+// one wg_busy_bgp_session_state series per state, 1 for the current one.
+var bgpStates = []string{"Down", "Idle", "Connect", "Active", "OpenSent", "OpenConfirm", "Established"}
+
+// Metrics handles GET /metrics: everything the stats bar, BGP and ZeroTier tabs
+// show, in the Prometheus text format. Counters are the kernel's, so they reset
+// when wg0 is recreated; Prometheus's rate() handles that.
+func (h *handler) Metrics(w http.ResponseWriter, _ *http.Request) {
+	var cfg models.AppConfig
+	h.store.Read(func(c *models.AppConfig) { cfg = c.Clone() })
+
+	var m metrics.Writer
+	h.writeWireGuardMetrics(&m, cfg.Peers)
+	h.writeProbeMetrics(&m, cfg.Peers)
+	writeBGPMetrics(&m, bgp.GetBGPStats())
+	h.writeZeroTierMetrics(&m)
+	h.writeRoutingDriftMetrics(&m)
+
+	m.Family("wg_busy_apply_failures_total", "counter", "Saves and reapplies whose live apply did not complete.")
+	m.Sample("wg_busy_apply_failures_total", float64(h.store.ApplyFailures()))
+	m.Histogram("wg_busy_reconcile_duration_seconds", "Time taken to apply a saved config to WireGuard, routing and BGP.", h.store.ReconcileDuration())
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	_, _ = w.Write(m.Bytes())
+}
+
+func (h *handler) writeWireGuardMetrics(m *metrics.Writer, peers []models.Peer) {
+	var (
+		up     bool
+		uptime time.Duration
+		iface  wgstats.InterfaceStats
+		stats  map[string]wgstats.PeerStats
+	)
+	if h.stats != nil {
+		up, uptime = h.stats.IsUp(), h.stats.Uptime()
+		iface, stats = h.stats.GetInterfaceStats(), h.stats.GetAllPeerStats()
+	}
+
+	m.Family("wg_busy_wireguard_up", "gauge", "Whether the WireGuard interface is up.")
+	m.Bool("wg_busy_wireguard_up", up, "interface", models.WGDevice)
+	m.Family("wg_busy_wireguard_uptime_seconds", "gauge", "Time since the WireGuard interface was last brought up.")
+	m.Sample("wg_busy_wireguard_uptime_seconds", uptime.Seconds(), "interface", models.WGDevice)
+	m.Family("wg_busy_wireguard_receive_bytes_total", "counter", "Bytes received on the WireGuard interface from all peers.")
+	m.Sample("wg_busy_wireguard_receive_bytes_total", float64(iface.TotalRx), "interface", models.WGDevice)
+	m.Family("wg_busy_wireguard_transmit_bytes_total", "counter", "Bytes sent on the WireGuard interface to all peers.")
+	m.Sample("wg_busy_wireguard_transmit_bytes_total", float64(iface.TotalTx), "interface", models.WGDevice)
+
+	m.Family("wg_busy_peer_enabled", "gauge", "Whether the peer is enabled in config.yaml.")
+	for _, p := range peers {
+		m.Bool("wg_busy_peer_enabled", p.Enabled, peerLabels(p)...)
+	}
+	m.Family("wg_busy_peer_receive_bytes_total", "counter", "Bytes received from the peer.")
+	for _, p := range peers {
+		if ps, ok := stats[p.PublicKey]; ok {
+			m.Sample("wg_busy_peer_receive_bytes_total", float64(ps.TransferRx), peerLabels(p)...)
+		}
+	}
+	m.Family("wg_busy_peer_transmit_bytes_total", "counter", "Bytes sent to the peer.")
+	for _, p := range peers {
+		if ps, ok := stats[p.PublicKey]; ok {
+			m.Sample("wg_busy_peer_transmit_bytes_total", float64(ps.TransferTx), peerLabels(p)...)
+		}
+	}
+	m.Family("wg_busy_peer_latest_handshake_seconds", "gauge", "Unix time of the peer's latest handshake, 0 if it has none.")
+	for _, p := range peers {
+		if ps, ok := stats[p.PublicKey]; ok {
+			var at float64
+			if !ps.LatestHandshake.IsZero() {
+				at = float64(ps.LatestHandshake.Unix())
+			}
+			m.Sample("wg_busy_peer_latest_handshake_seconds", at, peerLabels(p)...)
+		}
+	}
+}
+
+func (h *handler) writeProbeMetrics(m *metrics.Writer, peers []models.Peer) {
+	type probed struct {
+		labels []string
+		result probe.Result
+	}
+	var results []probed
+	for _, p := range peers {
+		if r, ok := h.probes.Result(p.ID); ok {
+			results = append(results, probed{append(peerLabels(p), "target", r.Target), r})
+		}
+	}
+
+	m.Family("wg_busy_peer_probe_loss_ratio", "gauge", "Fraction of the latest reachability probe's echo requests left unanswered.")
+	for _, p := range results {
+		m.Sample("wg_busy_peer_probe_loss_ratio", p.result.Loss(), p.labels...)
+	}
+	m.Family("wg_busy_peer_probe_rtt_seconds", "gauge", "Average round-trip time of the latest reachability probe; absent when nothing answered.")
+	for _, p := range results {
+		if p.result.Received > 0 {
+			m.Sample("wg_busy_peer_probe_rtt_seconds", p.result.RTT.Seconds(), p.labels...)
+		}
+	}
+	m.Family("wg_busy_peer_probe_jitter_seconds", "gauge", "Mean difference between consecutive round-trip times of the latest reachability probe.")
+	for _, p := range results {
+		if p.result.Received > 1 {
+			m.Sample("wg_busy_peer_probe_jitter_seconds", p.result.Jitter.Seconds(), p.labels...)
+		}
+	}
+}
+
+func peerLabels(p models.Peer) []string {
+	return []string{"peer", p.Name, "public_key", p.PublicKey}
+}
+
+func writeBGPMetrics(m *metrics.Writer, stats *models.BGPStats) {
+	if stats == nil {
+		stats = &models.BGPStats{}
+	}
+	m.Family("wg_busy_bgp_running", "gauge", "Whether the BGP speaker is running.")
+	m.Bool("wg_busy_bgp_running", stats.Running)
+
+	m.Family("wg_busy_bgp_session_state", "gauge", "BGP session FSM state: 1 for the current state.")
+	for _, p := range stats.Peers {
+		for _, state := range bgpStates {
+			m.Bool("wg_busy_bgp_session_state", p.State == state, append(bgpPeerLabels(p), "state", state)...)
+		}
+	}
+	m.Family("wg_busy_bgp_session_uptime_seconds", "gauge", "Time the BGP session has been established, 0 when it is not.")
+	for _, p := range stats.Peers {
+		uptime, _ := time.ParseDuration(p.Uptime)
+		m.Sample("wg_busy_bgp_session_uptime_seconds", uptime.Seconds(), bgpPeerLabels(p)...)
+	}
+	m.Family("wg_busy_bgp_updates_received_total", "counter", "BGP UPDATE messages received in the session.")
+	for _, p := range stats.Peers {
+		m.Sample("wg_busy_bgp_updates_received_total", float64(p.UpdatesReceived), bgpPeerLabels(p)...)
+	}
+	m.Family("wg_busy_bgp_prefixes", "gauge", "Prefixes received from the neighbour, by import filter result, and advertised to it.")
+	for _, p := range stats.Peers {
+		counts := map[string]int{"Accepted": 0, "Filtered": 0}
+		for _, route := range p.Routes {
+			counts[route.Status]++
+		}
+		m.Sample("wg_busy_bgp_prefixes", float64(counts["Accepted"]), append(bgpPeerLabels(p), "status", "accepted")...)
+		m.Sample("wg_busy_bgp_prefixes", float64(counts["Filtered"]), append(bgpPeerLabels(p), "status", "filtered")...)
+		m.Sample("wg_busy_bgp_prefixes", float64(len(p.AdvertisedRoutes)), append(bgpPeerLabels(p), "status", "advertised")...)
+	}
+}
+
+func bgpPeerLabels(p models.BGPPeerStats) []string {
+	return []string{"peer", p.Name, "ip", p.IP, "asn", strconv.FormatUint(uint64(p.ASN), 10)}
+}
+
+func (h *handler) writeZeroTierMetrics(m *metrics.Writer) {
+	if h.zt == nil {
+		return
+	}
+	snap := h.zt.Snapshot()
+	m.Family("wg_busy_zerotier_running", "gauge", "Whether the supervised ZeroTier service answers its control API.")
+	m.Bool("wg_busy_zerotier_running", snap.Running)
+	m.Family("wg_busy_zerotier_online", "gauge", "Whether the ZeroTier node reports itself online.")
+	m.Bool("wg_busy_zerotier_online", snap.Status != nil && snap.Status.Online)
+
+	m.Family("wg_busy_zerotier_network_ok", "gauge", "Whether the joined network's status is OK.")
+	for _, n := range snap.Networks {
+		m.Bool("wg_busy_zerotier_network_ok", n.Status == "OK", ztNetworkLabels(n.ID, n.Name, n.PortDeviceName)...)
+	}
+	m.Family("wg_busy_zerotier_network_receive_bytes_total", "counter", "Bytes received on the network's interface.")
+	for _, n := range snap.Networks {
+		m.Sample("wg_busy_zerotier_network_receive_bytes_total", float64(n.Rx), ztNetworkLabels(n.ID, n.Name, n.PortDeviceName)...)
+	}
+	m.Family("wg_busy_zerotier_network_transmit_bytes_total", "counter", "Bytes sent on the network's interface.")
+	for _, n := range snap.Networks {
+		m.Sample("wg_busy_zerotier_network_transmit_bytes_total", float64(n.Tx), ztNetworkLabels(n.ID, n.Name, n.PortDeviceName)...)
+	}
+}
+
+func ztNetworkLabels(id, name, device string) []string {
+	return []string{"network", id, "name", name, "device", device}
+}
+
+// writeRoutingDriftMetrics writes the drift watcher's latest check; nothing
+// before the first one.
+func (h *handler) writeRoutingDriftMetrics(m *metrics.Writer) {
+	status := h.drifts.Status()
+	if status.CheckedAt.IsZero() {
+		return
+	}
+	counts := make(map[string]int)
+	for _, d := range status.Drift {
+		counts[d.Kind]++
+	}
+	m.Family("wg_busy_routing_drift_entries", "gauge", "Installed routing entries missing from the kernel at the latest drift check, by kind.")
+	for _, kind := range []string{"rule", "route", "nat", "filter"} {
+		m.Sample("wg_busy_routing_drift_entries", float64(counts[kind]), "kind", kind)
+	}
+	m.Family("wg_busy_routing_drift_check_error", "gauge", "Whether the latest drift check could not read the kernel's state.")
+	m.Bool("wg_busy_routing_drift_check_error", status.Error != "")
+	m.Family("wg_busy_routing_drift_last_check_timestamp_seconds", "gauge", "Unix time of the latest drift check.")
+	m.Sample("wg_busy_routing_drift_last_check_timestamp_seconds", float64(status.CheckedAt.Unix()))
+	m.Family("wg_busy_routing_repairs_total", "counter", "Reinstalls of the routing state after drift, automatic and manual.")
+	m.Sample("wg_busy_routing_repairs_total", float64(h.drifts.Repairs()))
+}
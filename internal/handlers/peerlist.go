@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"cmp"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/importer"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+// peersPageSize is how many peers the list shows at once. Rows are only built
+// for the visible page, so the two-second stats refresh costs the same with
+// ten peers or ten thousand.
+const peersPageSize = 50
+
+// Peer list sort keys. The default keeps config order, which is creation order.
+const (
+	sortName     = "name"
+	sortLastSeen = "lastseen" // most recent first
+	sortTraffic  = "traffic"  // most transferred first
+)
+
+// Exit node filter values; any other value is an exit node ID, matching the
+// peers routed through it.
+const (
+	exitFilterNodes  = "nodes"
+	exitFilterDirect = "direct"
+)
+
+// peerListQuery is the search, filters, sort and page of the peers list. The
+// list keeps it in the #peer-filter form, which the peer dialogs, bulk bar
+// and stats poll include, so every refresh of the list, full or live, shows
+// the same peers.
+type peerListQuery struct {
+	Search string // matched against name, IPs, public key and endpoint
+	State  string // "enabled", "disabled", or "" for both
+	Online bool
+	Exit   string
+	Tag    string
+	Sort   string
+	Page   int // 1-based
+}
+
+func peerListQueryFrom(r *http.Request) peerListQuery {
+	q := peerListQuery{
+		Search: strings.TrimSpace(r.FormValue("q")),
+		State:  r.FormValue("state"),
+		Online: r.FormValue("online") == "on",
+		Exit:   r.FormValue("exit"),
+		Tag:    strings.TrimSpace(r.FormValue("tag")),
+		Sort:   r.FormValue("sort"),
+	}
+	q.Page, _ = strconv.Atoi(r.FormValue("page"))
+	return q
+}
+
+func (q peerListQuery) matches(p models.Peer, stats wgstats.PeerStats, now time.Time) bool {
+	switch {
+	case q.State == "enabled" && !p.Enabled, q.State == "disabled" && p.Enabled:
+		return false
+	case q.Online && !stats.Online(now):
+		return false
+	case q.Tag != "" && !p.HasTag(q.Tag):
+		return false
+	}
+	switch q.Exit {
+	case "":
+	case exitFilterNodes:
+		if !p.IsExitNode {
+			return false
+		}
+	case exitFilterDirect:
+		if p.IsExitNode || p.ExitNodeID != "" {
+			return false
+		}
+	default:
+		if p.ExitNodeID != q.Exit {
+			return false
+		}
+	}
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	for _, field := range []string{p.Name, p.AllowedIPs, p.PublicKey, p.Endpoint, stats.Endpoint} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// listedPeer is a peer with the live stats filtering and sorting look at.
+type listedPeer struct {
+	peer  models.Peer
+	stats wgstats.PeerStats
+}
+
+func (l listedPeer) lastSeen() time.Time {
+	if l.stats.LatestHandshake.After(l.peer.LastSeen) {
+		return l.stats.LatestHandshake
+	}
+	return l.peer.LastSeen
+}
+
+// sortPeers orders the matches by a sort key, keeping config order among ties.
+func sortPeers(peers []listedPeer, key string) {
+	var compare func(a, b listedPeer) int
+	switch key {
+	case sortName:
+		compare = func(a, b listedPeer) int {
+			return cmp.Compare(strings.ToLower(a.peer.Name), strings.ToLower(b.peer.Name))
+		}
+	case sortLastSeen:
+		compare = func(a, b listedPeer) int { return b.lastSeen().Compare(a.lastSeen()) }
+	case sortTraffic:
+		compare = func(a, b listedPeer) int {
+			return cmp.Compare(b.stats.TransferRx+b.stats.TransferTx, a.stats.TransferRx+a.stats.TransferTx)
+		}
+	default:
+		return
+	}
+	slices.SortStableFunc(peers, compare)
+}
+
+// buildPeersListData filters and sorts every peer but builds rows, the costly
+// part with its sparkline, only for the requested page.
+func (h *handler) buildPeersListData(q peerListQuery) peersListData {
+	var cfg *models.AppConfig
+	h.store.Read(func(c *models.AppConfig) {
+		cfg = c
+	})
+
+	// Fetch peer stats if available.
+	var allPeerStats map[string]wgstats.PeerStats
+	if h.stats != nil {
+		allPeerStats = h.stats.GetAllPeerStats()
+	}
+
+	exitNodeNames := make(map[string]string)
+	for _, p := range cfg.Peers {
+		if p.IsExitNode {
+			exitNodeNames[p.ID] = p.Name
+		}
+	}
+
+	page, matched, pages := pagePeers(cfg.Peers, allPeerStats, &q, time.Now())
+	data := peersListData{
+		Query:     q,
+		Total:     len(cfg.Peers),
+		Matched:   matched,
+		Pages:     pages,
+		Tags:      models.PeerTags(cfg.Peers),
+		ExitNodes: models.ExitNodePeers(cfg.Peers),
+		Unmanaged: len(importer.Unmanaged(*cfg, slices.Collect(maps.Keys(allPeerStats)))),
+	}
+	if q.Page > 1 {
+		data.PrevPage = q.Page - 1
+	}
+	if q.Page < pages {
+		data.NextPage = q.Page + 1
+	}
+	for _, l := range page {
+		data.Peers = append(data.Peers, h.buildPeerRow(l.peer, exitNodeNames[l.peer.ExitNodeID], l.stats))
+	}
+	return data
+}
+
+// pagePeers filters and sorts peers for q, clamps q.Page to the pages there
+// are, and returns that page with how many peers matched and the page count.
+func pagePeers(peers []models.Peer, allPeerStats map[string]wgstats.PeerStats, q *peerListQuery, now time.Time) (page []listedPeer, matched, pages int) {
+	var listed []listedPeer
+	for _, p := range peers {
+		if stats := allPeerStats[p.PublicKey]; q.matches(p, stats, now) {
+			listed = append(listed, listedPeer{p, stats})
+		}
+	}
+	sortPeers(listed, q.Sort)
+
+	pages = max((len(listed)+peersPageSize-1)/peersPageSize, 1)
+	q.Page = min(max(q.Page, 1), pages)
+	first := (q.Page - 1) * peersPageSize
+	last := min(first+peersPageSize, len(listed))
+	return listed[first:last], len(listed), pages
+}
@@ -1,16 +1,16 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/yix/wg-busy/internal/ipam"
 	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/probe"
 	"github.com/yix/wg-busy/internal/routing"
 	"github.com/yix/wg-busy/internal/wgstats"
 	"github.com/yix/wg-busy/internal/wireguard"
@@ -32,12 +32,40 @@ type peerRowData struct {
 	LastSeenAt   string
 	SparklineSVG string
 	HasStats     bool
+	// Usage is the traffic counted in the current quota period, against the
+	// quota when the peer has one.
+	Usage         string
+	QuotaExceeded bool
+	// ExpiresOn is the last day of access, if the peer expires.
+	ExpiresOn string
+	// Probe summarises the latest reachability probe, ProbeTitle says what
+	// was pinged when, and ProbeLossy flags a probe that lost packets.
+	Probe      string
+	ProbeTitle string
+	ProbeLossy bool
 }
 
 // peersListData is the template data for the peers list.
 type peersListData struct {
 	Peers []peerRowData
 	OOB   bool
+	// Query is the active search, filters, sort and page.
+	Query peerListQuery
+	// Total counts every peer, Matched those passing the filters, and Peers
+	// holds only the current page of them.
+	Total   int
+	Matched int
+	Pages   int
+	// PrevPage and NextPage are 0 on the first and last page.
+	PrevPage int
+	NextPage int
+	// Tags lists every tag in use for the filter.
+	Tags []string
+	// ExitNodes are the choices for the exit node filter and the bulk
+	// move-to-exit-node action.
+	ExitNodes []models.Peer
+	// Unmanaged counts peers live on wg0 that config.yaml does not know.
+	Unmanaged int
 }
 
 // peerFormData is the template data for the peer create/edit form.
@@ -50,38 +78,18 @@ type peerFormData struct {
 	ExitNodes []models.Peer
 	// Gateways are the subnets a policy route gateway may point into, shown as a
 	// hint on the form: the WireGuard subnet and any joined ZeroTier networks.
-	Gateways         []models.GatewayNet
+	Gateways []models.GatewayNet
+	// QuotaLimit is the quota limit formatted for the size input.
+	QuotaLimit string
+	// ExpiresOn is the last day of access, for the date input.
+	ExpiresOn string
+	// ProbeMode is the server's probe mode, which decides whether the probe
+	// checkbox matters.
+	ProbeMode        string
 	Error            string
 	ValidationErrors models.ValidationErrors
 }
 
-func (h *handler) buildPeersListData() peersListData {
-	var data peersListData
-	var cfg *models.AppConfig
-	h.store.Read(func(c *models.AppConfig) {
-		cfg = c
-	})
-
-	// Fetch peer stats if available.
-	var allPeerStats map[string]wgstats.PeerStats
-	if h.stats != nil {
-		allPeerStats = h.stats.GetAllPeerStats()
-	}
-
-	exitNodeNames := make(map[string]string)
-	for _, p := range cfg.Peers {
-		if p.IsExitNode {
-			exitNodeNames[p.ID] = p.Name
-		}
-	}
-
-	for _, p := range cfg.Peers {
-		row := h.buildPeerRow(p, exitNodeNames[p.ExitNodeID], allPeerStats[p.PublicKey])
-		data.Peers = append(data.Peers, row)
-	}
-	return data
-}
-
 func (h *handler) buildPeerRow(peer models.Peer, exitNodeName string, stats wgstats.PeerStats) peerRowData {
 	row := peerRowData{
 		Peer: peer, ID: peer.ID, AllowedIPs: peer.AllowedIPs, CreatedAt: peer.CreatedAt,
@@ -101,15 +109,28 @@ func (h *handler) buildPeerRow(peer models.Peer, exitNodeName string, stats wgst
 		}
 	}
 	row.LastSeen = wgstats.FormatHandshake(lastSeen)
+	row.ExpiresOn = models.ExpiryDate(peer.ExpiresAt, time.Local)
 	if !lastSeen.IsZero() {
 		row.LastSeenAt = lastSeen.UTC().Format(time.RFC3339)
 	}
+	used := wgstats.FormatBytes(int64(peer.Usage.CurrentTotal(peer.Quota, time.Now())))
+	if peer.Quota.Limit > 0 {
+		row.Usage = fmt.Sprintf("%s / %s %s", used, wgstats.FormatBytes(int64(peer.Quota.Limit)), peer.Quota.PeriodName())
+		row.QuotaExceeded = peer.Usage.Exceeded
+	} else {
+		row.Usage = used + " this month"
+	}
+	if r, ok := h.probes.Result(peer.ID); ok {
+		row.Probe = probe.Format(r)
+		row.ProbeTitle = fmt.Sprintf("ping %s at %s", r.Target, r.Time.Local().Format(time.TimeOnly))
+		row.ProbeLossy = r.Received < r.Sent || r.Error != ""
+	}
 	return row
 }
 
-// ListPeers returns the peers list data.
+// ListPeers returns the peers list data, filtered by ?tag= when given.
 func (h *handler) ListPeers(w http.ResponseWriter, r *http.Request) {
-	data := h.buildPeersListData()
+	data := h.buildPeersListData(peerListQueryFrom(r))
 	writePageJSON(w, http.StatusOK, "peers-list", data, nil)
 }
 
@@ -129,7 +150,10 @@ func (h *handler) GetPeerForm(w http.ResponseWriter, r *http.Request) {
 		}
 		data.ExitNodes = models.ExitNodePeers(cfg.Peers)
 		data.Gateways = models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())
+		data.ProbeMode = cfg.Server.ProbeMode
 	})
+	data.QuotaLimit = formatQuotaLimit(data.Peer.Quota.Limit)
+	data.ExpiresOn = models.ExpiryDate(data.Peer.ExpiresAt, time.Local)
 
 	if !isNew && data.Peer.ID == "" {
 		writePageError(w, http.StatusNotFound, fmt.Errorf("peer not found"))
@@ -173,8 +197,11 @@ func (h *handler) CreatePeer(w http.ResponseWriter, r *http.Request) {
 	exitNodeRoutes := parseRouteList(r.FormValue("exitNodeRoutes"))
 	advertisedRoutes := parseRouteList(r.FormValue("advertisedRoutes"))
 	policyRoutes := parseRouteList(r.FormValue("policyRoutes"))
+	quota, quotaErrs := parseQuotaForm(r)
+	rateLimit, exitNodeShared := parseRateLimitForm(r, isExitNode)
+	expiresAt, expiryErrs := parseExpiryForm(r)
 
-	id, err := newPeerID()
+	id, err := models.NewID()
 	if err != nil {
 		writePageError(w, http.StatusInternalServerError, fmt.Errorf("ID generation failed: %w", err))
 		return
@@ -182,46 +209,61 @@ func (h *handler) CreatePeer(w http.ResponseWriter, r *http.Request) {
 
 	now := time.Now().UTC()
 	peer := models.Peer{
-		ID:                  id,
-		Name:                strings.TrimSpace(r.FormValue("name")),
-		PrivateKey:          privKey,
-		PublicKey:           pubKey,
-		PresharedKey:        psk,
-		AllowedIPs:          strings.TrimSpace(r.FormValue("allowedIPs")),
-		Endpoint:            strings.TrimSpace(r.FormValue("endpoint")),
-		PersistentKeepalive: uint16(keepalive),
-		DNS:                 strings.TrimSpace(r.FormValue("dns")),
-		ClientAllowedIPs:    strings.TrimSpace(r.FormValue("clientAllowedIPs")),
-		IsExitNode:          isExitNode,
-		ExitNodeID:          exitNodeID,
-		ExitNodeAllowAll:    exitNodeAllowAll,
-		ExitNodeRoutes:      exitNodeRoutes,
-		AdvertisedRoutes:    advertisedRoutes,
-		PolicyRoutes:        policyRoutes,
-		StrictPolicyRouting: r.FormValue("strictPolicyRouting") == "on",
-		Enabled:             r.FormValue("enabled") == "on",
-		CreatedAt:           now,
-		UpdatedAt:           now,
+		ID:                      id,
+		Name:                    strings.TrimSpace(r.FormValue("name")),
+		PrivateKey:              privKey,
+		PublicKey:               pubKey,
+		PresharedKey:            psk,
+		AllowedIPs:              strings.TrimSpace(r.FormValue("allowedIPs")),
+		Endpoint:                strings.TrimSpace(r.FormValue("endpoint")),
+		PersistentKeepalive:     uint16(keepalive),
+		DNS:                     strings.TrimSpace(r.FormValue("dns")),
+		ClientAllowedIPs:        strings.TrimSpace(r.FormValue("clientAllowedIPs")),
+		IsExitNode:              isExitNode,
+		ExitNodeID:              exitNodeID,
+		ExitNodeAllowAll:        exitNodeAllowAll,
+		ExitNodeRoutes:          exitNodeRoutes,
+		AdvertisedRoutes:        advertisedRoutes,
+		DelegatedPrefix:         strings.TrimSpace(r.FormValue("delegatedPrefix")),
+		AnnounceDelegatedPrefix: r.FormValue("announceDelegatedPrefix") == "on",
+		PolicyRoutes:            policyRoutes,
+		StrictPolicyRouting:     r.FormValue("strictPolicyRouting") == "on",
+		Enabled:                 r.FormValue("enabled") == "on",
+		Tags:                    models.ParseTags(r.FormValue("tags")),
+		Schedule:                parseScheduleForm(r),
+		ExpiresAt:               expiresAt,
+		Quota:                   quota,
+		RateLimit:               rateLimit,
+		ExitNodeSharedKbit:      exitNodeShared,
+		FirewallRules:           parseLineList(r.FormValue("firewallRules")),
+		FirewallDenyByDefault:   r.FormValue("firewallDenyByDefault") == "on",
+		Probe:                   parseProbeForm(r),
+		CreatedAt:               now,
+		UpdatedAt:               now,
 	}
 
+	routed := h.routedNetworks()
 	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
-		// Auto-assign IP if empty.
-		if peer.AllowedIPs == "" {
-			usedIPs := make([]string, len(cfg.Peers))
-			for i, p := range cfg.Peers {
-				usedIPs[i] = p.AllowedIPs
-			}
-			ip, err := ipam.NextAvailableIP(cfg.Server.Address, usedIPs)
-			if err != nil {
-				return fmt.Errorf("auto-assign IP: %w", err)
-			}
-			peer.AllowedIPs = ip
+		// Auto-assign an address from every server subnet the peer has none in.
+		alloc, err := ipam.New(cfg, routed)
+		if err != nil {
+			return fmt.Errorf("auto-assign IP: %w", err)
+		}
+		ips, err := alloc.Assign(peer, "")
+		if err != nil {
+			return fmt.Errorf("auto-assign IP: %w", err)
+		}
+		peer.AllowedIPs = ips
+		delegated, err := alloc.Delegate(peer)
+		if err != nil {
+			return models.ValidationErrors{{Field: "delegatedPrefix", Message: err.Error()}}
 		}
+		peer.DelegatedPrefix = delegated
 
 		assignNewPeerRoutingTables(&peer, cfg.Peers)
 
 		// Validate.
-		if errs := peer.Validate(models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())); len(errs) > 0 {
+		if errs := slices.Concat(peer.Validate(models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())), alloc.Check(peer), quotaErrs, expiryErrs); len(errs) > 0 {
 			return errs
 		}
 
@@ -274,18 +316,27 @@ func (h *handler) UpdatePeer(w http.ResponseWriter, r *http.Request) {
 	exitNodeRoutes := parseRouteList(r.FormValue("exitNodeRoutes"))
 	advertisedRoutes := parseRouteList(r.FormValue("advertisedRoutes"))
 	policyRoutes := parseRouteList(r.FormValue("policyRoutes"))
+	quota, quotaErrs := parseQuotaForm(r)
+	rateLimit, exitNodeShared := parseRateLimitForm(r, isExitNode)
+	expiresAt, expiryErrs := parseExpiryForm(r)
 
 	// Holds what the user submitted, so a rejected edit can be shown back to them
 	// (the store rolls its own copy back on error).
 	var submitted models.Peer
 
+	routed := h.routedNetworks()
 	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		alloc, err := ipam.New(cfg, routed)
+		if err != nil {
+			return err
+		}
 		p := models.FindPeerByID(cfg.Peers, id)
 		if p == nil {
 			return fmt.Errorf("peer not found")
 		}
 
 		wasExitNode := p.IsExitNode
+		previousIPs := p.AllowedIPs
 
 		p.Name = strings.TrimSpace(r.FormValue("name"))
 		p.AllowedIPs = strings.TrimSpace(r.FormValue("allowedIPs"))
@@ -298,11 +349,40 @@ func (h *handler) UpdatePeer(w http.ResponseWriter, r *http.Request) {
 		p.ExitNodeAllowAll = exitNodeAllowAll
 		p.ExitNodeRoutes = exitNodeRoutes
 		p.AdvertisedRoutes = advertisedRoutes
+		p.DelegatedPrefix = strings.TrimSpace(r.FormValue("delegatedPrefix"))
+		p.AnnounceDelegatedPrefix = r.FormValue("announceDelegatedPrefix") == "on"
 		p.PolicyRoutes = policyRoutes
 		p.StrictPolicyRouting = r.FormValue("strictPolicyRouting") == "on"
-		p.Enabled = r.FormValue("enabled") == "on"
+		if enabled := r.FormValue("enabled") == "on"; enabled != p.Enabled {
+			p.Enabled = enabled
+			p.StateReason = models.StateReasonManual
+		}
+		p.Tags = models.ParseTags(r.FormValue("tags"))
+		p.Schedule = parseScheduleForm(r)
+		p.ExpiresAt = expiresAt
+		p.Quota = quota
+		p.RateLimit = rateLimit
+		p.ExitNodeSharedKbit = exitNodeShared
+		p.FirewallRules = parseLineList(r.FormValue("firewallRules"))
+		p.FirewallDenyByDefault = r.FormValue("firewallDenyByDefault") == "on"
+		p.Probe = parseProbeForm(r)
 		p.UpdatedAt = time.Now().UTC()
 
+		// Keep one address per server subnet: an edit that drops or moves one
+		// gets its pair filled in again, from the pool the new tags select.
+		ips, err := alloc.Assign(*p, previousIPs)
+		if err != nil {
+			submitted = *p
+			return models.ValidationErrors{{Field: "allowedIPs", Message: err.Error()}}
+		}
+		p.AllowedIPs = ips
+		delegated, err := alloc.Delegate(*p)
+		if err != nil {
+			submitted = *p
+			return models.ValidationErrors{{Field: "delegatedPrefix", Message: err.Error()}}
+		}
+		p.DelegatedPrefix = delegated
+
 		// Handle exit node transitions.
 		if isExitNode && p.RoutingTableID == 0 {
 			p.RoutingTableID = routing.AssignRoutingTableID(cfg.Peers)
@@ -324,7 +404,7 @@ func (h *handler) UpdatePeer(w http.ResponseWriter, r *http.Request) {
 			models.CascadeClearExitNode(cfg.Peers, id)
 		}
 
-		if errs := p.Validate(models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())); len(errs) > 0 {
+		if errs := slices.Concat(p.Validate(models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())), alloc.Check(*p), quotaErrs, expiryErrs); len(errs) > 0 {
 			submitted = *p
 			return errs
 		}
@@ -386,7 +466,7 @@ func (h *handler) DeletePeer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return full peers list so the UI updates.
-	data := h.buildPeersListData()
+	data := h.buildPeersListData(peerListQueryFrom(r))
 	writePageJSON(w, http.StatusOK, "peers-list", data, warning)
 }
 
@@ -401,14 +481,7 @@ func (h *handler) TogglePeer(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("peer not found")
 		}
 
-		p.Enabled = !p.Enabled
-		p.UpdatedAt = time.Now().UTC()
-
-		// If disabling an exit node, cascade clear.
-		if !p.Enabled && p.IsExitNode {
-			models.CascadeClearExitNode(cfg.Peers, id)
-		}
-
+		p = models.SetPeerEnabled(cfg.Peers, id, !p.Enabled, models.StateReasonManual, time.Now())
 		peer = *p
 		return nil
 	})
@@ -461,6 +534,7 @@ func (h *handler) RegeneratePeerKeys(w http.ResponseWriter, r *http.Request) {
 
 		p.PrivateKey = privKey
 		p.PublicKey = pubKey
+		p.KeyHeld = false
 		p.LastSeen = time.Time{}
 		p.UpdatedAt = time.Now().UTC()
 		return nil
@@ -484,7 +558,10 @@ func (h *handler) RegeneratePeerKeys(w http.ResponseWriter, r *http.Request) {
 		}
 		data.ExitNodes = models.ExitNodePeers(cfg.Peers)
 		data.Gateways = models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())
+		data.ProbeMode = cfg.Server.ProbeMode
 	})
+	data.QuotaLimit = formatQuotaLimit(data.Peer.Quota.Limit)
+	data.ExpiresOn = models.ExpiryDate(data.Peer.ExpiresAt, time.Local)
 	writePageJSON(w, http.StatusOK, "peer-form", data, warning)
 }
 
@@ -499,17 +576,19 @@ func (h *handler) renderPeerFormError(w http.ResponseWriter, data peerFormData,
 	h.store.Read(func(cfg *models.AppConfig) {
 		data.ExitNodes = models.ExitNodePeers(cfg.Peers)
 		data.Gateways = models.GatewayNets(cfg.Server.Address, h.ztGatewayNets())
+		data.ProbeMode = cfg.Server.ProbeMode
 	})
+	data.QuotaLimit = formatQuotaLimit(data.Peer.Quota.Limit)
+	data.ExpiresOn = models.ExpiryDate(data.Peer.ExpiresAt, time.Local)
 	writePageJSON(w, http.StatusUnprocessableEntity, "peer-form", data, nil)
 }
 
-// newPeerID returns a random opaque ID for a new peer.
-func newPeerID() (string, error) {
-	var b [16]byte
-	if _, err := rand.Read(b[:]); err != nil {
-		return "", err
+// parseProbeForm reads the reachability probe fields.
+func parseProbeForm(r *http.Request) models.PeerProbe {
+	return models.PeerProbe{
+		Enabled: r.FormValue("probeEnabled") == "on",
+		Target:  strings.TrimSpace(r.FormValue("probeTarget")),
 	}
-	return hex.EncodeToString(b[:]), nil
 }
 
 // parseRouteList splits a routes textarea into entries. Browsers submit CRLF,
@@ -525,8 +604,93 @@ func parseRouteList(s string) []string {
 	return out
 }
 
+// parseScheduleForm reads the access schedule fields. Windows are one per line:
+// unlike routes they may contain commas ("sat,sun 10:00-14:00").
+func parseScheduleForm(r *http.Request) models.AccessSchedule {
+	schedule := models.AccessSchedule{
+		Enabled:  r.FormValue("scheduleEnabled") == "on",
+		Timezone: strings.TrimSpace(r.FormValue("scheduleTimezone")),
+	}
+	schedule.Windows = parseLineList(r.FormValue("scheduleWindows"))
+	return schedule
+}
+
+// parseExpiryForm reads the expiry date, the last day of access in server
+// local time, like access schedules without a timezone.
+func parseExpiryForm(r *http.Request) (time.Time, models.ValidationErrors) {
+	expiresAt, err := models.ParseExpiry(r.FormValue("expiresOn"), time.Local)
+	if err != nil {
+		return time.Time{}, models.ValidationErrors{{Field: "expiresOn", Message: err.Error()}}
+	}
+	return expiresAt, nil
+}
+
+// parseLineList splits a textarea into one entry per line, collapsing runs of
+// whitespace. For fields whose entries may contain commas themselves.
+func parseLineList(s string) []string {
+	var out []string
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// parseQuotaForm reads the data quota fields. A limit or throttle rate that
+// does not parse is returned as a validation error, so it is reported with the
+// peer's others.
+func parseQuotaForm(r *http.Request) (models.PeerQuota, models.ValidationErrors) {
+	var errs models.ValidationErrors
+	limit, err := models.ParseByteSize(r.FormValue("quotaLimit"))
+	if err != nil {
+		errs = append(errs, models.ValidationError{Field: "quotaLimit", Message: "must be a size such as 500 MB or 50 GB"})
+	}
+	var throttle uint64
+	if raw := strings.TrimSpace(r.FormValue("quotaThrottleKbit")); raw != "" {
+		if throttle, err = strconv.ParseUint(raw, 10, 32); err != nil {
+			errs = append(errs, models.ValidationError{Field: "quotaThrottleKbit", Message: "must be a whole number of kbit/s"})
+		}
+	}
+	return models.PeerQuota{
+		Limit:        limit,
+		Period:       r.FormValue("quotaPeriod"),
+		Action:       r.FormValue("quotaAction"),
+		ThrottleKbit: uint32(throttle),
+	}, errs
+}
+
+// parseRateLimitForm reads the bandwidth limit fields, in kbit/s. Only an exit
+// node keeps a shared cap for the peers routed through it.
+func parseRateLimitForm(r *http.Request, isExitNode bool) (models.RateLimit, uint32) {
+	upload, _ := strconv.ParseUint(strings.TrimSpace(r.FormValue("rateLimitUpload")), 10, 32)
+	download, _ := strconv.ParseUint(strings.TrimSpace(r.FormValue("rateLimitDownload")), 10, 32)
+	var shared uint64
+	if isExitNode {
+		shared, _ = strconv.ParseUint(strings.TrimSpace(r.FormValue("exitNodeSharedKbit")), 10, 32)
+	}
+	return models.RateLimit{UploadKbit: uint32(upload), DownloadKbit: uint32(download)}, uint32(shared)
+}
+
+// formatQuotaLimit renders a limit for the size input in the largest unit that
+// divides it exactly, so saving the form again never rounds the limit.
+func formatQuotaLimit(limit uint64) string {
+	if limit == 0 {
+		return ""
+	}
+	for _, unit := range []struct {
+		name string
+		size uint64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if limit%unit.size == 0 {
+			return fmt.Sprintf("%d %s", limit/unit.size, unit.name)
+		}
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
 func (h *handler) listPeersOOB(w http.ResponseWriter, r *http.Request, warning *toastData) {
-	data := h.buildPeersListData()
+	data := h.buildPeersListData(peerListQueryFrom(r))
 	data.OOB = true
 	writePageJSON(w, http.StatusOK, "peers-list", data, warning)
 }
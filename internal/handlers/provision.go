@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/provision"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// provisionFormData is the template data for the bulk provisioning dialog.
+type provisionFormData struct {
+	Content   string
+	Error     string
+	RowErrors provision.Errors
+	// Created lists the peers just created, for the configs download; List
+	// refreshes the peers list behind the dialog.
+	Created []models.Peer
+	List    *peersListData
+}
+
+// GetProvisionForm handles GET /peers/provision.
+func (h *handler) GetProvisionForm(w http.ResponseWriter, r *http.Request) {
+	writePageJSON(w, http.StatusOK, "provision-form", provisionFormData{}, nil)
+}
+
+// provisionPeers creates the peers in the uploaded or pasted list in one
+// store write. The content is returned so a rejected list can be shown again.
+func (h *handler) provisionPeers(w http.ResponseWriter, r *http.Request) ([]models.Peer, string, error) {
+	content, err := readUpload(w, r)
+	if err != nil {
+		return nil, content, err
+	}
+	if content == "" {
+		return nil, content, fmt.Errorf("paste a list or choose a file")
+	}
+	rows, err := provision.Parse(content)
+	if err != nil {
+		return nil, content, err
+	}
+	var created []models.Peer
+	routed := h.routedNetworks()
+	err = h.store.Write(func(cfg *models.AppConfig) error {
+		var err error
+		created, err = provision.Create(cfg, rows, routed, time.Now())
+		return err
+	})
+	return created, content, err
+}
+
+// ProvisionPeers handles POST /peers/provision: the dialog then offers the
+// new peers' configs as one download.
+func (h *handler) ProvisionPeers(w http.ResponseWriter, r *http.Request) {
+	created, content, err := h.provisionPeers(w, r)
+	toast := &toastData{Kind: "success", Message: fmt.Sprintf("Created %d peer(s)", len(created))}
+	if err != nil {
+		logRejected(r, err)
+		warning, ok := applyWarning(err)
+		if !ok {
+			data := provisionFormData{Content: content}
+			if !errors.As(err, &data.RowErrors) {
+				data.Error = err.Error()
+			}
+			writePageJSON(w, http.StatusUnprocessableEntity, "provision-form", data, nil)
+			return
+		}
+		toast = &warning
+	}
+	list := h.buildPeersListData(peerListQueryFrom(r))
+	list.OOB = true
+	writePageJSON(w, http.StatusOK, "provision-form", provisionFormData{Created: created, List: &list}, toast)
+}
+
+// ProvisionPeersZip handles POST /api/peers/provision, for scripts: it
+// creates the peers and responds with their configs zip directly.
+func (h *handler) ProvisionPeersZip(w http.ResponseWriter, r *http.Request) {
+	created, _, err := h.provisionPeers(w, r)
+	if _, ok := applyWarning(err); err != nil && !ok {
+		logRejected(r, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	h.writeConfigsZip(w, created)
+}
+
+// DownloadConfigsZip handles POST /api/peers/configs: a zip of the client
+// config and QR code of each peer in ids.
+func (h *handler) DownloadConfigsZip(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var peers []models.Peer
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, id := range r.Form["ids"] {
+			if p := models.FindPeerByID(cfg.Peers, id); p != nil {
+				peers = append(peers, *p)
+			}
+		}
+	})
+	if len(peers) == 0 {
+		http.Error(w, "no peers selected", http.StatusNotFound)
+		return
+	}
+	h.writeConfigsZip(w, peers)
+}
+
+// writeConfigsZip responds with NAME.conf and NAME.png for each peer. Peers
+// whose private key only their device knows have no config and are skipped.
+func (h *handler) writeConfigsZip(w http.ResponseWriter, peers []models.Peer) {
+	var server models.ServerConfig
+	h.store.Read(func(cfg *models.AppConfig) { server = cfg.Server })
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "wg-busy-peers-"+time.Now().Format("20060102-150405")+".zip"))
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, peer := range peers {
+		content, err := wireguard.RenderClientConfig(server, peer)
+		if errors.Is(err, wireguard.ErrNoPrivateKey) {
+			continue
+		}
+		if err == nil {
+			err = writeConfigFiles(zw, names, peer, content)
+		}
+		if err != nil {
+			// The status is already sent; a truncated zip is the best signal left.
+			log.Printf("writing configs zip: peer %q: %v", peer.Name, err)
+			return
+		}
+	}
+	_ = zw.Close()
+}
+
+func writeConfigFiles(zw *zip.Writer, names map[string]bool, peer models.Peer, content string) error {
+	name := configFileName(peer)
+	if names[name] {
+		name += "-" + peer.ID[:min(6, len(peer.ID))]
+	}
+	names[name] = true
+
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return fmt.Errorf("QR generation failed: %w", err)
+	}
+	f, err := zw.Create(name + ".conf")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		return err
+	}
+	if f, err = zw.Create(name + ".png"); err != nil {
+		return err
+	}
+	_, err = f.Write(png)
+	return err
+}
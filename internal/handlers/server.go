@@ -12,6 +12,8 @@ import (
 // serverFormData is the template data for the server config form.
 type serverFormData struct {
 	Server           models.ServerConfig
+	Addresses        addressUsage
+	Webhooks         webhooksData
 	Success          string
 	Error            string
 	ValidationErrors models.ValidationErrors
@@ -20,9 +22,12 @@ type serverFormData struct {
 // GetServerConfig returns the server settings data.
 func (h *handler) GetServerConfig(w http.ResponseWriter, r *http.Request) {
 	var data serverFormData
+	routed := h.routedNetworks()
 	h.store.Read(func(cfg *models.AppConfig) {
 		data.Server = cfg.Server
+		data.Addresses = buildAddressUsage(cfg, routed)
 	})
+	data.Webhooks = h.buildWebhooksData()
 
 	writePageJSON(w, http.StatusOK, "server-config", data, nil)
 }
@@ -51,6 +56,13 @@ func (h *handler) UpdateServerConfig(w http.ResponseWriter, r *http.Request) {
 		cfg.Server.PostUp = r.FormValue("postUp")
 		cfg.Server.PreDown = r.FormValue("preDown")
 		cfg.Server.PostDown = r.FormValue("postDown")
+		cfg.Server.IsolatePeers = r.FormValue("isolatePeers") == "on"
+		cfg.Server.DeriveIPv6 = r.FormValue("deriveIPv6") == "on"
+		cfg.Server.ProbeMode = r.FormValue("probeMode")
+		cfg.Server.RepairRouting = r.FormValue("repairRouting") == "on"
+		cfg.Server.AddressPools = parseLineList(r.FormValue("addressPools"))
+		cfg.Server.ReservedAddresses = parseLineList(r.FormValue("reservedAddresses"))
+		cfg.Server.DelegationPool = strings.TrimSpace(r.FormValue("delegationPool"))
 		// Capture what was submitted before validating: the store rolls its copy
 		// back on error, and the form has to show the user their own input.
 		data.Server = cfg.Server
@@ -62,6 +74,12 @@ func (h *handler) UpdateServerConfig(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	routed := h.routedNetworks()
+	h.store.Read(func(cfg *models.AppConfig) {
+		data.Addresses = buildAddressUsage(cfg, routed)
+	})
+	data.Webhooks = h.buildWebhooksData()
+
 	if writeErr != nil {
 		logRejected(r, writeErr)
 		if ve, ok := writeErr.(models.ValidationErrors); ok {
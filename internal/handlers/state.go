@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yix/wg-busy/internal/declarative"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// maxStateSize bounds a desired state document.
+const maxStateSize = 4 << 20
+
+// stateResponse is the JSON reply of POST /api/state.
+type stateResponse struct {
+	DryRun  bool                 `json:"dryRun"`
+	Changes []declarative.Change `json:"changes"`
+	// Warning is set when the state was saved but not fully applied live.
+	Warning string `json:"warning,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func writeStateJSON(w http.ResponseWriter, status int, resp stateResponse) {
+	if resp.Changes == nil {
+		resp.Changes = []declarative.Change{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ApplyState handles POST /api/state: it makes the peers and BGP peers match
+// the desired state in the body, YAML or JSON, and returns the change set.
+// With ?dryRun=true nothing is saved.
+func (h *handler) ApplyState(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil {
+		writeStateJSON(w, http.StatusBadRequest, stateResponse{DryRun: dryRun, Error: err.Error()})
+		return
+	}
+	state, err := declarative.Parse(body)
+	if err != nil {
+		writeStateJSON(w, http.StatusUnprocessableEntity, stateResponse{DryRun: dryRun, Error: err.Error()})
+		return
+	}
+
+	// Plan on a snapshot first: a state already in place must not cost a
+	// Store.Write, which would reload wg0 on every run of a GitOps loop.
+	var changes []declarative.Change
+	routed := h.routedNetworks()
+	h.store.Read(func(cfg *models.AppConfig) {
+		changes, err = declarative.Apply(cfg, state, routed, time.Now())
+		if err == nil {
+			if errs := models.ValidateConfig(*cfg); len(errs) > 0 {
+				err = errs
+			}
+		}
+	})
+	if err != nil {
+		logRejected(r, err)
+		writeStateJSON(w, http.StatusUnprocessableEntity, stateResponse{DryRun: dryRun, Error: err.Error()})
+		return
+	}
+	if dryRun || len(changes) == 0 {
+		writeStateJSON(w, http.StatusOK, stateResponse{DryRun: dryRun, Changes: changes})
+		return
+	}
+
+	err = h.store.Write(func(cfg *models.AppConfig) error {
+		var err error
+		changes, err = declarative.Apply(cfg, state, routed, time.Now())
+		return err
+	})
+	if err != nil {
+		if warning, ok := applyWarning(err); ok {
+			writeStateJSON(w, http.StatusOK, stateResponse{Changes: changes, Warning: warning.Message})
+			return
+		}
+		logRejected(r, err)
+		writeStateJSON(w, http.StatusUnprocessableEntity, stateResponse{Error: err.Error()})
+		return
+	}
+	writeStateJSON(w, http.StatusOK, stateResponse{Changes: changes})
+}
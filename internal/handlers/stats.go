@@ -22,6 +22,8 @@ type statsBarData struct {
 	CurrentRxPS  string
 	CurrentTxPS  string
 	SparklineSVG string
+	// RoutingDrift counts the installed routing entries the kernel lost.
+	RoutingDrift int
 	Peers        []peerLiveData   `json:",omitempty"`
 	BGPStats     *models.BGPStats `json:",omitempty"`
 }
@@ -29,41 +31,45 @@ type statsBarData struct {
 // peerLiveData is deliberately smaller than peerRowData: the two-second peers
 // refresh must not resend keys, routing policy, and other form-only settings.
 type peerLiveData struct {
-	ID           string
-	AllowedIPs   string
-	CreatedAt    time.Time
-	TransferRx   string
-	TransferTx   string
-	CurrentRxPS  string
-	CurrentTxPS  string
-	LastSeen     string
-	LastSeenAt   string
-	SparklineSVG string
-	HasStats     bool
+	ID            string
+	AllowedIPs    string
+	CreatedAt     time.Time
+	TransferRx    string
+	TransferTx    string
+	CurrentRxPS   string
+	CurrentTxPS   string
+	LastSeen      string
+	LastSeenAt    string
+	SparklineSVG  string
+	HasStats      bool
+	Usage         string
+	QuotaExceeded bool
+	Probe         string
+	ProbeTitle    string
+	ProbeLossy    bool
 }
 
 // GetCombinedStats returns the title stats plus only the live data needed by
 // the active tab. Peer and BGP updates are rendered as out-of-band swaps.
 func (h *handler) GetCombinedStats(w http.ResponseWriter, r *http.Request) {
-	var data statsBarData
+	data := h.buildStatsBar()
 	switch r.URL.Query().Get("kind") {
 	case "bgp":
 		data.BGPStats = bgp.GetBGPStats()
-	case "server", "zerotier":
+	case "server", "zerotier", "alerts", "diagnostics":
 		// These tabs need only the interface summary in the title.
 	default:
 		// Keep peers as the default for the initial page and old clients.
-		for _, row := range h.buildPeersListData().Peers {
-			data.Peers = append(data.Peers, peerLiveData{
-				ID: row.ID, AllowedIPs: row.AllowedIPs, CreatedAt: row.CreatedAt,
-				TransferRx: row.TransferRx, TransferTx: row.TransferTx,
-				CurrentRxPS: row.CurrentRxPS, CurrentTxPS: row.CurrentTxPS,
-				LastSeen: row.LastSeen, LastSeenAt: row.LastSeenAt,
-				SparklineSVG: row.SparklineSVG, HasStats: row.HasStats,
-			})
+		for _, row := range h.buildPeersListData(peerListQueryFrom(r)).Peers {
+			data.Peers = append(data.Peers, livePeerData(row))
 		}
 	}
+	writePageJSON(w, http.StatusOK, "stats-bar", data, nil)
+}
 
+// buildStatsBar returns the interface summary shown in the title on every tab.
+func (h *handler) buildStatsBar() statsBarData {
+	var data statsBarData
 	if h.stats != nil {
 		iface := h.stats.GetInterfaceStats()
 		data.IsUp = h.stats.IsUp()
@@ -74,8 +80,20 @@ func (h *handler) GetCombinedStats(w http.ResponseWriter, r *http.Request) {
 		data.CurrentTxPS = wgstats.FormatBytesPerSec(iface.CurrentTxPS)
 		data.SparklineSVG = wgstats.RenderSparklineSVG(h.stats.GetHistory(), 120, 24)
 	}
+	data.RoutingDrift = len(h.drifts.Status().Drift)
+	return data
+}
 
-	writePageJSON(w, http.StatusOK, "stats-bar", data, nil)
+func livePeerData(row peerRowData) peerLiveData {
+	return peerLiveData{
+		ID: row.ID, AllowedIPs: row.AllowedIPs, CreatedAt: row.CreatedAt,
+		TransferRx: row.TransferRx, TransferTx: row.TransferTx,
+		CurrentRxPS: row.CurrentRxPS, CurrentTxPS: row.CurrentTxPS,
+		LastSeen: row.LastSeen, LastSeenAt: row.LastSeenAt,
+		SparklineSVG: row.SparklineSVG, HasStats: row.HasStats,
+		Usage: row.Usage, QuotaExceeded: row.QuotaExceeded,
+		Probe: row.Probe, ProbeTitle: row.ProbeTitle, ProbeLossy: row.ProbeLossy,
+	}
 }
 
 // QRCode handles GET /api/peers/{id}/qr.
@@ -96,7 +114,7 @@ func (h *handler) QRCode(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if genErr != nil {
-		http.Error(w, genErr.Error(), http.StatusInternalServerError)
+		writeClientConfigError(w, genErr)
 		return
 	}
 
@@ -121,11 +139,12 @@ func (h *handler) QRCode(w http.ResponseWriter, r *http.Request) {
 func (h *handler) QRCodeModal(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	var peerName string
+	var keyHeld bool
 
 	h.store.Read(func(cfg *models.AppConfig) {
 		peer := models.FindPeerByID(cfg.Peers, id)
 		if peer != nil {
-			peerName = peer.Name
+			peerName, keyHeld = peer.Name, peer.KeyHeld
 		}
 	})
 
@@ -133,6 +152,10 @@ func (h *handler) QRCodeModal(w http.ResponseWriter, r *http.Request) {
 		writePageError(w, http.StatusNotFound, fmt.Errorf("peer not found"))
 		return
 	}
+	if keyHeld {
+		writePageError(w, http.StatusConflict, wireguard.ErrNoPrivateKey)
+		return
+	}
 
 	data := struct {
 		ID   string
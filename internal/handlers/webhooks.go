@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/webhook"
+)
+
+// webhookRow is one webhook in the Server tab's list.
+type webhookRow struct {
+	models.Webhook
+	// Host is all the list shows of the URL: chat webhook URLs carry their
+	// token in the path.
+	Host string
+	// Last is the latest delivery attempt, if any.
+	Last *deliveryRow
+}
+
+// deliveryRow is a delivery attempt as the UI shows it.
+type deliveryRow struct {
+	webhook.Delivery
+	When string
+	OK   bool
+}
+
+// webhooksData is the template data of the webhooks list on the Server tab.
+type webhooksData struct {
+	Hooks []webhookRow
+	OOB   bool
+}
+
+// webhookFormData is the template data of the webhook create or edit dialog.
+type webhookFormData struct {
+	IsNew            bool
+	Hook             models.Webhook
+	Events           []webhookEventChoice
+	Formats          []string
+	Error            string
+	ValidationErrors models.ValidationErrors
+}
+
+type webhookEventChoice struct {
+	Type    string
+	Checked bool
+}
+
+// webhookDeliveriesData is the template data of the delivery log dialog.
+type webhookDeliveriesData struct {
+	Name       string
+	Deliveries []deliveryRow
+}
+
+func newDeliveryRow(d webhook.Delivery) deliveryRow {
+	return deliveryRow{Delivery: d, When: d.Time.Local().Format(historyTimeLayout + ":05"), OK: d.OK()}
+}
+
+func (h *handler) buildWebhooksData() webhooksData {
+	var data webhooksData
+	h.store.Read(func(cfg *models.AppConfig) {
+		for _, hook := range cfg.Webhooks {
+			row := webhookRow{Webhook: hook}
+			if u, err := url.Parse(hook.URL); err == nil {
+				row.Host = u.Host
+			}
+			if h.notifier != nil {
+				if deliveries := h.notifier.Deliveries(hook.ID); len(deliveries) > 0 {
+					last := newDeliveryRow(deliveries[0])
+					row.Last = &last
+				}
+			}
+			data.Hooks = append(data.Hooks, row)
+		}
+	})
+	return data
+}
+
+func newWebhookFormData(isNew bool, hook models.Webhook) webhookFormData {
+	data := webhookFormData{IsNew: isNew, Hook: hook, Formats: models.WebhookFormats}
+	for _, event := range models.WebhookEvents {
+		data.Events = append(data.Events, webhookEventChoice{Type: event, Checked: slices.Contains(hook.Events, event)})
+	}
+	return data
+}
+
+// GetWebhookForm returns the webhook create or edit dialog.
+func (h *handler) GetWebhookForm(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	hook := models.Webhook{Enabled: true, Format: models.WebhookFormatJSON}
+	if id != "" {
+		var found bool
+		h.store.Read(func(cfg *models.AppConfig) {
+			if p := models.FindWebhookByID(cfg.Webhooks, id); p != nil {
+				hook, found = *p, true
+			}
+		})
+		if !found {
+			writePageError(w, http.StatusNotFound, fmt.Errorf("webhook not found"))
+			return
+		}
+	}
+	writePageJSON(w, http.StatusOK, "webhook-form", newWebhookFormData(id == "", hook), nil)
+}
+
+// parseWebhookForm fills the submitted fields into hook.
+func parseWebhookForm(r *http.Request, hook *models.Webhook) {
+	hook.Name = strings.TrimSpace(r.FormValue("name"))
+	hook.Enabled = r.FormValue("enabled") == "on"
+	hook.URL = strings.TrimSpace(r.FormValue("webhookURL"))
+	hook.Secret = strings.TrimSpace(r.FormValue("webhookSecret"))
+	hook.Format = r.FormValue("webhookFormat")
+	hook.Events = r.Form["webhookEvents"]
+	hook.UpdatedAt = time.Now().UTC()
+}
+
+// CreateWebhook handles POST /webhooks.
+func (h *handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	id, err := models.NewID()
+	if err != nil {
+		writePageError(w, http.StatusInternalServerError, fmt.Errorf("ID generation failed: %w", err))
+		return
+	}
+	hook := models.Webhook{ID: id}
+	parseWebhookForm(r, &hook)
+	hook.CreatedAt = hook.UpdatedAt
+
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		if errs := hook.Validate(); len(errs) > 0 {
+			return errs
+		}
+		cfg.Webhooks = append(cfg.Webhooks, hook)
+		return nil
+	})
+	h.finishWebhookWrite(w, r, true, hook, writeErr)
+}
+
+// UpdateWebhook handles PUT /webhooks/{id}.
+func (h *handler) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writePageError(w, http.StatusBadRequest, fmt.Errorf("bad request"))
+		return
+	}
+	var submitted models.Webhook
+	writeErr := h.store.Write(func(cfg *models.AppConfig) error {
+		hook := models.FindWebhookByID(cfg.Webhooks, r.PathValue("id"))
+		if hook == nil {
+			return errWebhookNotFound
+		}
+		parseWebhookForm(r, hook)
+		submitted = *hook
+		if errs := hook.Validate(); len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
+	if errors.Is(writeErr, errWebhookNotFound) {
+		writePageError(w, http.StatusNotFound, writeErr)
+		return
+	}
+	h.finishWebhookWrite(w, r, false, submitted, writeErr)
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// finishWebhookWrite answers a create or update: the refreshed list, or the
+// form again with what was wrong.
+func (h *handler) finishWebhookWrite(w http.ResponseWriter, r *http.Request, isNew bool, hook models.Webhook, writeErr error) {
+	if writeErr == nil {
+		h.listWebhooksOOB(w, nil)
+		return
+	}
+	logRejected(r, writeErr)
+	if warning, ok := applyWarning(writeErr); ok {
+		h.listWebhooksOOB(w, &warning)
+		return
+	}
+	data := newWebhookFormData(isNew, hook)
+	if ve, ok := writeErr.(models.ValidationErrors); ok {
+		data.ValidationErrors = ve
+	} else {
+		data.Error = writeErr.Error()
+	}
+	writePageJSON(w, http.StatusUnprocessableEntity, "webhook-form", data, nil)
+}
+
+// DeleteWebhook handles DELETE /webhooks/{id}.
+func (h *handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := h.store.Write(func(cfg *models.AppConfig) error {
+		i := slices.IndexFunc(cfg.Webhooks, func(hook models.Webhook) bool { return hook.ID == id })
+		if i == -1 {
+			return errWebhookNotFound
+		}
+		cfg.Webhooks = slices.Delete(cfg.Webhooks, i, i+1)
+		return nil
+	})
+
+	var warning *toastData
+	if err != nil {
+		if value, ok := applyWarning(err); ok {
+			warning = &value
+		} else if errors.Is(err, errWebhookNotFound) {
+			writePageError(w, http.StatusNotFound, err)
+			return
+		} else {
+			writePageError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	h.listWebhooksOOB(w, warning)
+}
+
+// TestWebhook handles POST /webhooks/{id}/test: it sends a test event now and
+// reports how the receiver answered.
+func (h *handler) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook *models.Webhook
+	h.store.Read(func(cfg *models.AppConfig) { hook = models.FindWebhookByID(cfg.Webhooks, r.PathValue("id")) })
+	if hook == nil {
+		writePageError(w, http.StatusNotFound, errWebhookNotFound)
+		return
+	}
+	if h.notifier == nil {
+		writePageError(w, http.StatusServiceUnavailable, errors.New("webhooks are not running"))
+		return
+	}
+
+	d := h.notifier.Test(r.Context(), *hook)
+	toast := toastData{Kind: "success", Message: fmt.Sprintf("Test event delivered to %s (HTTP %d).", hook.Name, d.Status)}
+	if !d.OK() {
+		toast = toastData{Kind: "error", Message: fmt.Sprintf("Test event to %s failed: %s", hook.Name, d.Error)}
+	}
+	h.listWebhooksOOB(w, &toast)
+}
+
+// GetWebhookDeliveries handles GET /webhooks/{id}/deliveries: the delivery
+// log dialog.
+func (h *handler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	var hook *models.Webhook
+	h.store.Read(func(cfg *models.AppConfig) { hook = models.FindWebhookByID(cfg.Webhooks, r.PathValue("id")) })
+	if hook == nil {
+		writePageError(w, http.StatusNotFound, errWebhookNotFound)
+		return
+	}
+	data := webhookDeliveriesData{Name: hook.Name}
+	if h.notifier != nil {
+		for _, d := range h.notifier.Deliveries(hook.ID) {
+			data.Deliveries = append(data.Deliveries, newDeliveryRow(d))
+		}
+	}
+	writePageJSON(w, http.StatusOK, "webhook-deliveries", data, nil)
+}
+
+// GetWebhookDeliveriesJSON handles GET /api/webhooks/deliveries?webhook=ID:
+// the latest delivery attempts, newest first, of one webhook or all of them.
+func (h *handler) GetWebhookDeliveriesJSON(w http.ResponseWriter, r *http.Request) {
+	deliveries := []webhook.Delivery{}
+	if h.notifier != nil {
+		deliveries = append(deliveries, h.notifier.Deliveries(r.URL.Query().Get("webhook"))...)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(struct {
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}{deliveries})
+}
+
+func (h *handler) listWebhooksOOB(w http.ResponseWriter, toast *toastData) {
+	data := h.buildWebhooksData()
+	data.OOB = true
+	writePageJSON(w, http.StatusOK, "webhooks-list", data, toast)
+}
@@ -0,0 +1,475 @@
+// Package history keeps long-range traffic history for the WireGuard interface
+// and each peer. wgstats holds only the last two minutes in memory; this store
+// sums the same per-poll byte deltas into coarser buckets the further back they
+// go, and persists them so a restart does not lose last week. Peers' probe
+// results are bucketed alongside their traffic.
+//
+// Memory is bounded by the tiers: a peer with traffic in every bucket holds
+// MaxBuckets points. The file is appended to rather than rewritten, like the
+// connection log, and compacted once stale lines outnumber live ones.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// Tier is one resolution the store keeps: buckets of Step, for Retention.
+// Only Persisted tiers are saved; the others start empty after a restart.
+type Tier struct {
+	Step      time.Duration
+	Retention time.Duration
+	Persisted bool
+}
+
+// Tiers are kept from finest to coarsest. Every tier is fed from the same
+// deltas, so a coarse bucket is exact, not an average of averages. The chart
+// draws at most 360 points, so finer buckets would only cost memory, and
+// nothing older than the longest Range is ever queried: hourly buckets are
+// kept 31 days, not a year, since a year of them would be 8,761 points per
+// series, over a gigabyte for 2,000 busy peers, none of it ever charted.
+var Tiers = []Tier{
+	{Step: 10 * time.Second, Retention: time.Hour, Persisted: true},
+	{Step: 5 * time.Minute, Retention: 24 * time.Hour, Persisted: true},
+	{Step: time.Hour, Retention: 31 * 24 * time.Hour, Persisted: true},
+}
+
+// MaxBuckets is the most points one series holds: every bucket of every tier.
+var MaxBuckets = func() int {
+	n := 0
+	for _, tier := range Tiers {
+		n += int(tier.Retention/tier.Step) + 1
+	}
+	return n
+}()
+
+// Range is a span the history API and chart offer.
+type Range struct {
+	Name string
+	Span time.Duration
+}
+
+// Ranges are the offered spans, shortest first.
+var Ranges = []Range{
+	{Name: "1h", Span: time.Hour},
+	{Name: "24h", Span: 24 * time.Hour},
+	{Name: "7d", Span: 7 * 24 * time.Hour},
+	{Name: "30d", Span: 30 * 24 * time.Hour},
+}
+
+// ParseRange looks up a range by name.
+func ParseRange(name string) (Range, bool) {
+	for _, r := range Ranges {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Range{}, false
+}
+
+// SaveInterval bounds how much history a crash can lose, without appending to
+// the file on every stats poll.
+const SaveInterval = time.Minute
+
+// compactSlack lets a small history append for a while before its first
+// compaction.
+const compactSlack = 10000
+
+// Point is the traffic of one bucket, in bytes. Rx is what the peer (or, for
+// the interface, all peers) sent to the server.
+//
+// The probe fields sum the reachability probes that ended in the bucket, so
+// that merged buckets stay exact: packets sent and answered, and the replies'
+// round-trip times and jitter in microseconds, each reply counting once.
+type Point struct {
+	Time          time.Time `json:"time"`
+	Rx            uint64    `json:"rx"`
+	Tx            uint64    `json:"tx"`
+	ProbeSent     uint32    `json:"probeSent,omitempty"`
+	ProbeReceived uint32    `json:"probeReceived,omitempty"`
+	RTTMicros     uint64    `json:"rttMicros,omitempty"`
+	JitterMicros  uint64    `json:"jitterMicros,omitempty"`
+}
+
+// Add sums q into p, keeping p's time.
+func (p *Point) Add(q Point) {
+	p.Rx += q.Rx
+	p.Tx += q.Tx
+	p.ProbeSent += q.ProbeSent
+	p.ProbeReceived += q.ProbeReceived
+	p.RTTMicros += q.RTTMicros
+	p.JitterMicros += q.JitterMicros
+}
+
+// Probed reports whether any probe ended in the bucket.
+func (p Point) Probed() bool { return p.ProbeSent > 0 }
+
+// Loss is the fraction of the bucket's probe packets left unanswered.
+func (p Point) Loss() float64 {
+	if p.ProbeSent == 0 {
+		return 0
+	}
+	return 1 - float64(p.ProbeReceived)/float64(p.ProbeSent)
+}
+
+// RTT is the bucket's average probe round-trip time, 0 without replies.
+func (p Point) RTT() time.Duration {
+	if p.ProbeReceived == 0 {
+		return 0
+	}
+	return time.Duration(p.RTTMicros/uint64(p.ProbeReceived)) * time.Microsecond
+}
+
+// Jitter is the bucket's average probe jitter, 0 without replies.
+func (p Point) Jitter() time.Duration {
+	if p.ProbeReceived == 0 {
+		return 0
+	}
+	return time.Duration(p.JitterMicros/uint64(p.ProbeReceived)) * time.Microsecond
+}
+
+// Series is a dense run of buckets returned by Query.
+type Series struct {
+	Step   time.Duration
+	Points []Point
+	// Rx and Tx are the totals over Points.
+	Rx, Tx uint64
+}
+
+// Downsample merges adjacent buckets so at most max points remain.
+func (s Series) Downsample(max int) Series {
+	if max <= 0 || len(s.Points) <= max {
+		return s
+	}
+	factor := (len(s.Points) + max - 1) / max
+	out := Series{Step: s.Step * time.Duration(factor), Rx: s.Rx, Tx: s.Tx}
+	for i := 0; i < len(s.Points); i += factor {
+		merged := Point{Time: s.Points[i].Time}
+		for _, p := range s.Points[i:min(i+factor, len(s.Points))] {
+			merged.Add(p)
+		}
+		out.Points = append(out.Points, merged)
+	}
+	return out
+}
+
+// Store holds the history of the interface and every peer, keyed by peer ID so
+// it survives key regeneration. The empty ID is the interface total. Only
+// buckets that saw traffic or probes are stored. A deleted peer's history is never
+// queried again and ages out with the coarsest tier.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	series  map[string][][]Point // per ID, one ascending slice per tier
+	pending map[bucketKey]Point  // what the persisted tiers gained since the last save
+	savedAt time.Time
+	// appended counts lines in the file and kept the persisted buckets in
+	// memory; once stale lines outnumber live ones the file is compacted.
+	appended int
+	kept     int
+}
+
+// bucketKey names one bucket of one tier of one series.
+type bucketKey struct {
+	id   string
+	tier int
+	time int64 // Unix seconds
+}
+
+// record is one line of the history file: what one bucket of a persisted tier
+// gained between two saves. A bucket still filling is appended again as it
+// grows, and lines for the same bucket sum up on load.
+type record struct {
+	ID   string `json:"id,omitempty"`
+	Step int64  `json:"step"` // the tier's Step in seconds
+	Point
+}
+
+// Open loads the history saved at path, dropping expired buckets. A missing
+// file starts an empty history. Lines that cannot be decoded are skipped and
+// reported, and the next compaction drops them.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, series: make(map[string][][]Point), pending: make(map[bucketKey]Point), savedAt: time.Now()}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("reading traffic history: %w", err)
+	}
+
+	var bad int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		s.appended++
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			bad++
+			continue
+		}
+		// A tier no longer kept, or no longer persisted, is dropped.
+		tier := slices.IndexFunc(Tiers, func(t Tier) bool { return t.Persisted && t.Step == time.Duration(r.Step)*time.Second })
+		if tier < 0 || r.Time.IsZero() {
+			continue
+		}
+		s.insert(r.ID, tier, r.Point)
+	}
+	s.prune(time.Now())
+	if bad > 0 {
+		return s, fmt.Errorf("traffic history %s: skipped %d unreadable lines", path, bad)
+	}
+	return s, nil
+}
+
+// insert adds p to its bucket of one tier of id's series, keeping the buckets
+// in time order. Lines usually come in order, except after a compaction.
+func (s *Store) insert(id string, tier int, p Point) {
+	tiers := s.series[id]
+	if tiers == nil {
+		tiers = make([][]Point, len(Tiers))
+		s.series[id] = tiers
+	}
+	points := tiers[tier]
+	i := len(points)
+	for i > 0 && points[i-1].Time.After(p.Time) {
+		i--
+	}
+	if i > 0 && points[i-1].Time.Equal(p.Time) {
+		points[i-1].Add(p)
+		return
+	}
+	tiers[tier] = slices.Insert(points, i, p)
+}
+
+// Record adds one poll's traffic: iface to the interface's history and each
+// of peers, keyed by peer ID, to that peer's. It saves at most every
+// SaveInterval.
+func (s *Store) Record(iface models.Transfer, peers map[string]models.Transfer, now time.Time) error {
+	if iface == (models.Transfer{}) && len(peers) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add("", Point{Rx: iface.Rx, Tx: iface.Tx}, now)
+	for id, t := range peers {
+		s.add(id, Point{Rx: t.Rx, Tx: t.Tx}, now)
+	}
+	return s.recorded(now)
+}
+
+// RecordProbe adds one reachability probe of peer id: packets sent and
+// answered, and the replies' average round-trip time and jitter.
+func (s *Store) RecordProbe(id string, sent, received int, rtt, jitter time.Duration, now time.Time) error {
+	if sent == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(id, Point{
+		ProbeSent:     uint32(sent),
+		ProbeReceived: uint32(received),
+		RTTMicros:     uint64(rtt.Microseconds()) * uint64(received),
+		JitterMicros:  uint64(jitter.Microseconds()) * uint64(received),
+	}, now)
+	return s.recorded(now)
+}
+
+// recorded saves the history if SaveInterval has passed. The caller holds
+// s.mu.
+func (s *Store) recorded(now time.Time) error {
+	if now.Sub(s.savedAt) < SaveInterval {
+		return nil
+	}
+	return s.save(now)
+}
+
+func (s *Store) add(id string, sample Point, now time.Time) {
+	if sample == (Point{}) {
+		return
+	}
+	tiers := s.series[id]
+	if tiers == nil {
+		tiers = make([][]Point, len(Tiers))
+		s.series[id] = tiers
+	}
+	for i, tier := range Tiers {
+		bucket := now.Truncate(tier.Step)
+		points := tiers[i]
+		// A clock stepping back adds to the latest bucket rather than
+		// breaking the ordering.
+		if n := len(points); n > 0 && !points[n-1].Time.Before(bucket) {
+			points[n-1].Add(sample)
+			bucket = points[n-1].Time
+		} else {
+			p := sample
+			p.Time = bucket
+			points = append(points, p)
+		}
+		tiers[i] = prune(points, now.Add(-tier.Retention))
+
+		if tier.Persisted {
+			key := bucketKey{id: id, tier: i, time: bucket.Unix()}
+			p := s.pending[key]
+			p.Time = bucket
+			p.Add(sample)
+			s.pending[key] = p
+		}
+	}
+}
+
+// prune drops the buckets that ended before cutoff.
+func prune(points []Point, cutoff time.Time) []Point {
+	i := 0
+	for i < len(points) && points[i].Time.Before(cutoff) {
+		i++
+	}
+	return points[i:]
+}
+
+// Query returns the last span of id's history, ending with the bucket that
+// contains now, from the finest tier that still covers the span.
+func (s *Store) Query(id string, span time.Duration, now time.Time) Series {
+	tier := len(Tiers) - 1
+	for i, t := range Tiers {
+		if t.Retention >= span {
+			tier = i
+			break
+		}
+	}
+	step := Tiers[tier].Step
+	n := max(1, int(span/step))
+	end := now.Truncate(step)
+	begin := end.Add(-time.Duration(n-1) * step)
+
+	series := Series{Step: step, Points: make([]Point, n)}
+	for i := range series.Points {
+		series.Points[i].Time = begin.Add(time.Duration(i) * step)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tiers := s.series[id]; tiers != nil {
+		for _, p := range tiers[tier] {
+			if p.Time.Before(begin) || p.Time.After(end) {
+				continue
+			}
+			i := int(p.Time.Sub(begin) / step)
+			series.Points[i].Add(p)
+			series.Rx += p.Rx
+			series.Tx += p.Tx
+		}
+	}
+	return series
+}
+
+// Flush writes any history not yet persisted, e.g. at shutdown.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	return s.save(time.Now())
+}
+
+// save prunes expired buckets and appends what the persisted tiers gained
+// since the last save, or compacts the file once it is mostly stale. Like
+// usage accounting, a failed save keeps everything in memory for the next
+// attempt.
+func (s *Store) save(now time.Time) error {
+	s.savedAt = now
+	s.prune(now)
+	if s.appended+len(s.pending) > 2*s.kept+compactSlack {
+		return s.compact()
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for key, p := range s.pending {
+		if err := enc.Encode(record{ID: key.id, Step: int64(Tiers[key.tier].Step / time.Second), Point: p}); err != nil {
+			return fmt.Errorf("encoding traffic history: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("creating traffic history dir: %w", err)
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening traffic history: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("writing traffic history: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing traffic history: %w", err)
+	}
+	s.appended += len(s.pending)
+	clear(s.pending)
+	return nil
+}
+
+// prune drops expired buckets and series left empty, and recounts kept.
+func (s *Store) prune(now time.Time) {
+	s.kept = 0
+	for id, tiers := range s.series {
+		empty := true
+		for i, tier := range Tiers {
+			tiers[i] = prune(tiers[i], now.Add(-tier.Retention))
+			empty = empty && len(tiers[i]) == 0
+			if tier.Persisted {
+				s.kept += len(tiers[i])
+			}
+		}
+		if empty {
+			delete(s.series, id)
+		}
+	}
+}
+
+// compact rewrites the file with one line per persisted bucket, atomically.
+func (s *Store) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for id, tiers := range s.series {
+		for i, tier := range Tiers {
+			if !tier.Persisted {
+				continue
+			}
+			for _, p := range tiers[i] {
+				if err := enc.Encode(record{ID: id, Step: int64(tier.Step / time.Second), Point: p}); err != nil {
+					return fmt.Errorf("encoding traffic history: %w", err)
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("creating traffic history dir: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing temp traffic history: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("renaming traffic history: %w", err)
+	}
+	s.appended = s.kept
+	clear(s.pending)
+	return nil
+}
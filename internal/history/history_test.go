@@ -0,0 +1,249 @@
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+func TestQueryPicksTierAndSumsBuckets(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	// Two days ago, yesterday, and twice in the last minute.
+	for _, at := range []time.Time{now.Add(-48 * time.Hour), now.Add(-25 * time.Hour), now.Add(-30 * time.Second), now.Add(-29 * time.Second)} {
+		if err := s.Record(models.Transfer{Rx: 150, Tx: 10}, map[string]models.Transfer{"site": {Rx: 100, Tx: 10}}, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hour := s.Query("site", time.Hour, now)
+	if hour.Step != 10*time.Second || len(hour.Points) != 360 || hour.Rx != 200 || hour.Tx != 20 {
+		t.Fatalf("1h: step %v, %d points, rx %d tx %d", hour.Step, len(hour.Points), hour.Rx, hour.Tx)
+	}
+	if last := hour.Points[len(hour.Points)-1]; !last.Time.Equal(now) {
+		t.Errorf("1h ends at %v, want %v", last.Time, now)
+	}
+	// Both polls fell into the same 10s bucket.
+	if p := hour.Points[len(hour.Points)-4]; p.Rx != 200 || !p.Time.Equal(now.Add(-30*time.Second)) {
+		t.Errorf("bucket %v = %d", p.Time, p.Rx)
+	}
+
+	week := s.Query("site", 7*24*time.Hour, now)
+	if week.Step != time.Hour || len(week.Points) != 168 || week.Rx != 400 {
+		t.Fatalf("7d: step %v, %d points, rx %d", week.Step, len(week.Points), week.Rx)
+	}
+	if iface := s.Query("", 7*24*time.Hour, now); iface.Rx != 600 || iface.Tx != 40 {
+		t.Errorf("interface 7d = %d/%d", iface.Rx, iface.Tx)
+	}
+	if day := s.Query("site", 24*time.Hour, now); day.Step != 5*time.Minute || day.Rx != 200 {
+		t.Errorf("24h: step %v, rx %d", day.Step, day.Rx)
+	}
+
+	down := week.Downsample(50)
+	if len(down.Points) != 42 || down.Step != 4*time.Hour || down.Rx != 400 {
+		t.Errorf("Downsample: %d points of %v, rx %d", len(down.Points), down.Step, down.Rx)
+	}
+}
+
+func TestHistorySurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := s.Record(models.Transfer{Rx: 5, Tx: 7}, map[string]models.Transfer{"site": {Rx: 5, Tx: 7}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Query("site", 30*24*time.Hour, now); got.Rx != 5 || got.Tx != 7 {
+		t.Fatalf("after reopen = %d/%d, want 5/7", got.Rx, got.Tx)
+	}
+	// The 10s tier is saved too, so the 1h chart survives a restart.
+	if got := reopened.Query("site", time.Hour, now); got.Rx != 5 || got.Tx != 7 {
+		t.Errorf("10s tier after reopen = %d/%d, want 5/7", got.Rx, got.Tx)
+	}
+	// Buckets past every tier's retention are dropped on save.
+	if err := reopened.save(now.Add(40 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.series) != 0 {
+		t.Fatalf("expired series kept: %v", reopened.series)
+	}
+}
+
+func TestRecordProbeMergesBuckets(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	// Two probes in the same minute: one clean, one losing three of five.
+	if err := s.RecordProbe("site", 5, 5, 10*time.Millisecond, time.Millisecond, now.Add(-50*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordProbe("site", 5, 2, 24*time.Millisecond, 8*time.Millisecond, now.Add(-20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	day := s.Query("site", 24*time.Hour, now)
+	p := day.Points[len(day.Points)-2]
+	if !p.Probed() || p.ProbeSent != 10 || p.ProbeReceived != 7 {
+		t.Fatalf("minute bucket = %+v", p)
+	}
+	// Each reply counts once: (5×10 + 2×24) / 7 = 14 ms.
+	if p.RTT() != 14*time.Millisecond || p.Jitter() != 3*time.Millisecond || math.Abs(p.Loss()-0.3) > 1e-9 {
+		t.Errorf("rtt %v, jitter %v, loss %v", p.RTT(), p.Jitter(), p.Loss())
+	}
+	// Probes are a peer's alone, and add no traffic.
+	if day.Rx != 0 || s.Query("", 24*time.Hour, now).Points[len(day.Points)-2].Probed() {
+		t.Error("probe leaked into traffic or the interface history")
+	}
+}
+
+func TestSavesAppendAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recent, since Open drops expired buckets.
+	now := time.Now().Truncate(time.Hour)
+	// Three saves a minute apart, each into a new 10s bucket but the same
+	// 5-minute and hourly ones, append to them rather than rewrite the file.
+	for i := range 3 {
+		if err := s.Record(models.Transfer{}, map[string]models.Transfer{"site": {Rx: 10}}, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countLines(t, path); n != 9 {
+		t.Fatalf("file has %d lines, want 3 per save", n)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Query("site", 24*time.Hour, now.Add(3*time.Minute)); got.Rx != 30 {
+		t.Fatalf("after reopen = %d, want the three saves summed", got.Rx)
+	}
+	if err := reopened.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 5 {
+		t.Fatalf("compacted file has %d lines, want one per bucket", n)
+	}
+	if again, err := Open(path); err != nil || again.Query("site", 7*24*time.Hour, now).Rx != 30 {
+		t.Fatalf("after compaction: %v", err)
+	}
+}
+
+// TestMemoryBoundedAt2000Peers keeps a month of traffic in every bucket of
+// every peer and checks that no series outgrows the tiers.
+func TestMemoryBoundedAt2000Peers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fills a month of buckets for 2,000 peers")
+	}
+	s, err := Open(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make(map[string]models.Transfer, 2000)
+	for i := range 2000 {
+		peers[fmt.Sprintf("peer%04d", i)] = models.Transfer{Rx: 1000, Tx: 100}
+	}
+	end := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	// Hourly for the month, then every 5 minutes for the day, then every 10
+	// seconds for the hour: every bucket any tier keeps sees traffic.
+	var at []time.Time
+	for t := end.Add(-31 * 24 * time.Hour); t.Before(end.Add(-24 * time.Hour)); t = t.Add(time.Hour) {
+		at = append(at, t)
+	}
+	for t := end.Add(-24 * time.Hour); t.Before(end.Add(-time.Hour)); t = t.Add(5 * time.Minute) {
+		at = append(at, t)
+	}
+	for t := end.Add(-time.Hour); !t.After(end); t = t.Add(10 * time.Second) {
+		at = append(at, t)
+	}
+	for _, now := range at {
+		for id, tr := range peers {
+			s.add(id, Point{Rx: tr.Rx, Tx: tr.Tx}, now)
+		}
+		clear(s.pending) // as a save would
+	}
+
+	var buckets int
+	for id, tiers := range s.series {
+		n := 0
+		for _, points := range tiers {
+			n += len(points)
+		}
+		if n > MaxBuckets {
+			t.Fatalf("%s holds %d buckets, more than MaxBuckets %d", id, n, MaxBuckets)
+		}
+		buckets += n
+	}
+	// At most 180 MB of points: 1,395 buckets of 64 bytes per peer.
+	if limit := 2000 * MaxBuckets; buckets > limit || MaxBuckets > 1400 {
+		t.Errorf("%d buckets for 2,000 peers, MaxBuckets %d", buckets, MaxBuckets)
+	}
+}
+
+// BenchmarkSave2000Peers times a poll of 2,000 peers and the save after it,
+// which appends three lines per peer, one per tier, instead of rewriting the
+// file.
+func BenchmarkSave2000Peers(b *testing.B) {
+	s, err := Open(filepath.Join(b.TempDir(), "history.jsonl"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	peers := make(map[string]models.Transfer, 2000)
+	for i := range 2000 {
+		peers[fmt.Sprintf("peer%04d", i)] = models.Transfer{Rx: 1000, Tx: 100}
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for i := range b.N {
+		now = now.Add(SaveInterval)
+		if err := s.Record(models.Transfer{Rx: 2000000}, peers, now); err != nil {
+			b.Fatal(err)
+		}
+		if i == 0 {
+			b.ReportMetric(float64(s.appended), "lines/save")
+		}
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
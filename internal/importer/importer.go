@@ -0,0 +1,258 @@
+// Package importer brings existing WireGuard setups under wg-busy's
+// management. Each source format is parsed into a Source; Preview compares it
+// with the current config, and Apply merges the chosen parts inside the
+// caller's Store.Write.
+package importer
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// Peer preview statuses.
+const (
+	StatusNew     = "new"     // not in config.yaml yet
+	StatusExists  = "exists"  // a peer with this public key is already managed
+	StatusInvalid = "invalid" // would not pass validation; see the notes
+)
+
+// Source is what an importer read, before it is merged into the config.
+type Source struct {
+	Format string
+	// Server holds the interface settings the source carried. Zero fields were
+	// absent and leave the current settings alone.
+	Server models.ServerConfig
+	Peers  []models.Peer
+	// Notes explain per peer, by public key, what was changed or dropped on
+	// the way in.
+	Notes map[string][]string
+	// Warnings are about the source as a whole.
+	Warnings []string
+}
+
+func (s *Source) note(publicKey, format string, args ...any) {
+	if s.Notes == nil {
+		s.Notes = make(map[string][]string)
+	}
+	s.Notes[publicKey] = append(s.Notes[publicKey], fmt.Sprintf(format, args...))
+}
+
+// Parse reads content in whichever supported format it is in.
+func Parse(content string) (Source, error) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "{") {
+		return ParseWGEasy(content)
+	}
+	first, _, _ := strings.Cut(content, "\n")
+	if strings.Count(first, "\t") == 3 {
+		return ParseDump(content)
+	}
+	return ParseWGQuick(content)
+}
+
+// PeerPreview is one source peer and what importing it would do.
+type PeerPreview struct {
+	Peer   models.Peer
+	Status string
+	Notes  []string
+}
+
+// Preview is a Source checked against the current config.
+type Preview struct {
+	Format   string
+	Warnings []string
+	// ServerChanges describes each server setting the import would change.
+	ServerChanges []string
+	Peers         []PeerPreview
+}
+
+// NewPreview compares src with cfg.
+func NewPreview(cfg models.AppConfig, src Source) Preview {
+	preview := Preview{Format: src.Format, Warnings: src.Warnings, ServerChanges: serverChanges(cfg.Server, src.Server)}
+	for _, p := range src.Peers {
+		row := PeerPreview{Peer: p, Status: StatusNew, Notes: src.Notes[p.PublicKey]}
+		if existing := findByPublicKey(cfg.Peers, p.PublicKey); existing != nil {
+			row.Status = StatusExists
+			row.Notes = append(row.Notes, fmt.Sprintf("already managed as %q", existing.Name))
+		} else if errs := p.Validate(nil); len(errs) > 0 {
+			row.Status = StatusInvalid
+			for _, err := range errs {
+				row.Notes = append(row.Notes, err.Field+": "+err.Message)
+			}
+		}
+		preview.Peers = append(preview.Peers, row)
+	}
+	return preview
+}
+
+// Apply adds the new peers among publicKeys to cfg, and with server set also
+// the source's server settings. It returns how many peers were added. The
+// caller runs it inside Store.Write, which validates the result as a whole.
+func Apply(cfg *models.AppConfig, src Source, publicKeys []string, server bool, now time.Time) (int, error) {
+	if server {
+		mergeServer(&cfg.Server, src.Server)
+	}
+	added := 0
+	for _, p := range src.Peers {
+		if !slices.Contains(publicKeys, p.PublicKey) || findByPublicKey(cfg.Peers, p.PublicKey) != nil {
+			continue
+		}
+		id, err := models.NewID()
+		if err != nil {
+			return 0, fmt.Errorf("ID generation failed: %w", err)
+		}
+		p.ID = id
+		p.CreatedAt = cmp.Or(p.CreatedAt, now.UTC())
+		p.UpdatedAt = now.UTC()
+		cfg.Peers = append(cfg.Peers, p)
+		added++
+	}
+	return added, nil
+}
+
+func findByPublicKey(peers []models.Peer, publicKey string) *models.Peer {
+	for i := range peers {
+		if peers[i].PublicKey == publicKey {
+			return &peers[i]
+		}
+	}
+	return nil
+}
+
+// Unmanaged returns the public keys in live that config.yaml does not know.
+// They are on wg0 only until the next apply: wg syncconf removes them.
+func Unmanaged(cfg models.AppConfig, live []string) []string {
+	var keys []string
+	for _, key := range live {
+		if findByPublicKey(cfg.Peers, key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// serverFields pairs each importable server setting with its accessor.
+var serverFields = []struct {
+	name string
+	get  func(*models.ServerConfig) *string
+}{
+	{"Address", func(s *models.ServerConfig) *string { return &s.Address }},
+	{"DNS", func(s *models.ServerConfig) *string { return &s.DNS }},
+	{"Table", func(s *models.ServerConfig) *string { return &s.Table }},
+	{"FwMark", func(s *models.ServerConfig) *string { return &s.FwMark }},
+	{"PreUp", func(s *models.ServerConfig) *string { return &s.PreUp }},
+	{"PostUp", func(s *models.ServerConfig) *string { return &s.PostUp }},
+	{"PreDown", func(s *models.ServerConfig) *string { return &s.PreDown }},
+	{"PostDown", func(s *models.ServerConfig) *string { return &s.PostDown }},
+	{"Endpoint", func(s *models.ServerConfig) *string { return &s.Endpoint }},
+}
+
+func serverChanges(current, src models.ServerConfig) []string {
+	var changes []string
+	if src.PrivateKey != "" && src.PrivateKey != current.PrivateKey {
+		changes = append(changes, "PrivateKey: replaced with the imported key, so existing clients keep working")
+	}
+	if src.ListenPort != 0 && src.ListenPort != current.ListenPort {
+		changes = append(changes, fmt.Sprintf("ListenPort: %d → %d", current.ListenPort, src.ListenPort))
+	}
+	if src.MTU != 0 && src.MTU != current.MTU {
+		changes = append(changes, fmt.Sprintf("MTU: %d → %d", current.MTU, src.MTU))
+	}
+	for _, field := range serverFields {
+		if value := *field.get(&src); value != "" && value != *field.get(&current) {
+			changes = append(changes, fmt.Sprintf("%s: %q → %q", field.name, *field.get(&current), value))
+		}
+	}
+	return changes
+}
+
+func mergeServer(dst *models.ServerConfig, src models.ServerConfig) {
+	if src.PrivateKey != "" {
+		dst.PrivateKey = src.PrivateKey
+	}
+	if src.ListenPort != 0 {
+		dst.ListenPort = src.ListenPort
+	}
+	if src.MTU != 0 {
+		dst.MTU = src.MTU
+	}
+	for _, field := range serverFields {
+		if value := *field.get(&src); value != "" {
+			*field.get(dst) = value
+		}
+	}
+}
+
+// splitAllowedIPs maps a peer's server-side AllowedIPs onto wg-busy's model:
+// host routes are the peer's own tunnel addresses, anything wider is a network
+// behind it. Default routes are dropped; in wg-busy that is an exit node,
+// which needs its own routing table.
+func splitAllowedIPs(src *Source, publicKey string, allowed []string) (addresses string, advertised []string) {
+	var hosts []string
+	for _, entry := range allowed {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			if ip = net.ParseIP(entry); ip == nil {
+				src.note(publicKey, "dropped invalid AllowedIPs entry %q", entry)
+				continue
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		ones, bits := network.Mask.Size()
+		switch {
+		case ones == 0:
+			src.note(publicKey, "dropped default route %s: make the peer an exit node to route internet traffic through it", entry)
+		case ones == bits:
+			hosts = append(hosts, network.String())
+		default:
+			advertised = append(advertised, network.String())
+		}
+	}
+	if len(hosts) == 0 {
+		src.note(publicKey, "no host address (/32 or /128) in AllowedIPs to use as its tunnel address")
+	}
+	if len(advertised) > 0 {
+		src.note(publicKey, "wider AllowedIPs imported as advertised routes: %s", strings.Join(advertised, ", "))
+	}
+	return strings.Join(hosts, ", "), advertised
+}
+
+// peerName turns a comment or other label into a valid peer name, falling
+// back to the start of the public key.
+func peerName(label, publicKey string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" _.-", r) {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(label))
+	name = strings.Trim(name, " -")
+	if len(name) > 64 {
+		name = strings.TrimSpace(name[:64])
+	}
+	if name == "" {
+		key := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("+/=", r) {
+				return -1
+			}
+			return r
+		}, publicKey)
+		name = "imported-" + key[:min(8, len(key))]
+	}
+	return name
+}
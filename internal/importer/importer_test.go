@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+const (
+	serverKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	aliceKey  = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	bobKey    = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+	carolKey  = "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA="
+)
+
+const wgQuickConf = `[Interface]
+# Hand-written long ago
+Address = 10.8.0.1/24
+Address = fd00::1/64
+ListenPort = 51821
+PrivateKey = ` + serverKey + `
+PostUp = iptables -A FORWARD -i wg0 -j ACCEPT
+PostUp = iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
+SaveConfig = true
+
+### Client alice laptop
+[Peer]
+PublicKey = ` + aliceKey + `
+AllowedIPs = 10.8.0.2/32, fd00::2/128
+
+[Peer]
+# bob@office
+PublicKey = ` + bobKey + `
+PresharedKey = ` + carolKey + `
+AllowedIPs = 10.8.0.3/32
+AllowedIPs = 192.168.50.0/24, 0.0.0.0/0
+Endpoint = 203.0.113.9:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = ` + carolKey + `
+AllowedIPs = 172.16.0.0/16
+`
+
+func TestParseWGQuick(t *testing.T) {
+	src, err := Parse(wgQuickConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Format != FormatWGQuick || src.Server.Address != "10.8.0.1/24, fd00::1/64" || src.Server.ListenPort != 51821 ||
+		src.Server.PrivateKey != serverKey || !strings.Contains(src.Server.PostUp, "\niptables -t nat") {
+		t.Fatalf("server = %+v", src.Server)
+	}
+	if len(src.Warnings) != 1 || !strings.Contains(src.Warnings[0], "saveconfig") {
+		t.Fatalf("warnings = %q", src.Warnings)
+	}
+	if len(src.Peers) != 3 {
+		t.Fatalf("peers = %+v", src.Peers)
+	}
+	alice, bob, carol := src.Peers[0], src.Peers[1], src.Peers[2]
+	if alice.Name != "Client alice laptop" || alice.AllowedIPs != "10.8.0.2/32, fd00::2/128" || alice.PrivateKey != "" || !alice.Enabled {
+		t.Errorf("alice = %+v", alice)
+	}
+	if bob.Name != "bob-office" || bob.AllowedIPs != "10.8.0.3/32" || !slices.Equal(bob.AdvertisedRoutes, []string{"192.168.50.0/24"}) ||
+		bob.PresharedKey != carolKey || bob.Endpoint != "203.0.113.9:51820" || bob.PersistentKeepalive != 25 {
+		t.Errorf("bob = %+v", bob)
+	}
+	if notes := strings.Join(src.Notes[bobKey], "\n"); !strings.Contains(notes, "default route 0.0.0.0/0") || !strings.Contains(notes, "no private key") {
+		t.Errorf("bob notes = %s", notes)
+	}
+	if carol.Name != "imported-gN65BkIK" || carol.AllowedIPs != "" {
+		t.Errorf("carol = %+v", carol)
+	}
+
+	if _, err := Parse("[Interface]\nnot a setting\n"); err == nil {
+		t.Error("malformed line accepted")
+	}
+}
+
+func TestParseDump(t *testing.T) {
+	dump := serverKey + "\t(pubkey)\t51820\toff\n" +
+		aliceKey + "\t(none)\t198.51.100.4:3333\t10.0.0.2/32\t1700000000\t100\t200\toff\n" +
+		bobKey + "\t" + carolKey + "\t(none)\t10.0.0.3/32,10.9.0.0/16\t0\t0\t0\t25\n"
+	src, err := Parse(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Format != FormatDump || src.Server.PrivateKey != serverKey || src.Server.ListenPort != 51820 || src.Server.FwMark != "" {
+		t.Fatalf("server = %+v", src.Server)
+	}
+	if len(src.Peers) != 2 || src.Peers[0].Endpoint != "" || src.Peers[0].PresharedKey != "" ||
+		src.Peers[1].PresharedKey != carolKey || src.Peers[1].PersistentKeepalive != 25 || src.Peers[1].AdvertisedRoutes[0] != "10.9.0.0/16" {
+		t.Fatalf("peers = %+v", src.Peers)
+	}
+}
+
+func TestPreviewAndApply(t *testing.T) {
+	src, err := ParseWGQuick(wgQuickConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{PrivateKey: aliceKey, Address: "10.8.0.1/24", ListenPort: 51820},
+		Peers:  []models.Peer{{ID: "a", Name: "alice", PublicKey: aliceKey, KeyHeld: true, AllowedIPs: "10.8.0.2/32"}},
+	}
+
+	preview := NewPreview(cfg, src)
+	var statuses []string
+	for _, p := range preview.Peers {
+		statuses = append(statuses, p.Status)
+	}
+	if !slices.Equal(statuses, []string{StatusExists, StatusNew, StatusInvalid}) {
+		t.Fatalf("statuses = %v", statuses)
+	}
+	if len(preview.ServerChanges) != 4 {
+		t.Fatalf("server changes = %q", preview.ServerChanges)
+	}
+
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	added, err := Apply(&cfg, src, []string{aliceKey, bobKey}, false, now)
+	if err != nil || added != 1 {
+		t.Fatalf("added %d, err %v", added, err)
+	}
+	if bob := cfg.Peers[1]; bob.ID == "" || bob.PublicKey != bobKey || !bob.KeyHeld || !bob.CreatedAt.Equal(now) || cfg.Server.ListenPort != 51820 {
+		t.Fatalf("after apply: %+v, server %+v", bob, cfg.Server)
+	}
+	if errs := models.ValidateConfig(cfg); len(errs) > 0 {
+		t.Fatalf("imported config invalid: %v", errs)
+	}
+
+	if _, err := Apply(&cfg, src, nil, true, now); err != nil || cfg.Server.ListenPort != 51821 || cfg.Server.PrivateKey != serverKey {
+		t.Fatalf("server not imported: %+v, %v", cfg.Server, err)
+	}
+
+	if got := Unmanaged(cfg, []string{carolKey, aliceKey, bobKey}); !slices.Equal(got, []string{carolKey}) {
+		t.Fatalf("Unmanaged = %v", got)
+	}
+}
@@ -0,0 +1,234 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// Source formats.
+const (
+	FormatWGQuick = "wg-quick"
+	FormatDump    = "wg-dump"
+)
+
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// ReadInterface returns the output of "wg show wg0 dump", for ParseDump.
+func ReadInterface() (string, error) {
+	out, err := runCommand("wg", "show", models.WGDevice, "dump")
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", models.WGDevice, err)
+	}
+	return string(out), nil
+}
+
+// ParseWGQuick parses a wg-quick server config such as /etc/wireguard/wg0.conf.
+// A comment directly above or at the top of a [Peer] section names the peer.
+// Server-side configs never hold the peers' private keys, so every imported
+// peer keeps the config already on its device.
+func ParseWGQuick(content string) (Source, error) {
+	src := Source{Format: FormatWGQuick}
+	var (
+		section string
+		comment string
+		peer    *models.Peer
+		allowed []string
+		label   string
+	)
+	finishPeer := func() {
+		if peer == nil {
+			return
+		}
+		if peer.PublicKey == "" {
+			src.Warnings = append(src.Warnings, fmt.Sprintf("skipped a [Peer] without PublicKey (%s)", peerName(label, "")))
+		} else {
+			peer.Name = peerName(label, peer.PublicKey)
+			peer.KeyHeld = true
+			peer.AllowedIPs, peer.AdvertisedRoutes = splitAllowedIPs(&src, peer.PublicKey, allowed)
+			src.Peers = append(src.Peers, *peer)
+		}
+		peer, allowed, label = nil, nil, ""
+	}
+	appendLine := func(dst *string, value string) {
+		if *dst != "" {
+			*dst += "\n"
+		}
+		*dst += value
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			comment = ""
+			continue
+		case strings.HasPrefix(line, "#"):
+			text := strings.TrimSpace(strings.TrimLeft(line, "#"))
+			if peer != nil && label == "" && peer.PublicKey == "" {
+				label = text
+			} else {
+				comment = text
+			}
+			continue
+		case strings.HasPrefix(line, "["):
+			finishPeer()
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			if section == "peer" {
+				peer = &models.Peer{Enabled: true}
+				label = comment
+			}
+			comment = ""
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return src, fmt.Errorf("line %d: expected KEY = VALUE: %s", lineNo, line)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch section {
+		case "interface":
+			s := &src.Server
+			switch key {
+			case "privatekey":
+				s.PrivateKey = value
+			case "listenport":
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return src, fmt.Errorf("line %d: invalid ListenPort %q", lineNo, value)
+				}
+				s.ListenPort = uint16(port)
+			case "address":
+				s.Address = joinList(s.Address, value)
+			case "dns":
+				s.DNS = joinList(s.DNS, value)
+			case "mtu":
+				mtu, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return src, fmt.Errorf("line %d: invalid MTU %q", lineNo, value)
+				}
+				s.MTU = uint16(mtu)
+			case "table":
+				s.Table = value
+			case "fwmark":
+				s.FwMark = value
+			case "preup":
+				appendLine(&s.PreUp, value)
+			case "postup":
+				appendLine(&s.PostUp, value)
+			case "predown":
+				appendLine(&s.PreDown, value)
+			case "postdown":
+				appendLine(&s.PostDown, value)
+			default:
+				src.Warnings = append(src.Warnings, fmt.Sprintf("line %d: ignored [Interface] setting %s", lineNo, key))
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peer.PublicKey = value
+			case "presharedkey":
+				peer.PresharedKey = value
+			case "allowedips":
+				allowed = append(allowed, strings.Split(value, ",")...)
+			case "endpoint":
+				peer.Endpoint = value
+			case "persistentkeepalive":
+				if value != "off" {
+					keepalive, err := strconv.ParseUint(value, 10, 16)
+					if err != nil {
+						return src, fmt.Errorf("line %d: invalid PersistentKeepalive %q", lineNo, value)
+					}
+					peer.PersistentKeepalive = uint16(keepalive)
+				}
+			default:
+				src.Warnings = append(src.Warnings, fmt.Sprintf("line %d: ignored [Peer] setting %s", lineNo, key))
+			}
+		default:
+			return src, fmt.Errorf("line %d: setting outside [Interface] or [Peer]", lineNo)
+		}
+	}
+	finishPeer()
+	if err := scanner.Err(); err != nil {
+		return src, err
+	}
+	if src.Server.PrivateKey == "" && len(src.Peers) == 0 {
+		return src, fmt.Errorf("no [Interface] or [Peer] found")
+	}
+	for _, p := range src.Peers {
+		src.note(p.PublicKey, "no private key: the device keeps its own config, which wg-busy cannot download or show as a QR code")
+	}
+	return src, nil
+}
+
+// ParseDump parses "wg show wg0 dump": a tab-separated interface line, then
+// one line per peer. The dump has no names, DNS, addresses or hooks, so only
+// the keys, port and fwmark of the interface are imported.
+func ParseDump(content string) (Source, error) {
+	src := Source{Format: FormatDump}
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return src, fmt.Errorf("empty dump")
+	}
+	iface := strings.Split(lines[0], "\t")
+	if len(iface) != 4 {
+		return src, fmt.Errorf("line 1: expected the interface's 4 fields, got %d", len(iface))
+	}
+	src.Server.PrivateKey = none(iface[0])
+	if port, err := strconv.ParseUint(iface[2], 10, 16); err == nil {
+		src.Server.ListenPort = uint16(port)
+	}
+	if fwmark := iface[3]; fwmark != "off" {
+		src.Server.FwMark = fwmark
+	}
+
+	for i, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return src, fmt.Errorf("line %d: expected a peer's 8 fields, got %d", i+2, len(fields))
+		}
+		// The endpoint is where the peer last connected from, not necessarily
+		// where to reach it, so it is left for the peer to re-establish.
+		p := models.Peer{
+			PublicKey:    fields[0],
+			PresharedKey: none(fields[1]),
+			KeyHeld:      true,
+			Enabled:      true,
+		}
+		if keepalive, err := strconv.ParseUint(fields[7], 10, 16); err == nil {
+			p.PersistentKeepalive = uint16(keepalive)
+		}
+		p.Name = peerName("", p.PublicKey)
+		var allowed []string
+		if list := none(fields[3]); list != "" {
+			allowed = strings.Split(list, ",")
+		}
+		p.AllowedIPs, p.AdvertisedRoutes = splitAllowedIPs(&src, p.PublicKey, allowed)
+		src.note(p.PublicKey, "no private key: the device keeps its own config, which wg-busy cannot download or show as a QR code")
+		src.Peers = append(src.Peers, p)
+	}
+	return src, nil
+}
+
+// none maps wg's "(none)" placeholder to "".
+func none(field string) string {
+	if field == "(none)" {
+		return ""
+	}
+	return field
+}
+
+func joinList(list, value string) string {
+	if list == "" {
+		return value
+	}
+	return list + ", " + value
+}
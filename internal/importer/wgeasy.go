@@ -0,0 +1,246 @@
+package importer
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// wg-easy source formats.
+const (
+	FormatWGEasy   = "wg-easy"    // wg0.json, up to wg-easy 14
+	FormatWGEasyDB = "wg-easy-db" // JSON export of the wg-easy 15 database
+)
+
+// wgEasyFile covers both wg-easy formats: wg0.json keys clients by ID under
+// "server", the database export lists them next to "interface".
+type wgEasyFile struct {
+	Server     *wgEasyServer     `json:"server"`
+	Interface  *wgEasyInterface  `json:"interface"`
+	UserConfig *wgEasyUserConfig `json:"userConfig"`
+	Hooks      *wgEasyHooks      `json:"hooks"`
+	Clients    json.RawMessage   `json:"clients"`
+}
+
+type wgEasyServer struct {
+	PrivateKey string `json:"privateKey"`
+	Address    string `json:"address"`
+}
+
+type wgEasyInterface struct {
+	PrivateKey string `json:"privateKey"`
+	Port       uint16 `json:"port"`
+	IPv4CIDR   string `json:"ipv4Cidr"`
+	IPv6CIDR   string `json:"ipv6Cidr"`
+	MTU        uint16 `json:"mtu"`
+}
+
+type wgEasyUserConfig struct {
+	Host              string   `json:"host"`
+	Port              uint16   `json:"port"`
+	DefaultDNS        []string `json:"defaultDns"`
+	DefaultAllowedIPs []string `json:"defaultAllowedIps"`
+}
+
+type wgEasyHooks struct {
+	PreUp    string `json:"preUp"`
+	PostUp   string `json:"postUp"`
+	PreDown  string `json:"preDown"`
+	PostDown string `json:"postDown"`
+}
+
+type wgEasyClient struct {
+	Name         string     `json:"name"`
+	PrivateKey   string     `json:"privateKey"`
+	PublicKey    string     `json:"publicKey"`
+	PreSharedKey string     `json:"preSharedKey"`
+	Enabled      *bool      `json:"enabled"`
+	CreatedAt    wgEasyTime `json:"createdAt"`
+	ExpiresAt    wgEasyTime `json:"expiresAt"`
+	ExpiredAt    wgEasyTime `json:"expiredAt"` // wg0.json's name for it
+	// wg0.json
+	Address string `json:"address"`
+	// database export
+	IPv4Address         string   `json:"ipv4Address"`
+	IPv6Address         string   `json:"ipv6Address"`
+	AllowedIPs          []string `json:"allowedIps"`
+	ServerAllowedIPs    []string `json:"serverAllowedIps"`
+	DNS                 []string `json:"dns"`
+	PersistentKeepalive uint16   `json:"persistentKeepalive"`
+	MTU                 uint16   `json:"mtu"`
+	ServerEndpoint      string   `json:"serverEndpoint"`
+	PreUp               string   `json:"preUp"`
+	PostUp              string   `json:"postUp"`
+	PreDown             string   `json:"preDown"`
+	PostDown            string   `json:"postDown"`
+}
+
+// wgEasyTime reads both the ISO timestamps of wg0.json and the SQLite
+// "YYYY-MM-DD HH:MM:SS" ones of the database.
+type wgEasyTime struct{ time.Time }
+
+func (t *wgEasyTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil || s == "" {
+		return err
+	}
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime} {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = parsed.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q", s)
+}
+
+// ParseWGEasy parses wg-easy's wg0.json or a JSON export of its newer
+// database. Unlike a server config, both hold the clients' private keys, so
+// migrated peers keep working and their configs can still be downloaded.
+func ParseWGEasy(content string) (Source, error) {
+	var file wgEasyFile
+	if err := json.Unmarshal([]byte(content), &file); err != nil {
+		return Source{}, fmt.Errorf("reading wg-easy JSON: %w", err)
+	}
+	var (
+		src     Source
+		clients []wgEasyClient
+		now     = time.Now()
+	)
+	switch {
+	case file.Interface != nil:
+		src = Source{Format: FormatWGEasyDB}
+		if err := json.Unmarshal(file.Clients, &clients); len(file.Clients) > 0 && err != nil {
+			return src, fmt.Errorf("reading wg-easy clients: %w", err)
+		}
+		wgEasyDBServer(&src, file)
+	case file.Server != nil:
+		src = Source{Format: FormatWGEasy}
+		var byID map[string]wgEasyClient
+		if err := json.Unmarshal(file.Clients, &byID); len(file.Clients) > 0 && err != nil {
+			return src, fmt.Errorf("reading wg-easy clients: %w", err)
+		}
+		for _, c := range byID {
+			clients = append(clients, c)
+		}
+		// Map order is random; wg-easy listed clients by creation.
+		slices.SortStableFunc(clients, func(a, b wgEasyClient) int {
+			return cmp.Or(a.CreatedAt.Compare(b.CreatedAt.Time), strings.Compare(a.PublicKey, b.PublicKey))
+		})
+		src.Server.PrivateKey = file.Server.PrivateKey
+		if file.Server.Address != "" {
+			src.Server.Address = file.Server.Address + "/24"
+			src.Warnings = append(src.Warnings, "wg0.json has no subnet size: assumed /24, wg-easy's default")
+		}
+		src.Warnings = append(src.Warnings, "wg0.json has no port, DNS, MTU, endpoint or hooks: wg-easy took those from WG_* environment variables, so set them in Server settings")
+	default:
+		return Source{}, fmt.Errorf("not a wg-easy export: neither \"server\" nor \"interface\" found")
+	}
+
+	var (
+		defaultAllowedIPs string
+		mtu               uint16
+	)
+	if file.UserConfig != nil {
+		defaultAllowedIPs = strings.Join(file.UserConfig.DefaultAllowedIPs, ", ")
+	}
+	if file.Interface != nil {
+		mtu = file.Interface.MTU
+	}
+	for _, c := range clients {
+		if c.PublicKey == "" {
+			src.Warnings = append(src.Warnings, fmt.Sprintf("skipped client %q without a public key", c.Name))
+			continue
+		}
+		src.Peers = append(src.Peers, wgEasyPeer(&src, c, defaultAllowedIPs, mtu, now))
+	}
+	return src, nil
+}
+
+func wgEasyDBServer(src *Source, file wgEasyFile) {
+	iface := file.Interface
+	src.Server.PrivateKey = iface.PrivateKey
+	src.Server.ListenPort = iface.Port
+	src.Server.MTU = iface.MTU
+	var addresses []string
+	for _, cidr := range []string{iface.IPv4CIDR, iface.IPv6CIDR} {
+		if cidr == "" {
+			continue
+		}
+		// wg-easy gives the server the first address of each range.
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			src.Warnings = append(src.Warnings, fmt.Sprintf("ignored invalid interface range %q", cidr))
+			continue
+		}
+		prefix = prefix.Masked()
+		addresses = append(addresses, netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits()).String())
+	}
+	src.Server.Address = strings.Join(addresses, ", ")
+	if uc := file.UserConfig; uc != nil {
+		if uc.Host != "" {
+			src.Server.Endpoint = net.JoinHostPort(uc.Host, strconv.Itoa(int(cmp.Or(uc.Port, iface.Port))))
+		}
+		src.Server.DNS = strings.Join(uc.DefaultDNS, ", ")
+	}
+	if h := file.Hooks; h != nil {
+		src.Server.PreUp, src.Server.PostUp = h.PreUp, h.PostUp
+		src.Server.PreDown, src.Server.PostDown = h.PreDown, h.PostDown
+	}
+}
+
+func wgEasyPeer(src *Source, c wgEasyClient, defaultAllowedIPs string, mtu uint16, now time.Time) models.Peer {
+	p := models.Peer{
+		Name:                peerName(c.Name, c.PublicKey),
+		PrivateKey:          c.PrivateKey,
+		PublicKey:           c.PublicKey,
+		PresharedKey:        c.PreSharedKey,
+		Enabled:             c.Enabled == nil || *c.Enabled,
+		PersistentKeepalive: c.PersistentKeepalive,
+		DNS:                 strings.Join(c.DNS, ", "),
+		ClientAllowedIPs:    strings.Join(c.AllowedIPs, ", "),
+		CreatedAt:           c.CreatedAt.Time,
+	}
+	// A client without its own AllowedIPs used wg-easy's defaults, which are
+	// not necessarily wg-busy's full tunnel.
+	if c.AllowedIPs == nil {
+		p.ClientAllowedIPs = defaultAllowedIPs
+	}
+	if p.PrivateKey == "" {
+		p.KeyHeld = true
+		src.note(p.PublicKey, "no private key: the device keeps its own config, which wg-busy cannot download or show as a QR code")
+	}
+
+	var allowed []string
+	for _, address := range []string{c.Address, c.IPv4Address, c.IPv6Address} {
+		if address != "" {
+			allowed = append(allowed, address)
+		}
+	}
+	allowed = append(allowed, c.ServerAllowedIPs...)
+	p.AllowedIPs, p.AdvertisedRoutes = splitAllowedIPs(src, p.PublicKey, allowed)
+
+	p.ExpiresAt = cmp.Or(c.ExpiresAt.Time, c.ExpiredAt.Time)
+	if p.Expired(now) && p.Enabled {
+		p.Enabled = false
+		p.StateReason = models.StateReasonExpired
+		src.note(p.PublicKey, "expired on %s: imported disabled", p.ExpiresAt.Format(time.DateOnly))
+	}
+	if c.MTU != 0 && mtu != 0 && c.MTU != mtu {
+		src.note(p.PublicKey, "client MTU %d not carried over: the config uses the server MTU", c.MTU)
+	}
+	if c.ServerEndpoint != "" {
+		src.note(p.PublicKey, "per-client server endpoint %q not carried over", c.ServerEndpoint)
+	}
+	if c.PreUp != "" || c.PostUp != "" || c.PreDown != "" || c.PostDown != "" {
+		src.note(p.PublicKey, "client hooks not carried over")
+	}
+	return p
+}
@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+const wgEasyJSON = `{
+  "server": {"privateKey": "` + serverKey + `", "publicKey": "unused", "address": "10.8.0.1"},
+  "clients": {
+    "b-id": {"id": "b-id", "name": "Bob's phone", "address": "10.8.0.3", "privateKey": "` + carolKey + `",
+      "publicKey": "` + bobKey + `", "createdAt": "2023-05-02T10:00:00.000Z", "updatedAt": "2023-05-02T10:00:00.000Z",
+      "enabled": false, "expiredAt": null},
+    "a-id": {"id": "a-id", "name": "alice", "address": "10.8.0.2", "privateKey": "` + serverKey + `",
+      "publicKey": "` + aliceKey + `", "preSharedKey": "` + carolKey + `",
+      "createdAt": "2023-01-01T08:30:00.000Z", "updatedAt": "2024-01-01T00:00:00.000Z", "enabled": true}
+  }
+}`
+
+const wgEasyDBJSON = `{
+  "interface": {"name": "wg0", "port": 51822, "privateKey": "` + serverKey + `",
+    "ipv4Cidr": "10.8.0.0/24", "ipv6Cidr": "fdcc:ad94:bacf:61a4::cafe:0/112", "mtu": 1420},
+  "userConfig": {"host": "vpn.example.com", "port": 443, "defaultDns": ["1.1.1.1", "2606:4700:4700::1111"],
+    "defaultAllowedIps": ["10.8.0.0/24"]},
+  "hooks": {"postUp": "iptables -A FORWARD -i wg0 -j ACCEPT"},
+  "clients": [
+    {"name": "office", "ipv4Address": "10.8.0.2", "ipv6Address": "fdcc:ad94:bacf:61a4::cafe:2",
+      "privateKey": "` + serverKey + `", "publicKey": "` + aliceKey + `", "enabled": true,
+      "allowedIps": null, "serverAllowedIps": ["192.168.1.0/24"], "dns": ["10.8.0.1"], "persistentKeepalive": 25,
+      "mtu": 1280, "createdAt": "2025-02-03 04:05:06", "expiresAt": "2001-01-01 00:00:00"},
+    {"name": "laptop", "ipv4Address": "10.8.0.3", "privateKey": "` + carolKey + `", "publicKey": "` + bobKey + `",
+      "enabled": true, "allowedIps": ["0.0.0.0/0"], "mtu": 1420, "postUp": "echo hi"}
+  ]
+}`
+
+func TestParseWGEasyJSON(t *testing.T) {
+	src, err := Parse(wgEasyJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Format != FormatWGEasy || src.Server.PrivateKey != serverKey || src.Server.Address != "10.8.0.1/24" {
+		t.Fatalf("server = %+v", src.Server)
+	}
+	if len(src.Warnings) != 2 {
+		t.Errorf("warnings = %q", src.Warnings)
+	}
+	if len(src.Peers) != 2 {
+		t.Fatalf("peers = %+v", src.Peers)
+	}
+	alice, bob := src.Peers[0], src.Peers[1]
+	if alice.Name != "alice" || alice.AllowedIPs != "10.8.0.2/32" || alice.PrivateKey != serverKey || alice.PresharedKey != carolKey ||
+		!alice.Enabled || !alice.CreatedAt.Equal(time.Date(2023, 1, 1, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("alice = %+v", alice)
+	}
+	if bob.Name != "Bob-s phone" || bob.Enabled || bob.PrivateKey != carolKey {
+		t.Errorf("bob = %+v", bob)
+	}
+	if notes := src.Notes[aliceKey]; len(notes) != 0 {
+		t.Errorf("alice notes = %q", notes)
+	}
+}
+
+func TestParseWGEasyDatabase(t *testing.T) {
+	src, err := Parse(wgEasyDBJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := src.Server
+	if src.Format != FormatWGEasyDB || s.ListenPort != 51822 || s.MTU != 1420 || s.Endpoint != "vpn.example.com:443" ||
+		s.Address != "10.8.0.1/24, fdcc:ad94:bacf:61a4::cafe:1/112" || s.DNS != "1.1.1.1, 2606:4700:4700::1111" || !strings.HasPrefix(s.PostUp, "iptables") {
+		t.Fatalf("server = %+v", s)
+	}
+	office, laptop := src.Peers[0], src.Peers[1]
+	if office.AllowedIPs != "10.8.0.2/32, fdcc:ad94:bacf:61a4::cafe:2/128" || !slices.Equal(office.AdvertisedRoutes, []string{"192.168.1.0/24"}) ||
+		office.ClientAllowedIPs != "10.8.0.0/24" || office.DNS != "10.8.0.1" || office.PersistentKeepalive != 25 || office.Enabled ||
+		office.StateReason != models.StateReasonExpired || office.ExpiresAt.Year() != 2001 {
+		t.Errorf("office = %+v", office)
+	}
+	notes := strings.Join(src.Notes[aliceKey], "\n")
+	for _, want := range []string{"expired on 2001-01-01", "client MTU 1280"} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("office notes = %s, want %q", notes, want)
+		}
+	}
+	if laptop.ClientAllowedIPs != "0.0.0.0/0" || !laptop.Enabled || !strings.Contains(strings.Join(src.Notes[bobKey], "\n"), "hooks") {
+		t.Errorf("laptop = %+v, notes %q", laptop, src.Notes[bobKey])
+	}
+
+	if _, err := Parse(`{"clients": []}`); err == nil {
+		t.Error("JSON without server or interface accepted")
+	}
+}
@@ -1,105 +1,573 @@
 package ipam
 
 import (
+	"cmp"
+	"encoding/binary"
 	"fmt"
-	"net"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
 )
 
-// NextAvailableIP returns the next unallocated host address from the server's
-// first IPv4 pool (or first IPv6 pool when IPv6-only) as a /32 or /128 CIDR.
-// Both serverAddress and each usedIPs value may be comma-separated CIDR lists.
-func NextAvailableIP(serverAddress string, usedIPs []string) (string, error) {
-	serverIP, ipNet, err := allocationNetwork(serverAddress)
+// subnet is one CIDR of the server address list, from which peers get a host
+// address.
+type subnet struct {
+	server netip.Addr   // the server's own address in it
+	prefix netip.Prefix // masked
+}
+
+// subnets parses the server address list. IPv4 subnets sort first, so a
+// peer's addresses read IPv4 then IPv6 however the server list is ordered.
+func subnets(serverAddress string) ([]subnet, error) {
+	var result []subnet
+	for _, value := range strings.Split(serverAddress, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		result = append(result, subnet{server: prefix.Addr(), prefix: prefix.Masked()})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("invalid server address %q", serverAddress)
+	}
+	slices.SortStableFunc(result, func(a, b subnet) int {
+		return cmp.Compare(a.prefix.Addr().BitLen(), b.prefix.Addr().BitLen())
+	})
+	return result, nil
+}
+
+// host reports whether addr is a host address of s other than the server's:
+// not the network address nor the IPv4 broadcast address.
+func (s subnet) host(addr netip.Addr) bool {
+	if !s.prefix.Contains(addr) || addr == s.server || addr == s.prefix.Addr() {
+		return false
+	}
+	return !addr.Is4() || addr != models.LastAddr(s.prefix)
+}
+
+// hostIn returns the host address in list that lies in s.
+func (s subnet) hostIn(list []netip.Prefix) (netip.Addr, bool) {
+	for _, prefix := range list {
+		if prefix.IsSingleIP() && s.prefix.Contains(prefix.Addr()) {
+			return prefix.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// parseList parses a comma-separated list of CIDRs or bare addresses; bare
+// addresses become host prefixes. ok is false if any entry parses as neither.
+func parseList(list string) (result []netip.Prefix, ok bool) {
+	ok = true
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			result = append(result, prefix)
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+		} else if value != "" {
+			ok = false
+		}
+	}
+	return result, ok
+}
+
+// Network is a prefix routed somewhere other than to a peer's tunnel address:
+// a site LAN behind a peer, a joined ZeroTier network, or a route learned over
+// BGP. A peer given an address inside one is unreachable, and can take the
+// site down with it.
+type Network struct {
+	Prefix netip.Prefix // masked
+	Source string       // what routes it, for messages
+	PeerID string       // the peer routing it, which it does not conflict with
+}
+
+type owner struct{ id, name string }
+
+// Allocator hands out and checks tunnel addresses on one server. Build it from
+// the whole config inside a store write; it remembers what it hands out, so a
+// batch of new peers never collides.
+type Allocator struct {
+	subnets  []subnet
+	pools    []models.AddressPool
+	reserved []models.AddressReservation
+	derive   bool
+	used     map[netip.Addr]owner
+	networks []Network
+	// delegation is the pool delegated prefixes come from, if configured.
+	delegation netip.Prefix
+}
+
+// New returns an allocator for cfg. routed are the networks known outside
+// config.yaml, from ZeroTier and BGP; the peers' own routes are read from cfg.
+func New(cfg *models.AppConfig, routed []Network) (*Allocator, error) {
+	subnets, err := subnets(cfg.Server.Address)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	a := &Allocator{
+		subnets:  subnets,
+		pools:    cfg.Server.ParsedAddressPools(),
+		reserved: cfg.Server.ParsedReservedAddresses(),
+		derive:   cfg.Server.DeriveIPv6,
+		used:     make(map[netip.Addr]owner),
+	}
+	if pool, err := netip.ParsePrefix(cfg.Server.DelegationPool); err == nil && pool.Addr().Is6() {
+		a.delegation = pool.Masked()
 	}
+	for _, p := range cfg.Peers {
+		a.Use(p, p.AllowedIPs)
+		for _, route := range p.AdvertisedRoutes {
+			if prefix, err := netip.ParsePrefix(strings.TrimSpace(route)); err == nil {
+				a.networks = append(a.networks, Network{Prefix: prefix.Masked(), Source: fmt.Sprintf("%s advertised by %q", prefix.Masked(), p.Name), PeerID: p.ID})
+			}
+		}
+		a.delegate(p, p.DelegatedPrefix)
+	}
+	a.networks = append(a.networks, routed...)
+	return a, nil
+}
 
-	used := make(map[string]bool)
-	used[serverIP.String()] = true
+// Use records addresses, a comma-separated list, as p's. A wider prefix than a
+// single address is a network routed to p.
+func (a *Allocator) Use(p models.Peer, addresses string) {
+	prefixes, _ := parseList(addresses)
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			a.used[prefix.Addr()] = owner{id: p.ID, name: p.Name}
+		} else {
+			a.networks = append(a.networks, Network{Prefix: prefix.Masked(), Source: fmt.Sprintf("%s routed to %q", prefix.Masked(), p.Name), PeerID: p.ID})
+		}
+	}
+}
 
-	// Exclude network and broadcast addresses.
-	networkAddr := ipNet.IP
-	prefixBits := 128
-	if ip4 := networkAddr.To4(); ip4 != nil {
-		networkAddr = ip4
-		prefixBits = 32
-		used[networkAddr.String()] = true
-		used[broadcastAddress(ipNet).String()] = true
+// conflict returns the network other than p's own that addr, a host address
+// of s, lies in. A network covering all of s is an aggregate such as a default
+// route, not a conflict.
+func (a *Allocator) conflict(p *models.Peer, s subnet, addr netip.Addr) (Network, bool) {
+	for _, n := range a.networks {
+		if n.PeerID != "" && n.PeerID == p.ID {
+			continue
+		}
+		if n.Prefix.Contains(addr) && !(n.Prefix.Bits() <= s.prefix.Bits() && n.Prefix.Contains(s.prefix.Addr())) {
+			return n, true
+		}
+	}
+	return Network{}, false
+}
+
+// scope returns where p's new address in s comes from: the pool p's tags
+// select, else the untagged pool, else s less every pool in it.
+func (a *Allocator) scope(p *models.Peer, s subnet) (netip.Prefix, []netip.Prefix) {
+	var inside []models.AddressPool
+	for _, pool := range a.pools {
+		if s.prefix.Bits() <= pool.Prefix.Bits() && s.prefix.Contains(pool.Prefix.Addr()) {
+			inside = append(inside, pool)
+		}
+	}
+	for _, pool := range inside {
+		if pool.Selects(p) {
+			return pool.Prefix, nil
+		}
+	}
+	for _, pool := range inside {
+		if len(pool.Tags) == 0 {
+			return pool.Prefix, nil
+		}
+	}
+	excluded := make([]netip.Prefix, len(inside))
+	for i, pool := range inside {
+		excluded[i] = pool.Prefix
+	}
+	return s.prefix, excluded
+}
+
+// blocked reports whether addr, in p's scope of s, cannot be handed to p, and
+// if so the last address of the block it is in, so a search can skip it whole.
+func (a *Allocator) blocked(p *models.Peer, s subnet, excluded []netip.Prefix, addr netip.Addr) (netip.Addr, bool) {
+	if !s.host(addr) {
+		return addr, true
+	}
+	if o, ok := a.used[addr]; ok && o.id != p.ID {
+		return addr, true
+	}
+	for _, prefix := range excluded {
+		if prefix.Contains(addr) {
+			return models.LastAddr(prefix), true
+		}
+	}
+	for _, r := range a.reserved {
+		if r.Contains(addr) && r.Name != p.Name {
+			return r.Last, true
+		}
 	}
+	if n, ok := a.conflict(p, s, addr); ok {
+		return models.LastAddr(n.Prefix), true
+	}
+	return addr, false
+}
+
+// available reports whether addr can be handed to p.
+func (a *Allocator) available(p *models.Peer, s subnet, addr netip.Addr) bool {
+	scope, excluded := a.scope(p, s)
+	if !scope.Contains(addr) {
+		return false
+	}
+	_, blocked := a.blocked(p, s, excluded, addr)
+	return !blocked
+}
+
+func (a *Allocator) next(p *models.Peer, s subnet) (netip.Addr, error) {
+	scope, excluded := a.scope(p, s)
+	for addr := scope.Addr(); addr.IsValid() && scope.Contains(addr); {
+		last, blocked := a.blocked(p, s, excluded, addr)
+		if !blocked {
+			return addr, nil
+		}
+		addr = last.Next()
+	}
+	return netip.Addr{}, fmt.Errorf("no available IPs in subnet %s", scope)
+}
 
-	for _, value := range usedIPs {
-		for _, cidr := range strings.Split(value, ",") {
-			cidr = strings.TrimSpace(cidr)
-			ip, _, parseErr := net.ParseCIDR(cidr)
-			if parseErr != nil {
-				ip = net.ParseIP(cidr)
+// held returns the free address in s reserved for p's name, if any.
+func (a *Allocator) held(p *models.Peer, s subnet) (netip.Addr, bool) {
+	for _, r := range a.reserved {
+		if r.Name != "" && r.Name == p.Name && s.prefix.Contains(r.First) {
+			if _, blocked := a.blocked(p, s, nil, r.First); !blocked {
+				return r.First, true
 			}
-			if ip != nil {
-				used[ip.String()] = true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Assign returns the tunnel addresses p should have: its AllowedIPs, plus a
+// host address (/32 or /128) from every server subnet it has none in, and
+// records them as p's. The address comes from the one reserved for p's name,
+// else from the pool p's tags select, skipping reserved ranges, other peers'
+// addresses and networks routed elsewhere.
+//
+// An empty AllowedIPs gets an address from every subnet. One with no address
+// in any subnet is returned as is: the peer is numbered by hand outside the
+// server subnets. So is one that does not parse, for validation to report.
+//
+// When the server derives IPv6 addresses, a new one reuses the host part of
+// the peer's IPv4 address when that is available (10.0.0.50 in 10.0.0.0/24
+// gives fd00::50 in fd00::/64). previous is the peer's addresses before an
+// edit, "" for a new peer: an IPv6 address derived from the previous IPv4
+// address follows the IPv4 address when it changes.
+func (a *Allocator) Assign(p models.Peer, previous string) (string, error) {
+	addrs, ok := parseList(p.AllowedIPs)
+	inSubnet := slices.ContainsFunc(a.subnets, func(s subnet) bool {
+		_, ok := s.hostIn(addrs)
+		return ok
+	})
+	if !ok || (strings.TrimSpace(p.AllowedIPs) != "" && !inSubnet) {
+		return p.AllowedIPs, nil
+	}
+	if a.derive && previous != "" {
+		prev, _ := parseList(previous)
+		addrs = a.followIPv4(&p, prev, addrs)
+	}
+
+	for _, s := range a.subnets {
+		if _, ok := s.hostIn(addrs); ok {
+			continue
+		}
+		addr, ok := a.held(&p, s)
+		if !ok && a.derive && s.prefix.Addr().Is6() {
+			addr, ok = a.derived(addrs, s)
+			ok = ok && a.available(&p, s, addr)
+		}
+		if !ok {
+			var err error
+			if addr, err = a.next(&p, s); err != nil {
+				return "", err
 			}
 		}
+		addrs = append(addrs, netip.PrefixFrom(addr, addr.BitLen()))
 	}
 
-	ip := nextIP(networkAddr)
-	for ipNet.Contains(ip) {
-		if !used[ip.String()] {
-			return fmt.Sprintf("%s/%d", ip.String(), prefixBits), nil
+	values := make([]string, len(addrs))
+	for i, prefix := range addrs {
+		values[i] = prefix.String()
+	}
+	result := strings.Join(values, ", ")
+	a.Use(p, result)
+	return result, nil
+}
+
+// followIPv4 replaces IPv6 addresses derived from the previous IPv4 address
+// with ones derived from the current IPv4 address.
+func (a *Allocator) followIPv4(p *models.Peer, previous, current []netip.Prefix) []netip.Prefix {
+	current = slices.Clone(current)
+	for _, s := range a.subnets {
+		if !s.prefix.Addr().Is6() {
+			continue
+		}
+		old, ok := a.derived(previous, s)
+		if !ok {
+			continue
+		}
+		i := slices.Index(current, netip.PrefixFrom(old, old.BitLen()))
+		if next, ok := a.derived(current, s); i >= 0 && ok && next != old && a.available(p, s, next) {
+			current[i] = netip.PrefixFrom(next, next.BitLen())
 		}
-		ip = nextIP(ip)
 	}
+	return current
+}
 
-	return "", fmt.Errorf("no available IPs in subnet %s", ipNet.String())
+// derived returns the address in the IPv6 subnet v6 with the host part of the
+// first IPv4 subnet address in addrs.
+func (a *Allocator) derived(addrs []netip.Prefix, v6 subnet) (netip.Addr, bool) {
+	for _, s := range a.subnets {
+		v4, ok := s.hostIn(addrs)
+		if !ok || !v4.Is4() {
+			continue
+		}
+		// The host number's decimal digits, read as hex: 10.0.0.50 pairs with
+		// ::50 rather than ::32, so the pair is recognisable at a glance.
+		host, _ := strconv.ParseUint(strconv.FormatUint(uint64(uint32FromAddr(v4)-uint32FromAddr(s.prefix.Addr())), 10), 16, 64)
+		b := v6.prefix.Addr().As16()
+		low := binary.BigEndian.Uint64(b[8:])
+		if low+host < low {
+			return netip.Addr{}, false
+		}
+		binary.BigEndian.PutUint64(b[8:], low+host)
+		addr := netip.AddrFrom16(b)
+		return addr, v6.prefix.Contains(addr)
+	}
+	return netip.Addr{}, false
+}
+
+func uint32FromAddr(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
 }
 
-func allocationNetwork(addresses string) (net.IP, *net.IPNet, error) {
-	var firstIP net.IP
-	var firstNet *net.IPNet
-	for _, value := range strings.Split(addresses, ",") {
-		ip, network, err := net.ParseCIDR(strings.TrimSpace(value))
+// delegate records prefix, if it parses, as delegated to p.
+func (a *Allocator) delegate(p models.Peer, prefix string) {
+	if parsed, err := netip.ParsePrefix(prefix); err == nil {
+		a.networks = append(a.networks, Network{Prefix: parsed.Masked(), Source: fmt.Sprintf("%s delegated to %q", parsed.Masked(), p.Name), PeerID: p.ID})
+	}
+}
+
+// overlapping returns the network other than p's own that prefix overlaps. A
+// network covering the whole delegation pool, or a default route, is an
+// aggregate rather than a conflict.
+func (a *Allocator) overlapping(p *models.Peer, prefix netip.Prefix) (Network, bool) {
+	for _, n := range a.networks {
+		if (n.PeerID != "" && n.PeerID == p.ID) || n.Prefix.Bits() == 0 {
+			continue
+		}
+		if a.delegation.IsValid() && n.Prefix.Bits() <= a.delegation.Bits() && n.Prefix.Contains(a.delegation.Addr()) {
+			continue
+		}
+		if n.Prefix.Overlaps(prefix) {
+			return n, true
+		}
+	}
+	return Network{}, false
+}
+
+// Delegate returns the delegated prefix p should have, and records it as p's.
+// A request for a length alone, such as "/56", gets the first free prefix of
+// that length in the delegation pool: one overlapping no other peer's
+// delegated prefix or routes, nor a network routed elsewhere. Anything else is
+// returned as is, a CIDR in canonical form, for validation to report if it
+// does not parse.
+func (a *Allocator) Delegate(p models.Peer) (string, error) {
+	request := strings.TrimSpace(p.DelegatedPrefix)
+	if !strings.HasPrefix(request, "/") {
+		if prefix, err := netip.ParsePrefix(request); err == nil && prefix.Masked() == prefix {
+			request = prefix.String()
+		}
+		a.delegate(p, request)
+		return request, nil
+	}
+	if !a.delegation.IsValid() {
+		return "", fmt.Errorf("no delegation pool is configured to allocate %s from", request)
+	}
+	bits, err := strconv.Atoi(request[1:])
+	if err != nil || bits < a.delegation.Bits() || bits > 128 {
+		return "", fmt.Errorf("%s does not fit in the delegation pool %s", request, a.delegation)
+	}
+
+	for addr := a.delegation.Addr(); addr.IsValid() && a.delegation.Contains(addr); {
+		candidate := netip.PrefixFrom(addr, bits)
+		last := models.LastAddr(candidate)
+		n, blocked := a.overlapping(&p, candidate)
+		if !blocked {
+			result := candidate.String()
+			a.delegate(p, result)
+			return result, nil
+		}
+		// A wider network blocks every candidate inside it.
+		if n.Prefix.Bits() < bits {
+			last = models.LastAddr(n.Prefix)
+		}
+		addr = last.Next()
+	}
+	return "", fmt.Errorf("no free %s left in the delegation pool %s", request, a.delegation)
+}
+
+// Check reports tunnel addresses of p that lie inside a network routed
+// elsewhere, and advertised routes of p that swallow another peer's tunnel
+// address. Either way, traffic for one of them would go to the wrong place.
+func (a *Allocator) Check(p models.Peer) models.ValidationErrors {
+	var errs models.ValidationErrors
+	addrs, _ := parseList(p.AllowedIPs)
+	for _, prefix := range addrs {
+		for _, s := range a.subnets {
+			if !prefix.IsSingleIP() || !s.prefix.Contains(prefix.Addr()) {
+				continue
+			}
+			if n, ok := a.conflict(&p, s, prefix.Addr()); ok {
+				errs = append(errs, models.ValidationError{Field: "allowedIPs", Message: fmt.Sprintf("%s is inside %s", prefix.Addr(), n.Source)})
+			}
+		}
+	}
+
+	used := make([]netip.Addr, 0, len(a.used))
+	for addr := range a.used {
+		used = append(used, addr)
+	}
+	slices.SortFunc(used, netip.Addr.Compare)
+	for _, route := range p.AdvertisedRoutes {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(route))
 		if err != nil {
 			continue
 		}
-		if firstNet == nil {
-			firstIP, firstNet = ip, network
+		prefix = prefix.Masked()
+		for _, addr := range used {
+			o := a.used[addr]
+			if o.id == p.ID || !prefix.Contains(addr) {
+				continue
+			}
+			for _, s := range a.subnets {
+				if s.prefix.Contains(addr) && !(prefix.Bits() <= s.prefix.Bits() && prefix.Contains(s.prefix.Addr())) {
+					errs = append(errs, models.ValidationError{Field: "advertisedRoutes", Message: fmt.Sprintf("%s covers %s, the address of %q", prefix, addr, o.name)})
+				}
+			}
+		}
+	}
+
+	if prefix, err := netip.ParsePrefix(p.DelegatedPrefix); err == nil {
+		if n, ok := a.overlapping(&p, prefix.Masked()); ok {
+			errs = append(errs, models.ValidationError{Field: "delegatedPrefix", Message: fmt.Sprintf("%s overlaps %s", prefix.Masked(), n.Source)})
+		}
+		for _, addr := range used {
+			if o := a.used[addr]; o.id != p.ID && prefix.Contains(addr) {
+				errs = append(errs, models.ValidationError{Field: "delegatedPrefix", Message: fmt.Sprintf("%s covers %s, the address of %q", prefix.Masked(), addr, o.name)})
+			}
 		}
-		// Preserve the established behavior for dual-stack servers by preferring
-		// their IPv4 pool regardless of address-list ordering.
-		if ip.To4() != nil {
-			return ip, network, nil
+	}
+	return errs
+}
+
+// Conflicts runs Check over every peer, for the utilisation view.
+func (a *Allocator) Conflicts(peers []models.Peer) []string {
+	var result []string
+	for _, p := range peers {
+		for _, e := range a.Check(p) {
+			result = append(result, fmt.Sprintf("%s: %s", p.Name, e.Message))
 		}
 	}
-	if firstNet != nil {
-		return firstIP, firstNet, nil
+	return result
+}
+
+// PoolUsage is one row of the address utilisation view: a server subnet, or
+// a named pool inside one.
+type PoolUsage struct {
+	Name     string // "" for a whole subnet
+	Prefix   string
+	Tags     []string
+	Capacity string // host addresses, "2^N" when too many to count
+	Used     int
+	Reserved uint64
+	Percent  int // Used as a share of Capacity
+}
+
+// Usage returns every subnet followed by the pools inside it.
+func (a *Allocator) Usage() []PoolUsage {
+	var rows []PoolUsage
+	for _, s := range a.subnets {
+		rows = append(rows, a.usage(s, s.prefix))
+		for _, pool := range a.pools {
+			if s.prefix.Bits() <= pool.Prefix.Bits() && s.prefix.Contains(pool.Prefix.Addr()) {
+				row := a.usage(s, pool.Prefix)
+				row.Name, row.Tags = pool.Name, pool.Tags
+				rows = append(rows, row)
+			}
+		}
 	}
-	return nil, nil, fmt.Errorf("invalid server address %q", addresses)
+	return rows
 }
 
-func nextIP(ip net.IP) net.IP {
-	if ip == nil {
-		return nil
+func (a *Allocator) usage(s subnet, prefix netip.Prefix) PoolUsage {
+	row := PoolUsage{Prefix: prefix.String()}
+	for addr := range a.used {
+		if prefix.Contains(addr) && s.host(addr) {
+			row.Used++
+		}
 	}
-	if ip4 := ip.To4(); ip4 != nil {
-		ip = ip4
-	} else {
-		ip = ip.To16()
+	for _, r := range a.reserved {
+		first, last := r.First, r.Last
+		if first.BitLen() != prefix.Addr().BitLen() || last.Less(prefix.Addr()) || models.LastAddr(prefix).Less(first) {
+			continue
+		}
+		first, last = maxAddr(first, prefix.Addr()), minAddr(last, models.LastAddr(prefix))
+		row.Reserved = addSaturating(row.Reserved, span(first, last))
+	}
+
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits >= 63 {
+		row.Capacity = "2^" + strconv.Itoa(bits)
+		return row
 	}
-	next := append(net.IP(nil), ip...)
-	for i := len(next) - 1; i >= 0; i-- {
-		next[i]++
-		if next[i] != 0 {
-			return next
+	capacity := uint64(1) << bits
+	for _, addr := range slices.Compact([]netip.Addr{prefix.Addr(), s.server, models.LastAddr(prefix)}) {
+		if prefix.Contains(addr) && !s.host(addr) {
+			capacity--
 		}
 	}
-	return nil
+	row.Capacity = strconv.FormatUint(capacity, 10)
+	if capacity > 0 {
+		row.Percent = int(uint64(row.Used) * 100 / capacity)
+	}
+	return row
+}
+
+// span returns the number of addresses from first to last, saturating.
+func span(first, last netip.Addr) uint64 {
+	f, l := first.As16(), last.As16()
+	if binary.BigEndian.Uint64(f[:8]) != binary.BigEndian.Uint64(l[:8]) {
+		return math.MaxUint64
+	}
+	return addSaturating(binary.BigEndian.Uint64(l[8:])-binary.BigEndian.Uint64(f[8:]), 1)
+}
+
+func addSaturating(a, b uint64) uint64 {
+	if a+b < a {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+func minAddr(a, b netip.Addr) netip.Addr {
+	if a.Less(b) {
+		return a
+	}
+	return b
 }
 
-func broadcastAddress(n *net.IPNet) net.IP {
-	ip := n.IP.To4()
-	mask := n.Mask
-	broadcast := make(net.IP, 4)
-	for i := range ip {
-		broadcast[i] = ip[i] | ^mask[i]
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Less(b) {
+		return b
 	}
-	return broadcast
+	return a
 }
@@ -1,26 +1,204 @@
 package ipam
 
-import "testing"
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
 
-func TestNextAvailableIPHandlesAddressLists(t *testing.T) {
-	got, err := NextAvailableIP(
-		"fd00::1/64, 10.0.0.1/24",
-		[]string{"10.0.0.2/32, fd00::2/128"},
-	)
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// allocator returns an allocator for server, where each of used is the
+// AllowedIPs of another peer.
+func allocator(t *testing.T, server models.ServerConfig, used ...string) *Allocator {
+	t.Helper()
+	cfg := models.AppConfig{Server: server}
+	for i, ips := range used {
+		cfg.Peers = append(cfg.Peers, models.Peer{ID: fmt.Sprint("used", i), Name: fmt.Sprint("used", i), AllowedIPs: ips})
+	}
+	a, err := New(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAssignHandlesAddressLists(t *testing.T) {
+	a := allocator(t, models.ServerConfig{Address: "fd00::1/64, 10.0.0.1/24"}, "10.0.0.2/32, fd00::2/128")
+	got, err := a.Assign(models.Peer{ID: "new"}, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != "10.0.0.3/32" {
-		t.Fatalf("NextAvailableIP = %q, want 10.0.0.3/32", got)
+	if got != "10.0.0.3/32, fd00::3/128" {
+		t.Fatalf("Assign = %q, want 10.0.0.3/32, fd00::3/128", got)
 	}
 }
 
-func TestNextAvailableIPSupportsIPv6Only(t *testing.T) {
-	got, err := NextAvailableIP("fd00::1/120", []string{"fd00::2/128"})
+func TestAssignSupportsIPv6Only(t *testing.T) {
+	got, err := allocator(t, models.ServerConfig{Address: "fd00::1/120"}, "fd00::2/128").Assign(models.Peer{ID: "new"}, "")
 	if err != nil {
 		t.Fatal(err)
 	}
 	if got != "fd00::3/128" {
-		t.Fatalf("NextAvailableIP = %q, want fd00::3/128", got)
+		t.Fatalf("Assign = %q, want fd00::3/128", got)
+	}
+}
+
+func TestAssignSkipsBroadcastAndFullSubnets(t *testing.T) {
+	a := allocator(t, models.ServerConfig{Address: "10.0.0.1/30"})
+	got, err := a.Assign(models.Peer{ID: "first"}, "")
+	if err != nil || got != "10.0.0.2/32" {
+		t.Fatalf("Assign = %q, %v", got, err)
+	}
+	// The allocator remembers what it handed out.
+	if got, err := a.Assign(models.Peer{ID: "second"}, ""); err == nil {
+		t.Fatalf("allocated %q from a full subnet", got)
+	}
+}
+
+func TestAssignCompletesPairs(t *testing.T) {
+	server := models.ServerConfig{Address: "10.0.0.1/24, fd00::1/64"}
+	for _, tc := range []struct {
+		name              string
+		previous, current string
+		used              []string
+		derive            bool
+		want              string
+	}{
+		{"new peer derives", "", "", []string{"10.0.0.2/32"}, true, "10.0.0.3/32, fd00::3/128"},
+		{"derived address taken", "", "", []string{"10.0.0.2/32, fd00::9/128", "fd00::3/128"}, true, "10.0.0.3/32, fd00::2/128"},
+		{"explicit IPv4 gains IPv6", "", "10.0.0.50/32", nil, true, "10.0.0.50/32, fd00::50/128"},
+		{"bare address", "", "10.0.0.7", nil, false, "10.0.0.7/32, fd00::2/128"},
+		{"pair kept", "10.0.0.5/32, fd00::99/128", "10.0.0.5/32, fd00::99/128", nil, true, "10.0.0.5/32, fd00::99/128"},
+		{"derived follows IPv4", "10.0.0.5/32, fd00::5/128", "10.0.0.6/32, fd00::5/128", nil, true, "10.0.0.6/32, fd00::6/128"},
+		{"hand-picked IPv6 stays", "10.0.0.5/32, fd00::77/128", "10.0.0.6/32, fd00::77/128", nil, true, "10.0.0.6/32, fd00::77/128"},
+		{"outside the subnets", "", "192.168.50.2/32", nil, true, "192.168.50.2/32"},
+		{"left for validation", "", "10.0.0.5/32, nonsense", nil, true, "10.0.0.5/32, nonsense"},
+	} {
+		server.DeriveIPv6 = tc.derive
+		got, err := allocator(t, server, tc.used...).Assign(models.Peer{ID: "peer", AllowedIPs: tc.current}, tc.previous)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: Assign = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestAssignHonoursPoolsAndReservations(t *testing.T) {
+	server := models.ServerConfig{
+		Address:           "10.0.0.1/24",
+		AddressPools:      []string{"office 10.0.0.64/26 office", "default 10.0.0.128/25"},
+		ReservedAddresses: []string{"10.0.0.128-10.0.0.131", "10.0.0.70 printer"},
+	}
+	a := allocator(t, server, "10.0.0.64/32")
+	for _, tc := range []struct {
+		peer models.Peer
+		want string
+	}{
+		{models.Peer{ID: "desk", Name: "desk", Tags: []string{"Office"}}, "10.0.0.65/32"},
+		{models.Peer{ID: "printer", Name: "printer", Tags: []string{"office"}}, "10.0.0.70/32"},
+		{models.Peer{ID: "laptop", Name: "laptop"}, "10.0.0.132/32"},
+	} {
+		if got, err := a.Assign(tc.peer, ""); err != nil || got != tc.want {
+			t.Errorf("%s: Assign = %q, %v, want %s", tc.peer.Name, got, err, tc.want)
+		}
+	}
+
+	// Without an untagged pool, untagged peers stay out of every pool.
+	server.AddressPools = server.AddressPools[:1]
+	server.ReservedAddresses = []string{"10.0.0.2/31"}
+	if got, err := allocator(t, server).Assign(models.Peer{ID: "laptop", Name: "laptop"}, ""); err != nil || got != "10.0.0.4/32" {
+		t.Errorf("Assign = %q, %v, want 10.0.0.4/32", got, err)
+	}
+}
+
+func TestAllocatorAvoidsRoutedNetworks(t *testing.T) {
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{Address: "10.0.0.1/24, fd00::1/64"},
+		Peers: []models.Peer{
+			{ID: "site", Name: "site", AllowedIPs: "10.0.0.2/32, fd00::2/128", AdvertisedRoutes: []string{"10.0.0.0/28", "0.0.0.0/0"}},
+		},
+	}
+	routed := []Network{
+		{Prefix: netip.MustParsePrefix("fd00::/65"), Source: "BGP route fd00::/65"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Source: "BGP route 10.0.0.0/8"},
+	}
+	a, err := New(&cfg, routed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Assign(models.Peer{ID: "new", Name: "new"}, "")
+	if err != nil || got != "10.0.0.16/32, fd00::8000:0:0:0/128" {
+		t.Fatalf("Assign = %q, %v", got, err)
+	}
+
+	errs := a.Check(models.Peer{ID: "manual", Name: "manual", AllowedIPs: "10.0.0.5/32"})
+	if len(errs) != 1 || !strings.Contains(errs[0].Message, `10.0.0.0/28 advertised by "site"`) {
+		t.Fatalf("Check(manual) = %v", errs)
+	}
+	errs = a.Check(models.Peer{ID: "lan", Name: "lan", AllowedIPs: "10.0.0.40/32", AdvertisedRoutes: []string{"10.0.0.0/30"}})
+	if len(errs) != 1 || errs[0].Field != "advertisedRoutes" || !strings.Contains(errs[0].Message, `the address of "site"`) {
+		t.Fatalf("Check(lan) = %v", errs)
+	}
+	// The site's own LAN is not a conflict for it; a BGP route is.
+	if conflicts := a.Conflicts(cfg.Peers); len(conflicts) != 1 || conflicts[0] != "site: fd00::2 is inside BGP route fd00::/65" {
+		t.Fatalf("Conflicts = %q", conflicts)
+	}
+}
+
+func TestDelegate(t *testing.T) {
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{Address: "10.0.0.1/24", DelegationPool: "2001:db8::/48"},
+		Peers: []models.Peer{
+			{ID: "a", Name: "a", AllowedIPs: "10.0.0.2/32", DelegatedPrefix: "2001:db8::/56"},
+			{ID: "b", Name: "b", AllowedIPs: "10.0.0.3/32", AdvertisedRoutes: []string{"2001:db8:0:200::/55"}},
+		},
+	}
+	routed := []Network{
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), Source: "BGP route 2001:db8::/32"},
+		{Prefix: netip.MustParsePrefix("2001:db8:0:500::/64"), Source: "BGP route 2001:db8:0:500::/64"},
+	}
+	a, err := New(&cfg, routed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		request, want string
+	}{
+		{"/56", "2001:db8:0:100::/56"},
+		{"/56", "2001:db8:0:400::/56"}, // past b's /55; the upstream /32 is an aggregate
+		{"/56", "2001:db8:0:600::/56"},
+		{"/64", "2001:db8:0:501::/64"}, // beside the routed /64
+		{"2001:DB8:1::/64", "2001:db8:1::/64"},
+	} {
+		p := models.Peer{ID: tc.want, Name: tc.want, DelegatedPrefix: tc.request}
+		if got, err := a.Delegate(p); err != nil || got != tc.want {
+			t.Errorf("Delegate(%s) = %q, %v, want %s", tc.request, got, err, tc.want)
+		}
+	}
+	if _, err := a.Delegate(models.Peer{ID: "c", DelegatedPrefix: "/40"}); err == nil {
+		t.Error("delegated a /40 from a /48")
+	}
+
+	errs := a.Check(models.Peer{ID: "c", Name: "c", DelegatedPrefix: "2001:db8::/52"})
+	if len(errs) == 0 || errs[0].Field != "delegatedPrefix" || !strings.Contains(errs[0].Message, `delegated to "a"`) {
+		t.Fatalf("Check = %v", errs)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	server := models.ServerConfig{
+		Address:           "10.0.0.1/24, fd00::1/64",
+		AddressPools:      []string{"office 10.0.0.64/26 office"},
+		ReservedAddresses: []string{"10.0.0.60-10.0.0.69"},
+	}
+	rows := allocator(t, server, "10.0.0.2/32, fd00::2/128", "10.0.0.65/32").Usage()
+	want := []PoolUsage{
+		{Prefix: "10.0.0.0/24", Capacity: "253", Used: 2, Reserved: 10},
+		{Name: "office", Prefix: "10.0.0.64/26", Tags: []string{"office"}, Capacity: "64", Used: 1, Reserved: 6, Percent: 1},
+		{Prefix: "fd00::/64", Capacity: "2^64", Used: 1},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Fatalf("Usage =\n%v\nwant\n%v", rows, want)
 	}
 }
@@ -0,0 +1,136 @@
+// Package metrics writes the Prometheus text exposition format. wg-busy already
+// keeps everything worth scraping in its own collectors, so rather than mirror
+// that state into a client library's registry, the /metrics handler reads it on
+// each scrape and writes it out with a Writer.
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writer accumulates metric families for one scrape.
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Family starts a metric family: kind is "counter", "gauge" or "histogram".
+// Its samples must follow before the next family starts.
+func (w *Writer) Family(name, kind, help string) {
+	w.buf.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	w.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Sample writes one sample. labels are name, value pairs.
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatValue(value))
+	w.buf.WriteByte('\n')
+}
+
+// Bool writes a sample of 1 for true and 0 for false.
+func (w *Writer) Bool(name string, value bool, labels ...string) {
+	if value {
+		w.Sample(name, 1, labels...)
+	} else {
+		w.Sample(name, 0, labels...)
+	}
+}
+
+// Histogram writes h as a histogram family.
+func (w *Writer) Histogram(name, help string, h *Histogram) {
+	bounds, counts, sum, count := h.snapshot()
+	w.Family(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		w.Sample(name+"_bucket", float64(cumulative), "le", formatValue(bound))
+	}
+	w.Sample(name+"_bucket", float64(count), "le", "+Inf")
+	w.Sample(name+"_sum", sum)
+	w.Sample(name+"_count", float64(count))
+}
+
+// Bytes returns everything written so far.
+func (w *Writer) Bytes() []byte { return w.buf.Bytes() }
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// DefaultBuckets are the upper bounds, in seconds, a zero Histogram counts
+// observations into: from a quick syncconf up to a slow wg-quick restart.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets. The zero value uses
+// DefaultBuckets and is safe for concurrent use.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram with the given ascending upper bounds.
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: slices.Clone(bounds)}
+}
+
+// Observe records one observation.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	if i, _ := slices.BinarySearch(h.bounds, value); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) init() {
+	if h.bounds == nil {
+		h.bounds = DefaultBuckets
+	}
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.bounds))
+	}
+}
+
+func (h *Histogram) snapshot() (bounds []float64, counts []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	return h.bounds, slices.Clone(h.counts), h.sum, h.count
+}
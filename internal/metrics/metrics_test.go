@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWriterEscapesLabelsAndFormatsValues(t *testing.T) {
+	var w Writer
+	w.Family("x_total", "counter", "Help with a \\ and\na newline.")
+	w.Sample("x_total", 1.5, "name", `say "hi"`+"\n", "path", `C:\`)
+	w.Bool("x_up", true)
+	w.Sample("x_inf", math.Inf(1))
+	want := "# HELP x_total Help with a \\\\ and\\na newline.\n" +
+		"# TYPE x_total counter\n" +
+		"x_total{name=\"say \\\"hi\\\"\\n\",path=\"C:\\\\\"} 1.5\n" +
+		"x_up 1\n" +
+		"x_inf +Inf\n"
+	if got := string(w.Bytes()); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramIsCumulative(t *testing.T) {
+	h := NewHistogram(0.1, 1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+	var w Writer
+	w.Histogram("d_seconds", "Durations.", h)
+	want := "# HELP d_seconds Durations.\n" +
+		"# TYPE d_seconds histogram\n" +
+		"d_seconds_bucket{le=\"0.1\"} 2\n" +
+		"d_seconds_bucket{le=\"1\"} 3\n" +
+		"d_seconds_bucket{le=\"+Inf\"} 4\n" +
+		"d_seconds_sum 3.65\n" +
+		"d_seconds_count 4\n"
+	if got := string(w.Bytes()); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The zero value is usable, with the default buckets.
+	var zero Histogram
+	zero.Observe(0.2)
+	if _, counts, _, count := zero.snapshot(); len(counts) != len(DefaultBuckets) || count != 1 {
+		t.Fatalf("zero histogram: %d buckets, %d observations", len(counts), count)
+	}
+}
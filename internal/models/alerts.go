@@ -0,0 +1,208 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Alert rule kinds.
+const (
+	AlertPeerUnseen       = "peer_unseen"        // no handshake from a peer for the rule's For
+	AlertBGPDown          = "bgp_down"           // a BGP session is not established
+	AlertBGPPrefixesBelow = "bgp_prefixes_below" // an established session sends fewer prefixes than Threshold
+	AlertInterfaceDown    = "interface_down"     // wg0 is down
+	AlertZeroTierOffline  = "zerotier_offline"   // ZeroTier is enabled but not online
+	AlertQuotaAbove       = "quota_above"        // a peer has used Threshold percent of its data quota
+)
+
+// AlertKinds lists every rule kind, in the order the UI offers them.
+var AlertKinds = []string{AlertPeerUnseen, AlertBGPDown, AlertBGPPrefixesBelow, AlertInterfaceDown, AlertZeroTierOffline, AlertQuotaAbove}
+
+// Alert severities.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// AlertSeverities lists every severity, least severe first.
+var AlertSeverities = []string{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// MaxAlertFor bounds how long a rule's condition may have to hold.
+const MaxAlertFor = 7 * 24 * time.Hour
+
+// AlertConfig holds the alert rules, the silences and where notifications go.
+// HTTP notifications are the alert.firing and alert.resolved webhook events.
+type AlertConfig struct {
+	Rules    []AlertRule    `yaml:"rules,omitempty"`
+	Silences []AlertSilence `yaml:"silences,omitempty"`
+	Mail     AlertMail      `yaml:"mail,omitempty"`
+}
+
+// AlertRule is a condition wg-busy evaluates itself. An alert fires once the
+// condition has held for For, and resolves when it stops holding.
+type AlertRule struct {
+	ID       string `yaml:"id"`
+	Name     string `yaml:"name"`
+	Enabled  bool   `yaml:"enabled"`
+	Kind     string `yaml:"kind"`
+	Severity string `yaml:"severity"`
+	// Target narrows peer rules to one peer ID and BGP rules to one
+	// neighbour IP; empty matches every peer or neighbour.
+	Target string `yaml:"target,omitempty"`
+	// Threshold is the prefix count of bgp_prefixes_below and the percentage
+	// of quota_above.
+	Threshold float64 `yaml:"threshold,omitempty"`
+	// For is how long the condition must hold before the alert fires. For
+	// peer_unseen it counts from the peer's last handshake.
+	For       time.Duration `yaml:"for,omitempty"`
+	CreatedAt time.Time     `yaml:"createdAt"`
+	UpdatedAt time.Time     `yaml:"updatedAt"`
+}
+
+// TargetsPeers reports whether Target names a peer rather than a BGP neighbour.
+func (r *AlertRule) TargetsPeers() bool {
+	return r.Kind == AlertPeerUnseen || r.Kind == AlertQuotaAbove
+}
+
+// TargetsBGP reports whether Target names a BGP neighbour.
+func (r *AlertRule) TargetsBGP() bool {
+	return r.Kind == AlertBGPDown || r.Kind == AlertBGPPrefixesBelow
+}
+
+// Validate checks all fields on AlertRule and returns all errors found.
+func (r *AlertRule) Validate() ValidationErrors {
+	var errs ValidationErrors
+
+	if strings.TrimSpace(r.Name) == "" {
+		errs = append(errs, ValidationError{Field: "name", Message: "required"})
+	} else if len(r.Name) > 64 {
+		errs = append(errs, ValidationError{Field: "name", Message: "maximum 64 characters"})
+	} else if !nameRegexp.MatchString(r.Name) {
+		errs = append(errs, ValidationError{Field: "name", Message: "only letters, numbers, spaces, dashes, dots, underscores"})
+	}
+
+	if !slices.Contains(AlertKinds, r.Kind) {
+		errs = append(errs, ValidationError{Field: "alertKind", Message: "must be one of " + strings.Join(AlertKinds, ", ")})
+	}
+	if !slices.Contains(AlertSeverities, r.Severity) {
+		errs = append(errs, ValidationError{Field: "alertSeverity", Message: "must be one of " + strings.Join(AlertSeverities, ", ")})
+	}
+
+	switch {
+	case r.Target == "":
+	case r.TargetsBGP():
+		if _, err := netip.ParseAddr(r.Target); err != nil {
+			errs = append(errs, ValidationError{Field: "alertTarget", Message: "must be a BGP neighbour IP address"})
+		}
+	case !r.TargetsPeers():
+		errs = append(errs, ValidationError{Field: "alertTarget", Message: "this kind of rule has no target"})
+	}
+
+	switch r.Kind {
+	case AlertBGPPrefixesBelow:
+		if r.Threshold < 1 || r.Threshold != float64(int64(r.Threshold)) {
+			errs = append(errs, ValidationError{Field: "alertThreshold", Message: "must be a whole number of prefixes, at least 1"})
+		}
+	case AlertQuotaAbove:
+		if r.Threshold <= 0 || r.Threshold > 100 {
+			errs = append(errs, ValidationError{Field: "alertThreshold", Message: "must be a percentage between 0 and 100"})
+		}
+	}
+
+	if r.For < 0 || r.For > MaxAlertFor {
+		errs = append(errs, ValidationError{Field: "alertFor", Message: "must be between 0 and 7 days"})
+	} else if r.Kind == AlertPeerUnseen && r.For < time.Minute {
+		errs = append(errs, ValidationError{Field: "alertFor", Message: "must be at least 1m for peer rules"})
+	}
+
+	return errs
+}
+
+// FindAlertRuleByID returns a pointer to the rule with the given ID, or nil.
+func FindAlertRuleByID(rules []AlertRule, id string) *AlertRule {
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// AlertSilence suppresses the notifications of matching alerts until it ends.
+// Silenced alerts still show in the alerts panel.
+type AlertSilence struct {
+	ID string `yaml:"id"`
+	// Rule is the rule ID to silence; empty silences every rule.
+	Rule string `yaml:"rule,omitempty"`
+	// Subject narrows the silence to one peer ID, neighbour IP or other
+	// subject of the rule; empty silences all of them.
+	Subject   string    `yaml:"subject,omitempty"`
+	Until     time.Time `yaml:"until"`
+	Comment   string    `yaml:"comment,omitempty"`
+	CreatedAt time.Time `yaml:"createdAt"`
+}
+
+// Matches reports whether the silence covers the alert of rule about subject
+// at now.
+func (s *AlertSilence) Matches(rule, subject string, now time.Time) bool {
+	return now.Before(s.Until) && (s.Rule == "" || s.Rule == rule) && (s.Subject == "" || s.Subject == subject)
+}
+
+// Validate checks all fields on AlertSilence and returns all errors found.
+func (s *AlertSilence) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if s.Until.IsZero() {
+		errs = append(errs, ValidationError{Field: "silenceUntil", Message: "required"})
+	}
+	if len(s.Comment) > 256 {
+		errs = append(errs, ValidationError{Field: "silenceComment", Message: "maximum 256 characters"})
+	}
+	return errs
+}
+
+// AlertMail sends notifications through a local mail relay. The relay is
+// trusted: the message is handed over without authentication or TLS.
+type AlertMail struct {
+	Relay string   `yaml:"relay,omitempty"` // host:port; empty disables mail
+	From  string   `yaml:"from,omitempty"`
+	To    []string `yaml:"to,omitempty"`
+	// MinSeverity is the least severe alert that is mailed; empty mails all.
+	MinSeverity string `yaml:"minSeverity,omitempty"`
+}
+
+// Wants reports whether alerts of this severity are mailed.
+func (m *AlertMail) Wants(severity string) bool {
+	return m.Relay != "" && slices.Index(AlertSeverities, severity) >= slices.Index(AlertSeverities, m.MinSeverity)
+}
+
+// Validate checks the mail settings.
+func (m *AlertMail) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if m.Relay == "" {
+		return nil
+	}
+	if host, port, err := net.SplitHostPort(m.Relay); err != nil || host == "" || port == "" {
+		errs = append(errs, ValidationError{Field: "mailRelay", Message: "must be host:port"})
+	}
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		errs = append(errs, ValidationError{Field: "mailFrom", Message: "must be an email address"})
+	}
+	if len(m.To) == 0 {
+		errs = append(errs, ValidationError{Field: "mailTo", Message: "required when a relay is set"})
+	}
+	for _, to := range m.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			errs = append(errs, ValidationError{Field: "mailTo", Message: fmt.Sprintf("%q is not an email address", to)})
+		}
+	}
+	if m.MinSeverity != "" && !slices.Contains(AlertSeverities, m.MinSeverity) {
+		errs = append(errs, ValidationError{Field: "mailMinSeverity", Message: "must be one of " + strings.Join(AlertSeverities, ", ")})
+	}
+	return errs
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Firewall rule actions.
+const (
+	FirewallAllow = "allow"
+	FirewallDeny  = "deny"
+)
+
+// maxPortSlots is how many ports one rule may list: iptables' multiport match
+// takes at most 15, and a LOW-HIGH range uses two of them.
+const maxPortSlots = 15
+
+// Rule target prefixes naming other peers rather than a network:
+// "peer:build-server" is one peer, "group:servers" every peer tagged servers.
+const (
+	FirewallPeerPrefix  = "peer:"
+	FirewallGroupPrefix = "group:"
+)
+
+// FirewallRule is one parsed Peer.FirewallRules entry:
+//
+//	ACTION TARGET [PROTO[/PORTS]]
+//
+// e.g. "allow 10.0.0.10 tcp/22,443", "allow peer:build-server" or
+// "deny 192.168.0.0/16". TARGET is an IP, a CIDR, "peer:NAME", "group:TAG",
+// or "any".
+// PROTO is tcp, udp, icmp, or any (the default); PORTS, for tcp and udp only,
+// is a comma list of ports and LOW-HIGH ranges, at most maxPortSlots of them.
+type FirewallRule struct {
+	Action   string
+	Target   string
+	Protocol string // "" for any
+	Ports    []string
+}
+
+// PeerName returns the peer a "peer:NAME" target refers to.
+func (r FirewallRule) PeerName() (string, bool) {
+	return strings.CutPrefix(r.Target, FirewallPeerPrefix)
+}
+
+// GroupTag returns the tag a "group:TAG" target refers to.
+func (r FirewallRule) GroupTag() (string, bool) {
+	return strings.CutPrefix(r.Target, FirewallGroupPrefix)
+}
+
+// ParseFirewallRule parses one rule line.
+func ParseFirewallRule(s string) (FirewallRule, error) {
+	var rule FirewallRule
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("invalid format (must be 'allow|deny TARGET [PROTO[/PORTS]]'): %s", s)
+	}
+
+	rule.Action = strings.ToLower(fields[0])
+	if rule.Action != FirewallAllow && rule.Action != FirewallDeny {
+		return rule, fmt.Errorf("action must be 'allow' or 'deny': %s", s)
+	}
+
+	rule.Target = fields[1]
+	if name, ok := rule.PeerName(); ok {
+		if name == "" {
+			return rule, fmt.Errorf("missing peer name: %s", s)
+		}
+	} else if tag, ok := rule.GroupTag(); ok {
+		if tag == "" {
+			return rule, fmt.Errorf("missing group tag: %s", s)
+		}
+	} else if strings.EqualFold(rule.Target, "any") {
+		rule.Target = "any"
+	} else if ip := net.ParseIP(rule.Target); ip != nil {
+		rule.Target = ip.String()
+	} else if _, network, err := net.ParseCIDR(rule.Target); err == nil {
+		rule.Target = network.String()
+	} else {
+		return rule, fmt.Errorf("target must be an IP, CIDR, 'peer:NAME', 'group:TAG', or 'any': %s", s)
+	}
+
+	if len(fields) == 3 {
+		proto, ports, hasPorts := strings.Cut(strings.ToLower(fields[2]), "/")
+		switch proto {
+		case "any":
+		case "tcp", "udp", "icmp":
+			rule.Protocol = proto
+		default:
+			return rule, fmt.Errorf("protocol must be tcp, udp, icmp, or any: %s", s)
+		}
+		if hasPorts {
+			if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+				return rule, fmt.Errorf("ports need tcp or udp: %s", s)
+			}
+			slots := 0
+			for _, port := range strings.Split(ports, ",") {
+				if !isValidPortRange(port) {
+					return rule, fmt.Errorf("invalid port %q: %s", port, s)
+				}
+				slots++
+				if strings.Contains(port, "-") {
+					slots++
+				}
+				rule.Ports = append(rule.Ports, port)
+			}
+			if slots > maxPortSlots {
+				return rule, fmt.Errorf("too many ports: at most %d, a range counting as two: %s", maxPortSlots, s)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// isValidPortRange accepts "PORT" or "LOW-HIGH".
+func isValidPortRange(s string) bool {
+	low, high, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(low, 10, 16)
+	if err != nil || lo == 0 {
+		return false
+	}
+	if !isRange {
+		return true
+	}
+	hi, err := strconv.ParseUint(high, 10, 16)
+	return err == nil && hi >= lo
+}
+
+// validateFirewallRules checks the syntax of a peer's rules. Peer targets are
+// resolved by ValidateFirewallRefs, which sees every peer.
+func validateFirewallRules(rules []string) ValidationErrors {
+	var errs ValidationErrors
+	for _, line := range rules {
+		if _, err := ParseFirewallRule(line); err != nil {
+			errs = append(errs, ValidationError{Field: "firewallRules", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// ValidateFirewallRefs checks that every "peer:NAME" target names an existing
+// peer and every "group:TAG" target a tag in use, so a typo cannot silently
+// drop an allow or a deny.
+func ValidateFirewallRefs(peers []Peer) ValidationErrors {
+	names := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		names[p.Name] = true
+	}
+	tags := make(map[string]bool)
+	for _, tag := range PeerTags(peers) {
+		tags[strings.ToLower(tag)] = true
+	}
+
+	var errs ValidationErrors
+	for _, p := range peers {
+		for _, line := range p.FirewallRules {
+			rule, err := ParseFirewallRule(line)
+			if err != nil {
+				continue
+			}
+			if name, ok := rule.PeerName(); ok && !names[name] {
+				errs = append(errs, ValidationError{
+					Field:   "firewallRules",
+					Message: fmt.Sprintf("peer %q has a rule for unknown peer %q", p.Name, name),
+				})
+			}
+			if tag, ok := rule.GroupTag(); ok && !tags[strings.ToLower(tag)] {
+				errs = append(errs, ValidationError{
+					Field:   "firewallRules",
+					Message: fmt.Sprintf("peer %q has a rule for unused tag %q", p.Name, tag),
+				})
+			}
+		}
+	}
+	return errs
+}
@@ -1,10 +1,13 @@
 package models
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,16 +19,23 @@ type AppConfig struct {
 	Peers    []Peer         `yaml:"peers"`
 	BGPPeers []BGPPeer      `yaml:"bgpPeers,omitempty"`
 	ZeroTier ZeroTierConfig `yaml:"zerotier,omitempty"`
+	Webhooks []Webhook      `yaml:"webhooks,omitempty"`
+	Alerts   AlertConfig    `yaml:"alerts,omitempty"`
 }
 
 // Clone returns an independent copy suitable for rollback and reconciliation.
 func (c AppConfig) Clone() AppConfig {
 	clone := c
+	clone.Server.AddressPools = append([]string(nil), c.Server.AddressPools...)
+	clone.Server.ReservedAddresses = append([]string(nil), c.Server.ReservedAddresses...)
 	clone.Peers = append([]Peer(nil), c.Peers...)
 	for i := range clone.Peers {
 		clone.Peers[i].ExitNodeRoutes = append([]string(nil), c.Peers[i].ExitNodeRoutes...)
 		clone.Peers[i].AdvertisedRoutes = append([]string(nil), c.Peers[i].AdvertisedRoutes...)
 		clone.Peers[i].PolicyRoutes = append([]string(nil), c.Peers[i].PolicyRoutes...)
+		clone.Peers[i].Schedule.Windows = append([]string(nil), c.Peers[i].Schedule.Windows...)
+		clone.Peers[i].FirewallRules = append([]string(nil), c.Peers[i].FirewallRules...)
+		clone.Peers[i].Tags = append([]string(nil), c.Peers[i].Tags...)
 	}
 	clone.BGPPeers = append([]BGPPeer(nil), c.BGPPeers...)
 	for i := range clone.BGPPeers {
@@ -33,6 +43,13 @@ func (c AppConfig) Clone() AppConfig {
 		clone.BGPPeers[i].ExportFilters = append([]RouteFilter(nil), c.BGPPeers[i].ExportFilters...)
 	}
 	clone.ZeroTier.Networks = append([]ZeroTierNetwork(nil), c.ZeroTier.Networks...)
+	clone.Webhooks = append([]Webhook(nil), c.Webhooks...)
+	for i := range clone.Webhooks {
+		clone.Webhooks[i].Events = append([]string(nil), c.Webhooks[i].Events...)
+	}
+	clone.Alerts.Rules = append([]AlertRule(nil), c.Alerts.Rules...)
+	clone.Alerts.Silences = append([]AlertSilence(nil), c.Alerts.Silences...)
+	clone.Alerts.Mail.To = append([]string(nil), c.Alerts.Mail.To...)
 	return clone
 }
 
@@ -92,6 +109,26 @@ type ServerConfig struct {
 	BGPListenAddress string `yaml:"bgpListenAddress,omitempty"`
 	BGPListenPort    uint16 `yaml:"bgpListenPort,omitempty"`
 	BGPASN           uint32 `yaml:"bgpAsn,omitempty"`
+	// IsolatePeers rejects new connections between peers' tunnel addresses
+	// unless a peer's own firewall rules allow them.
+	IsolatePeers bool `yaml:"isolatePeers,omitempty"`
+	// DeriveIPv6 gives a peer's IPv6 tunnel address the host part of its IPv4
+	// one (10.0.0.50 and fd00::50) on dual-stack servers.
+	DeriveIPv6 bool `yaml:"deriveIPv6,omitempty"`
+	// AddressPools and ReservedAddresses shape automatic addressing; see
+	// AddressPool and AddressReservation.
+	AddressPools      []string `yaml:"addressPools,omitempty"`
+	ReservedAddresses []string `yaml:"reservedAddresses,omitempty"`
+	// DelegationPool is the IPv6 prefix peers' delegated prefixes are
+	// allocated from; see Peer.DelegatedPrefix.
+	DelegationPool string `yaml:"delegationPool,omitempty"`
+	// ProbeMode selects the peers whose reachability is probed: none, all
+	// enabled peers, or those with Peer.Probe.Enabled; see ProbeModes.
+	ProbeMode string `yaml:"probeMode,omitempty"`
+	// RepairRouting reinstalls policy rules, routes and NAT rules the kernel
+	// lost as soon as the periodic drift check finds them missing, instead of
+	// only reporting them.
+	RepairRouting bool `yaml:"repairRouting,omitempty"`
 }
 
 // RouteFilter represents a single routing policy filter for BGP.
@@ -207,6 +244,39 @@ type Peer struct {
 	RoutingTableID       uint     `yaml:"routingTableID,omitempty"`
 	PolicyRoutingTableID uint     `yaml:"policyRoutingTableID,omitempty"`
 	Enabled              bool     `yaml:"enabled"`
+	// KeyHeld marks a peer whose private key only its own device knows, such
+	// as one imported from a server-side config. PrivateKey is then empty:
+	// wg-busy manages the server side but has no client config to hand out.
+	KeyHeld bool `yaml:"keyHeld,omitempty"`
+	// Tags group peers for filtering, bulk operations and "group:TAG" firewall
+	// rule targets.
+	Tags []string `yaml:"tags,omitempty"`
+	// DelegatedPrefix is an IPv6 prefix routed to the peer besides its tunnel
+	// address, such as a site router's LAN, usually allocated from
+	// ServerConfig.DelegationPool. AnnounceDelegatedPrefix exports it to the
+	// BGP neighbours that take wg-busy's local routes.
+	DelegatedPrefix         string `yaml:"delegatedPrefix,omitempty"`
+	AnnounceDelegatedPrefix bool   `yaml:"announceDelegatedPrefix,omitempty"`
+	// StateReason records why Enabled last changed when it was not a plain
+	// edit, e.g. the access schedule closing.
+	StateReason string         `yaml:"stateReason,omitempty"`
+	Schedule    AccessSchedule `yaml:"schedule,omitempty"`
+	// ExpiresAt, when set, is when the peer loses access for good: the
+	// scheduler disables it then, and does not re-enable it.
+	ExpiresAt time.Time `yaml:"expiresAt,omitempty"`
+	Quota     PeerQuota `yaml:"quota,omitempty"`
+	Usage     PeerUsage `yaml:"usage,omitempty"`
+	RateLimit RateLimit `yaml:"rateLimit,omitempty"`
+	// ExitNodeSharedKbit caps the combined traffic, in each direction, of every
+	// peer routed through this exit node. Only meaningful when IsExitNode.
+	ExitNodeSharedKbit uint32 `yaml:"exitNodeSharedKbit,omitempty"`
+	// FirewallRules are "ACTION TARGET [PROTO[/PORTS]]" lines applied, in order,
+	// to new connections the peer opens; see FirewallRule.
+	FirewallRules []string `yaml:"firewallRules,omitempty"`
+	// FirewallDenyByDefault rejects anything FirewallRules does not allow.
+	FirewallDenyByDefault bool `yaml:"firewallDenyByDefault,omitempty"`
+	// Probe selects and aims the reachability probes; see ServerConfig.ProbeMode.
+	Probe PeerProbe `yaml:"probe,omitempty"`
 
 	CreatedAt time.Time `yaml:"createdAt"`
 	UpdatedAt time.Time `yaml:"updatedAt"`
@@ -369,6 +439,8 @@ func (s *ServerConfig) Validate() ValidationErrors {
 		errs = append(errs, ValidationError{Field: "postDown", Message: "maximum 4096 characters"})
 	}
 
+	errs = append(errs, validateProbeMode(s.ProbeMode)...)
+
 	if s.BGPEnabled {
 		if s.BGPListenAddress != "" && net.ParseIP(s.BGPListenAddress) == nil {
 			errs = append(errs, ValidationError{Field: "bgpListenAddress", Message: "must be a valid IP address"})
@@ -381,6 +453,8 @@ func (s *ServerConfig) Validate() ValidationErrors {
 		}
 	}
 
+	errs = append(errs, s.validateAddressPlan()...)
+
 	return errs
 }
 
@@ -434,9 +508,14 @@ func (p *Peer) Validate(gateways []GatewayNet) ValidationErrors {
 		errs = append(errs, ValidationError{Field: "name", Message: "only letters, numbers, spaces, dashes, dots, underscores"})
 	}
 
-	if p.PrivateKey == "" {
+	switch {
+	case p.KeyHeld:
+		if p.PrivateKey != "" {
+			errs = append(errs, ValidationError{Field: "keyHeld", Message: "cannot be set on a peer with a private key"})
+		}
+	case p.PrivateKey == "":
 		errs = append(errs, ValidationError{Field: "privateKey", Message: "required"})
-	} else if !isValidBase64Key(p.PrivateKey) {
+	case !isValidBase64Key(p.PrivateKey):
 		errs = append(errs, ValidationError{Field: "privateKey", Message: "must be a 44-character base64 key"})
 	}
 
@@ -488,6 +567,12 @@ func (p *Peer) Validate(gateways []GatewayNet) ValidationErrors {
 		}
 	}
 
+	if p.DelegatedPrefix != "" {
+		if ip, network, err := net.ParseCIDR(p.DelegatedPrefix); err != nil || ip.To4() != nil || network.String() != p.DelegatedPrefix {
+			errs = append(errs, ValidationError{Field: "delegatedPrefix", Message: fmt.Sprintf("must be an IPv6 network such as 2001:db8:0:100::/56: %s", p.DelegatedPrefix)})
+		}
+	}
+
 	if len(p.PolicyRoutes) > 0 {
 		// Policy routes are installed as "ip route add <cidr> via <gw> dev <iface>",
 		// so the gateway must be on-link for one of the interfaces we manage —
@@ -513,6 +598,14 @@ func (p *Peer) Validate(gateways []GatewayNet) ValidationErrors {
 		}
 	}
 
+	errs = append(errs, p.Schedule.Validate()...)
+	errs = append(errs, p.Quota.Validate()...)
+	errs = append(errs, p.RateLimit.Validate()...)
+	errs = append(errs, validateRate("exitNodeSharedKbit", p.ExitNodeSharedKbit)...)
+	errs = append(errs, validateFirewallRules(p.FirewallRules)...)
+	errs = append(errs, validateTags(p.Tags)...)
+	errs = append(errs, p.Probe.Validate()...)
+
 	// Strict mode installs a reject rule after the peer's own table lookups.
 	// Without a table to consult first it would drop everything, so require one
 	// rather than letting the peer silently lose all connectivity.
@@ -560,6 +653,9 @@ func ValidateConfig(cfg AppConfig) ValidationErrors {
 		errs = append(errs, cfg.Peers[i].Validate(nil)...)
 	}
 	errs = append(errs, ValidateExitNodeRefs(cfg.Peers)...)
+	errs = append(errs, ValidateFirewallRefs(cfg.Peers)...)
+	errs = append(errs, ValidateReservations(cfg.Server, cfg.Peers)...)
+	errs = append(errs, ValidateDelegations(cfg.Peers)...)
 	for i := range cfg.BGPPeers {
 		errs = append(errs, cfg.BGPPeers[i].Validate()...)
 	}
@@ -640,6 +736,30 @@ func ValidateConfig(cfg AppConfig) ValidationErrors {
 		}
 	}
 
+	webhookIDs := make(map[string]string, len(cfg.Webhooks))
+	for i, hook := range cfg.Webhooks {
+		errs = append(errs, cfg.Webhooks[i].Validate()...)
+		if previous, ok := webhookIDs[hook.ID]; ok {
+			errs = append(errs, ValidationError{Field: "id", Message: fmt.Sprintf("webhook %q duplicates ID used by %q", hook.Name, previous)})
+		} else {
+			webhookIDs[hook.ID] = hook.Name
+		}
+	}
+
+	ruleIDs := make(map[string]string, len(cfg.Alerts.Rules))
+	for i, rule := range cfg.Alerts.Rules {
+		errs = append(errs, cfg.Alerts.Rules[i].Validate()...)
+		if previous, ok := ruleIDs[rule.ID]; ok {
+			errs = append(errs, ValidationError{Field: "id", Message: fmt.Sprintf("alert rule %q duplicates ID used by %q", rule.Name, previous)})
+		} else {
+			ruleIDs[rule.ID] = rule.Name
+		}
+	}
+	for i := range cfg.Alerts.Silences {
+		errs = append(errs, cfg.Alerts.Silences[i].Validate()...)
+	}
+	errs = append(errs, cfg.Alerts.Mail.Validate()...)
+
 	return errs
 }
 
@@ -653,6 +773,9 @@ func effectiveAllowedPrefixes(p Peer) []string {
 			values = append(values, p.ExitNodeRoutes...)
 		}
 		values = append(values, p.AdvertisedRoutes...)
+		if p.DelegatedPrefix != "" && !slices.Contains(p.AdvertisedRoutes, p.DelegatedPrefix) {
+			values = append(values, p.DelegatedPrefix)
+		}
 	}
 
 	result := make([]string, 0, len(values))
@@ -673,6 +796,15 @@ func CascadeClearExitNode(peers []Peer, exitNodeID string) {
 	}
 }
 
+// NewID returns a random opaque ID for a new peer or BGP peer.
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
 // FindPeerByID returns a pointer to the peer with the given ID, or nil.
 func FindPeerByID(peers []Peer, id string) *Peer {
 	for i := range peers {
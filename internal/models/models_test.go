@@ -3,6 +3,7 @@ package models
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 // A policy route becomes "ip route add <cidr> via <gw> dev <iface>", so the
@@ -189,6 +190,33 @@ func TestValidPeerHasNoErrors(t *testing.T) {
 	}
 }
 
+// Only a peer whose device holds its key may go without a private key, and
+// such a peer must not carry one.
+func TestPrivateKeyRequiredUnlessKeyHeld(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*Peer)
+		wantErr string
+	}{
+		{"missing key", func(p *Peer) { p.PrivateKey = "" }, "privateKey"},
+		{"device-held", func(p *Peer) { p.PrivateKey, p.KeyHeld = "", true }, ""},
+		{"device-held with a key", func(p *Peer) { p.KeyHeld = true }, "keyHeld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := validPeer()
+			tt.mutate(&p)
+			errs := p.Validate(nil)
+			switch {
+			case tt.wantErr == "" && len(errs) > 0:
+				t.Fatalf("unexpected errors: %v", errs)
+			case tt.wantErr != "" && (len(errs) != 1 || errs[0].Field != tt.wantErr):
+				t.Fatalf("errors = %v, want one on %s", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestAppConfigCloneIsIndependent(t *testing.T) {
 	original := AppConfig{
 		Peers: []Peer{{
@@ -201,6 +229,7 @@ func TestAppConfigCloneIsIndependent(t *testing.T) {
 			RouteFilters: []RouteFilter{{Prefix: "203.0.113.0/24"}},
 		}},
 		ZeroTier: ZeroTierConfig{Networks: []ZeroTierNetwork{{ID: "8056c2e21c000001", Name: "old"}}},
+		Webhooks: []Webhook{{ID: "hook1", Events: []string{EventPeerCreated}}},
 	}
 	clone := original.Clone()
 	clone.Peers[0].ExitNodeRoutes[0] = "changed"
@@ -208,12 +237,14 @@ func TestAppConfigCloneIsIndependent(t *testing.T) {
 	clone.Peers[0].PolicyRoutes[0] = "changed"
 	clone.BGPPeers[0].RouteFilters[0].Prefix = "changed"
 	clone.ZeroTier.Networks[0].Name = "changed"
+	clone.Webhooks[0].Events[0] = "changed"
 
 	if original.Peers[0].ExitNodeRoutes[0] == "changed" ||
 		original.Peers[0].AdvertisedRoutes[0] == "changed" ||
 		original.Peers[0].PolicyRoutes[0] == "changed" ||
 		original.BGPPeers[0].RouteFilters[0].Prefix == "changed" ||
-		original.ZeroTier.Networks[0].Name == "changed" {
+		original.ZeroTier.Networks[0].Name == "changed" ||
+		original.Webhooks[0].Events[0] == "changed" {
 		t.Fatal("Clone shares mutable slices with the original")
 	}
 }
@@ -325,3 +356,369 @@ func validConfig(peers ...Peer) AppConfig {
 }
 
 func testKey(prefix string) string { return prefix + strings.Repeat("A", 42) + "=" }
+
+func TestAccessScheduleAllows(t *testing.T) {
+	schedule := AccessSchedule{
+		Enabled:  true,
+		Timezone: "Europe/Berlin",
+		Windows:  []string{"mon-fri 08:00-19:00", "sat 22:00-02:00"},
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"weekday inside", time.Date(2026, time.October, 14, 8, 0, 0, 0, berlin), true},
+		{"weekday end is exclusive", time.Date(2026, time.October, 14, 19, 0, 0, 0, berlin), false},
+		{"weekday early", time.Date(2026, time.October, 14, 7, 59, 0, 0, berlin), false},
+		{"sunday", time.Date(2026, time.October, 18, 12, 0, 0, 0, berlin), false},
+		{"overnight start day", time.Date(2026, time.October, 17, 23, 0, 0, 0, berlin), true},
+		{"overnight next day", time.Date(2026, time.October, 18, 1, 30, 0, 0, berlin), true},
+		{"overnight after end", time.Date(2026, time.October, 18, 2, 0, 0, 0, berlin), false},
+		{"zone conversion", time.Date(2026, time.October, 14, 6, 30, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := schedule.Allows(tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Allows(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+
+	schedule.Enabled = false
+	if got, _ := schedule.Allows(time.Date(2026, time.October, 18, 12, 0, 0, 0, berlin)); !got {
+		t.Fatal("a disabled schedule must not restrict the peer")
+	}
+}
+
+func TestAccessScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule AccessSchedule
+		field    string
+	}{
+		{"valid", AccessSchedule{Enabled: true, Windows: []string{"weekdays 08:00-24:00", "fri-mon 10:00-12:00"}}, ""},
+		{"unknown timezone", AccessSchedule{Timezone: "Mars/Olympus"}, "scheduleTimezone"},
+		{"unknown day", AccessSchedule{Windows: []string{"funday 08:00-19:00"}}, "scheduleWindows"},
+		{"bad time", AccessSchedule{Windows: []string{"mon 25:00-26:00"}}, "scheduleWindows"},
+		{"missing range", AccessSchedule{Windows: []string{"mon 08:00"}}, "scheduleWindows"},
+		{"enabled without windows", AccessSchedule{Enabled: true}, "scheduleWindows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.schedule.Validate()
+			if tt.field == "" && len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if tt.field != "" && !errs.HasField(tt.field) {
+				t.Fatalf("errors = %v, want %s", errs, tt.field)
+			}
+		})
+	}
+}
+
+func TestSetPeerEnabledCascadesDisabledExitNode(t *testing.T) {
+	peers := []Peer{
+		{ID: "exit", Enabled: true, IsExitNode: true},
+		{ID: "client", Enabled: true, ExitNodeID: "exit"},
+	}
+	now := time.Date(2026, time.October, 14, 8, 0, 0, 0, time.UTC)
+	p := SetPeerEnabled(peers, "exit", false, StateReasonScheduleClosed, now)
+	if p == nil || p.Enabled || p.StateReason != StateReasonScheduleClosed || !p.UpdatedAt.Equal(now) {
+		t.Fatalf("updated peer = %#v", p)
+	}
+	if peers[1].ExitNodeID != "" {
+		t.Fatal("disabling an exit node did not clear references to it")
+	}
+	if SetPeerEnabled(peers, "missing", true, StateReasonManual, now) != nil {
+		t.Fatal("missing peer returned non-nil")
+	}
+}
+
+func TestQuotaPeriodStart(t *testing.T) {
+	wed := time.Date(2026, time.October, 14, 15, 4, 5, 0, time.UTC)
+	cases := map[string]time.Time{
+		QuotaPeriodDaily:   time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC),
+		QuotaPeriodWeekly:  time.Date(2026, time.October, 12, 0, 0, 0, 0, time.UTC),
+		QuotaPeriodMonthly: time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC),
+		"":                 time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for period, want := range cases {
+		if got := (PeerQuota{Period: period}).PeriodStart(wed); !got.Equal(want) {
+			t.Errorf("period %q: start = %s, want %s", period, got, want)
+		}
+	}
+	sunday := time.Date(2026, time.October, 18, 23, 0, 0, 0, time.UTC)
+	if got := (PeerQuota{Period: QuotaPeriodWeekly}).PeriodStart(sunday); !got.Equal(cases[QuotaPeriodWeekly]) {
+		t.Errorf("weekly start for Sunday = %s", got)
+	}
+}
+
+func TestPeerUsageRollsOverWithPeriod(t *testing.T) {
+	var usage PeerUsage
+	quota := PeerQuota{Period: QuotaPeriodDaily}
+	day1 := time.Date(2026, time.October, 14, 10, 0, 0, 0, time.UTC)
+	usage.AddTransfer(quota, Transfer{Rx: 100, Tx: 50}, day1)
+	usage.AddTransfer(quota, Transfer{Rx: 1}, day1.Add(time.Hour))
+	if usage.Total() != 151 || usage.CurrentTotal(quota, day1) != 151 {
+		t.Fatalf("usage = %#v", usage)
+	}
+
+	day2 := day1.AddDate(0, 0, 1)
+	if got := usage.CurrentTotal(quota, day2); got != 0 {
+		t.Fatalf("usage from a finished period counted: %d", got)
+	}
+	usage.Exceeded = true
+	usage.AddTransfer(quota, Transfer{Tx: 7}, day2)
+	if usage.Rx != 0 || usage.Tx != 7 || !usage.Exceeded {
+		t.Fatalf("usage after rollover = %#v, want counts reset and Exceeded left to the enforcer", usage)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]uint64{
+		"":       0,
+		"1024":   1024,
+		"500MB":  500 << 20,
+		"1.5 GB": 3 << 29,
+		"2t":     2 << 40,
+		"10 KB":  10 << 10,
+	}
+	for input, want := range cases {
+		got, err := ParseByteSize(input)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"lots", "-1GB", "GB", "inf", "-Inf", "NaN", "-0", "1e30", "16777216 TB"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) accepted", input)
+		}
+	}
+}
+
+func TestQuotaValidate(t *testing.T) {
+	if errs := (PeerQuota{Limit: 1, Action: QuotaActionThrottle}).Validate(); !errs.HasField("quotaThrottleKbit") {
+		t.Errorf("throttle without a rate accepted: %v", errs)
+	}
+	if errs := (PeerQuota{Period: "yearly", Action: "explode"}).Validate(); !errs.HasField("quotaPeriod") || !errs.HasField("quotaAction") {
+		t.Errorf("unknown period/action accepted: %v", errs)
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	rule := AlertRule{Name: "rr down", Kind: AlertBGPDown, Severity: SeverityCritical, Target: "peer-id", For: 8 * 24 * time.Hour}
+	if errs := rule.Validate(); !errs.HasField("alertTarget") || !errs.HasField("alertFor") {
+		t.Errorf("errs = %v", errs)
+	}
+	rule = AlertRule{Name: "quota", Kind: AlertQuotaAbove, Severity: SeverityWarning, Threshold: 120}
+	if errs := rule.Validate(); !errs.HasField("alertThreshold") || len(errs) != 1 {
+		t.Errorf("errs = %v", errs)
+	}
+	mail := AlertMail{Relay: "localhost", From: "wg-busy", To: []string{"ops@example.com"}}
+	if errs := mail.Validate(); !errs.HasField("mailRelay") || !errs.HasField("mailFrom") {
+		t.Errorf("mail errs = %v", errs)
+	}
+	if mail := (AlertMail{Relay: "localhost:25", MinSeverity: SeverityWarning}); mail.Wants(SeverityInfo) || !mail.Wants(SeverityCritical) {
+		t.Error("MinSeverity not applied")
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	if errs := (RateLimit{UploadKbit: 4, DownloadKbit: 0}).Validate(); !errs.HasField("rateLimitUpload") || errs.HasField("rateLimitDownload") {
+		t.Errorf("errs = %v", errs)
+	}
+	if errs := (RateLimit{UploadKbit: MinRateKbit, DownloadKbit: 100000}).Validate(); len(errs) > 0 {
+		t.Errorf("valid limits rejected: %v", errs)
+	}
+}
+
+func TestParseFirewallRule(t *testing.T) {
+	rule, err := ParseFirewallRule("ALLOW 10.0.0.10 tcp/22,8000-8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != FirewallAllow || rule.Target != "10.0.0.10" || rule.Protocol != "tcp" || len(rule.Ports) != 2 || rule.Ports[1] != "8000-8080" {
+		t.Fatalf("rule = %#v", rule)
+	}
+	if rule, err := ParseFirewallRule("deny 192.168.1.7/16"); err != nil || rule.Target != "192.168.0.0/16" || rule.Protocol != "" {
+		t.Fatalf("CIDR rule = %#v, %v", rule, err)
+	}
+	if name, ok := (FirewallRule{Target: "peer:build"}).PeerName(); !ok || name != "build" {
+		t.Fatalf("PeerName = %q, %v", name, ok)
+	}
+
+	for _, bad := range []string{
+		"allow",
+		"permit any",
+		"allow somewhere",
+		"allow any gre",
+		"allow any icmp/8",
+		"allow any tcp/0",
+		"allow any udp/90-80",
+		"allow peer:",
+	} {
+		if _, err := ParseFirewallRule(bad); err == nil {
+			t.Errorf("ParseFirewallRule(%q) accepted", bad)
+		}
+	}
+}
+
+func TestParseFirewallRuleFitsMultiport(t *testing.T) {
+	// 13 ports and one range fill all 15 slots of iptables' multiport match.
+	ports := "1,2,3,4,5,6,7,8,9,10,11,12,13,8000-8080"
+	if rule, err := ParseFirewallRule("allow any tcp/" + ports); err != nil || len(rule.Ports) != 14 {
+		t.Fatalf("15 slots: %#v, %v", rule, err)
+	}
+	for _, bad := range []string{
+		"allow any tcp/" + ports + ",14",
+		"allow any udp/1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16",
+		"allow any tcp/1-2,3-4,5-6,7-8,9-10,11-12,13-14,15-16",
+	} {
+		if _, err := ParseFirewallRule(bad); err == nil || !strings.Contains(err.Error(), "too many ports") {
+			t.Errorf("ParseFirewallRule(%q) = %v, want too many ports", bad, err)
+		}
+	}
+}
+
+func TestValidateFirewallRefsRejectsUnknownPeer(t *testing.T) {
+	peers := []Peer{
+		{Name: "contractor", FirewallRules: []string{"allow peer:build tcp/22", "allow peer:ghost"}},
+		{Name: "build"},
+	}
+	errs := ValidateFirewallRefs(peers)
+	if len(errs) != 1 || !strings.Contains(errs[0].Message, "ghost") {
+		t.Fatalf("errs = %v", errs)
+	}
+}
+
+func TestParseTagsAndPeerTags(t *testing.T) {
+	tags := ParseTags("office, laptops Office,,ops\n")
+	if len(tags) != 3 || tags[0] != "office" || tags[1] != "laptops" || tags[2] != "ops" {
+		t.Fatalf("ParseTags = %q", tags)
+	}
+	peers := []Peer{{Tags: []string{"ops", "Office"}}, {Tags: []string{"office", "laptops"}}}
+	if got := PeerTags(peers); len(got) != 3 || got[0] != "laptops" || got[1] != "Office" || got[2] != "ops" {
+		t.Fatalf("PeerTags = %q", got)
+	}
+	if !peers[1].HasTag("OFFICE") || peers[1].HasTag("ops") {
+		t.Fatal("HasTag must match case-insensitively and only the peer's own tags")
+	}
+	if errs := validateTags([]string{"ok-tag_1.x", "-lead", "has space", strings.Repeat("a", 33)}); len(errs) != 3 {
+		t.Fatalf("errs = %v", errs)
+	}
+}
+
+func TestValidateFirewallRefsRejectsUnusedTag(t *testing.T) {
+	peers := []Peer{
+		{Name: "contractor", FirewallRules: []string{"allow group:Servers tcp/22", "allow group:ghosts"}},
+		{Name: "build", Tags: []string{"servers"}},
+	}
+	errs := ValidateFirewallRefs(peers)
+	if len(errs) != 1 || !strings.Contains(errs[0].Message, "ghosts") {
+		t.Fatalf("errs = %v", errs)
+	}
+}
+
+func TestAddressPlanValidation(t *testing.T) {
+	server := ServerConfig{
+		PrivateKey: testKey("A"), ListenPort: 51820, Address: "10.0.0.1/24",
+		AddressPools:      []string{"office 10.0.0.64/26 office", "lab 10.0.0.96/27", "far 10.1.0.0/24", "bad"},
+		ReservedAddresses: []string{"10.0.0.9-10.0.0.2", "10.0.0.0/30 gateway", "10.0.0.10 printer"},
+	}
+	errs := server.Validate()
+	var messages []string
+	for _, e := range errs {
+		messages = append(messages, e.Message)
+	}
+	got := strings.Join(messages, "\n")
+	for _, want := range []string{"pools office and lab overlap", "pool far: 10.1.0.0/24 is not inside", "invalid format", "invalid range", "only a single address"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("errors lack %q:\n%s", want, got)
+		}
+	}
+	if len(errs) != 5 {
+		t.Fatalf("errs = %v", errs)
+	}
+
+	server.AddressPools, server.ReservedAddresses = nil, []string{"10.0.0.10 printer"}
+	peer := validPeer()
+	peer.AllowedIPs, peer.Enabled = "10.0.0.10/32", true
+	cfg := validConfig(peer)
+	cfg.Server = server
+	if errs := ValidateConfig(cfg); len(errs) != 1 || !strings.Contains(errs[0].Message, `reserved for "printer"`) {
+		t.Fatalf("ValidateConfig = %v", errs)
+	}
+	cfg.Peers[0].Name = "printer"
+	if errs := ValidateConfig(cfg); len(errs) != 0 {
+		t.Fatalf("ValidateConfig = %v", errs)
+	}
+}
+
+func TestDelegationValidation(t *testing.T) {
+	server := validConfig().Server
+	for pool, want := range map[string]string{
+		"2001:db8::/48":  "",
+		"10.1.0.0/16":    "must be an IPv6 network",
+		"2001:db8::1/48": "must be an IPv6 network",
+		"2001:db8::/96":  "must be a /64 or larger",
+		"fd00::/48":      "overlaps the server subnet",
+	} {
+		server.Address, server.DelegationPool = "10.0.0.1/24, fd00::1/64", pool
+		errs := server.Validate()
+		if want == "" && len(errs) > 0 || want != "" && (len(errs) != 1 || !strings.Contains(errs[0].Message, want)) {
+			t.Errorf("pool %s: errs = %v, want %q", pool, errs, want)
+		}
+	}
+
+	a, b := validPeer(), validPeer()
+	a.ID, a.Name, a.Enabled, a.DelegatedPrefix = "a", "a", true, "2001:db8::/56"
+	b.ID, b.Name, b.Enabled, b.DelegatedPrefix = "b", "b", true, "2001:db8::/64"
+	b.PublicKey, b.AllowedIPs = testKey("B"), "10.0.0.6/32"
+	if errs := ValidateConfig(validConfig(a, b)); len(errs) != 1 || errs[0].Field != "delegatedPrefix" {
+		t.Fatalf("overlapping delegations: %v", errs)
+	}
+	b.DelegatedPrefix = "2001:db8:0:100::1/56"
+	if errs := b.Validate(nil); len(errs) != 1 || errs[0].Field != "delegatedPrefix" {
+		t.Fatalf("host bits set: %v", errs)
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	peer := Peer{Enabled: true, AllowedIPs: "10.0.0.2/32, fd00::2/128"}
+	for _, tc := range []struct {
+		mode   string
+		probe  PeerProbe
+		target string
+	}{
+		{ProbeOff, PeerProbe{Enabled: true}, ""},
+		{ProbeAll, PeerProbe{}, "10.0.0.2"},
+		{ProbeSelected, PeerProbe{}, ""},
+		{ProbeSelected, PeerProbe{Enabled: true, Target: "192.168.1.1"}, "192.168.1.1"},
+	} {
+		peer.Probe = tc.probe
+		if got := peer.ProbeTarget(tc.mode); got != tc.target {
+			t.Errorf("mode %q, %+v: target %q, want %q", tc.mode, tc.probe, got, tc.target)
+		}
+	}
+	peer.Enabled = false
+	if got := peer.ProbeTarget(ProbeAll); got != "" {
+		t.Errorf("disabled peer probed at %q", got)
+	}
+
+	if errs := (PeerProbe{Target: "192.168.1.0/24"}).Validate(); len(errs) != 1 || errs[0].Field != "probeTarget" {
+		t.Errorf("CIDR target: %v", errs)
+	}
+	if errs := validateProbeMode("sometimes"); len(errs) != 1 {
+		t.Errorf("bad mode accepted")
+	}
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AddressPool is one parsed ServerConfig.AddressPools entry:
+//
+//	NAME CIDR [TAG...]
+//
+// e.g. "office 10.0.0.64/26 office staff". CIDR lies inside a server subnet.
+// A peer carrying one of the tags is numbered from the pool; a pool without
+// tags is where untagged peers are numbered from, instead of the rest of the
+// subnet.
+type AddressPool struct {
+	Name   string
+	Prefix netip.Prefix // masked
+	Tags   []string
+}
+
+// Selects reports whether new addresses for p come from this pool.
+func (pool AddressPool) Selects(p *Peer) bool {
+	for _, tag := range pool.Tags {
+		if p.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAddressPool parses one pool line.
+func ParseAddressPool(s string) (AddressPool, error) {
+	var pool AddressPool
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return pool, fmt.Errorf("invalid format (must be 'NAME CIDR [TAG...]'): %s", s)
+	}
+	if !tagPattern.MatchString(fields[0]) {
+		return pool, fmt.Errorf("invalid pool name %q: use up to 32 letters, digits, '.', '_' or '-'", fields[0])
+	}
+	prefix, err := netip.ParsePrefix(fields[1])
+	if err != nil {
+		return pool, fmt.Errorf("invalid CIDR: %s", fields[1])
+	}
+	pool.Name = fields[0]
+	pool.Prefix = prefix.Masked()
+	pool.Tags = ParseTags(strings.Join(fields[2:], " "))
+	return pool, nil
+}
+
+// AddressReservation is one parsed ServerConfig.ReservedAddresses entry:
+//
+//	ADDR|CIDR|FIRST-LAST [NAME]
+//
+// e.g. "10.0.0.200-10.0.0.254" or "10.0.0.10 printer". Reserved addresses are
+// never handed out automatically. With NAME, the single address is held for
+// the peer of that name: it is that peer's address when it is created without
+// one, and no other peer may use it.
+type AddressReservation struct {
+	First, Last netip.Addr
+	Name        string
+}
+
+// Contains reports whether addr is inside the reserved range.
+func (r AddressReservation) Contains(addr netip.Addr) bool {
+	return r.First.BitLen() == addr.BitLen() && r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+// ParseAddressReservation parses one reservation line.
+func ParseAddressReservation(s string) (AddressReservation, error) {
+	var r AddressReservation
+	value, name, _ := strings.Cut(strings.TrimSpace(s), " ")
+	r.Name = strings.TrimSpace(name)
+
+	if first, last, ok := strings.Cut(value, "-"); ok {
+		var err error
+		if r.First, err = netip.ParseAddr(first); err != nil {
+			return r, fmt.Errorf("invalid address: %s", first)
+		}
+		if r.Last, err = netip.ParseAddr(last); err != nil {
+			return r, fmt.Errorf("invalid address: %s", last)
+		}
+		if r.First.BitLen() != r.Last.BitLen() || r.Last.Less(r.First) {
+			return r, fmt.Errorf("invalid range: %s", value)
+		}
+	} else if prefix, err := netip.ParsePrefix(value); err == nil {
+		r.First, r.Last = prefix.Masked().Addr(), LastAddr(prefix)
+	} else if addr, err := netip.ParseAddr(value); err == nil {
+		r.First, r.Last = addr, addr
+	} else {
+		return r, fmt.Errorf("must be an address, CIDR or FIRST-LAST range: %s", value)
+	}
+
+	if r.Name != "" {
+		if r.First != r.Last {
+			return r, fmt.Errorf("only a single address can be held for a peer: %s", s)
+		}
+		if len(r.Name) > 64 || !nameRegexp.MatchString(r.Name) {
+			return r, fmt.Errorf("invalid peer name %q", r.Name)
+		}
+	}
+	return r, nil
+}
+
+// ParsedAddressPools parses the server's pools, skipping invalid lines; Validate
+// reports those.
+func (s *ServerConfig) ParsedAddressPools() []AddressPool {
+	var pools []AddressPool
+	for _, line := range s.AddressPools {
+		if pool, err := ParseAddressPool(line); err == nil {
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// ParsedReservedAddresses parses the server's reservations, skipping invalid
+// lines; Validate reports those.
+func (s *ServerConfig) ParsedReservedAddresses() []AddressReservation {
+	var reservations []AddressReservation
+	for _, line := range s.ReservedAddresses {
+		if r, err := ParseAddressReservation(line); err == nil {
+			reservations = append(reservations, r)
+		}
+	}
+	return reservations
+}
+
+// validateAddressPlan checks that pools lie inside the server subnets without
+// overlapping each other, that reservations parse, and that the delegation
+// pool lies outside the server subnets.
+func (s *ServerConfig) validateAddressPlan() ValidationErrors {
+	var errs ValidationErrors
+	var subnets []netip.Prefix
+	for _, value := range strings.Split(s.Address, ",") {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(value)); err == nil {
+			subnets = append(subnets, prefix.Masked())
+		}
+	}
+
+	var pools []AddressPool
+	for _, line := range s.AddressPools {
+		pool, err := ParseAddressPool(line)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: "addressPools", Message: err.Error()})
+			continue
+		}
+		inside := false
+		for _, subnet := range subnets {
+			inside = inside || (subnet.Bits() <= pool.Prefix.Bits() && subnet.Contains(pool.Prefix.Addr()))
+		}
+		if !inside {
+			errs = append(errs, ValidationError{Field: "addressPools", Message: fmt.Sprintf("pool %s: %s is not inside the server address %s", pool.Name, pool.Prefix, s.Address)})
+		}
+		for _, other := range pools {
+			if other.Name == pool.Name {
+				errs = append(errs, ValidationError{Field: "addressPools", Message: fmt.Sprintf("duplicate pool name: %s", pool.Name)})
+			} else if other.Prefix.Overlaps(pool.Prefix) {
+				errs = append(errs, ValidationError{Field: "addressPools", Message: fmt.Sprintf("pools %s and %s overlap", other.Name, pool.Name)})
+			}
+		}
+		pools = append(pools, pool)
+	}
+
+	for _, line := range s.ReservedAddresses {
+		if _, err := ParseAddressReservation(line); err != nil {
+			errs = append(errs, ValidationError{Field: "reservedAddresses", Message: err.Error()})
+		}
+	}
+
+	if s.DelegationPool != "" {
+		pool, err := netip.ParsePrefix(s.DelegationPool)
+		switch {
+		case err != nil || !pool.Addr().Is6() || pool.Masked() != pool:
+			errs = append(errs, ValidationError{Field: "delegationPool", Message: fmt.Sprintf("must be an IPv6 network such as 2001:db8::/48: %s", s.DelegationPool)})
+		case pool.Bits() > 64:
+			errs = append(errs, ValidationError{Field: "delegationPool", Message: "must be a /64 or larger"})
+		default:
+			for _, subnet := range subnets {
+				if subnet.Overlaps(pool) {
+					errs = append(errs, ValidationError{Field: "delegationPool", Message: fmt.Sprintf("overlaps the server subnet %s", subnet)})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateDelegations checks that no two enabled peers are delegated
+// overlapping prefixes.
+func ValidateDelegations(peers []Peer) ValidationErrors {
+	var errs ValidationErrors
+	var seen []Peer
+	for _, p := range peers {
+		prefix, err := netip.ParsePrefix(p.DelegatedPrefix)
+		if err != nil || !p.Enabled {
+			continue
+		}
+		for _, other := range seen {
+			if otherPrefix := netip.MustParsePrefix(other.DelegatedPrefix); otherPrefix.Overlaps(prefix) {
+				errs = append(errs, ValidationError{
+					Field:   "delegatedPrefix",
+					Message: fmt.Sprintf("peer %q is delegated %s, which overlaps %s delegated to %q", p.Name, prefix, otherPrefix, other.Name),
+				})
+			}
+		}
+		seen = append(seen, p)
+	}
+	return errs
+}
+
+// ValidateReservations checks that no enabled peer uses an address held for a
+// peer with another name.
+func ValidateReservations(server ServerConfig, peers []Peer) ValidationErrors {
+	var held []AddressReservation
+	for _, r := range server.ParsedReservedAddresses() {
+		if r.Name != "" {
+			held = append(held, r)
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+
+	var errs ValidationErrors
+	for _, p := range peers {
+		if !p.Enabled {
+			continue
+		}
+		for _, value := range strings.Split(p.AllowedIPs, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+			if err != nil || !prefix.IsSingleIP() {
+				continue
+			}
+			for _, r := range held {
+				if r.Contains(prefix.Addr()) && r.Name != p.Name {
+					errs = append(errs, ValidationError{
+						Field:   "allowedIPs",
+						Message: fmt.Sprintf("peer %q uses %s, which is reserved for %q", p.Name, prefix.Addr(), r.Name),
+					})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// LastAddr returns the highest address in prefix: the IPv4 broadcast address.
+func LastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := range b {
+		netBits := min(max(prefix.Bits()-i*8, 0), 8)
+		b[i] |= byte(0xff >> netBits)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// Reachability probe modes of ServerConfig.ProbeMode.
+const (
+	ProbeOff      = ""
+	ProbeAll      = "all"      // every enabled peer
+	ProbeSelected = "selected" // enabled peers whose Probe.Enabled is set
+)
+
+// ProbeModes are the accepted ProbeMode values.
+var ProbeModes = []string{ProbeOff, ProbeAll, ProbeSelected}
+
+// PeerProbe is how the reachability probes treat one peer.
+type PeerProbe struct {
+	// Enabled selects the peer when the server probes only selected peers.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Target is the address pinged instead of the peer's tunnel address,
+	// such as a site router's LAN address or, through an exit node, a host on
+	// the internet. It must be routed to the peer.
+	Target string `yaml:"target,omitempty"`
+}
+
+// Validate checks the probe target.
+func (p PeerProbe) Validate() ValidationErrors {
+	if p.Target != "" && net.ParseIP(p.Target) == nil {
+		return ValidationErrors{{Field: "probeTarget", Message: fmt.Sprintf("must be an IP address: %s", p.Target)}}
+	}
+	return nil
+}
+
+// ProbeTarget returns the address the reachability probes ping for p under
+// mode, or "" when p is not probed.
+func (p *Peer) ProbeTarget(mode string) string {
+	if !p.Enabled || mode == ProbeOff || (mode == ProbeSelected && !p.Probe.Enabled) {
+		return ""
+	}
+	if p.Probe.Target != "" {
+		return p.Probe.Target
+	}
+	return FirstIP(p.AllowedIPs)
+}
+
+func validateProbeMode(mode string) ValidationErrors {
+	if !slices.Contains(ProbeModes, mode) {
+		return ValidationErrors{{Field: "probeMode", Message: "must be off, all or selected"}}
+	}
+	return nil
+}
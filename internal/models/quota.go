@@ -0,0 +1,164 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons recorded when a quota with the disable action turns a peer off, and
+// when the next period starts and turns it back on.
+const (
+	StateReasonQuotaExceeded = "data quota exceeded"
+	StateReasonQuotaReset    = "data quota period reset"
+)
+
+// Quota periods and actions.
+const (
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodWeekly  = "weekly"
+	QuotaPeriodMonthly = "monthly"
+
+	QuotaActionWarn     = "warn"
+	QuotaActionThrottle = "throttle"
+	QuotaActionDisable  = "disable"
+)
+
+// PeerQuota caps how much a peer may transfer (received plus sent) per period.
+type PeerQuota struct {
+	Limit  uint64 `yaml:"limit,omitempty"`  // bytes per period; 0 means no quota
+	Period string `yaml:"period,omitempty"` // daily, weekly, monthly (default)
+	Action string `yaml:"action,omitempty"` // warn (default), throttle, disable
+	// ThrottleKbit is the rate, in kbit/s, each direction is limited to once a
+	// throttle quota is exceeded.
+	ThrottleKbit uint32 `yaml:"throttleKbit,omitempty"`
+}
+
+// PeerUsage is a peer's cumulative traffic in the current quota period. It is
+// accumulated from counter deltas, so it survives wg0 restarts that reset the
+// kernel's own counters.
+type PeerUsage struct {
+	PeriodStart time.Time `yaml:"periodStart,omitempty"`
+	Rx          uint64    `yaml:"rx,omitempty"`
+	Tx          uint64    `yaml:"tx,omitempty"`
+	// Exceeded records that the quota action has been applied this period.
+	Exceeded bool `yaml:"exceeded,omitempty"`
+}
+
+// Transfer is a number of bytes received from and sent to a peer.
+type Transfer struct {
+	Rx, Tx uint64
+}
+
+// Total returns the bytes transferred in both directions.
+func (u PeerUsage) Total() uint64 { return u.Rx + u.Tx }
+
+// PeriodName returns the effective period.
+func (q PeerQuota) PeriodName() string {
+	if q.Period == "" {
+		return QuotaPeriodMonthly
+	}
+	return q.Period
+}
+
+// ActionName returns the effective action.
+func (q PeerQuota) ActionName() string {
+	if q.Action == "" {
+		return QuotaActionWarn
+	}
+	return q.Action
+}
+
+// Throttled reports whether the peer's traffic should currently be rate limited.
+func (p *Peer) Throttled() bool {
+	return p.Enabled && p.Quota.Limit > 0 && p.Quota.ActionName() == QuotaActionThrottle && p.Usage.Exceeded && p.Quota.ThrottleKbit > 0
+}
+
+// PeriodStart returns the start of the quota period containing t, in t's
+// location. Weeks start on Monday.
+func (q PeerQuota) PeriodStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch q.PeriodName() {
+	case QuotaPeriodDaily:
+		return day
+	case QuotaPeriodWeekly:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// AddTransfer accumulates traffic into the usage, starting a new period first
+// when now has moved past the recorded one. Exceeded is left alone: clearing it
+// is the quota enforcer's job, since it also undoes the action.
+func (u *PeerUsage) AddTransfer(q PeerQuota, t Transfer, now time.Time) {
+	if start := q.PeriodStart(now); !u.PeriodStart.Equal(start) {
+		u.PeriodStart = start
+		u.Rx, u.Tx = 0, 0
+	}
+	u.Rx += t.Rx
+	u.Tx += t.Tx
+}
+
+// CurrentTotal returns the usage that counts against the quota at now: zero
+// once the recorded period has ended, even before new traffic rolls it over.
+func (u PeerUsage) CurrentTotal(q PeerQuota, now time.Time) uint64 {
+	if !u.PeriodStart.Equal(q.PeriodStart(now)) {
+		return 0
+	}
+	return u.Total()
+}
+
+// Validate checks the quota settings.
+func (q PeerQuota) Validate() ValidationErrors {
+	var errs ValidationErrors
+	switch q.Period {
+	case "", QuotaPeriodDaily, QuotaPeriodWeekly, QuotaPeriodMonthly:
+	default:
+		errs = append(errs, ValidationError{Field: "quotaPeriod", Message: "must be 'daily', 'weekly', or 'monthly'"})
+	}
+	switch q.Action {
+	case "", QuotaActionWarn, QuotaActionDisable:
+	case QuotaActionThrottle:
+		if q.Limit > 0 && q.ThrottleKbit == 0 {
+			errs = append(errs, ValidationError{Field: "quotaThrottleKbit", Message: "required when the quota action is throttle"})
+		}
+	default:
+		errs = append(errs, ValidationError{Field: "quotaAction", Message: "must be 'warn', 'throttle', or 'disable'"})
+	}
+	return errs
+}
+
+// ParseByteSize parses sizes such as "500MB", "1.5 GB" or "1024". Units are
+// binary, matching how the UI formats byte counts.
+func ParseByteSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		factor float64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 || math.Signbit(value) || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// 2^64 is exact as a float64; anything from there up would wrap.
+	if bytes := value * multiplier; bytes < 1<<64 {
+		return uint64(bytes), nil
+	}
+	return 0, fmt.Errorf("size %q is too large", s)
+}
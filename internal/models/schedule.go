@@ -0,0 +1,227 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons recorded in Peer.StateReason when something other than a direct
+// enable/disable toggle changes whether a peer is enabled.
+const (
+	StateReasonManual         = "changed manually"
+	StateReasonScheduleClosed = "outside access schedule"
+	StateReasonScheduleOpened = "access schedule window opened"
+	StateReasonExpired        = "access expired"
+)
+
+// Expired reports whether the peer's access has expired at now.
+func (p *Peer) Expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+// ParseExpiry reads an expiry as a date, the last day of access, which ends at
+// midnight in loc; or as an RFC 3339 timestamp. Empty means no expiry.
+func ParseExpiry(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return day.AddDate(0, 0, 1).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+	return t.UTC(), nil
+}
+
+// ExpiryDate formats an expiry as the last day of access in loc, the inverse
+// of ParseExpiry for dates.
+func ExpiryDate(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Add(-time.Nanosecond).In(loc).Format(time.DateOnly)
+}
+
+// AccessSchedule restricts a peer to recurring time windows. While it is
+// enabled the peer is disabled outside every window, and re-enabled when a
+// window opens if the schedule (not an admin) was what disabled it.
+type AccessSchedule struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Timezone is an IANA zone name such as "Europe/Berlin". Empty means the
+	// server's local time.
+	Timezone string `yaml:"timezone,omitempty"`
+	// Windows are "DAYS HH:MM-HH:MM" strings, e.g. "mon-fri 08:00-19:00" or
+	// "sat,sun 10:00-14:00". An end at or before the start runs past midnight
+	// into the next day.
+	Windows []string `yaml:"windows,omitempty"`
+}
+
+// scheduleWindow is one parsed AccessSchedule window. Times are minutes since
+// midnight; end may be 24*60 for "24:00".
+type scheduleWindow struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseScheduleWindow(s string) (scheduleWindow, error) {
+	var w scheduleWindow
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid format (must be 'DAYS HH:MM-HH:MM'): %s", s)
+	}
+
+	for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+		switch part {
+		case "daily", "*":
+			for i := range w.days {
+				w.days[i] = true
+			}
+			continue
+		case "weekdays":
+			part = "mon-fri"
+		case "weekends":
+			part = "sat-sun"
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdayNames[first]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q in %s", first, s)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdayNames[last]; !ok {
+				return w, fmt.Errorf("unknown day %q in %s", last, s)
+			}
+		}
+		// Ranges wrap through the week, so "fri-mon" is Friday to Monday.
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range (must be HH:MM-HH:MM): %s", fields[1])
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil || w.start == 24*60 {
+		return w, fmt.Errorf("invalid start time %q in %s", start, s)
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return w, fmt.Errorf("invalid end time %q in %s", end, s)
+	}
+	return w, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, accepting "24:00".
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || len(mm) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hh)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(mm)
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether the local wall-clock time t falls inside the window.
+func (w scheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if w.end > w.start {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// Overnight: the window belongs to the day it starts on.
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// Location returns the schedule's timezone, falling back to the server's.
+func (s AccessSchedule) Location() (*time.Location, error) {
+	if strings.TrimSpace(s.Timezone) == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(strings.TrimSpace(s.Timezone))
+}
+
+// Allows reports whether the schedule permits the peer to be enabled at t.
+// A disabled schedule always allows it.
+func (s AccessSchedule) Allows(t time.Time) (bool, error) {
+	if !s.Enabled {
+		return true, nil
+	}
+	loc, err := s.Location()
+	if err != nil {
+		return false, err
+	}
+	local := t.In(loc)
+	for _, value := range s.Windows {
+		w, err := parseScheduleWindow(value)
+		if err != nil {
+			return false, err
+		}
+		if w.contains(local) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Validate checks the schedule's timezone and windows.
+func (s AccessSchedule) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if _, err := s.Location(); err != nil {
+		errs = append(errs, ValidationError{Field: "scheduleTimezone", Message: fmt.Sprintf("unknown timezone: %s", s.Timezone)})
+	}
+	for _, value := range s.Windows {
+		if _, err := parseScheduleWindow(value); err != nil {
+			errs = append(errs, ValidationError{Field: "scheduleWindows", Message: err.Error()})
+		}
+	}
+	// An enabled schedule without windows would keep the peer disabled forever.
+	if s.Enabled && len(s.Windows) == 0 {
+		errs = append(errs, ValidationError{Field: "scheduleWindows", Message: "at least one window is required when the schedule is enabled"})
+	}
+	return errs
+}
+
+// SetPeerEnabled enables or disables the peer with the given ID, recording why,
+// and clears references to it when a disabled peer was an exit node. It
+// returns the updated peer, or nil if no peer has that ID.
+func SetPeerEnabled(peers []Peer, id string, enabled bool, reason string, now time.Time) *Peer {
+	p := FindPeerByID(peers, id)
+	if p == nil {
+		return nil
+	}
+	p.Enabled = enabled
+	p.StateReason = reason
+	p.UpdatedAt = now.UTC()
+
+	// If disabling an exit node, cascade clear.
+	if !p.Enabled && p.IsExitNode {
+		CascadeClearExitNode(peers, id)
+	}
+	return p
+}
@@ -0,0 +1,31 @@
+package models
+
+import "fmt"
+
+// MinRateKbit is the smallest rate limit accepted. Anything lower cannot pass a
+// single full-size WireGuard packet per second.
+const MinRateKbit = 8
+
+// RateLimit caps a peer's own traffic, matched by its tunnel addresses. Zero
+// leaves that direction unlimited.
+type RateLimit struct {
+	UploadKbit   uint32 `yaml:"uploadKbit,omitempty"`   // from the peer, kbit/s
+	DownloadKbit uint32 `yaml:"downloadKbit,omitempty"` // to the peer, kbit/s
+}
+
+// IsZero reports whether the limit leaves both directions unlimited.
+func (r RateLimit) IsZero() bool { return r.UploadKbit == 0 && r.DownloadKbit == 0 }
+
+// validateRate checks one kbit/s field; zero means unlimited.
+func validateRate(field string, kbit uint32) ValidationErrors {
+	if kbit != 0 && kbit < MinRateKbit {
+		return ValidationErrors{{Field: field, Message: fmt.Sprintf("must be 0 (unlimited) or at least %d kbit/s", MinRateKbit)}}
+	}
+	return nil
+}
+
+// Validate checks the rate limits.
+func (r RateLimit) Validate() ValidationErrors {
+	errs := validateRate("rateLimitUpload", r.UploadKbit)
+	return append(errs, validateRate("rateLimitDownload", r.DownloadKbit)...)
+}
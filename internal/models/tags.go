@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// tagPattern keeps tags safe to use unquoted in URLs, firewall rule targets
+// ("group:TAG") and form values.
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,31}$`)
+
+// ParseTags splits a comma- or space-separated tag list, dropping duplicates.
+// Tags keep their case but compare case-insensitively, like peer tags in the
+// filter, so "Ops" and "ops" are one tag.
+func ParseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		if !slices.ContainsFunc(tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// HasTag reports whether the peer carries tag, ignoring case.
+func (p *Peer) HasTag(tag string) bool {
+	return slices.ContainsFunc(p.Tags, func(t string) bool { return strings.EqualFold(t, tag) })
+}
+
+// PeerTags returns every tag in use, sorted, using each tag's first spelling.
+func PeerTags(peers []Peer) []string {
+	var tags []string
+	for _, p := range peers {
+		for _, tag := range p.Tags {
+			if !slices.ContainsFunc(tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	slices.SortFunc(tags, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	return tags
+}
+
+func validateTags(tags []string) ValidationErrors {
+	var errs ValidationErrors
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			errs = append(errs, ValidationError{Field: "tags", Message: fmt.Sprintf("invalid tag %q: use up to 32 letters, digits, '.', '_' or '-'", tag)})
+		}
+	}
+	return errs
+}
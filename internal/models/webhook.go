@@ -0,0 +1,112 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Webhook event types. They are part of the payload schema: a type keeps its
+// meaning once released, and new kinds of events get new types.
+const (
+	EventPeerConnected       = "peer.connected"
+	EventPeerDisconnected    = "peer.disconnected"
+	EventPeerCreated         = "peer.created"
+	EventPeerDeleted         = "peer.deleted"
+	EventPeerExpired         = "peer.expired"
+	EventBGPSessionUp        = "bgp.session_up"
+	EventBGPSessionDown      = "bgp.session_down"
+	EventBGPPrefixesChanged  = "bgp.prefixes_changed"
+	EventZeroTierOffline     = "zerotier.offline"
+	EventZeroTierOnline      = "zerotier.online"
+	EventZeroTierNetworkDown = "zerotier.network_down"
+	EventZeroTierNetworkUp   = "zerotier.network_up"
+	EventApplyFailed         = "apply.failed"
+	EventAlertFiring         = "alert.firing"
+	EventAlertResolved       = "alert.resolved"
+)
+
+// WebhookEvents lists every event type, in the order the UI offers them.
+var WebhookEvents = []string{
+	EventPeerConnected, EventPeerDisconnected,
+	EventPeerCreated, EventPeerDeleted, EventPeerExpired,
+	EventBGPSessionUp, EventBGPSessionDown, EventBGPPrefixesChanged,
+	EventZeroTierOffline, EventZeroTierOnline, EventZeroTierNetworkDown, EventZeroTierNetworkUp,
+	EventApplyFailed,
+	EventAlertFiring, EventAlertResolved,
+}
+
+// Webhook payload formats. JSON posts the event itself; the others wrap its
+// summary in the message shape each chat service's incoming webhooks accept.
+const (
+	WebhookFormatJSON    = "json"
+	WebhookFormatSlack   = "slack"
+	WebhookFormatTeams   = "teams"
+	WebhookFormatDiscord = "discord"
+)
+
+// WebhookFormats lists every format, in the order the UI offers them.
+var WebhookFormats = []string{WebhookFormatJSON, WebhookFormatSlack, WebhookFormatTeams, WebhookFormatDiscord}
+
+// Webhook posts operational events to an HTTP endpoint.
+type Webhook struct {
+	ID      string `yaml:"id"`
+	Name    string `yaml:"name"`
+	Enabled bool   `yaml:"enabled"`
+	URL     string `yaml:"url"`
+	// Secret, when set, signs every body with HMAC-SHA256 so the receiver can
+	// check it came from this server.
+	Secret string `yaml:"secret,omitempty"`
+	Format string `yaml:"format,omitempty"` // json (the default), slack, teams, discord
+	// Events limits which event types are sent; empty sends all of them.
+	Events    []string  `yaml:"events,omitempty"`
+	CreatedAt time.Time `yaml:"createdAt"`
+	UpdatedAt time.Time `yaml:"updatedAt"`
+}
+
+// Wants reports whether the webhook should receive events of this type.
+func (w *Webhook) Wants(event string) bool {
+	return w.Enabled && (len(w.Events) == 0 || slices.Contains(w.Events, event))
+}
+
+// Validate checks all fields on Webhook and returns all errors found.
+func (w *Webhook) Validate() ValidationErrors {
+	var errs ValidationErrors
+
+	if strings.TrimSpace(w.Name) == "" {
+		errs = append(errs, ValidationError{Field: "name", Message: "required"})
+	} else if len(w.Name) > 64 {
+		errs = append(errs, ValidationError{Field: "name", Message: "maximum 64 characters"})
+	} else if !nameRegexp.MatchString(w.Name) {
+		errs = append(errs, ValidationError{Field: "name", Message: "only letters, numbers, spaces, dashes, dots, underscores"})
+	}
+
+	if w.URL == "" {
+		errs = append(errs, ValidationError{Field: "webhookURL", Message: "required"})
+	} else if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, ValidationError{Field: "webhookURL", Message: "must be an http:// or https:// URL"})
+	}
+
+	if w.Format != "" && !slices.Contains(WebhookFormats, w.Format) {
+		errs = append(errs, ValidationError{Field: "webhookFormat", Message: "must be one of " + strings.Join(WebhookFormats, ", ")})
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			errs = append(errs, ValidationError{Field: "webhookEvents", Message: fmt.Sprintf("unknown event %q", event)})
+		}
+	}
+
+	return errs
+}
+
+// FindWebhookByID returns a pointer to the webhook with the given ID, or nil.
+func FindWebhookByID(hooks []Webhook, id string) *Webhook {
+	for i := range hooks {
+		if hooks[i].ID == id {
+			return &hooks[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Package probe pings peers through the tunnel and keeps their round-trip
+// time, loss and jitter. A recent handshake only proves the peer's WireGuard
+// is alive; a probe of its tunnel address, or of a host behind it, proves
+// traffic actually gets through — which matters most for site routers and exit
+// nodes, whose failure silently blackholes everyone behind or routed via them.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/history"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+const (
+	// Interval is how often every probed peer is pinged.
+	Interval = 30 * time.Second
+
+	// Count is how many echo requests one probe sends, Spacing apart.
+	Count   = 5
+	Spacing = 200 * time.Millisecond
+
+	// Deadline bounds one probe; replies later than that count as lost.
+	Deadline = 3 * time.Second
+
+	// Workers bounds the probes in flight. A round of many unreachable peers
+	// can outlast Interval; the next round then starts late rather than
+	// piling up.
+	Workers = 8
+)
+
+// Result is a peer's latest probe.
+type Result struct {
+	Target   string        `json:"target"`
+	Time     time.Time     `json:"time"`
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	RTT      time.Duration `json:"rtt"`    // average over the replies
+	Jitter   time.Duration `json:"jitter"` // mean difference between consecutive replies' RTTs
+	// Error is why ping itself failed, e.g. no route to the target.
+	Error string `json:"error,omitempty"`
+}
+
+// Loss is the fraction of echo requests left unanswered.
+func (r Result) Loss() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return 1 - float64(r.Received)/float64(r.Sent)
+}
+
+// runPing pings target Count times out of wg0, so the kernel hands the
+// packets to WireGuard whatever the routing tables say, and returns ping's
+// output. Both iputils and busybox ping take these flags.
+var runPing = func(ctx context.Context, target string) ([]byte, error) {
+	return exec.CommandContext(ctx, "ping", "-n", "-I", models.WGDevice,
+		"-c", strconv.Itoa(Count), "-i", strconv.FormatFloat(Spacing.Seconds(), 'f', -1, 64),
+		"-w", strconv.Itoa(int(Deadline/time.Second)), target).CombinedOutput()
+}
+
+var (
+	replyRTT   = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+	summaryRTT = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+)
+
+// parse reads a result from ping's output. runErr, ping's exit error, is only
+// reported when the output has no summary: ping exits non-zero whenever a
+// reply is missing.
+func parse(target string, out []byte, runErr error) Result {
+	r := Result{Target: target}
+	var rtts []time.Duration
+	summary := false
+	for line := range strings.Lines(string(out)) {
+		if m := summaryRTT.FindStringSubmatch(line); m != nil {
+			r.Sent, _ = strconv.Atoi(m[1])
+			r.Received, _ = strconv.Atoi(m[2])
+			summary = true
+			continue
+		}
+		// A duplicate reply is not another answered request.
+		if strings.Contains(line, "DUP!") {
+			continue
+		}
+		if m := replyRTT.FindStringSubmatch(line); m != nil {
+			ms, _ := strconv.ParseFloat(m[1], 64)
+			rtts = append(rtts, time.Duration(ms*float64(time.Millisecond)))
+		}
+	}
+	if !summary {
+		r.Sent = Count
+		r.Error = pingError(out, runErr)
+		return r
+	}
+
+	var sum, diffs time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			diffs += (rtt - rtts[i-1]).Abs()
+		}
+	}
+	if len(rtts) > 0 {
+		r.RTT = sum / time.Duration(len(rtts))
+	}
+	if len(rtts) > 1 {
+		r.Jitter = diffs / time.Duration(len(rtts)-1)
+	}
+	return r
+}
+
+// pingError describes a ping that printed no summary by its last line of
+// output, which is where both pings explain themselves.
+func pingError(out []byte, runErr error) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	if runErr != nil {
+		return runErr.Error()
+	}
+	return "ping printed no summary"
+}
+
+// Prober probes the peers the config selects every Interval.
+type Prober struct {
+	store   *config.Store
+	history *history.Store
+
+	mu      sync.Mutex
+	results map[string]Result // by peer ID
+}
+
+// New returns a prober for the store's peers. hist may be nil, in which case
+// only the latest results are kept.
+func New(store *config.Store, hist *history.Store) *Prober {
+	return &Prober{store: store, history: hist, results: make(map[string]Result)}
+}
+
+// Start begins probing in the background.
+func (p *Prober) Start() {
+	go func() {
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+
+		p.Run(context.Background())
+		for range ticker.C {
+			p.Run(context.Background())
+		}
+	}()
+}
+
+// target is one peer to probe.
+type target struct {
+	id, addr string
+}
+
+// Run probes every selected peer once and waits for the results. Peers no
+// longer probed lose their result.
+func (p *Prober) Run(ctx context.Context) {
+	var targets []target
+	p.store.Read(func(cfg *models.AppConfig) {
+		for i := range cfg.Peers {
+			if addr := cfg.Peers[i].ProbeTarget(cfg.Server.ProbeMode); addr != "" {
+				targets = append(targets, target{cfg.Peers[i].ID, addr})
+			}
+		}
+	})
+
+	results := make([]Result, len(targets))
+	sem := make(chan struct{}, Workers)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = probe(ctx, t.addr)
+		})
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	clear(p.results)
+	for i, t := range targets {
+		p.results[t.id] = results[i]
+	}
+	p.mu.Unlock()
+
+	if p.history == nil {
+		return
+	}
+	var errs []error
+	for i, t := range targets {
+		r := results[i]
+		errs = append(errs, p.history.RecordProbe(t.id, r.Sent, r.Received, r.RTT, r.Jitter, r.Time))
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("persisting traffic history: %v", err)
+	}
+}
+
+// probe pings addr once.
+func probe(ctx context.Context, addr string) Result {
+	ctx, cancel := context.WithTimeout(ctx, Deadline+2*time.Second)
+	defer cancel()
+	out, err := runPing(ctx, addr)
+	r := parse(addr, out, err)
+	r.Time = time.Now()
+	return r
+}
+
+// Result returns the latest probe of peer id.
+func (p *Prober) Result(id string) (Result, bool) {
+	if p == nil {
+		return Result{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.results[id]
+	return r, ok
+}
+
+// Format summarises r for the peers list, e.g. "12.3 ms ±0.8 ms, 20% loss".
+func Format(r Result) string {
+	switch {
+	case r.Error != "":
+		return "unreachable: " + r.Error
+	case r.Received == 0:
+		return "unreachable"
+	}
+	s := fmt.Sprintf("%s ±%s", FormatRTT(r.RTT), FormatRTT(r.Jitter))
+	if r.Received < r.Sent {
+		s += fmt.Sprintf(", %.0f%% loss", r.Loss()*100)
+	}
+	return s
+}
+
+// FormatRTT formats a round-trip time in milliseconds.
+func FormatRTT(d time.Duration) string {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms >= 100 {
+		return fmt.Sprintf("%.0f ms", ms)
+	}
+	return fmt.Sprintf("%.1f ms", ms)
+}
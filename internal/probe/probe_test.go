@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/history"
+)
+
+const busyboxOutput = `PING 10.0.0.2 (10.0.0.2): 56 data bytes
+64 bytes from 10.0.0.2: seq=0 ttl=64 time=10.000 ms
+64 bytes from 10.0.0.2: seq=0 ttl=64 time=11.000 ms (DUP!)
+64 bytes from 10.0.0.2: seq=1 ttl=64 time=14.000 ms
+64 bytes from 10.0.0.2: seq=3 ttl=64 time=12.000 ms
+
+--- 10.0.0.2 ping statistics ---
+5 packets transmitted, 3 packets received, 2 duplicates, 40% packet loss
+round-trip min/avg/max = 10.000/12.000/14.000 ms
+`
+
+const iputilsOutput = `PING 192.168.1.1 (192.168.1.1) from 10.0.0.1 wg0: 56(84) bytes of data.
+64 bytes from 192.168.1.1: icmp_seq=1 ttl=63 time=20.5 ms
+64 bytes from 192.168.1.1: icmp_seq=2 ttl=63 time=19.5 ms
+
+--- 192.168.1.1 ping statistics ---
+5 packets transmitted, 2 received, 60% packet loss, time 803ms
+rtt min/avg/max/mdev = 19.500/20.000/20.500/0.500 ms
+`
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		out    string
+		err    error
+		want   Result
+		format string
+	}{
+		{"busybox", busyboxOutput, errors.New("exit status 1"),
+			Result{Sent: 5, Received: 3, RTT: 12 * time.Millisecond, Jitter: 3 * time.Millisecond}, "12.0 ms ±3.0 ms, 40% loss"},
+		{"iputils", iputilsOutput, nil,
+			Result{Sent: 5, Received: 2, RTT: 20 * time.Millisecond, Jitter: time.Millisecond}, "20.0 ms ±1.0 ms, 60% loss"},
+		{"all lost", "PING 10.0.0.9 (10.0.0.9): 56 data bytes\n\n--- 10.0.0.9 ping statistics ---\n5 packets transmitted, 0 packets received, 100% packet loss\n", errors.New("exit status 1"),
+			Result{Sent: 5}, "unreachable"},
+		{"no key", "PING 10.9.9.9 (10.9.9.9): 56 data bytes\nping: sendto: Required key not available\n", errors.New("exit status 1"),
+			Result{Sent: 5, Error: "ping: sendto: Required key not available"}, "unreachable: ping: sendto: Required key not available"},
+		{"no ping", "", errors.New(`exec: "ping": executable file not found in $PATH`),
+			Result{Sent: 5, Error: `exec: "ping": executable file not found in $PATH`}, ""},
+	} {
+		got := parse("", []byte(tc.out), tc.err)
+		if got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+		if f := Format(got); tc.format != "" && f != tc.format {
+			t.Errorf("%s: Format = %q, want %q", tc.name, f, tc.format)
+		}
+	}
+}
+
+func TestRunProbesSelectedPeers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(`server:
+  privateKey: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+  listenPort: 51820
+  address: 10.0.0.1/24
+  probeMode: selected
+peers:
+  - id: site
+    name: site
+    allowedIPs: 10.0.0.2/32
+    enabled: true
+    probe: {enabled: true, target: 192.168.1.1}
+  - id: laptop
+    name: laptop
+    allowedIPs: 10.0.0.3/32
+    enabled: true
+  - id: exit
+    name: exit
+    allowedIPs: 10.0.0.4/32
+    enabled: true
+    probe: {enabled: true}
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.Load(filepath.Join(dir, "config.yaml"), filepath.Join(dir, "wg0.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist, err := history.Open(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(orig func(context.Context, string) ([]byte, error)) { runPing = orig }(runPing)
+	var pinged []string
+	runPing = func(_ context.Context, target string) ([]byte, error) {
+		pinged = append(pinged, target)
+		if target == "192.168.1.1" {
+			return []byte(iputilsOutput), nil
+		}
+		return []byte(busyboxOutput), errors.New("exit status 1")
+	}
+
+	p := New(store, hist)
+	p.Run(context.Background())
+
+	if len(pinged) != 2 {
+		t.Fatalf("pinged %v, want the two selected peers", pinged)
+	}
+	if r, ok := p.Result("site"); !ok || r.Target != "192.168.1.1" || r.Received != 2 {
+		t.Errorf("site = %+v, %v", r, ok)
+	}
+	if r, ok := p.Result("exit"); !ok || r.Target != "10.0.0.4" {
+		t.Errorf("exit probed its tunnel address? %+v", r)
+	}
+	if _, ok := p.Result("laptop"); ok {
+		t.Error("unselected peer probed")
+	}
+
+	series := hist.Query("site", time.Hour, time.Now())
+	var total history.Point
+	for _, pt := range series.Points {
+		total.Add(pt)
+	}
+	if total.ProbeSent != 5 || total.ProbeReceived != 2 || total.RTT() != 20*time.Millisecond {
+		t.Errorf("site history = %+v", total)
+	}
+}
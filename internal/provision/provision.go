@@ -0,0 +1,213 @@
+// Package provision creates peers in bulk from a CSV or JSON list, for
+// onboarding a class or a branch office in one step. Create runs inside the
+// caller's Store.Write, so a list goes in whole or not at all.
+package provision
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/yix/wg-busy/internal/ipam"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wireguard"
+)
+
+// Row is one peer to create. Everything but the name is optional.
+type Row struct {
+	Name string `json:"name"`
+	// Address is the tunnel address; empty allocates the next free one.
+	Address string   `json:"address"`
+	Tags    []string `json:"tags"`
+	DNS     string   `json:"dns"`
+	// ExitNode names the exit node to route the peer through.
+	ExitNode string `json:"exitNode"`
+	// Expires is the last day of access, or an RFC 3339 time.
+	Expires string `json:"expires"`
+}
+
+// RowError is a problem with one row. Rows are numbered from 1, not counting
+// a CSV header.
+type RowError struct {
+	Row     int
+	Name    string
+	Message string
+}
+
+// Errors are every problem found in a list, so it can be fixed in one go.
+type Errors []RowError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = fmt.Sprintf("row %d (%s): %s", err.Row, err.Name, err.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// csvColumns maps normalized CSV header names to the Row field they fill.
+var csvColumns = map[string]func(*Row, string){
+	"name":     func(r *Row, v string) { r.Name = v },
+	"address":  func(r *Row, v string) { r.Address = v },
+	"tags":     func(r *Row, v string) { r.Tags = models.ParseTags(v) },
+	"dns":      func(r *Row, v string) { r.DNS = v },
+	"exitnode": func(r *Row, v string) { r.ExitNode = v },
+	"expires":  func(r *Row, v string) { r.Expires = v },
+}
+
+// Parse reads a JSON array of rows, or a CSV list whose header names the
+// columns: name, address, tags, dns, exit_node, expires.
+func Parse(content string) ([]Row, error) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "[") {
+		var rows []Row
+		dec := json.NewDecoder(strings.NewReader(content))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rows); err != nil {
+			return nil, fmt.Errorf("reading JSON: %w", err)
+		}
+		return rows, nil
+	}
+	return parseCSV(content)
+}
+
+func parseCSV(content string) ([]Row, error) {
+	r := csv.NewReader(strings.NewReader(content))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the list is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	setters := make([]func(*Row, string), len(header))
+	for i, column := range header {
+		key := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" _-", r) {
+				return -1
+			}
+			return r
+		}, strings.ToLower(strings.TrimPrefix(column, "\ufeff")))
+		if setters[i] = csvColumns[key]; setters[i] == nil {
+			return nil, fmt.Errorf("unknown CSV column %q: use name, address, tags, dns, exit_node, expires", column)
+		}
+	}
+	r.FieldsPerRecord = len(header)
+
+	var rows []Row
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV: %w", err)
+		}
+		var row Row
+		for i, value := range record {
+			setters[i](&row, strings.TrimSpace(value))
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Create adds a peer for each row to cfg with fresh keys and a preshared key,
+// allocating addresses the rows leave empty outside the routed networks. It
+// returns the new peers, or Errors naming each bad row; the caller runs it
+// inside Store.Write and returns the error so nothing is saved.
+func Create(cfg *models.AppConfig, rows []Row, routed []ipam.Network, now time.Time) ([]models.Peer, error) {
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the list has no peers")
+	}
+	now = now.UTC()
+	var (
+		errs    Errors
+		created []models.Peer
+	)
+	alloc, err := ipam.New(cfg, routed)
+	if err != nil {
+		return nil, fmt.Errorf("auto-assign IP: %w", err)
+	}
+	// Reserve the rows' own addresses first, so allocation for an earlier row
+	// cannot take one a later row asks for.
+	for _, row := range rows {
+		alloc.Use(models.Peer{Name: row.Name}, row.Address)
+	}
+	for i, row := range rows {
+		fail := func(format string, args ...any) {
+			errs = append(errs, RowError{Row: i + 1, Name: row.Name, Message: fmt.Sprintf(format, args...)})
+		}
+		expiresAt, err := models.ParseExpiry(row.Expires, time.Local)
+		if err != nil {
+			fail("expires: %v", err)
+		}
+		var exitNodeID string
+		if row.ExitNode != "" {
+			if exitNodeID = exitNodeByName(cfg.Peers, row.ExitNode); exitNodeID == "" {
+				fail("exit node %q not found", row.ExitNode)
+			}
+		}
+		id, err := models.NewID()
+		if err != nil {
+			return nil, fmt.Errorf("ID generation failed: %w", err)
+		}
+		privKey, pubKey, err := wireguard.GenerateKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("key generation failed: %w", err)
+		}
+		psk, err := wireguard.GeneratePresharedKey()
+		if err != nil {
+			return nil, fmt.Errorf("PSK generation failed: %w", err)
+		}
+		peer := models.Peer{
+			ID:           id,
+			Name:         row.Name,
+			PrivateKey:   privKey,
+			PublicKey:    pubKey,
+			PresharedKey: psk,
+			AllowedIPs:   hostPrefix(row.Address),
+			DNS:          row.DNS,
+			ExitNodeID:   exitNodeID,
+			Enabled:      true,
+			Tags:         models.ParseTags(strings.Join(row.Tags, ",")),
+			ExpiresAt:    expiresAt,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		if peer.AllowedIPs, err = alloc.Assign(peer, ""); err != nil {
+			fail("auto-assign IP: %v", err)
+		}
+		for _, verr := range append(peer.Validate(nil), alloc.Check(peer)...) {
+			fail("%s: %s", verr.Field, verr.Message)
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+		created = append(created, peer)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return created, nil
+}
+
+func exitNodeByName(peers []models.Peer, name string) string {
+	for _, p := range peers {
+		if p.IsExitNode && strings.EqualFold(p.Name, name) {
+			return p.ID
+		}
+	}
+	return ""
+}
+
+// hostPrefix turns a bare address into its /32 or /128; anything else is left
+// for validation to judge.
+func hostPrefix(address string) string {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	return address
+}
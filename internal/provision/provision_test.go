@@ -0,0 +1,84 @@
+package provision
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+func TestParseCSVAndJSON(t *testing.T) {
+	csvRows, err := Parse("Name, Address, Tags, DNS, Exit Node, Expires\n" +
+		"alice,,\"class-2026 students\",,,2026-12-31\n" +
+		"branch,10.0.0.50,branch,10.0.0.1,gateway,\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonRows, err := Parse(`[{"name": "alice", "tags": ["class-2026", "students"], "expires": "2026-12-31"},
+		{"name": "branch", "address": "10.0.0.50", "tags": ["branch"], "dns": "10.0.0.1", "exitNode": "gateway"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rows := range [][]Row{csvRows, jsonRows} {
+		if len(rows) != 2 || !slices.Equal(rows[0].Tags, []string{"class-2026", "students"}) || rows[0].Expires != "2026-12-31" ||
+			rows[1].Address != "10.0.0.50" || rows[1].ExitNode != "gateway" || rows[1].DNS != "10.0.0.1" {
+			t.Errorf("rows = %+v", rows)
+		}
+	}
+
+	for _, bad := range []string{"name,email\nalice,a@example.com\n", `[{"name": "a", "email": "x"}]`, "name,address\nalice\n", ""} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) accepted", bad)
+		}
+	}
+}
+
+func TestCreateAllocatesAroundRequestedAddresses(t *testing.T) {
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{Address: "10.0.0.1/24"},
+		Peers: []models.Peer{
+			{ID: "gw", Name: "Gateway", IsExitNode: true, AllowedIPs: "10.0.0.2/32"},
+		},
+	}
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	created, err := Create(&cfg, []Row{
+		{Name: "first"},
+		{Name: "second", Address: "10.0.0.3", ExitNode: "gateway", Tags: []string{"branch"}, Expires: "2026-12-31T18:00:00Z"},
+	}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := created[0], created[1]
+	if first.AllowedIPs != "10.0.0.4/32" || second.AllowedIPs != "10.0.0.3/32" {
+		t.Fatalf("addresses = %s, %s", first.AllowedIPs, second.AllowedIPs)
+	}
+	if second.ExitNodeID != "gw" || second.PrivateKey == "" || second.PresharedKey == "" || !second.Enabled ||
+		!second.ExpiresAt.Equal(time.Date(2026, 12, 31, 18, 0, 0, 0, time.UTC)) || !second.CreatedAt.Equal(now) {
+		t.Fatalf("second = %+v", second)
+	}
+	if len(cfg.Peers) != 3 {
+		t.Fatalf("config has %d peers", len(cfg.Peers))
+	}
+}
+
+func TestCreateReportsEveryBadRow(t *testing.T) {
+	cfg := models.AppConfig{Server: models.ServerConfig{Address: "10.0.0.1/24"}}
+	_, err := Create(&cfg, []Row{
+		{Name: "ok"},
+		{Name: "", Expires: "someday"},
+		{Name: "routed", ExitNode: "nowhere"},
+	}, nil, time.Now())
+	var rowErrs Errors
+	if !errors.As(err, &rowErrs) {
+		t.Fatalf("err = %v", err)
+	}
+	var rows []int
+	for _, e := range rowErrs {
+		rows = append(rows, e.Row)
+	}
+	if !slices.Contains(rows, 2) || !slices.Contains(rows, 3) || slices.Contains(rows, 1) {
+		t.Fatalf("errors = %v", rowErrs)
+	}
+}
@@ -0,0 +1,120 @@
+package quota
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+)
+
+// CheckInterval is how often peer usage is compared against quotas.
+const CheckInterval = 30 * time.Second
+
+// Change is one peer whose quota state moves. Toggle is set when the peer's
+// enabled state changes along with it.
+type Change struct {
+	ID       string
+	Name     string
+	Exceeded bool
+	Used     uint64
+	Quota    models.PeerQuota
+	Toggle   bool
+	Enabled  bool
+	Reason   string
+}
+
+// Changes returns the quota transitions due at now. A peer over a disable
+// quota is kept disabled even if someone re-enables it mid-period; a peer the
+// quota disabled comes back once it is under quota again, which in practice
+// means the next period (or a raised limit).
+func Changes(cfg *models.AppConfig, now time.Time) []Change {
+	var changes []Change
+	for _, p := range cfg.Peers {
+		used := p.Usage.CurrentTotal(p.Quota, now)
+		over := p.Quota.Limit > 0 && used >= p.Quota.Limit
+		c := Change{ID: p.ID, Name: p.Name, Exceeded: over, Used: used, Quota: p.Quota}
+
+		blocked := over && p.Quota.ActionName() == models.QuotaActionDisable
+		switch {
+		case blocked && p.Enabled:
+			c.Toggle, c.Enabled, c.Reason = true, false, models.StateReasonQuotaExceeded
+		case !blocked && !p.Enabled && p.StateReason == models.StateReasonQuotaExceeded:
+			c.Toggle, c.Enabled, c.Reason = true, true, models.StateReasonQuotaReset
+		}
+		if c.Toggle || over != p.Usage.Exceeded {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// Enforcer periodically applies quota actions through the store.
+type Enforcer struct {
+	store *config.Store
+}
+
+// New returns an enforcer for the store's peers.
+func New(store *config.Store) *Enforcer {
+	return &Enforcer{store: store}
+}
+
+// Start begins enforcing quotas in the background.
+func (e *Enforcer) Start() {
+	go func() {
+		ticker := time.NewTicker(CheckInterval)
+		defer ticker.Stop()
+
+		e.check(time.Now())
+		for now := range ticker.C {
+			e.check(now)
+		}
+	}()
+}
+
+func (e *Enforcer) check(now time.Time) {
+	// Usage grows on every stats poll, but Write reloads wg0, so only write
+	// when a quota actually crosses its limit or resets.
+	var pending []Change
+	e.store.Read(func(cfg *models.AppConfig) { pending = Changes(cfg, now) })
+	if len(pending) == 0 {
+		return
+	}
+
+	var applied []Change
+	err := e.store.Write(func(cfg *models.AppConfig) error {
+		applied = Changes(cfg, now)
+		for _, c := range applied {
+			if p := models.FindPeerByID(cfg.Peers, c.ID); p != nil {
+				p.Usage.Exceeded = c.Exceeded
+			}
+			if c.Toggle {
+				models.SetPeerEnabled(cfg.Peers, c.ID, c.Enabled, c.Reason, now)
+			}
+		}
+		return nil
+	})
+	var applyErr *config.ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
+		log.Printf("quota: applying data quotas: %v", err)
+		return
+	}
+	for _, c := range applied {
+		if c.Exceeded {
+			log.Printf("quota: peer %q used %s of its %s %s quota, action %s",
+				c.Name, wgstats.FormatBytes(int64(c.Used)), wgstats.FormatBytes(int64(c.Quota.Limit)), c.Quota.PeriodName(), c.Quota.ActionName())
+		} else {
+			log.Printf("quota: peer %q is within its data quota again", c.Name)
+		}
+		if c.Toggle && c.Enabled {
+			log.Printf("quota: enabled peer %q: %s", c.Name, c.Reason)
+		} else if c.Toggle {
+			log.Printf("quota: disabled peer %q: %s", c.Name, c.Reason)
+		}
+	}
+	if applyErr != nil {
+		log.Printf("quota: %v", applyErr)
+	}
+}
@@ -0,0 +1,68 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+func TestChangesDisableOverQuotaAndRestoreNextPeriod(t *testing.T) {
+	now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.Local)
+	quota := models.PeerQuota{Limit: 1000, Action: models.QuotaActionDisable}
+	usage := models.PeerUsage{PeriodStart: quota.PeriodStart(now), Rx: 600, Tx: 400}
+	cfg := &models.AppConfig{Peers: []models.Peer{
+		{ID: "over", Name: "over", Enabled: true, Quota: quota, Usage: usage},
+		{ID: "under", Name: "under", Enabled: true, Quota: quota, Usage: models.PeerUsage{PeriodStart: usage.PeriodStart, Rx: 10}},
+		{ID: "unlimited", Name: "unlimited", Enabled: true, Usage: usage},
+	}}
+
+	changes := Changes(cfg, now)
+	if len(changes) != 1 || changes[0].ID != "over" || !changes[0].Exceeded || !changes[0].Toggle || changes[0].Enabled {
+		t.Fatalf("changes = %#v", changes)
+	}
+
+	// Applied: the peer is off and flagged. Nothing more happens this period.
+	cfg.Peers[0].Enabled = false
+	cfg.Peers[0].StateReason = models.StateReasonQuotaExceeded
+	cfg.Peers[0].Usage.Exceeded = true
+	if changes := Changes(cfg, now); len(changes) != 0 {
+		t.Fatalf("changes after applying = %#v", changes)
+	}
+
+	nextMonth := time.Date(2026, time.November, 1, 0, 1, 0, 0, time.Local)
+	changes = Changes(cfg, nextMonth)
+	if len(changes) != 1 || changes[0].Exceeded || !changes[0].Toggle || !changes[0].Enabled || changes[0].Reason != models.StateReasonQuotaReset {
+		t.Fatalf("changes next period = %#v", changes)
+	}
+}
+
+func TestChangesKeepsManuallyDisabledPeerOff(t *testing.T) {
+	now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.Local)
+	quota := models.PeerQuota{Limit: 1000, Action: models.QuotaActionDisable}
+	cfg := &models.AppConfig{Peers: []models.Peer{{
+		ID: "p", Name: "p", StateReason: models.StateReasonManual, Quota: quota,
+		Usage: models.PeerUsage{PeriodStart: quota.PeriodStart(now), Rx: 5000, Exceeded: true},
+	}}}
+
+	next := time.Date(2026, time.November, 2, 0, 0, 0, 0, time.Local)
+	changes := Changes(cfg, next)
+	if len(changes) != 1 || changes[0].Toggle || changes[0].Exceeded {
+		t.Fatalf("changes = %#v, want only the exceeded flag cleared", changes)
+	}
+}
+
+func TestChangesWarnAndThrottleOnlyFlag(t *testing.T) {
+	now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.Local)
+	for _, action := range []string{"", models.QuotaActionWarn, models.QuotaActionThrottle} {
+		quota := models.PeerQuota{Limit: 1000, Action: action, ThrottleKbit: 512}
+		cfg := &models.AppConfig{Peers: []models.Peer{{
+			ID: "p", Name: "p", Enabled: true, Quota: quota,
+			Usage: models.PeerUsage{PeriodStart: quota.PeriodStart(now), Tx: 1000},
+		}}}
+		changes := Changes(cfg, now)
+		if len(changes) != 1 || !changes[0].Exceeded || changes[0].Toggle {
+			t.Fatalf("action %q: changes = %#v", action, changes)
+		}
+	}
+}
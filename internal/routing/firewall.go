@@ -0,0 +1,206 @@
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// FirewallChain is the filter-table chain wg-busy owns. FORWARD jumps to it
+// for everything arriving on wg0.
+//
+// The chain only ever RETURNs or REJECTs: an allowed packet carries on through
+// the rest of FORWARD, so the host's own policy still applies. Quota throttles
+// are inserted after the jump on every apply, which puts them above it: they
+// police a peer's traffic before the chain sees it. Replies are returned first, which makes every rule apply to new
+// connections only — a rule describes what the peer may open, and isolation
+// never cuts off exit-node return traffic or a peer answering someone else.
+const FirewallChain = "WG-BUSY-FORWARD"
+
+type ipFamily struct {
+	iptables string
+	v6       bool
+	icmp     string
+}
+
+var (
+	familyIPv4 = ipFamily{"iptables", false, "icmp"}
+	familyIPv6 = ipFamily{"ip6tables", true, "ipv6-icmp"}
+)
+
+func (f ipFamily) contains(address string) bool {
+	return strings.Contains(address, ":") == f.v6
+}
+
+// firewallActive reports whether the config needs the chain at all. Without
+// isolation or any rules nothing is rendered, leaving the host's FORWARD alone.
+func firewallActive(cfg models.AppConfig) bool {
+	if cfg.Server.IsolatePeers {
+		return true
+	}
+	for _, p := range cfg.Peers {
+		if p.Enabled && (len(p.FirewallRules) > 0 || p.FirewallDenyByDefault) {
+			return true
+		}
+	}
+	return false
+}
+
+// firewallTargets resolves a rule target to the destinations to match in one
+// family; "" means any destination. A peer or group target resolves to the
+// tunnel addresses of every enabled peer with that name or tag, so a disabled
+// peer's rules simply match nothing.
+func firewallTargets(cfg models.AppConfig, target string, family ipFamily) []string {
+	if target == "any" {
+		return []string{""}
+	}
+	name, byName := strings.CutPrefix(target, models.FirewallPeerPrefix)
+	tag, byTag := strings.CutPrefix(target, models.FirewallGroupPrefix)
+	if byName || byTag {
+		var targets []string
+		for _, p := range cfg.Peers {
+			if !p.Enabled || (byName && p.Name != name) || (byTag && !p.HasTag(tag)) {
+				continue
+			}
+			for _, source := range models.PeerSources(p.AllowedIPs) {
+				if family.contains(source) {
+					targets = append(targets, source)
+				}
+			}
+		}
+		return targets
+	}
+	if family.contains(target) {
+		return []string{target}
+	}
+	return nil
+}
+
+// firewallSpecs returns the chain's rules for one family, in order: replies,
+// then each peer's own rules and default, then isolation.
+func firewallSpecs(cfg models.AppConfig, family ipFamily) []string {
+	specs := []string{"-m conntrack --ctstate ESTABLISHED,RELATED -j RETURN"}
+	for _, p := range cfg.Peers {
+		if !p.Enabled {
+			continue
+		}
+		for _, source := range models.PeerSources(p.AllowedIPs) {
+			if !family.contains(source) {
+				continue
+			}
+			for _, line := range p.FirewallRules {
+				rule, err := models.ParseFirewallRule(line)
+				if err != nil {
+					// Validation rejects these; never guess what a broken rule meant.
+					continue
+				}
+				verdict := "RETURN"
+				if rule.Action == models.FirewallDeny {
+					verdict = "REJECT"
+				}
+				var match string
+				switch rule.Protocol {
+				case "":
+				case "icmp":
+					match = " -p " + family.icmp
+				default:
+					match = " -p " + rule.Protocol
+					if len(rule.Ports) > 0 {
+						match += " -m multiport --dports " + strings.ReplaceAll(strings.Join(rule.Ports, ","), "-", ":")
+					}
+				}
+				for _, target := range firewallTargets(cfg, rule.Target, family) {
+					spec := "-s " + source
+					if target != "" {
+						spec += " -d " + target
+					}
+					specs = append(specs, spec+match+" -j "+verdict)
+				}
+			}
+			if p.FirewallDenyByDefault {
+				specs = append(specs, fmt.Sprintf("-s %s -j REJECT", source))
+			}
+		}
+	}
+	if cfg.Server.IsolatePeers {
+		for _, p := range cfg.Peers {
+			if !p.Enabled {
+				continue
+			}
+			for _, source := range models.PeerSources(p.AllowedIPs) {
+				if family.contains(source) {
+					specs = append(specs, fmt.Sprintf("-d %s -j REJECT", source))
+				}
+			}
+		}
+	}
+	return specs
+}
+
+// firewallFamilies returns the families any enabled peer has addresses in.
+func firewallFamilies(cfg models.AppConfig) []ipFamily {
+	var families []ipFamily
+	for _, family := range []ipFamily{familyIPv4, familyIPv6} {
+	peers:
+		for _, p := range cfg.Peers {
+			if !p.Enabled {
+				continue
+			}
+			for _, source := range models.PeerSources(p.AllowedIPs) {
+				if family.contains(source) {
+					families = append(families, family)
+					break peers
+				}
+			}
+		}
+	}
+	return families
+}
+
+// peerFirewall returns the commands that install the managed chain. The chain
+// is created if missing, flushed and refilled, and the FORWARD jump is added
+// last, so traffic never sees a half-built chain on bring-up. On a reconcile
+// the jump stays where it is and the chain is refilled in place.
+func peerFirewall(cfg models.AppConfig) []string {
+	if !firewallActive(cfg) {
+		return nil
+	}
+	jump := fmt.Sprintf("FORWARD -i %s -j %s", models.WGDevice, FirewallChain)
+
+	var cmds []string
+	for _, family := range firewallFamilies(cfg) {
+		ipt := family.iptables
+		cmds = append(cmds,
+			fmt.Sprintf("%s -N %s 2>/dev/null || true", ipt, FirewallChain),
+			fmt.Sprintf("%s -F %s", ipt, FirewallChain))
+		for _, spec := range firewallSpecs(cfg, family) {
+			cmds = append(cmds, fmt.Sprintf("%s -A %s %s", ipt, FirewallChain, spec))
+		}
+		cmds = append(cmds, fmt.Sprintf("%s -C %s 2>/dev/null || %s -I %s", ipt, jump, ipt, jump))
+	}
+	return cmds
+}
+
+// peerFirewallTeardown removes the jump and the chain in each family cfg
+// filters, except those in keep.
+func peerFirewallTeardown(cfg models.AppConfig, keep []ipFamily) []string {
+	if !firewallActive(cfg) {
+		return nil
+	}
+	jump := fmt.Sprintf("FORWARD -i %s -j %s", models.WGDevice, FirewallChain)
+
+	var cmds []string
+	for _, family := range firewallFamilies(cfg) {
+		if slices.Contains(keep, family) {
+			continue
+		}
+		ipt := family.iptables
+		cmds = append(cmds,
+			fmt.Sprintf("%s -D %s 2>/dev/null || true", ipt, jump),
+			fmt.Sprintf("%s -F %s 2>/dev/null || true", ipt, FirewallChain),
+			fmt.Sprintf("%s -X %s 2>/dev/null || true", ipt, FirewallChain))
+	}
+	return cmds
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"slices"
 	"sort"
 	"strings"
 
@@ -269,16 +270,27 @@ func policyRouteCmds(action string, cfg models.AppConfig, gateways []models.Gate
 // Order: first create routing tables for exit nodes, then add rules for peers.
 // gateways are the on-link networks policy route gateways may point into.
 func GeneratePostUpCommands(cfg models.AppConfig, gateways []models.GatewayNet) []string {
-	return generatePostUpCommands(cfg, gateways, nil)
+	return generatePostUpCommands(cfg, gateways, nil, kept{})
 }
 
 // GeneratePostUpCommandsWithBGP renders routing hooks using the routes
 // currently present in each peer's BGP Adj-RIB-Out.
 func GeneratePostUpCommandsWithBGP(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) []string {
-	return generatePostUpCommands(cfg, gateways, advertisedByPeer)
+	return generatePostUpCommands(cfg, gateways, advertisedByPeer, kept{})
 }
 
-func generatePostUpCommands(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) []string {
+// kept is the state Reconcile leaves installed instead of tearing it down and
+// rebuilding it, since config writes run every few seconds: the firewall chain
+// and its FORWARD jump in each family the next config still filters, which
+// the way up flushes and refills in place, and the tc tree when its rendering
+// has not changed, since rebuilding it resets every queue and policer.
+// wg0's own hooks keep nothing.
+type kept struct {
+	firewall []ipFamily
+	shaping  bool
+}
+
+func generatePostUpCommands(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string, keep kept) []string {
 	exitNodes := enabledExitNodes(cfg)
 
 	// No early return when there are no exit nodes: custom policy routes are
@@ -301,7 +313,17 @@ func generatePostUpCommands(cfg models.AppConfig, gateways []models.GatewayNet,
 	}
 
 	// Add the routes that populate each peer's own policy table.
-	return append(cmds, policyRouteCmds("replace", cfg, gateways)...)
+	cmds = append(cmds, policyRouteCmds("replace", cfg, gateways)...)
+
+	// Peer isolation and firewall rules.
+	cmds = append(cmds, peerFirewall(cfg)...)
+
+	// Rate limits for peers over a throttle quota, then configured shaping.
+	cmds = append(cmds, quotaThrottle(cfg, true)...)
+	if keep.shaping {
+		return cmds
+	}
+	return append(cmds, trafficShaping(cfg, true)...)
 }
 
 func applyCommands(cmds []string) error {
@@ -319,11 +341,16 @@ func Reconcile(previous models.AppConfig, previousGateways []models.GatewayNet,
 	if !interfaceUp() {
 		return nil
 	}
-	if err := applyCommands(generatePostDownCommands(previous, previousGateways, previousAdvertised)); err != nil {
+	var keep kept
+	if firewallActive(next) {
+		keep.firewall = firewallFamilies(next)
+	}
+	keep.shaping = slices.Equal(trafficShaping(previous, true), trafficShaping(next, true))
+	if err := applyCommands(generatePostDownCommands(previous, previousGateways, previousAdvertised, keep)); err != nil {
 		return fmt.Errorf("removing previous routing state: %w", err)
 	}
-	if err := applyCommands(generatePostUpCommands(next, nextGateways, nextAdvertised)); err != nil {
-		restoreErr := applyCommands(generatePostUpCommands(previous, previousGateways, previousAdvertised))
+	if err := applyCommands(generatePostUpCommands(next, nextGateways, nextAdvertised, keep)); err != nil {
+		restoreErr := applyCommands(generatePostUpCommands(previous, previousGateways, previousAdvertised, keep))
 		if restoreErr != nil {
 			return errors.Join(fmt.Errorf("installing new routing state: %w", err), fmt.Errorf("restoring previous routing state: %w", restoreErr))
 		}
@@ -335,21 +362,27 @@ func Reconcile(previous models.AppConfig, previousGateways []models.GatewayNet,
 // GeneratePostDownCommands returns cleanup commands for wg0.conf PostDown.
 // Order: first remove rules, then remove routing tables (reverse of PostUp).
 func GeneratePostDownCommands(cfg models.AppConfig, gateways []models.GatewayNet) []string {
-	return generatePostDownCommands(cfg, gateways, nil)
+	return generatePostDownCommands(cfg, gateways, nil, kept{})
 }
 
 // GeneratePostDownCommandsWithBGP removes routing hooks rendered from the
 // routes currently present in each peer's BGP Adj-RIB-Out.
 func GeneratePostDownCommandsWithBGP(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) []string {
-	return generatePostDownCommands(cfg, gateways, advertisedByPeer)
+	return generatePostDownCommands(cfg, gateways, advertisedByPeer, kept{})
 }
 
-func generatePostDownCommands(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) []string {
+func generatePostDownCommands(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string, keep kept) []string {
 	exitNodes := enabledExitNodes(cfg)
 
 	// No early return when there are no exit nodes: custom policy routes are
 	// independent of them and must still be emitted.
-	cmds := zeroTierMasquerade(cfg, gateways, advertisedByPeer, false)
+	var cmds []string
+	if !keep.shaping {
+		cmds = trafficShaping(cfg, false)
+	}
+	cmds = append(cmds, quotaThrottle(cfg, false)...)
+	cmds = append(cmds, peerFirewallTeardown(cfg, keep.firewall)...)
+	cmds = append(cmds, zeroTierMasquerade(cfg, gateways, advertisedByPeer, false)...)
 
 	// Remove policy rules first. Deleting by priority is exact, so repeated
 	// apply cycles cannot leave duplicates behind.
@@ -453,3 +453,295 @@ func TestPolicyRoutesWithoutExitNode(t *testing.T) {
 		t.Error("no PostDown commands emitted; routes would leak on interface down")
 	}
 }
+
+func TestQuotaThrottleRulesOnlyForExceededPeers(t *testing.T) {
+	quota := models.PeerQuota{Limit: 1 << 30, Action: models.QuotaActionThrottle, ThrottleKbit: 1000}
+	cfg := models.AppConfig{Peers: []models.Peer{
+		{ID: "aaaa1111bbbb2222", Enabled: true, AllowedIPs: "10.0.0.5/32, fd00::5/128", Quota: quota, Usage: models.PeerUsage{Exceeded: true}},
+		{ID: "cccc", Enabled: true, AllowedIPs: "10.0.0.6/32", Quota: quota},
+	}}
+
+	up := strings.Join(GeneratePostUpCommands(cfg, nil), "\n")
+	for _, want := range []string{
+		"iptables -C FORWARD -s 10.0.0.5 -m hashlimit --hashlimit-above 125kb/s --hashlimit-name wgqaaaa1111bbu -j DROP 2>/dev/null || iptables -I FORWARD -s 10.0.0.5",
+		"iptables -C FORWARD -d 10.0.0.5 -m hashlimit --hashlimit-above 125kb/s --hashlimit-name wgqaaaa1111bbd -j DROP",
+		"ip6tables -C FORWARD -s fd00::5 ",
+	} {
+		if !strings.Contains(up, want) {
+			t.Errorf("PostUp missing %q:\n%s", want, up)
+		}
+	}
+	if strings.Contains(up, "10.0.0.6") {
+		t.Errorf("peer under quota throttled:\n%s", up)
+	}
+
+	down := strings.Join(GeneratePostDownCommands(cfg, nil), "\n")
+	if !strings.Contains(down, "iptables -D FORWARD -s 10.0.0.5 -m hashlimit --hashlimit-above 125kb/s --hashlimit-name wgqaaaa1111bbu -j DROP || true") {
+		t.Errorf("PostDown does not remove the throttle:\n%s", down)
+	}
+}
+
+func TestTrafficShapingPerPeerAndSharedExitNodeCap(t *testing.T) {
+	cfg := models.AppConfig{Peers: []models.Peer{
+		{ID: "exit", Enabled: true, AllowedIPs: "10.0.0.2/32", IsExitNode: true, ExitNodeAllowAll: true, RoutingTableID: 100, ExitNodeSharedKbit: 50000},
+		{ID: "backup", Enabled: true, AllowedIPs: "10.0.0.5/32, fd00::5/128", ExitNodeID: "exit", RateLimit: models.RateLimit{UploadKbit: 8000, DownloadKbit: 2000}},
+		{ID: "off", AllowedIPs: "10.0.0.6/32", RateLimit: models.RateLimit{DownloadKbit: 1000}},
+	}}
+
+	up := GeneratePostUpCommands(cfg, nil)
+	joined := strings.Join(up, "\n")
+	for _, want := range []string{
+		"tc qdisc del dev wg0 root 2>/dev/null || true",
+		"tc actions add action police rate 50000kbit burst 625000 conform-exceed drop index 100 || true",
+		"tc qdisc add dev wg0 root handle 1: htb || true",
+		"tc class add dev wg0 parent 1: classid 1:10 htb rate 50000kbit ceil 50000kbit || true",
+		"tc class add dev wg0 parent 1: classid 1:11 htb rate 2000kbit ceil 2000kbit || true",
+		"tc filter add dev wg0 parent 1: protocol ip prio 1 u32 match ip dst 10.0.0.5/32 flowid 1:11 || true",
+		"tc filter add dev wg0 parent 1: protocol ipv6 prio 2 u32 match ip6 dst fd00::5/128 flowid 1:11 || true",
+		"tc filter add dev wg0 parent 1: protocol ip prio 3 u32 match ip src 10.0.0.5/32 flowid 1:10 || true",
+		"tc filter add dev wg0 parent ffff: protocol ip prio 1 u32 match ip src 10.0.0.5/32 action police rate 8000kbit burst 100000 conform-exceed drop || true",
+		"tc filter add dev wg0 parent ffff: protocol ip prio 3 u32 match ip dst 10.0.0.5/32 action police index 100 || true",
+	} {
+		if !slices.Contains(up, want) {
+			t.Errorf("PostUp missing %q:\n%s", want, joined)
+		}
+	}
+	if strings.Contains(joined, "10.0.0.6") {
+		t.Errorf("disabled peer shaped:\n%s", joined)
+	}
+	// Bring-up starts from a clean slate, so applying twice cannot stack filters.
+	if i, j := slices.Index(up, "tc qdisc del dev wg0 root 2>/dev/null || true"), slices.Index(up, "tc qdisc add dev wg0 root handle 1: htb || true"); i < 0 || i > j {
+		t.Errorf("root qdisc not removed before it is added:\n%s", joined)
+	}
+
+	down := strings.Join(GeneratePostDownCommands(cfg, nil), "\n")
+	for _, want := range []string{"tc qdisc del dev wg0 ingress 2>/dev/null || true", "tc actions del action police index 100 2>/dev/null || true"} {
+		if !strings.Contains(down, want) {
+			t.Errorf("PostDown missing %q:\n%s", want, down)
+		}
+	}
+}
+
+func TestTrafficShapingLeavesUnlimitedInterfaceAlone(t *testing.T) {
+	cfg := models.AppConfig{Peers: []models.Peer{{ID: "p", Enabled: true, AllowedIPs: "10.0.0.5/32"}}}
+	for _, cmd := range append(GeneratePostUpCommands(cfg, nil), GeneratePostDownCommands(cfg, nil)...) {
+		if strings.HasPrefix(cmd, "tc ") {
+			t.Fatalf("unexpected tc command without limits: %s", cmd)
+		}
+	}
+}
+
+func TestReconcileLeavesUnchangedShapingAlone(t *testing.T) {
+	previous := models.AppConfig{Peers: []models.Peer{
+		{ID: "a", Enabled: true, AllowedIPs: "10.0.0.5/32", RateLimit: models.RateLimit{DownloadKbit: 2000}},
+	}}
+	next := previous.Clone()
+	next.Peers[0].Tags = []string{"laptop"}
+
+	originalUp, originalRun := interfaceUp, runShellCommand
+	t.Cleanup(func() { interfaceUp, runShellCommand = originalUp, originalRun })
+	interfaceUp = func() bool { return true }
+	var commands []string
+	runShellCommand = func(command string) ([]byte, error) {
+		commands = append(commands, command)
+		return nil, nil
+	}
+	if err := Reconcile(previous, nil, nil, next, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range commands {
+		if strings.HasPrefix(command, "tc ") {
+			t.Errorf("unchanged limits reran %q", command)
+		}
+	}
+
+	commands = nil
+	changed := next.Clone()
+	changed.Peers[0].RateLimit.DownloadKbit = 4000
+	if err := Reconcile(next, nil, nil, changed, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(commands, "\n")
+	for _, want := range []string{"tc qdisc del dev wg0 root", "htb rate 4000kbit"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("changed limit missing %q:\n%s", want, joined)
+		}
+	}
+}
+
+func TestPeerFirewallChain(t *testing.T) {
+	cfg := models.AppConfig{
+		Server: models.ServerConfig{IsolatePeers: true},
+		Peers: []models.Peer{
+			{ID: "c", Name: "contractor", Enabled: true, AllowedIPs: "10.0.0.5/32", FirewallDenyByDefault: true,
+				FirewallRules: []string{"allow peer:build tcp/22,8000-8080", "allow 192.168.10.0/24", "allow fd00::/64"}},
+			{ID: "b", Name: "build", Enabled: true, AllowedIPs: "10.0.0.10/32"},
+			{ID: "l", Name: "laptop", Enabled: true, AllowedIPs: "10.0.0.11/32"},
+		},
+	}
+
+	up := GeneratePostUpCommands(cfg, nil)
+	want := []string{
+		"iptables -N WG-BUSY-FORWARD 2>/dev/null || true",
+		"iptables -F WG-BUSY-FORWARD",
+		"iptables -A WG-BUSY-FORWARD -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"iptables -A WG-BUSY-FORWARD -s 10.0.0.5 -d 10.0.0.10 -p tcp -m multiport --dports 22,8000:8080 -j RETURN",
+		"iptables -A WG-BUSY-FORWARD -s 10.0.0.5 -d 192.168.10.0/24 -j RETURN",
+		"iptables -A WG-BUSY-FORWARD -s 10.0.0.5 -j REJECT",
+		"iptables -A WG-BUSY-FORWARD -d 10.0.0.5 -j REJECT",
+		"iptables -A WG-BUSY-FORWARD -d 10.0.0.10 -j REJECT",
+		"iptables -A WG-BUSY-FORWARD -d 10.0.0.11 -j REJECT",
+		"iptables -C FORWARD -i wg0 -j WG-BUSY-FORWARD 2>/dev/null || iptables -I FORWARD -i wg0 -j WG-BUSY-FORWARD",
+	}
+	var got []string
+	for _, cmd := range up {
+		if strings.Contains(cmd, "WG-BUSY-FORWARD") {
+			got = append(got, cmd)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("firewall commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	down := strings.Join(GeneratePostDownCommands(cfg, nil), "\n")
+	for _, cmd := range []string{
+		"iptables -D FORWARD -i wg0 -j WG-BUSY-FORWARD 2>/dev/null || true",
+		"iptables -X WG-BUSY-FORWARD 2>/dev/null || true",
+	} {
+		if !strings.Contains(down, cmd) {
+			t.Errorf("PostDown missing %q:\n%s", cmd, down)
+		}
+	}
+	if strings.Contains(strings.Join(up, "\n")+down, "ip6tables") {
+		t.Errorf("IPv6 chain rendered without IPv6 peers")
+	}
+}
+
+// A config write must not lift isolation: the chain and its jump stay, and
+// the chain is refilled in place.
+func TestReconcileKeepsFirewallJump(t *testing.T) {
+	quota := models.PeerQuota{Limit: 1 << 30, Action: models.QuotaActionThrottle, ThrottleKbit: 1000}
+	previous := models.AppConfig{
+		Server: models.ServerConfig{IsolatePeers: true},
+		Peers: []models.Peer{
+			{ID: "a", Enabled: true, AllowedIPs: "10.0.0.5/32", Quota: quota, Usage: models.PeerUsage{Exceeded: true}},
+			{ID: "b", Enabled: true, AllowedIPs: "10.0.0.6/32"},
+		},
+	}
+	next := previous.Clone()
+	next.Peers[1].FirewallRules = []string{"allow any tcp/443"}
+
+	originalUp, originalRun := interfaceUp, runShellCommand
+	t.Cleanup(func() { interfaceUp, runShellCommand = originalUp, originalRun })
+	interfaceUp = func() bool { return true }
+	var commands []string
+	runShellCommand = func(command string) ([]byte, error) {
+		commands = append(commands, command)
+		return nil, nil
+	}
+	if err := Reconcile(previous, nil, nil, next, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(commands, "\n")
+	for _, gone := range []string{"iptables -D FORWARD -i wg0 -j WG-BUSY-FORWARD", "iptables -X WG-BUSY-FORWARD"} {
+		if strings.Contains(joined, gone) {
+			t.Errorf("reconcile ran %q:\n%s", gone, joined)
+		}
+	}
+	if !strings.Contains(joined, "iptables -A WG-BUSY-FORWARD -s 10.0.0.6 -p tcp -m multiport --dports 443 -j RETURN") {
+		t.Errorf("chain not refilled:\n%s", joined)
+	}
+	// Throttles are inserted after the jump, so they end up above it.
+	if jump, throttle := strings.Index(joined, "-I FORWARD -i wg0 -j WG-BUSY-FORWARD"), strings.LastIndex(joined, "hashlimit"); jump < 0 || throttle < jump {
+		t.Errorf("throttle not inserted after the firewall jump:\n%s", joined)
+	}
+
+	// Turning the firewall off does remove it.
+	commands = nil
+	if err := Reconcile(next, nil, nil, models.AppConfig{Peers: next.Peers[:1]}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if joined := strings.Join(commands, "\n"); !strings.Contains(joined, "iptables -X WG-BUSY-FORWARD") {
+		t.Errorf("firewall left behind:\n%s", joined)
+	}
+}
+
+func TestPeerFirewallAbsentByDefault(t *testing.T) {
+	cfg := models.AppConfig{Peers: []models.Peer{{ID: "p", Enabled: true, AllowedIPs: "10.0.0.5/32"}}}
+	if cmds := strings.Join(append(GeneratePostUpCommands(cfg, nil), GeneratePostDownCommands(cfg, nil)...), "\n"); strings.Contains(cmds, FirewallChain) {
+		t.Fatalf("firewall chain rendered without isolation or rules:\n%s", cmds)
+	}
+}
+
+func TestPeerFirewallGroupTarget(t *testing.T) {
+	cfg := models.AppConfig{Peers: []models.Peer{
+		{ID: "c", Name: "contractor", Enabled: true, AllowedIPs: "10.0.0.5/32", FirewallRules: []string{"allow group:servers tcp/22"}},
+		{ID: "a", Name: "build", Enabled: true, AllowedIPs: "10.0.0.10/32", Tags: []string{"Servers"}},
+		{ID: "b", Name: "db", Enabled: false, AllowedIPs: "10.0.0.11/32", Tags: []string{"servers"}},
+		{ID: "d", Name: "web", Enabled: true, AllowedIPs: "10.0.0.12/32", Tags: []string{"servers"}},
+	}}
+	got := firewallSpecs(cfg, familyIPv4)
+	want := []string{
+		"-m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-s 10.0.0.5 -d 10.0.0.10 -p tcp -m multiport --dports 22 -j RETURN",
+		"-s 10.0.0.5 -d 10.0.0.12 -p tcp -m multiport --dports 22 -j RETURN",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("specs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Verify must find a rule flushed from the kernel, a route pointing the wrong
+// way and a lost NAT rule, and accept what ip prints for everything still in
+// place.
+func TestVerifyReportsMissingRulesAndRoutes(t *testing.T) {
+	cfg := models.AppConfig{
+		Server:   models.ServerConfig{Address: "10.0.0.1/24"},
+		ZeroTier: models.ZeroTierConfig{Enabled: true},
+		Peers: []models.Peer{
+			{ID: "exit", Name: "exit", Enabled: true, AllowedIPs: "10.0.0.2/32", IsExitNode: true, ExitNodeAllowAll: true, RoutingTableID: 100},
+			{ID: "a", Name: "alice", Enabled: true, AllowedIPs: "10.0.0.5/32", ExitNodeID: "exit",
+				PolicyRoutingTableID: 101, PolicyRoutes: []string{"192.168.7.0/24 via 10.0.0.2"}, StrictPolicyRouting: true},
+		},
+	}
+
+	originalUp, originalShow, originalCheck := interfaceUp, showIP, checkIPTables
+	t.Cleanup(func() { interfaceUp, showIP, checkIPTables = originalUp, originalShow, originalCheck })
+	interfaceUp = func() bool { return true }
+	var checked []string
+	checkIPTables = func(args []string) error {
+		checked = append(checked, strings.Join(args, " "))
+		return errors.New("exit status 1")
+	}
+	live := map[string]string{
+		"-4 rule show":            "0:\tfrom all lookup local\n10000:\tfrom 10.0.0.5 lookup 100\n10002:\tfrom 10.0.0.5 prohibit\n32766:\tfrom all lookup main\n",
+		"-6 rule show":            "0:\tfrom all lookup local\n32766:\tfrom all lookup main\n",
+		"-4 route show table 100": "default dev wg0 scope link \n",
+		"-6 route show table 100": "default dev wg0 metric 1024 pref medium\n",
+		"-4 route show table 101": "192.168.7.0/24 via 10.0.0.3 dev wg0 \n",
+	}
+	showIP = func(args ...string) ([]byte, error) {
+		return []byte(live[strings.Join(args, " ")]), nil
+	}
+
+	drift, err := Verify(cfg, models.GatewayNets(cfg.Server.Address, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Drift{
+		{Kind: "rule", Want: "ip rule add from 10.0.0.5 table 101 priority 10001"},
+		{Kind: "route", Want: "ip route replace 192.168.7.0/24 via 10.0.0.2 dev wg0 table 101", Have: "192.168.7.0/24 via 10.0.0.3 dev wg0"},
+		{Kind: "nat", Want: "iptables -t nat -A POSTROUTING -o zt+ -j MASQUERADE"},
+	}
+	if !slices.Equal(drift, want) {
+		t.Errorf("drift = %+v, want %+v", drift, want)
+	}
+	if wantChecks := []string{"iptables -w -t nat -C POSTROUTING -o zt+ -j MASQUERADE"}; !slices.Equal(checked, wantChecks) {
+		t.Errorf("iptables checks = %q, want %q", checked, wantChecks)
+	}
+
+	interfaceUp = func() bool { return false }
+	if drift, err := Verify(cfg, nil, nil); err != nil || drift != nil {
+		t.Errorf("with wg0 down: %v, %v; want nothing expected", drift, err)
+	}
+}
@@ -0,0 +1,187 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// Traffic shaping on wg0.
+//
+// Egress (traffic to peers) goes through an HTB tree with an fq_codel leaf per
+// class: one class per download-limited peer, plus one per exit node with a
+// shared cap, collecting everything its users send out through it. Unmatched
+// traffic bypasses HTB at line rate, so peers without limits are untouched.
+//
+// Ingress (traffic from peers) cannot be queued without an IFB device, so it is
+// policed instead: per-peer upload limits drop what exceeds the rate, and an
+// exit node's shared cap is one named policer that every one of its users'
+// download filters points at.
+//
+// Filters are u32 matches on models.PeerSources, like the ip rules. tc requires
+// every filter sharing a priority to share a protocol, so IPv4 and IPv6 get
+// adjacent priorities.
+const (
+	shapingRoot    = "1:"
+	shapingIngress = "ffff:"
+	// sharedPolicerBase numbers the standalone policers for exit node caps.
+	sharedPolicerBase = 100
+	// firstShapingClass leaves the low HTB minors free for the root.
+	firstShapingClass = 0x10
+)
+
+// shapingPlan is the tc state for one config. Up and down both render from it,
+// so teardown always matches what was installed.
+type shapingPlan struct {
+	classes  []string // HTB class IDs
+	rates    []uint32 // each class's rate in kbit/s
+	egress   []string // filter specs under the HTB root
+	ingress  []string // filter specs under the ingress qdisc
+	policers []sharedPolicer
+}
+
+type sharedPolicer struct {
+	index    int
+	rateKbit uint32
+}
+
+func (p shapingPlan) empty() bool {
+	return len(p.classes) == 0 && len(p.ingress) == 0 && len(p.policers) == 0
+}
+
+// u32Match renders a u32 selector and its filter priority for one peer source.
+// band picks the priority pair: 0 for a peer's own limits, 1 for exit node caps.
+func u32Match(source, direction string, band int) (protocol string, prio int, match string) {
+	if strings.Contains(source, ":") {
+		if !strings.Contains(source, "/") {
+			source += "/128"
+		}
+		return "ipv6", band*2 + 2, fmt.Sprintf("match ip6 %s %s", direction, source)
+	}
+	if !strings.Contains(source, "/") {
+		source += "/32"
+	}
+	return "ip", band*2 + 1, fmt.Sprintf("match ip %s %s", direction, source)
+}
+
+// policeSpec renders a drop-above-rate policer. The burst allows 100ms at the
+// rate, but never less than a few full-size packets.
+func policeSpec(rateKbit uint32) string {
+	burst := max(int(rateKbit)*125/10, 16*1024)
+	return fmt.Sprintf("police rate %dkbit burst %d conform-exceed drop", rateKbit, burst)
+}
+
+func buildShapingPlan(cfg models.AppConfig) shapingPlan {
+	var plan shapingPlan
+	minor := firstShapingClass
+	addClass := func(rateKbit uint32) string {
+		class := fmt.Sprintf("1:%x", minor)
+		minor++
+		plan.classes = append(plan.classes, class)
+		plan.rates = append(plan.rates, rateKbit)
+		return class
+	}
+
+	// Exit node caps first, in config order, so IDs are stable across renders.
+	exitNodes := enabledExitNodes(cfg)
+	groupClass := make(map[string]string)
+	groupPolicer := make(map[string]int)
+	for _, p := range cfg.Peers {
+		if _, ok := exitNodes[p.ID]; !ok || p.ExitNodeSharedKbit == 0 {
+			continue
+		}
+		groupClass[p.ID] = addClass(p.ExitNodeSharedKbit)
+		index := sharedPolicerBase + len(plan.policers)
+		groupPolicer[p.ID] = index
+		plan.policers = append(plan.policers, sharedPolicer{index, p.ExitNodeSharedKbit})
+	}
+
+	for _, p := range cfg.Peers {
+		if !p.Enabled {
+			continue
+		}
+		sources := models.PeerSources(p.AllowedIPs)
+		if len(sources) == 0 {
+			continue
+		}
+		if p.RateLimit.DownloadKbit > 0 {
+			class := addClass(p.RateLimit.DownloadKbit)
+			for _, source := range sources {
+				protocol, prio, match := u32Match(source, "dst", 0)
+				plan.egress = append(plan.egress, fmt.Sprintf("protocol %s prio %d u32 %s flowid %s", protocol, prio, match, class))
+			}
+		}
+		if p.RateLimit.UploadKbit > 0 {
+			for _, source := range sources {
+				protocol, prio, match := u32Match(source, "src", 0)
+				plan.ingress = append(plan.ingress, fmt.Sprintf("protocol %s prio %d u32 %s action %s", protocol, prio, match, policeSpec(p.RateLimit.UploadKbit)))
+			}
+		}
+		if class, ok := groupClass[p.ExitNodeID]; ok {
+			for _, source := range sources {
+				protocol, prio, match := u32Match(source, "src", 1)
+				plan.egress = append(plan.egress, fmt.Sprintf("protocol %s prio %d u32 %s flowid %s", protocol, prio, match, class))
+				protocol, prio, match = u32Match(source, "dst", 1)
+				plan.ingress = append(plan.ingress, fmt.Sprintf("protocol %s prio %d u32 %s action police index %d", protocol, prio, match, groupPolicer[p.ExitNodeID]))
+			}
+		}
+	}
+	return plan
+}
+
+// trafficShaping returns the tc commands for the config's rate limits.
+// add=false renders the teardown. Nothing is rendered without limits, so
+// wg0's default qdisc is never touched.
+func trafficShaping(cfg models.AppConfig, add bool) []string {
+	plan := buildShapingPlan(cfg)
+	if plan.empty() {
+		return nil
+	}
+	dev := models.WGDevice
+
+	// Teardown is also the first step of bring-up: tc filters cannot be
+	// replaced in place, so a rebuild from scratch is the idempotent way to
+	// apply. Deleting the qdiscs drops every class and filter under them.
+	// Reconcile skips both halves when the rendering is unchanged, so config
+	// writes that touch no limit leave the queues alone.
+	cmds := []string{
+		fmt.Sprintf("tc qdisc del dev %s root 2>/dev/null || true", dev),
+		fmt.Sprintf("tc qdisc del dev %s ingress 2>/dev/null || true", dev),
+	}
+	for _, policer := range plan.policers {
+		cmds = append(cmds, fmt.Sprintf("tc actions del action police index %d 2>/dev/null || true", policer.index))
+	}
+	if !add {
+		return cmds
+	}
+
+	// Like policy routes, every install command is suffixed with "|| true": a
+	// kernel without the HTB or police modules must not abort wg-quick's
+	// set -e bring-up and take the whole interface down with it.
+	var install []string
+	for _, policer := range plan.policers {
+		install = append(install, fmt.Sprintf("tc actions add action %s index %d", policeSpec(policer.rateKbit), policer.index))
+	}
+	if len(plan.classes) > 0 {
+		install = append(install, fmt.Sprintf("tc qdisc add dev %s root handle %s htb", dev, shapingRoot))
+		for i, class := range plan.classes {
+			install = append(install,
+				fmt.Sprintf("tc class add dev %s parent %s classid %s htb rate %dkbit ceil %dkbit", dev, shapingRoot, class, plan.rates[i], plan.rates[i]),
+				fmt.Sprintf("tc qdisc add dev %s parent %s fq_codel", dev, class))
+		}
+		for _, filter := range plan.egress {
+			install = append(install, fmt.Sprintf("tc filter add dev %s parent %s %s", dev, shapingRoot, filter))
+		}
+	}
+	if len(plan.ingress) > 0 {
+		install = append(install, fmt.Sprintf("tc qdisc add dev %s handle %s ingress", dev, shapingIngress))
+		for _, filter := range plan.ingress {
+			install = append(install, fmt.Sprintf("tc filter add dev %s parent %s %s", dev, shapingIngress, filter))
+		}
+	}
+	for _, cmd := range install {
+		cmds = append(cmds, cmd+" || true")
+	}
+	return cmds
+}
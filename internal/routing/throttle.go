@@ -0,0 +1,47 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// quotaThrottle returns the FORWARD rules that police peers over a throttle
+// quota. Each direction of a peer gets its own hashlimit bucket, and traffic
+// above the rate is dropped. iptables and ip6tables keep separate hashlimit
+// tables, so the bucket is shared by the peer's prefixes of one family only: a
+// dual-stack peer gets the rate over IPv4 and again over IPv6.
+// add=false renders the teardown.
+func quotaThrottle(cfg models.AppConfig, add bool) []string {
+	var commands []string
+	for _, p := range cfg.Peers {
+		if !p.Throttled() {
+			continue
+		}
+		// hashlimit names are capped at 15 characters.
+		name := "wgq" + p.ID
+		if len(name) > 13 {
+			name = name[:13]
+		}
+		bytesPerSec := max(p.Quota.ThrottleKbit/8, 1)
+		for _, source := range models.PeerSources(p.AllowedIPs) {
+			iptables := "iptables"
+			if strings.Contains(source, ":") {
+				iptables = "ip6tables"
+			}
+			for _, dir := range []struct{ match, suffix string }{{"-s", "u"}, {"-d", "d"}} {
+				spec := fmt.Sprintf("FORWARD %s %s -m hashlimit --hashlimit-above %dkb/s --hashlimit-name %s%s -j DROP",
+					dir.match, source, bytesPerSec, name, dir.suffix)
+				if add {
+					// Check-then-insert, like the masquerade rule, so repeated
+					// applies never stack duplicates.
+					commands = append(commands, fmt.Sprintf("%s -C %s 2>/dev/null || %s -I %s", iptables, spec, iptables, spec))
+				} else {
+					commands = append(commands, fmt.Sprintf("%s -D %s || true", iptables, spec))
+				}
+			}
+		}
+	}
+	return commands
+}
@@ -0,0 +1,309 @@
+package routing
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// Drift is one piece of generated routing state the kernel does not hold.
+type Drift struct {
+	Kind string `json:"kind"` // "rule", "route", "nat" or "filter"
+	// Want is the missing entry, as the command that installs it.
+	Want string `json:"want"`
+	// Have is what the kernel holds in its place, if anything: another rule at
+	// the same priority, or another route to the same destination.
+	Have string `json:"have,omitempty"`
+}
+
+func (d Drift) String() string {
+	if d.Have == "" {
+		return "missing: " + d.Want
+	}
+	return fmt.Sprintf("%s, but found: %s", d.Want, d.Have)
+}
+
+var (
+	showIP = func(args ...string) ([]byte, error) {
+		return exec.Command("ip", args...).Output()
+	}
+	// checkIPTables runs an iptables -C, which fails when the rule is absent.
+	checkIPTables = func(args []string) error {
+		return exec.Command(args[0], args[1:]...).Run()
+	}
+)
+
+// wantRule and wantRoute are the install halves of the PostUp commands.
+type wantRule struct {
+	family   string // "-4" or "-6"
+	match    string // e.g. "from 10.0.0.5 table 100"
+	priority int
+	command  string
+}
+
+type wantRoute struct {
+	family  string
+	table   string
+	dest    string
+	via     string
+	dev     string
+	command string
+}
+
+// wantIPTablesRule is an iptables rule PostUp appends or inserts, with the -C
+// that finds it.
+type wantIPTablesRule struct {
+	kind    string
+	check   []string
+	command string
+}
+
+// Verify compares the kernel's policy rules, routing tables, and NAT and
+// filter rules with what GeneratePostUpCommandsWithBGP installs for cfg. Like
+// Reconcile, it expects nothing while wg0 is down: its PostDown removed
+// everything. Traffic shaping is not verified.
+func Verify(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) ([]Drift, error) {
+	if !interfaceUp() {
+		return nil, nil
+	}
+	cmds := generatePostUpCommands(cfg, gateways, advertisedByPeer, kept{})
+	rules, routes := parsePostUp(cmds)
+
+	var drift []Drift
+	liveRules := make(map[string]map[int][]string)
+	for _, want := range rules {
+		live, ok := liveRules[want.family]
+		if !ok {
+			out, err := showIP(want.family, "rule", "show")
+			if err != nil {
+				return nil, fmt.Errorf("reading ip %s rules: %w", want.family, err)
+			}
+			live = parseRules(string(out))
+			liveRules[want.family] = live
+		}
+		have := live[want.priority]
+		if !slices.Contains(have, want.match) {
+			drift = append(drift, Drift{Kind: "rule", Want: want.command, Have: strings.Join(have, "; ")})
+		}
+	}
+
+	liveTables := make(map[string]map[string]string)
+	for _, want := range routes {
+		key := want.family + " " + want.table
+		live, ok := liveTables[key]
+		if !ok {
+			out, err := showIP(want.family, "route", "show", "table", want.table)
+			if err != nil {
+				return nil, fmt.Errorf("reading ip %s routing table %s: %w", want.family, want.table, err)
+			}
+			live = parseRoutes(string(out))
+			liveTables[key] = live
+		}
+		have, ok := live[want.dest]
+		if !ok {
+			drift = append(drift, Drift{Kind: "route", Want: want.command})
+			continue
+		}
+		if routeField(have, "via") != want.via || routeField(have, "dev") != want.dev {
+			drift = append(drift, Drift{Kind: "route", Want: want.command, Have: have})
+		}
+	}
+
+	for _, want := range parseIPTables(cmds) {
+		if checkIPTables(want.check) != nil {
+			drift = append(drift, Drift{Kind: want.kind, Want: want.command})
+		}
+	}
+	return drift, nil
+}
+
+// Install runs the PostUp commands for cfg again. They are written to be run
+// over an existing installation — routes are replaced, rules deleted before
+// they are added, iptables rules checked first and the firewall chain and tc
+// rebuilt — so this puts back whatever went missing without tearing anything
+// down first.
+func Install(cfg models.AppConfig, gateways []models.GatewayNet, advertisedByPeer map[string][]string) error {
+	if !interfaceUp() {
+		return nil
+	}
+	return applyCommands(generatePostUpCommands(cfg, gateways, advertisedByPeer, kept{}))
+}
+
+// parsePostUp picks the ip rule and route installs out of rendered PostUp
+// commands, dropping the "|| true" guards and the deletes that precede a rule.
+func parsePostUp(cmds []string) ([]wantRule, []wantRoute) {
+	var rules []wantRule
+	var routes []wantRoute
+	for _, cmd := range cmds {
+		for _, part := range strings.Split(cmd, ";") {
+			part, _, _ = strings.Cut(part, "||")
+			part = strings.TrimSpace(part)
+			fields := strings.Fields(part)
+			if len(fields) < 4 || fields[0] != "ip" {
+				continue
+			}
+			family := "-4"
+			if fields[1] == "-4" || fields[1] == "-6" {
+				family = fields[1]
+				fields = fields[2:]
+			} else {
+				fields = fields[1:]
+			}
+			switch {
+			case fields[0] == "rule" && fields[1] == "add":
+				args := fields[2:]
+				if len(args) < 2 || args[len(args)-2] != "priority" {
+					continue
+				}
+				priority, err := strconv.Atoi(args[len(args)-1])
+				if err != nil {
+					continue
+				}
+				rules = append(rules, wantRule{family, strings.Join(args[:len(args)-2], " "), priority, part})
+			case fields[0] == "route" && fields[1] == "replace":
+				r := wantRoute{family: family, dest: normalizeDest(fields[2]), command: part}
+				for i := 3; i+1 < len(fields); i += 2 {
+					switch fields[i] {
+					case "via":
+						r.via = fields[i+1]
+					case "dev":
+						r.dev = fields[i+1]
+					case "table":
+						r.table = fields[i+1]
+					}
+				}
+				if r.table != "" {
+					routes = append(routes, r)
+				}
+			}
+		}
+	}
+	return rules, routes
+}
+
+// parseIPTables picks the iptables rules out of rendered PostUp commands: the
+// check-then-add ones, whose check is used as is, and the appends that fill
+// the firewall chain, turned into checks. Chain creation and flushes are left
+// out.
+func parseIPTables(cmds []string) []wantIPTablesRule {
+	var rules []wantIPTablesRule
+	for _, cmd := range cmds {
+		first, alternative, hasAlternative := strings.Cut(cmd, "||")
+		fields := strings.Fields(strings.ReplaceAll(first, "2>/dev/null", ""))
+		if len(fields) < 3 || (fields[0] != "iptables" && fields[0] != "ip6tables") {
+			continue
+		}
+		i := slices.IndexFunc(fields, func(f string) bool { return f == "-C" || f == "-A" })
+		if i < 0 {
+			continue
+		}
+		command := strings.TrimSpace(first)
+		if fields[i] == "-C" {
+			if !hasAlternative {
+				continue
+			}
+			command = strings.TrimSpace(alternative)
+		}
+		// -w waits for the xtables lock instead of failing while a rule is
+		// being added elsewhere.
+		check := append([]string{fields[0], "-w"}, fields[1:]...)
+		check[i+1] = "-C"
+		kind := "filter"
+		if t := slices.Index(fields, "-t"); t >= 0 && t+1 < len(fields) {
+			kind = fields[t+1]
+		}
+		rules = append(rules, wantIPTablesRule{kind, check, command})
+	}
+	return rules
+}
+
+// parseRules reads `ip rule show` into each priority's rules, each written as
+// the generated commands write it: "from SOURCE table N" or "from SOURCE
+// prohibit". Anything else the kernel prints about a rule is left out.
+func parseRules(out string) map[int][]string {
+	rules := make(map[int][]string)
+	for line := range strings.Lines(out) {
+		prio, rest, ok := strings.Cut(line, ":")
+		priority, err := strconv.Atoi(strings.TrimSpace(prio))
+		if !ok || err != nil {
+			continue
+		}
+		fields := strings.Fields(rest)
+		var match []string
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "from":
+				if i+1 < len(fields) {
+					match = append(match, "from", fields[i+1])
+					i++
+				}
+			case "lookup", "table":
+				if i+1 < len(fields) {
+					match = append(match, "table", fields[i+1])
+					i++
+				}
+			case "prohibit", "unreachable", "blackhole":
+				match = append(match, fields[i])
+			}
+		}
+		rules[priority] = append(rules[priority], strings.Join(match, " "))
+	}
+	return rules
+}
+
+// routeTypes are the route types ip prints ahead of the destination.
+var routeTypes = map[string]bool{
+	"unicast": true, "local": true, "broadcast": true, "multicast": true,
+	"throw": true, "unreachable": true, "prohibit": true, "blackhole": true, "nat": true,
+}
+
+// parseRoutes reads `ip route show table N` into each destination's route line.
+func parseRoutes(out string) map[string]string {
+	routes := make(map[string]string)
+	for line := range strings.Lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && routeTypes[fields[0]] {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		routes[normalizeDest(fields[0])] = strings.TrimSpace(line)
+	}
+	return routes
+}
+
+// routeField returns the value after key in a route line, e.g. its "dev".
+func routeField(line, key string) string {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == key {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// normalizeDest writes a destination the way ip prints it: a host route
+// without its prefix length, a network masked.
+func normalizeDest(dest string) string {
+	if dest == "default" {
+		return dest
+	}
+	prefix, err := netip.ParsePrefix(dest)
+	if err != nil {
+		return dest
+	}
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	if prefix.Bits() == 0 {
+		return "default"
+	}
+	return prefix.Masked().String()
+}
@@ -0,0 +1,114 @@
+package schedule
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// CheckInterval is how often peer access schedules and expiry are evaluated.
+// Windows have minute granularity, so this keeps enforcement within half a
+// minute.
+const CheckInterval = 30 * time.Second
+
+// Change is one peer whose enabled state the schedule flips.
+type Change struct {
+	ID      string
+	Name    string
+	Enabled bool
+	Reason  string
+}
+
+// Changes returns the toggles needed to bring every scheduled peer in line
+// with its access windows at now. Outside its windows a peer is always
+// disabled; inside them it is re-enabled only if the schedule disabled it, so
+// an admin's own "Disable" sticks until they change it. An expired peer is
+// disabled whatever its schedule says.
+func Changes(cfg *models.AppConfig, now time.Time) []Change {
+	var changes []Change
+	for _, p := range cfg.Peers {
+		if p.Expired(now) {
+			if p.Enabled {
+				changes = append(changes, Change{ID: p.ID, Name: p.Name, Enabled: false, Reason: models.StateReasonExpired})
+			}
+			continue
+		}
+		if !p.Schedule.Enabled {
+			continue
+		}
+		allowed, err := p.Schedule.Allows(now)
+		if err != nil {
+			// Validation rejects these; a hand-edited config.yaml fails closed.
+			log.Printf("schedule: peer %q: %v", p.Name, err)
+			allowed = false
+		}
+		switch {
+		case !allowed && p.Enabled:
+			changes = append(changes, Change{ID: p.ID, Name: p.Name, Enabled: false, Reason: models.StateReasonScheduleClosed})
+		case allowed && !p.Enabled && p.StateReason == models.StateReasonScheduleClosed:
+			changes = append(changes, Change{ID: p.ID, Name: p.Name, Enabled: true, Reason: models.StateReasonScheduleOpened})
+		}
+	}
+	return changes
+}
+
+// Scheduler periodically enforces peer access schedules through the store.
+type Scheduler struct {
+	store *config.Store
+}
+
+// New returns a scheduler for the store's peers.
+func New(store *config.Store) *Scheduler {
+	return &Scheduler{store: store}
+}
+
+// Start begins enforcing schedules in the background.
+func (s *Scheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(CheckInterval)
+		defer ticker.Stop()
+
+		s.check(time.Now())
+		for now := range ticker.C {
+			s.check(now)
+		}
+	}()
+}
+
+func (s *Scheduler) check(now time.Time) {
+	// Decide from a snapshot first: a no-op Store.Write would still reload wg0
+	// and reconcile routing every tick.
+	var pending []Change
+	s.store.Read(func(cfg *models.AppConfig) { pending = Changes(cfg, now) })
+	if len(pending) == 0 {
+		return
+	}
+
+	var applied []Change
+	err := s.store.Write(func(cfg *models.AppConfig) error {
+		// Recompute under the write lock; the config may have moved on.
+		applied = Changes(cfg, now)
+		for _, c := range applied {
+			models.SetPeerEnabled(cfg.Peers, c.ID, c.Enabled, c.Reason, now)
+		}
+		return nil
+	})
+	var applyErr *config.ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
+		log.Printf("schedule: applying access schedules: %v", err)
+		return
+	}
+	for _, c := range applied {
+		state := "disabled"
+		if c.Enabled {
+			state = "enabled"
+		}
+		log.Printf("schedule: %s peer %q: %s", state, c.Name, c.Reason)
+	}
+	if applyErr != nil {
+		log.Printf("schedule: %v", applyErr)
+	}
+}
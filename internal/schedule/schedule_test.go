@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+func TestChangesDisableOutsideAndReenableOnlyScheduleDisabledPeers(t *testing.T) {
+	schedule := models.AccessSchedule{Enabled: true, Timezone: "UTC", Windows: []string{"mon-fri 08:00-19:00"}}
+	cfg := &models.AppConfig{Peers: []models.Peer{
+		{ID: "open", Name: "open", Enabled: true, Schedule: schedule},
+		{ID: "closed-by-schedule", Name: "closed-by-schedule", StateReason: models.StateReasonScheduleClosed, Schedule: schedule},
+		{ID: "closed-by-admin", Name: "closed-by-admin", StateReason: models.StateReasonManual, Schedule: schedule},
+		{ID: "unscheduled", Name: "unscheduled", Enabled: true},
+	}}
+
+	inside := time.Date(2026, time.October, 14, 9, 0, 0, 0, time.UTC)
+	changes := Changes(cfg, inside)
+	if len(changes) != 1 || changes[0].ID != "closed-by-schedule" || !changes[0].Enabled || changes[0].Reason != models.StateReasonScheduleOpened {
+		t.Fatalf("changes inside window = %#v", changes)
+	}
+
+	outside := time.Date(2026, time.October, 14, 20, 0, 0, 0, time.UTC)
+	changes = Changes(cfg, outside)
+	if len(changes) != 1 || changes[0].ID != "open" || changes[0].Enabled || changes[0].Reason != models.StateReasonScheduleClosed {
+		t.Fatalf("changes outside window = %#v", changes)
+	}
+}
+
+func TestChangesFailClosedOnInvalidSchedule(t *testing.T) {
+	cfg := &models.AppConfig{Peers: []models.Peer{
+		{ID: "p", Name: "p", Enabled: true, Schedule: models.AccessSchedule{Enabled: true, Windows: []string{"never"}}},
+	}}
+	if changes := Changes(cfg, time.Now()); len(changes) != 1 || changes[0].Enabled {
+		t.Fatalf("changes = %#v, want the peer disabled", changes)
+	}
+}
+
+func TestChangesDisableExpiredPeers(t *testing.T) {
+	now := time.Date(2026, time.October, 14, 9, 0, 0, 0, time.UTC)
+	cfg := &models.AppConfig{Peers: []models.Peer{
+		{ID: "expired", Name: "expired", Enabled: true, ExpiresAt: now},
+		{ID: "valid", Name: "valid", Enabled: true, ExpiresAt: now.Add(time.Minute)},
+		// The schedule opening must not bring back an expired peer.
+		{ID: "expired-scheduled", Name: "expired-scheduled", StateReason: models.StateReasonScheduleClosed, ExpiresAt: now.Add(-time.Hour),
+			Schedule: models.AccessSchedule{Enabled: true, Timezone: "UTC", Windows: []string{"daily 00:00-24:00"}}},
+	}}
+	changes := Changes(cfg, now)
+	if len(changes) != 1 || changes[0].ID != "expired" || changes[0].Enabled || changes[0].Reason != models.StateReasonExpired {
+		t.Fatalf("changes = %#v", changes)
+	}
+}
@@ -0,0 +1,74 @@
+// Package unixsock serves the admin API on a Unix domain socket and reaches
+// it from the CLI. The API itself has no authentication: whoever can open the
+// socket file can administer wg-busy, so access is governed by the file's
+// mode and owner, and the web UI can stay bound to localhost.
+package unixsock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Listen creates the socket at path with the given file mode. A socket left
+// behind by a process that is gone is replaced; one still answering, or any
+// other kind of file, is an error rather than something to delete.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if Reachable(path) {
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating socket dir: %w", err)
+	}
+
+	// The socket is created with the umask's mode; without tightening it
+	// first, it would be open to everyone until the chmod below.
+	oldMask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("setting socket mode: %w", err)
+	}
+	return ln, nil
+}
+
+// Reachable reports whether something accepts connections on the socket.
+func Reachable(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Client returns an HTTP client whose every request goes to the socket,
+// whatever host the URL names.
+func Client(path string, timeout time.Duration) *http.Client {
+	var dialer net.Dialer
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
@@ -0,0 +1,67 @@
+package unixsock
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenReplacesOnlyStaleSockets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	// A socket whose process is gone: the file stays, nothing answers.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if Reachable(path) {
+		t.Fatal("closed socket is reachable")
+	}
+
+	ln, err := Listen(path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Fatalf("socket mode = %v, %v", fi.Mode(), err)
+	}
+	if _, err := Listen(path, 0600); err == nil {
+		t.Fatal("socket in use was replaced")
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("peers: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(file, 0600); err == nil {
+		t.Fatal("regular file was replaced by a socket")
+	}
+}
+
+func TestClientReachesSocketWhateverTheHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := Listen(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer ln.Close()
+
+	resp, err := Client(path, time.Second).Get("http://wg-busy/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "/peers" {
+		t.Fatalf("body = %q", body)
+	}
+}
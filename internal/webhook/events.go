@@ -0,0 +1,280 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/wgstats"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+const (
+	// BGPCheckInterval is how often BGP sessions are compared for changes.
+	BGPCheckInterval = 10 * time.Second
+
+	// ApplyFailedRepeat is how long the same apply failure stays quiet after
+	// it was reported.
+	ApplyFailedRepeat = 15 * time.Minute
+)
+
+// peerState is what configEvents compares between two configs.
+type peerState struct {
+	Name        string
+	Enabled     bool
+	StateReason string
+}
+
+func peerStates(peers []models.Peer) map[string]peerState {
+	states := make(map[string]peerState, len(peers))
+	for _, p := range peers {
+		states[p.ID] = peerState{Name: p.Name, Enabled: p.Enabled, StateReason: p.StateReason}
+	}
+	return states
+}
+
+// configEvents returns the peers created, deleted and expired between two
+// configs.
+func configEvents(prev, cur map[string]peerState, now time.Time) []Event {
+	var events []Event
+	for id, p := range cur {
+		old, existed := prev[id]
+		switch {
+		case !existed:
+			events = append(events, peerEvent(models.EventPeerCreated, "info", id, p.Name, now, "Peer %s created"))
+		case old.Enabled && !p.Enabled && p.StateReason == models.StateReasonExpired:
+			events = append(events, peerEvent(models.EventPeerExpired, "warning", id, p.Name, now, "Peer %s expired and was disabled"))
+		}
+	}
+	for id, p := range prev {
+		if _, ok := cur[id]; !ok {
+			events = append(events, peerEvent(models.EventPeerDeleted, "info", id, p.Name, now, "Peer %s deleted"))
+		}
+	}
+	return events
+}
+
+func peerEvent(typ, severity, id, name string, at time.Time, summary string) Event {
+	return Event{
+		Type:     typ,
+		Time:     at,
+		Severity: severity,
+		Summary:  fmt.Sprintf(summary, name),
+		Subject:  Subject{Kind: "peer", ID: id, Name: name},
+	}
+}
+
+// PeerEvents turns the session changes of a stats poll into peer.connected and
+// peer.disconnected events. byKey maps public keys to the managed peers;
+// changes of other peers, and endpoint changes, are not reported.
+func PeerEvents(changes []wgstats.PeerEvent, byKey map[string]models.Peer) []Event {
+	var events []Event
+	for _, change := range changes {
+		peer, ok := byKey[change.PublicKey]
+		if !ok {
+			continue
+		}
+		var e Event
+		switch change.Kind {
+		case wgstats.PeerConnected:
+			e = peerEvent(models.EventPeerConnected, "info", peer.ID, peer.Name, change.Time, "Peer %s connected")
+			if change.Endpoint != "" {
+				e.Summary += " from " + change.Endpoint
+			}
+		case wgstats.PeerStale:
+			e = peerEvent(models.EventPeerDisconnected, "warning", peer.ID, peer.Name, change.Time, "Peer %s disconnected")
+			e.Summary += fmt.Sprintf(" (no handshake for %s)", wgstats.FormatDuration(wgstats.OnlineWindow))
+		default:
+			continue
+		}
+		e.Details = map[string]any{"publicKey": peer.PublicKey}
+		if change.Endpoint != "" {
+			e.Details["endpoint"] = change.Endpoint
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// bgpEvents returns the sessions that came up or went down between two BGP
+// snapshots, and the received prefix counts of sessions that stayed up.
+// Neighbours present in only one snapshot were added or removed by the config
+// and are not reported.
+func bgpEvents(prev, cur *models.BGPStats, now time.Time) []Event {
+	if prev == nil || cur == nil {
+		return nil
+	}
+	before := make(map[string]models.BGPPeerStats, len(prev.Peers))
+	for _, p := range prev.Peers {
+		before[p.IP] = p
+	}
+
+	var events []Event
+	for _, p := range cur.Peers {
+		old, ok := before[p.IP]
+		if !ok {
+			continue
+		}
+		name := p.Name
+		if name == "" {
+			name = p.IP
+		}
+		e := Event{
+			Time:    now,
+			Subject: Subject{Kind: "bgp_peer", ID: p.IP, Name: p.Name},
+			Details: map[string]any{"ip": p.IP, "asn": p.ASN, "state": p.State, "previousState": old.State},
+		}
+		wasUp, isUp := old.State == "Established", p.State == "Established"
+		switch {
+		case !wasUp && isUp:
+			e.Type, e.Severity = models.EventBGPSessionUp, "info"
+			e.Summary = fmt.Sprintf("BGP session with %s (AS%d) established", name, p.ASN)
+		case wasUp && !isUp:
+			e.Type, e.Severity = models.EventBGPSessionDown, "warning"
+			e.Summary = fmt.Sprintf("BGP session with %s (AS%d) down: %s", name, p.ASN, p.State)
+		case isUp && len(p.Routes) != len(old.Routes):
+			accepted := 0
+			for _, route := range p.Routes {
+				if route.Status == "Accepted" {
+					accepted++
+				}
+			}
+			e.Type, e.Severity = models.EventBGPPrefixesChanged, "info"
+			e.Summary = fmt.Sprintf("BGP neighbour %s now sends %d prefixes (was %d)", name, len(p.Routes), len(old.Routes))
+			e.Details = map[string]any{"ip": p.IP, "asn": p.ASN, "received": len(p.Routes), "previousReceived": len(old.Routes), "accepted": accepted}
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// WatchBGP compares the BGP sessions every BGPCheckInterval and notifies of
+// the changes.
+func (n *Notifier) WatchBGP(stats func() *models.BGPStats) {
+	go func() {
+		ticker := time.NewTicker(BGPCheckInterval)
+		defer ticker.Stop()
+
+		prev := stats()
+		for now := range ticker.C {
+			cur := stats()
+			n.Notify(bgpEvents(prev, cur, now)...)
+			prev = cur
+		}
+	}()
+}
+
+// zeroTierState remembers what was last seen of the ZeroTier node. A node or
+// network is reported only once it has been seen up, so starting the daemon
+// and joining a network are not reported as recoveries.
+type zeroTierState struct {
+	seen     bool // the node has been online
+	online   bool
+	networks map[string]string // status of each network that has been OK
+}
+
+// update returns the events between the last snapshot and snap.
+func (s *zeroTierState) update(snap zerotier.Snapshot, now time.Time) []Event {
+	if !snap.Enabled {
+		*s = zeroTierState{}
+		return nil
+	}
+	if s.networks == nil {
+		s.networks = make(map[string]string)
+	}
+
+	var events []Event
+	online := snap.Running && snap.Status != nil && snap.Status.Online
+	var address string
+	if snap.Status != nil {
+		address = snap.Status.Address
+	}
+	node := Subject{Kind: "zerotier", ID: address}
+	switch {
+	case !s.seen:
+		s.seen = online
+	case s.online && !online:
+		reason := "not running"
+		if snap.Running {
+			reason = "cannot reach the ZeroTier roots"
+		}
+		if snap.ServiceErr != "" {
+			reason = snap.ServiceErr
+		}
+		events = append(events, Event{Type: models.EventZeroTierOffline, Time: now, Severity: "warning", Subject: node,
+			Summary: "ZeroTier is offline: " + reason, Details: map[string]any{"running": snap.Running}})
+	case !s.online && online:
+		events = append(events, Event{Type: models.EventZeroTierOnline, Time: now, Severity: "info", Subject: node,
+			Summary: "ZeroTier is online again"})
+	}
+	s.online = online
+
+	present := make(map[string]bool, len(snap.Networks))
+	for _, network := range snap.Networks {
+		present[network.ID] = true
+		prev, known := s.networks[network.ID]
+		if !known && network.Status != "OK" {
+			continue
+		}
+		s.networks[network.ID] = network.Status
+		if !known || prev == network.Status || (prev != "OK" && network.Status != "OK") {
+			continue
+		}
+		name := network.Label
+		if name == "" {
+			name = network.Name
+		}
+		if name == "" {
+			name = network.ID
+		}
+		e := Event{Time: now, Subject: Subject{Kind: "zerotier_network", ID: network.ID, Name: name},
+			Details: map[string]any{"status": network.Status, "previousStatus": prev}}
+		if network.Status == "OK" {
+			e.Type, e.Severity = models.EventZeroTierNetworkUp, "info"
+			e.Summary = fmt.Sprintf("ZeroTier network %s is OK again", name)
+		} else {
+			e.Type, e.Severity = models.EventZeroTierNetworkDown, "warning"
+			e.Summary = fmt.Sprintf("ZeroTier network %s left OK: %s", name, network.Status)
+		}
+		events = append(events, e)
+	}
+	// Networks that were left are forgotten; rejoining starts afresh. A
+	// stopped daemon lists none, which says nothing about what it has joined.
+	for id := range s.networks {
+		if !present[id] && snap.Running {
+			delete(s.networks, id)
+		}
+	}
+	return events
+}
+
+// WatchZeroTier notifies of the node going offline or back online, and of
+// joined networks leaving OK or returning to it.
+func (n *Notifier) WatchZeroTier(zt *zerotier.Supervisor) {
+	go func() {
+		var state zeroTierState
+		snap, revision := zt.SnapshotVersion()
+		state.update(snap, time.Now())
+		for {
+			if !zt.WaitForChange(context.Background(), revision, time.Minute) {
+				continue
+			}
+			snap, revision = zt.SnapshotVersion()
+			n.Notify(state.update(snap, time.Now())...)
+		}
+	}()
+}
+
+func applyFailedEvent(err error, now time.Time) Event {
+	return Event{
+		Type:     models.EventApplyFailed,
+		Time:     now,
+		Severity: "warning",
+		Summary:  "Live apply failed: " + err.Error(),
+		Subject:  Subject{Kind: "server"},
+		Details:  map[string]any{"error": err.Error()},
+	}
+}
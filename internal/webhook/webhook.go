@@ -0,0 +1,404 @@
+// Package webhook posts operational events — peers connecting and dropping,
+// BGP sessions changing state, ZeroTier losing its network, live applies that
+// failed — to the webhooks in config.yaml, so an operator hears about a dead
+// session before the users do.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// SchemaVersion is the version of the JSON payload. It changes only when a
+// field is removed or changes meaning; new fields and event types keep it.
+const SchemaVersion = 1
+
+// TestEvent is the type of the event sent by the "Send test" button. It
+// bypasses the webhook's event filter.
+const TestEvent = "webhook.test"
+
+const (
+	// QueueSize bounds the events waiting for one webhook. Events are sent in
+	// order, so while one is being retried the rest wait; past this many the
+	// newest are dropped, and the drop is logged as a delivery.
+	QueueSize = 100
+
+	// DeliveryLogSize is how many delivery attempts Deliveries remembers.
+	DeliveryLogSize = 200
+
+	// Timeout bounds one delivery attempt.
+	Timeout = 10 * time.Second
+)
+
+// Backoff is the wait before each retry of a failed delivery. An event is
+// dropped once it runs out; a 4xx other than 408 and 429 is not retried.
+var Backoff = []time.Duration{10 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute, 30 * time.Minute}
+
+// Event is the JSON payload of every webhook, and the source of the chat
+// presets' text.
+type Event struct {
+	Version int       `json:"version"`
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	// Severity is "info" for good news and "warning" for anything that may
+	// need someone to act. Alerts carry their rule's severity, which may also
+	// be "critical".
+	Severity string `json:"severity"`
+	// Summary is one human-readable line, what the chat presets post.
+	Summary string  `json:"summary"`
+	Subject Subject `json:"subject"`
+	// Details holds the fields of the event type, listed in DESIGN.md.
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Subject is what an event is about.
+type Subject struct {
+	Kind string `json:"kind"` // peer, bgp_peer, zerotier, zerotier_network, interface or server
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Delivery is one attempt to send an event to a webhook.
+type Delivery struct {
+	Webhook    string    `json:"webhook"` // webhook ID
+	Event      string    `json:"event"`   // event ID
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"` // HTTP status, 0 without a response
+	DurationMS int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+	// Retrying is set when the attempt failed and another will follow.
+	Retrying bool `json:"retrying,omitempty"`
+}
+
+// OK reports whether the receiver accepted the event.
+func (d Delivery) OK() bool { return d.Error == "" }
+
+// Notifier sends events to the configured webhooks. Each webhook has its own
+// queue and goroutine, so a slow or dead receiver delays only its own events.
+type Notifier struct {
+	client *http.Client
+	host   string
+
+	mu      sync.Mutex
+	targets map[string]*target // enabled webhooks, by ID
+	log     []Delivery         // ring of the latest attempts
+	next    int
+	// peers is the previous config's view of each peer, for ConfigChanged.
+	peers map[string]peerState
+	// lastApplyError throttles repeats of the same apply failure.
+	lastApplyError     string
+	lastApplyErrorTime time.Time
+}
+
+// target is the worker of one webhook.
+type target struct {
+	mu    sync.Mutex
+	hook  models.Webhook
+	queue chan Event
+	stop  chan struct{}
+}
+
+func (t *target) current() models.Webhook {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hook
+}
+
+// New returns a notifier with no webhooks; ConfigChanged supplies them.
+func New() *Notifier {
+	host, _ := os.Hostname()
+	return &Notifier{
+		client:  &http.Client{Timeout: Timeout},
+		host:    host,
+		targets: make(map[string]*target),
+	}
+}
+
+// ConfigChanged is a config.Store OnChange callback. It starts and stops the
+// webhook workers to match cfg and notifies of peers created, deleted and
+// expired since the previous call. The first call only records the peers.
+func (n *Notifier) ConfigChanged(cfg *models.AppConfig) {
+	n.mu.Lock()
+	enabled := make(map[string]bool, len(cfg.Webhooks))
+	for _, hook := range cfg.Webhooks {
+		if !hook.Enabled {
+			continue
+		}
+		enabled[hook.ID] = true
+		// cfg is the store's own copy; keep nothing that aliases it.
+		hook.Events = slices.Clone(hook.Events)
+		if t, ok := n.targets[hook.ID]; ok {
+			t.mu.Lock()
+			t.hook = hook
+			t.mu.Unlock()
+			continue
+		}
+		t := &target{hook: hook, queue: make(chan Event, QueueSize), stop: make(chan struct{})}
+		n.targets[hook.ID] = t
+		go n.run(t)
+	}
+	for id, t := range n.targets {
+		if !enabled[id] {
+			close(t.stop)
+			delete(n.targets, id)
+		}
+	}
+
+	prev := n.peers
+	n.peers = peerStates(cfg.Peers)
+	n.mu.Unlock()
+
+	if prev != nil {
+		n.Notify(configEvents(prev, n.peers, time.Now())...)
+	}
+}
+
+// Notify queues events for every webhook that wants them. It never blocks, so
+// it is safe to call from the stats poll loop and under the config store lock.
+func (n *Notifier) Notify(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range events {
+		n.stamp(&e)
+		for _, t := range n.targets {
+			hook := t.current()
+			if !hook.Wants(e.Type) {
+				continue
+			}
+			select {
+			case t.queue <- e:
+			default:
+				n.record(Delivery{Webhook: hook.ID, Event: e.ID, Type: e.Type, Time: time.Now().UTC(), Error: "dropped: queue full"})
+			}
+		}
+	}
+}
+
+// ApplyFailed is a config.Store OnApplyError callback. The same failure is
+// reported again only after ApplyFailedRepeat, so a reapply retried on every
+// ZeroTier change cannot flood the receiver.
+func (n *Notifier) ApplyFailed(err error) {
+	now := time.Now()
+	n.mu.Lock()
+	repeat := err.Error() == n.lastApplyError && now.Sub(n.lastApplyErrorTime) < ApplyFailedRepeat
+	if !repeat {
+		n.lastApplyError, n.lastApplyErrorTime = err.Error(), now
+	}
+	n.mu.Unlock()
+	if !repeat {
+		n.Notify(applyFailedEvent(err, now))
+	}
+}
+
+// Test sends one test event to hook straight away, whether or not it is
+// enabled or subscribed to anything, and returns the attempt.
+func (n *Notifier) Test(ctx context.Context, hook models.Webhook) Delivery {
+	e := Event{
+		Type:     TestEvent,
+		Severity: "info",
+		Summary:  fmt.Sprintf("Test event for webhook %s", hook.Name),
+		Subject:  Subject{Kind: "server"},
+	}
+	n.mu.Lock()
+	n.stamp(&e)
+	n.mu.Unlock()
+
+	d := n.send(ctx, hook, e, 1)
+	n.mu.Lock()
+	n.record(d)
+	n.mu.Unlock()
+	return d
+}
+
+// Deliveries returns the latest delivery attempts to the webhook, newest
+// first, or to every webhook when id is empty.
+func (n *Notifier) Deliveries(id string) []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var out []Delivery
+	for i := range len(n.log) {
+		d := n.log[(n.next-1-i+len(n.log))%len(n.log)]
+		if id == "" || d.Webhook == id {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// stamp fills in the fields every event carries. Callers must hold the lock.
+func (n *Notifier) stamp(e *Event) {
+	e.Version = SchemaVersion
+	if e.ID == "" {
+		e.ID, _ = models.NewID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Host = n.host
+}
+
+// record adds d to the delivery log. Callers must hold the lock.
+func (n *Notifier) record(d Delivery) {
+	if !d.OK() {
+		log.Printf("webhook %s: %s %s attempt %d: %s", d.Webhook, d.Type, d.Event, d.Attempt, d.Error)
+	}
+	if len(n.log) < DeliveryLogSize {
+		n.log = append(n.log, d)
+		n.next = len(n.log) % DeliveryLogSize
+		return
+	}
+	n.log[n.next] = d
+	n.next = (n.next + 1) % DeliveryLogSize
+}
+
+// run delivers t's events in order until the webhook is removed or disabled.
+func (n *Notifier) run(t *target) {
+	for {
+		select {
+		case <-t.stop:
+			return
+		case e := <-t.queue:
+			n.deliver(t, e)
+		}
+	}
+}
+
+// deliver sends e, retrying per Backoff.
+func (n *Notifier) deliver(t *target, e Event) {
+	for attempt := 1; ; attempt++ {
+		hook := t.current()
+		d := n.send(context.Background(), hook, e, attempt)
+		d.Retrying = !d.OK() && retryable(d.Status) && attempt <= len(Backoff)
+		n.mu.Lock()
+		n.record(d)
+		n.mu.Unlock()
+		if !d.Retrying {
+			return
+		}
+		timer := time.NewTimer(Backoff[attempt-1])
+		select {
+		case <-t.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed attempt may succeed later: no response,
+// a timeout, rate limiting or a server error.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// send makes one attempt to post e to hook.
+func (n *Notifier) send(ctx context.Context, hook models.Webhook, e Event, attempt int) Delivery {
+	d := Delivery{Webhook: hook.ID, Event: e.ID, Type: e.Type, Time: time.Now().UTC(), Attempt: attempt}
+	body, err := Payload(hook.Format, e)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wg-busy-webhook")
+	req.Header.Set("X-WG-Busy-Event", e.Type)
+	req.Header.Set("X-WG-Busy-Delivery", e.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-WG-Busy-Signature", Sign(hook.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	d.DurationMS = time.Since(d.Time).Milliseconds()
+	if err != nil {
+		// The URL may carry a token, as Slack's and Discord's do; keep it out
+		// of the log.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		d.Error = err.Error()
+		return d
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	d.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.Error = resp.Status
+	}
+	return d
+}
+
+// Sign returns the X-WG-Busy-Signature header of body: "sha256=" and the hex
+// HMAC-SHA256 of the exact bytes posted, keyed with the webhook's secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Payload renders e in the webhook's format.
+func Payload(format string, e Event) ([]byte, error) {
+	text := e.Summary
+	if e.Host != "" {
+		text = "[" + e.Host + "] " + text
+	}
+	switch format {
+	case "", models.WebhookFormatJSON:
+		return json.Marshal(e)
+	case models.WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": text})
+	case models.WebhookFormatDiscord:
+		return json.Marshal(map[string]string{"content": text})
+	case models.WebhookFormatTeams:
+		color := "2EB886"
+		if e.Severity == "warning" || e.Severity == "critical" {
+			color = "D9534F"
+		}
+		facts := []map[string]string{{"name": "Event", "value": e.Type}}
+		for _, key := range slices.Sorted(maps.Keys(e.Details)) {
+			facts = append(facts, map[string]string{"name": key, "value": fmt.Sprint(e.Details[key])})
+		}
+		return json.Marshal(map[string]any{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    e.Summary,
+			"themeColor": color,
+			"title":      text,
+			"sections":   []any{map[string]any{"facts": facts}},
+		})
+	}
+	return nil, fmt.Errorf("unknown webhook format %q", format)
+}
@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/zerotier"
+)
+
+func TestDeliverySignsFiltersAndRetries(t *testing.T) {
+	saved := Backoff
+	Backoff = []time.Duration{time.Millisecond}
+	defer func() { Backoff = saved }()
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	received := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get("X-WG-Busy-Signature"))
+		first := len(bodies) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	n := New()
+	n.ConfigChanged(&models.AppConfig{Webhooks: []models.Webhook{
+		{ID: "ops", Name: "ops", Enabled: true, URL: srv.URL, Secret: "s3cret", Events: []string{models.EventBGPSessionDown}},
+		{ID: "off", Name: "off", URL: srv.URL},
+	}})
+	n.Notify(
+		Event{Type: models.EventPeerConnected, Summary: "not subscribed"},
+		Event{Type: models.EventBGPSessionDown, Summary: "BGP session with rr1 down", Subject: Subject{Kind: "bgp_peer", ID: "192.0.2.1"}},
+	)
+	for range 2 {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("delivery not retried")
+		}
+	}
+
+	// The worker records the second attempt after the receiver answered.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.Deliveries("ops")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	log := n.Deliveries("ops")
+	if len(log) != 2 || !log[0].OK() || log[0].Attempt != 2 || log[1].Status != http.StatusBadGateway || !log[1].Retrying {
+		t.Fatalf("deliveries = %+v", log)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d requests, want the one event twice", len(bodies))
+	}
+	var e Event
+	if err := json.Unmarshal(bodies[1], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != SchemaVersion || e.Type != models.EventBGPSessionDown || e.ID == "" || e.Time.IsZero() || e.Subject.ID != "192.0.2.1" {
+		t.Errorf("payload = %+v", e)
+	}
+	if signatures[1] != Sign("s3cret", bodies[1]) {
+		t.Errorf("signature %q does not match the body", signatures[1])
+	}
+}
+
+func TestPresetPayloads(t *testing.T) {
+	e := Event{Type: models.EventApplyFailed, Host: "vpn1", Severity: "warning", Summary: "Live apply failed: boom", Details: map[string]any{"error": "boom"}}
+	for format, want := range map[string]string{
+		models.WebhookFormatSlack:   `{"text":"[vpn1] Live apply failed: boom"}`,
+		models.WebhookFormatDiscord: `{"content":"[vpn1] Live apply failed: boom"}`,
+	} {
+		got, err := Payload(format, e)
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %s, %v; want %s", format, got, err, want)
+		}
+	}
+	teams, err := Payload(models.WebhookFormatTeams, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var card struct {
+		Type     string `json:"@type"`
+		Color    string `json:"themeColor"`
+		Sections []struct {
+			Facts []struct{ Name, Value string }
+		}
+	}
+	if err := json.Unmarshal(teams, &card); err != nil || card.Type != "MessageCard" || card.Color != "D9534F" || len(card.Sections) != 1 || len(card.Sections[0].Facts) != 2 {
+		t.Errorf("teams = %s", teams)
+	}
+}
+
+func TestEventsFromChanges(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	types := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.Type)
+		}
+		return out
+	}
+
+	prev := peerStates([]models.Peer{{ID: "a", Name: "a", Enabled: true}, {ID: "b", Name: "b", Enabled: true}})
+	cur := peerStates([]models.Peer{{ID: "a", Name: "a", StateReason: models.StateReasonExpired}, {ID: "c", Name: "c"}})
+	got := map[string]string{}
+	for _, e := range configEvents(prev, cur, now) {
+		got[e.Subject.ID] = e.Type
+	}
+	if len(got) != 3 || got["a"] != models.EventPeerExpired || got["b"] != models.EventPeerDeleted || got["c"] != models.EventPeerCreated {
+		t.Errorf("config events = %v", got)
+	}
+
+	routes := func(n int) []models.BGPRoute { return make([]models.BGPRoute, n) }
+	before := &models.BGPStats{Peers: []models.BGPPeerStats{
+		{IP: "192.0.2.1", State: "Established", Routes: routes(3)},
+		{IP: "192.0.2.2", State: "Active"},
+		{IP: "192.0.2.3", State: "Established", Routes: routes(3)},
+	}}
+	after := &models.BGPStats{Peers: []models.BGPPeerStats{
+		{IP: "192.0.2.1", State: "Idle"},
+		{IP: "192.0.2.2", State: "Established"},
+		{IP: "192.0.2.3", State: "Established", Routes: routes(5)},
+		{IP: "192.0.2.4", State: "Established"},
+	}}
+	bgp := bgpEvents(before, after, now)
+	if got := types(bgp); len(got) != 3 || got[0] != models.EventBGPSessionDown || got[1] != models.EventBGPSessionUp || got[2] != models.EventBGPPrefixesChanged {
+		t.Fatalf("bgp events = %v", got)
+	}
+	if bgp[2].Details["received"] != 5 || bgp[2].Details["previousReceived"] != 3 {
+		t.Errorf("prefix details = %v", bgp[2].Details)
+	}
+
+	snap := func(online bool, status string) zerotier.Snapshot {
+		return zerotier.Snapshot{Enabled: true, Running: true, Status: &zerotier.Status{Address: "abcdef0123", Online: online},
+			Networks: []zerotier.NetworkStats{{Network: zerotier.Network{ID: "8056c2e21c000001", Status: status}}}}
+	}
+	var zt zeroTierState
+	steps := []struct {
+		snap zerotier.Snapshot
+		want []string
+	}{
+		{zerotier.Snapshot{Enabled: true}, nil}, // starting
+		{snap(false, "REQUESTING_CONFIGURATION"), nil},
+		{snap(true, "OK"), nil},
+		{snap(true, "ACCESS_DENIED"), []string{models.EventZeroTierNetworkDown}},
+		{snap(false, "ACCESS_DENIED"), []string{models.EventZeroTierOffline}},
+		{snap(true, "OK"), []string{models.EventZeroTierOnline, models.EventZeroTierNetworkUp}},
+		{zerotier.Snapshot{}, nil}, // disabled
+		{snap(false, "OK"), nil},
+	}
+	for i, step := range steps {
+		if got := types(zt.update(step.snap, now)); !slices.Equal(got, step.want) {
+			t.Errorf("step %d: zerotier events = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestApplyFailedThrottlesRepeats(t *testing.T) {
+	n := New()
+	queue := make(chan Event, 10)
+	n.targets["t"] = &target{hook: models.Webhook{ID: "t", Enabled: true}, queue: queue, stop: make(chan struct{})}
+
+	n.ApplyFailed(errors.New("wg0 is down"))
+	n.ApplyFailed(errors.New("wg0 is down"))
+	n.ApplyFailed(errors.New("routing failed"))
+	if len(queue) != 2 {
+		t.Fatalf("queued %d events, want the repeat dropped", len(queue))
+	}
+	if e := <-queue; e.Type != models.EventApplyFailed || e.Details["error"] != "wg0 is down" {
+		t.Errorf("event = %+v", e)
+	}
+}
@@ -0,0 +1,149 @@
+package wgstats
+
+import (
+	"log"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// sample is one peer as read from the device.
+type sample struct {
+	PublicKey string
+	Endpoint  string
+	Handshake time.Time
+	Rx, Tx    int64
+}
+
+// reader reads the peers of wg0, appending them to dst so the caller can
+// reuse one buffer across polls.
+type reader interface {
+	read(dst []sample) ([]sample, error)
+}
+
+// newReader queries wg0 through wgctrl, falling back to wg show dump where
+// wgctrl cannot be used.
+func newReader() reader {
+	client, err := wgctrl.New()
+	if err != nil {
+		log.Printf("wgctrl unavailable, reading stats from wg show: %v", err)
+		return dumpReader{}
+	}
+	return &deviceReader{client: client, names: make(map[wgtypes.Key]*peerNames)}
+}
+
+// deviceReader asks the kernel over netlink (or wireguard-go over its UAPI
+// socket) for the device, without forking wg or parsing text. It keeps each
+// peer's base64 key and formatted endpoint, so a steady poll formats nothing.
+type deviceReader struct {
+	client *wgctrl.Client
+	names  map[wgtypes.Key]*peerNames
+	gen    uint64 // bumped every read, to find peers that left
+}
+
+type peerNames struct {
+	key       string
+	endpoint  netip.AddrPort
+	formatted string
+	gen       uint64
+}
+
+func (r *deviceReader) read(dst []sample) ([]sample, error) {
+	dev, err := r.client.Device(models.WGDevice)
+	if err != nil {
+		return dst, err
+	}
+	return r.convert(dev.Peers, dst), nil
+}
+
+func (r *deviceReader) convert(peers []wgtypes.Peer, dst []sample) []sample {
+	r.gen++
+	for i := range peers {
+		p := &peers[i]
+		names := r.names[p.PublicKey]
+		if names == nil {
+			names = &peerNames{key: p.PublicKey.String()}
+			r.names[p.PublicKey] = names
+		}
+		names.gen = r.gen
+
+		// Unmap, so IPv4 endpoints print as wg show prints them.
+		var endpoint netip.AddrPort
+		if p.Endpoint != nil {
+			ap := p.Endpoint.AddrPort()
+			endpoint = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		}
+		if endpoint != names.endpoint {
+			names.endpoint, names.formatted = endpoint, ""
+			if endpoint.IsValid() {
+				names.formatted = endpoint.String()
+			}
+		}
+
+		// A peer that never handshook reports the Unix epoch.
+		var handshake time.Time
+		if p.LastHandshakeTime.Unix() > 0 {
+			handshake = p.LastHandshakeTime
+		}
+		dst = append(dst, sample{
+			PublicKey: names.key,
+			Endpoint:  names.formatted,
+			Handshake: handshake,
+			Rx:        p.ReceiveBytes,
+			Tx:        p.TransmitBytes,
+		})
+	}
+
+	if len(r.names) > len(peers) {
+		for key, names := range r.names {
+			if names.gen != r.gen {
+				delete(r.names, key)
+			}
+		}
+	}
+	return dst
+}
+
+// dumpReader runs wg show wg0 dump.
+type dumpReader struct{}
+
+func (dumpReader) read(dst []sample) ([]sample, error) {
+	output, err := exec.Command("wg", "show", models.WGDevice, "dump").Output()
+	if err != nil {
+		return dst, err
+	}
+	return parseDump(output, dst), nil
+}
+
+// parseDump appends the peers of wg show dump output to dst.
+func parseDump(output []byte, dst []sample) []sample {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+
+	// First line is the interface. Skip it (we derive stats from peers).
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			continue
+		}
+
+		s := sample{PublicKey: fields[0], Endpoint: fields[2]}
+		if s.Endpoint == "(none)" {
+			s.Endpoint = ""
+		}
+		handshakeUnix, _ := strconv.ParseInt(fields[4], 10, 64)
+		if handshakeUnix > 0 {
+			s.Handshake = time.Unix(handshakeUnix, 0)
+		}
+		s.Rx, _ = strconv.ParseInt(fields[5], 10, 64)
+		s.Tx, _ = strconv.ParseInt(fields[6], 10, 64)
+		dst = append(dst, s)
+	}
+	return dst
+}
@@ -3,19 +3,30 @@ package wgstats
 import (
 	"fmt"
 	"math"
-	"os/exec"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/yix/wg-busy/internal/models"
 )
 
 const (
-	// PollInterval is how often we poll wg show.
+	// PollInterval is the default time between polls while someone watches the
+	// live UI.
 	PollInterval = 2 * time.Second
 
+	// IdlePollInterval is the default time between polls while no one does.
+	// Usage, quotas and history see the same bytes either way; only the rates
+	// are averaged over longer.
+	IdlePollInterval = 10 * time.Second
+
 	// HistorySize is the number of data points kept in the ring buffer (~2min at 2s).
 	HistorySize = 60
+
+	// OnlineWindow is how recent a handshake must be for a peer to count as
+	// online. WireGuard re-handshakes every two minutes while traffic flows,
+	// so a live session is never older than this.
+	OnlineWindow = 3 * time.Minute
 )
 
 // InterfaceStats holds aggregate stats for the wg interface.
@@ -29,7 +40,7 @@ type InterfaceStats struct {
 // PeerStats holds stats for a single peer.
 type PeerStats struct {
 	PublicKey       string
-	Endpoint        string
+	Endpoint        string // empty until the peer has connected
 	LatestHandshake time.Time
 	TransferRx      int64
 	TransferTx      int64
@@ -37,6 +48,32 @@ type PeerStats struct {
 	CurrentTxPS     float64
 }
 
+// Online reports whether the peer has handshaken within OnlineWindow.
+func (s PeerStats) Online(now time.Time) bool {
+	return !s.LatestHandshake.IsZero() && now.Sub(s.LatestHandshake) < OnlineWindow
+}
+
+// PeerEventKind is a change in a peer's session.
+type PeerEventKind string
+
+const (
+	PeerConnected PeerEventKind = "connected" // handshook while not online
+	PeerStale     PeerEventKind = "stale"     // last handshake is now older than OnlineWindow
+	PeerRoamed    PeerEventKind = "roamed"    // endpoint changed while online
+)
+
+// PeerEvent is a session change seen between two polls. WireGuard reports no
+// sessions, so connects and drops are derived from the handshake age.
+type PeerEvent struct {
+	PublicKey string
+	Kind      PeerEventKind
+	// Time is when it happened as far as the handshakes tell: the handshake
+	// for PeerConnected, OnlineWindow after the last one for PeerStale.
+	Time     time.Time
+	Endpoint string
+	From     string // the previous endpoint, for PeerRoamed
+}
+
 // HistoryPoint is a single bandwidth sample.
 type HistoryPoint struct {
 	Time time.Time
@@ -44,47 +81,132 @@ type HistoryPoint struct {
 	TxPS float64
 }
 
-// Collector polls wg show and collects stats.
+// Collector polls wg0 and collects stats.
 type Collector struct {
 	mu           sync.RWMutex
 	startedAt    time.Time
 	iface        InterfaceStats
-	peers        map[string]*PeerStats     // keyed by public key
-	history      []HistoryPoint            // ring buffer
-	peerHistory  map[string][]HistoryPoint // per-peer ring buffer
-	prevRx       int64
-	prevTx       int64
-	prevPeerRx   map[string]int64
-	prevPeerTx   map[string]int64
+	peers        map[string]*PeerStats // keyed by public key
+	history      ring
+	peerHistory  map[string]*ring // keyed by public key
 	prevTime     time.Time
 	isUp         bool
 	onHandshakes func(map[string]time.Time)
+	onTransfer   func(map[string]models.Transfer)
+	onEvents     func([]PeerEvent)
+	onPoll       func()
+
+	interval     time.Duration
+	idleInterval time.Duration
+	watchers     int
+	wake         chan struct{}
+
+	// Owned by the poll goroutine and reused by every poll, so a steady state
+	// allocates next to nothing however many peers there are.
+	reader     reader
+	samples    []sample
+	seen       map[string]bool
+	handshakes map[string]time.Time
+	transfers  map[string]models.Transfer
+	events     []PeerEvent
 }
 
 // NewCollector creates a new stats collector.
 func NewCollector() *Collector {
 	return &Collector{
-		peers:       make(map[string]*PeerStats),
-		peerHistory: make(map[string][]HistoryPoint),
-		prevPeerRx:  make(map[string]int64),
-		prevPeerTx:  make(map[string]int64),
+		peers:        make(map[string]*PeerStats),
+		peerHistory:  make(map[string]*ring),
+		interval:     PollInterval,
+		idleInterval: IdlePollInterval,
+		wake:         make(chan struct{}, 1),
+		seen:         make(map[string]bool),
+		handshakes:   make(map[string]time.Time),
+		transfers:    make(map[string]models.Transfer),
 	}
 }
 
 // OnHandshakes registers a callback for the latest non-zero peer handshake
 // timestamps. The callback runs after each successful poll, outside the lock.
+// The map is reused by the next poll, so the callback must not keep it.
 func (c *Collector) OnHandshakes(fn func(map[string]time.Time)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.onHandshakes = fn
 }
 
+// OnTransfer registers a callback for the bytes each peer transferred since the
+// previous poll, keyed by public key. Unlike the kernel's counters these deltas
+// carry on across wg0 restarts, so they can be summed into long-running usage.
+// The callback runs after each successful poll, outside the lock. The map is
+// reused by the next poll, so the callback must not keep it.
+func (c *Collector) OnTransfer(fn func(map[string]models.Transfer)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onTransfer = fn
+}
+
+// OnEvents registers a callback for the session changes of each poll. It runs
+// outside the lock, before the OnHandshakes callback, so state that callback
+// updates still reflects the previous poll. The slice is reused by the next
+// poll, so the callback must not keep it.
+func (c *Collector) OnEvents(fn func([]PeerEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvents = fn
+}
+
+// OnPoll registers a callback for the end of every poll, successful or not, so
+// live views can refresh as soon as new numbers exist. It runs outside the lock
+// and must not block.
+func (c *Collector) OnPoll(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onPoll = fn
+}
+
+// SetPollInterval sets the time between polls while the stats are watched
+// (see Watch) and while they are not. An idle interval shorter than interval,
+// zero included, polls at interval throughout. Call before Start.
+func (c *Collector) SetPollInterval(interval, idle time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interval = interval
+	c.idleInterval = max(idle, interval)
+}
+
+// Watch marks the stats as shown live until release is called; until then
+// polls run at the active interval. The first watcher of an idle collector
+// gets a poll as soon as the active interval allows, rather than waiting out
+// the idle one.
+func (c *Collector) Watch() (release func()) {
+	c.mu.Lock()
+	c.watchers++
+	first := c.watchers == 1
+	c.mu.Unlock()
+	if first {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.watchers--
+		})
+	}
+}
+
 // Start begins background polling. Call with startedAt set to when wg was brought up.
 func (c *Collector) Start(startedAt time.Time) {
 	c.mu.Lock()
 	c.startedAt = startedAt
 	c.mu.Unlock()
 
+	c.reader = newReader()
 	go c.pollLoop()
 }
 
@@ -135,9 +257,7 @@ func (c *Collector) GetAllPeerStats() map[string]PeerStats {
 func (c *Collector) GetHistory() []HistoryPoint {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	result := make([]HistoryPoint, len(c.history))
-	copy(result, c.history)
-	return result
+	return c.history.points()
 }
 
 // GetPeerHistory returns a copy of a specific peer's bandwidth history.
@@ -148,9 +268,7 @@ func (c *Collector) GetPeerHistory(publicKey string) []HistoryPoint {
 	if !ok {
 		return nil
 	}
-	result := make([]HistoryPoint, len(h))
-	copy(result, h)
-	return result
+	return h.points()
 }
 
 // Uptime returns the duration since WireGuard was started.
@@ -163,25 +281,52 @@ func (c *Collector) Uptime() time.Duration {
 	return time.Since(c.startedAt)
 }
 
-func (c *Collector) pollLoop() {
-	ticker := time.NewTicker(PollInterval)
-	defer ticker.Stop()
+// nextInterval is the time until the next poll: the active interval while
+// someone watches, the idle one otherwise.
+func (c *Collector) nextInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.watchers > 0 {
+		return c.interval
+	}
+	return c.idleInterval
+}
 
+func (c *Collector) pollLoop() {
 	// Do an initial poll immediately.
+	last := time.Now()
 	c.poll()
+	timer := time.NewTimer(c.nextInterval())
 
 	// ponytail: no stop channel — the collector lives as long as the process.
-	for range ticker.C {
+	for {
+		select {
+		case <-timer.C:
+		case <-c.wake:
+			// Someone started watching while idle: catch up as soon as the
+			// active interval allows.
+			if wait := c.nextInterval() - time.Since(last); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+		}
+		last = time.Now()
 		c.poll()
+		timer.Reset(c.nextInterval())
 	}
 }
 
 func (c *Collector) poll() {
-	output, err := exec.Command("wg", "show", "wg0", "dump").Output()
+	samples, err := c.reader.read(c.samples[:0])
 	now := time.Now()
 
 	c.mu.Lock()
 
+	onPoll := c.onPoll
+	if onPoll != nil {
+		defer onPoll()
+	}
+
 	if err != nil {
 		c.isUp = false
 		c.mu.Unlock()
@@ -189,94 +334,106 @@ func (c *Collector) poll() {
 	}
 
 	c.isUp = true
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) < 1 {
-		c.mu.Unlock()
-		return
+	c.samples = samples
+	c.account(samples, now)
+
+	onEvents := c.onEvents
+	onHandshakes := c.onHandshakes
+	onTransfer := c.onTransfer
+	c.mu.Unlock()
+	if onEvents != nil && len(c.events) > 0 {
+		onEvents(c.events)
+	}
+	if onHandshakes != nil && len(c.handshakes) > 0 {
+		onHandshakes(c.handshakes)
+	}
+	if onTransfer != nil && len(c.transfers) > 0 {
+		onTransfer(c.transfers)
 	}
+}
 
-	// First line is the interface. Skip it (we derive stats from peers).
-	// Parse peer lines.
-	var totalRx, totalTx int64
-	seenPeers := make(map[string]bool)
-	handshakes := make(map[string]time.Time)
+// account turns one read of the device into stats, rates, history and the
+// maps for the callbacks, updating the previous poll's entries in place.
+// c.mu must be held.
+func (c *Collector) account(samples []sample, now time.Time) {
+	var dt float64
+	if !c.prevTime.IsZero() {
+		dt = now.Sub(c.prevTime).Seconds()
+	}
+	clear(c.seen)
+	clear(c.handshakes)
+	clear(c.transfers)
+	c.events = c.events[:0]
 
-	for _, line := range lines[1:] {
-		fields := strings.Split(line, "\t")
-		if len(fields) < 8 {
-			continue
+	var totalRx, totalTx int64
+	for i := range samples {
+		s := &samples[i]
+		totalRx += s.Rx
+		totalTx += s.Tx
+		c.seen[s.PublicKey] = true
+		if !s.Handshake.IsZero() {
+			c.handshakes[s.PublicKey] = s.Handshake
 		}
 
-		pubKey := fields[0]
-		endpoint := fields[2]
-		handshakeUnix, _ := strconv.ParseInt(fields[4], 10, 64)
-		rx, _ := strconv.ParseInt(fields[5], 10, 64)
-		tx, _ := strconv.ParseInt(fields[6], 10, 64)
-
-		totalRx += rx
-		totalTx += tx
-		seenPeers[pubKey] = true
-
-		var handshake time.Time
-		if handshakeUnix > 0 {
-			handshake = time.Unix(handshakeUnix, 0)
-			handshakes[pubKey] = handshake
-		}
+		ps, known := c.peers[s.PublicKey]
+		continued := known && s.Rx >= ps.TransferRx && s.Tx >= ps.TransferTx
 
 		// Compute per-peer bandwidth.
 		var peerRxPS, peerTxPS float64
+		if continued && dt > 0 {
+			peerRxPS = float64(s.Rx-ps.TransferRx) / dt
+			peerTxPS = float64(s.Tx-ps.TransferTx) / dt
+		}
+
+		// The first poll only sets the baseline. After that a peer that is new or
+		// whose counters went backwards was (re)created by wg, so everything it
+		// has counted is new traffic.
 		if !c.prevTime.IsZero() {
-			dt := now.Sub(c.prevTime).Seconds()
-			if dt > 0 {
-				prevRx, ok1 := c.prevPeerRx[pubKey]
-				prevTx, ok2 := c.prevPeerTx[pubKey]
-				if ok1 && ok2 && rx >= prevRx && tx >= prevTx {
-					peerRxPS = float64(rx-prevRx) / dt
-					peerTxPS = float64(tx-prevTx) / dt
-				}
+			deltaRx, deltaTx := s.Rx, s.Tx
+			if continued {
+				deltaRx, deltaTx = s.Rx-ps.TransferRx, s.Tx-ps.TransferTx
+			}
+			if deltaRx > 0 || deltaTx > 0 {
+				c.transfers[s.PublicKey] = models.Transfer{Rx: uint64(deltaRx), Tx: uint64(deltaTx)}
 			}
 		}
 
-		c.peers[pubKey] = &PeerStats{
-			PublicKey:       pubKey,
-			Endpoint:        endpoint,
-			LatestHandshake: handshake,
-			TransferRx:      rx,
-			TransferTx:      tx,
-			CurrentRxPS:     peerRxPS,
-			CurrentTxPS:     peerTxPS,
+		if !c.prevTime.IsZero() {
+			c.detectEvents(ps, s, now)
 		}
 
-		c.prevPeerRx[pubKey] = rx
-		c.prevPeerTx[pubKey] = tx
-
-		// Update per-peer history.
-		ph := c.peerHistory[pubKey]
-		ph = append(ph, HistoryPoint{Time: now, RxPS: peerRxPS, TxPS: peerTxPS})
-		if len(ph) > HistorySize {
-			ph = ph[len(ph)-HistorySize:]
+		if !known {
+			ps = &PeerStats{PublicKey: s.PublicKey}
+			c.peers[s.PublicKey] = ps
 		}
-		c.peerHistory[pubKey] = ph
+		ps.Endpoint = s.Endpoint
+		ps.LatestHandshake = s.Handshake
+		ps.TransferRx, ps.TransferTx = s.Rx, s.Tx
+		ps.CurrentRxPS, ps.CurrentTxPS = peerRxPS, peerTxPS
+
+		h := c.peerHistory[s.PublicKey]
+		if h == nil {
+			h = &ring{}
+			c.peerHistory[s.PublicKey] = h
+		}
+		h.add(HistoryPoint{Time: now, RxPS: peerRxPS, TxPS: peerTxPS})
 	}
 
-	// Clean up peers that are no longer in the dump.
-	for pubKey := range c.peers {
-		if !seenPeers[pubKey] {
-			delete(c.peers, pubKey)
-			delete(c.prevPeerRx, pubKey)
-			delete(c.prevPeerTx, pubKey)
-			delete(c.peerHistory, pubKey)
+	// Clean up peers that are no longer on the device.
+	if len(c.peers) > len(c.seen) {
+		for pubKey := range c.peers {
+			if !c.seen[pubKey] {
+				delete(c.peers, pubKey)
+				delete(c.peerHistory, pubKey)
+			}
 		}
 	}
 
 	// Compute aggregate bandwidth.
 	var rxPS, txPS float64
-	if !c.prevTime.IsZero() {
-		dt := now.Sub(c.prevTime).Seconds()
-		if dt > 0 && totalRx >= c.prevRx && totalTx >= c.prevTx {
-			rxPS = float64(totalRx-c.prevRx) / dt
-			txPS = float64(totalTx-c.prevTx) / dt
-		}
+	if dt > 0 && totalRx >= c.iface.TotalRx && totalTx >= c.iface.TotalTx {
+		rxPS = float64(totalRx-c.iface.TotalRx) / dt
+		txPS = float64(totalTx-c.iface.TotalTx) / dt
 	}
 
 	c.iface = InterfaceStats{
@@ -285,22 +442,56 @@ func (c *Collector) poll() {
 		CurrentRxPS: rxPS,
 		CurrentTxPS: txPS,
 	}
-
-	c.prevRx = totalRx
-	c.prevTx = totalTx
 	c.prevTime = now
 
 	// Update aggregate history.
-	c.history = append(c.history, HistoryPoint{Time: now, RxPS: rxPS, TxPS: txPS})
-	if len(c.history) > HistorySize {
-		c.history = c.history[len(c.history)-HistorySize:]
+	c.history.add(HistoryPoint{Time: now, RxPS: rxPS, TxPS: txPS})
+}
+
+// detectEvents compares a peer's previous stats, nil for a peer new to the
+// device, with its sample and appends any session change to c.events.
+func (c *Collector) detectEvents(prev *PeerStats, s *sample, now time.Time) {
+	wasOnline := prev != nil && prev.Online(c.prevTime)
+	online := !s.Handshake.IsZero() && now.Sub(s.Handshake) < OnlineWindow
+	switch {
+	case online && !wasOnline:
+		c.events = append(c.events, PeerEvent{PublicKey: s.PublicKey, Kind: PeerConnected, Time: s.Handshake, Endpoint: s.Endpoint})
+	case wasOnline && !online:
+		// A zero handshake means wg0 recreated the peer: the session ended now.
+		at := now
+		if expired := s.Handshake.Add(OnlineWindow); !s.Handshake.IsZero() && expired.Before(now) {
+			at = expired
+		}
+		c.events = append(c.events, PeerEvent{PublicKey: s.PublicKey, Kind: PeerStale, Time: at, Endpoint: prev.Endpoint})
+	case online && prev.Endpoint != "" && s.Endpoint != "" && s.Endpoint != prev.Endpoint:
+		c.events = append(c.events, PeerEvent{PublicKey: s.PublicKey, Kind: PeerRoamed, Time: now, Endpoint: s.Endpoint, From: prev.Endpoint})
 	}
+}
 
-	onHandshakes := c.onHandshakes
-	c.mu.Unlock()
-	if onHandshakes != nil && len(handshakes) > 0 {
-		onHandshakes(handshakes)
+// ring holds the last HistorySize points. Once full, each new point
+// overwrites the oldest, at next.
+type ring struct {
+	buf  []HistoryPoint
+	next int
+}
+
+func (r *ring) add(p HistoryPoint) {
+	if len(r.buf) < HistorySize {
+		if r.buf == nil {
+			r.buf = make([]HistoryPoint, 0, HistorySize)
+		}
+		r.buf = append(r.buf, p)
+		return
 	}
+	r.buf[r.next] = p
+	r.next = (r.next + 1) % HistorySize
+}
+
+// points returns a copy of the points, oldest first.
+func (r *ring) points() []HistoryPoint {
+	result := make([]HistoryPoint, 0, len(r.buf))
+	result = append(result, r.buf[r.next:]...)
+	return append(result, r.buf[:r.next]...)
 }
 
 // RenderSparklineSVG renders an inline SVG sparkline from history data.
@@ -0,0 +1,222 @@
+package wgstats
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/yix/wg-busy/internal/models"
+)
+
+// testDevice returns n peers as wgctrl reports them and as wg show dump
+// prints them. Every third peer has never connected.
+func testDevice(n int) ([]wgtypes.Peer, []byte) {
+	peers := make([]wgtypes.Peer, n)
+	var dump strings.Builder
+	dump.WriteString("cHJpdmF0ZQ==\tcHVibGlj\t51820\toff\n")
+	for i := range peers {
+		var key wgtypes.Key
+		key[0], key[1] = byte(i), byte(i>>8)
+		p := wgtypes.Peer{
+			PublicKey:         key,
+			LastHandshakeTime: time.Unix(0, 0),
+			ReceiveBytes:      int64(1000 * i),
+			TransmitBytes:     int64(10 * i),
+		}
+		endpoint, handshake := "(none)", int64(0)
+		if i%3 != 0 {
+			p.Endpoint = &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 40000 + i}
+			p.LastHandshakeTime = time.Unix(1700000000+int64(i), 0)
+			endpoint, handshake = p.Endpoint.String(), p.LastHandshakeTime.Unix()
+		}
+		peers[i] = p
+		fmt.Fprintf(&dump, "%s\t(none)\t%s\t10.0.0.0/32\t%d\t%d\t%d\toff\n", key, endpoint, handshake, p.ReceiveBytes, p.TransmitBytes)
+	}
+	return peers, []byte(dump.String())
+}
+
+func TestDeviceReaderMatchesWgShowDump(t *testing.T) {
+	peers, dump := testDevice(6)
+	r := &deviceReader{names: make(map[wgtypes.Key]*peerNames)}
+	got := r.convert(peers, nil)
+	if want := parseDump(dump, nil); !slices.Equal(got, want) {
+		t.Fatalf("netlink read = %+v\nwg show dump = %+v", got, want)
+	}
+	if got[1].Endpoint != "192.0.2.1:40001" || got[0].Endpoint != "" || !got[0].Handshake.IsZero() {
+		t.Fatalf("samples = %+v", got[:2])
+	}
+
+	// A peer that left is forgotten.
+	r.convert(peers[1:], nil)
+	if _, ok := r.names[peers[0].PublicKey]; ok || len(r.names) != 5 {
+		t.Fatalf("names kept %d peers", len(r.names))
+	}
+}
+
+func TestAccountCountsDeltasAcrossRestarts(t *testing.T) {
+	c := NewCollector()
+	start := time.Now()
+	poll := func(at time.Duration, samples ...sample) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.account(samples, start.Add(at))
+	}
+
+	poll(0, sample{PublicKey: "a", Rx: 100, Tx: 10}, sample{PublicKey: "b", Rx: 5})
+	if len(c.transfers) != 0 {
+		t.Fatalf("baseline poll reported %v", c.transfers)
+	}
+	poll(2*time.Second, sample{PublicKey: "a", Rx: 300, Tx: 10}, sample{PublicKey: "b", Rx: 5})
+	if got := c.transfers["a"]; got != (models.Transfer{Rx: 200}) || len(c.transfers) != 1 {
+		t.Fatalf("transfers = %v", c.transfers)
+	}
+	if ps := c.GetPeerStats("a"); ps.CurrentRxPS != 100 || c.GetInterfaceStats().CurrentRxPS != 100 {
+		t.Fatalf("rates = %+v, %+v", ps, c.GetInterfaceStats())
+	}
+
+	// wg0 restarted: a's counters start over, b is gone.
+	poll(4*time.Second, sample{PublicKey: "a", Rx: 50, Tx: 1})
+	if got := c.transfers["a"]; got != (models.Transfer{Rx: 50, Tx: 1}) {
+		t.Fatalf("after restart = %v", c.transfers)
+	}
+	if c.GetPeerStats("b") != nil || c.GetPeerHistory("b") != nil {
+		t.Fatal("removed peer kept")
+	}
+
+	for i := range 2 * HistorySize {
+		poll(time.Duration(6+i)*time.Second, sample{PublicKey: "a", Rx: 50, Tx: 1})
+	}
+	h := c.GetPeerHistory("a")
+	if len(h) != HistorySize || cap(c.peerHistory["a"].buf) != HistorySize {
+		t.Fatalf("history holds %d of cap %d", len(h), cap(c.peerHistory["a"].buf))
+	}
+	if last := start.Add(time.Duration(5+2*HistorySize) * time.Second); !h[0].Time.Equal(last.Add(-(HistorySize-1)*time.Second)) || !h[HistorySize-1].Time.Equal(last) {
+		t.Fatalf("history runs %v to %v", h[0].Time, h[HistorySize-1].Time)
+	}
+}
+
+func TestAccountDerivesSessionEvents(t *testing.T) {
+	c := NewCollector()
+	start := time.Now()
+	poll := func(at time.Duration, samples ...sample) []PeerEvent {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.account(samples, start.Add(at))
+		return slices.Clone(c.events)
+	}
+
+	// The first poll is a baseline, even for a peer already online.
+	if got := poll(0, sample{PublicKey: "a"}, sample{PublicKey: "b", Handshake: start, Endpoint: "192.0.2.2:1"}); len(got) != 0 {
+		t.Fatalf("baseline events = %+v", got)
+	}
+	got := poll(2*time.Second, sample{PublicKey: "a", Handshake: start.Add(time.Second), Endpoint: "192.0.2.1:1"}, sample{PublicKey: "b", Handshake: start, Endpoint: "198.51.100.2:1"})
+	want := []PeerEvent{
+		{PublicKey: "a", Kind: PeerConnected, Time: start.Add(time.Second), Endpoint: "192.0.2.1:1"},
+		{PublicKey: "b", Kind: PeerRoamed, Time: start.Add(2 * time.Second), Endpoint: "198.51.100.2:1", From: "192.0.2.2:1"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("events = %+v", got)
+	}
+
+	// b's handshake ages out; a keeps handshaking.
+	later := OnlineWindow + time.Minute
+	got = poll(later, sample{PublicKey: "a", Handshake: start.Add(later), Endpoint: "192.0.2.1:1"}, sample{PublicKey: "b", Handshake: start, Endpoint: "198.51.100.2:1"})
+	want = []PeerEvent{{PublicKey: "b", Kind: PeerStale, Time: start.Add(OnlineWindow), Endpoint: "198.51.100.2:1"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("events = %+v", got)
+	}
+}
+
+func TestPollsSlowDownWithoutWatchers(t *testing.T) {
+	c := NewCollector()
+	c.SetPollInterval(time.Second, 30*time.Second)
+	if got := c.nextInterval(); got != 30*time.Second {
+		t.Fatalf("idle interval = %v", got)
+	}
+	release := c.Watch()
+	if got := c.nextInterval(); got != time.Second {
+		t.Fatalf("watched interval = %v", got)
+	}
+	select {
+	case <-c.wake:
+	default:
+		t.Fatal("first watcher did not wake the poll loop")
+	}
+	release()
+	release()
+	if got := c.nextInterval(); got != 30*time.Second || c.watchers != 0 {
+		t.Fatalf("after release: %v with %d watchers", got, c.watchers)
+	}
+
+	c.SetPollInterval(5*time.Second, 0)
+	if got := c.nextInterval(); got != 5*time.Second {
+		t.Fatalf("non-adaptive interval = %v", got)
+	}
+}
+
+// The benchmarks compare reading a 2,000-peer hub by parsing wg show dump
+// (the fork itself not included) with converting the device wgctrl returns,
+// and measure the accounting both feed.
+
+func BenchmarkParseDump(b *testing.B) {
+	_, dump := testDevice(2000)
+	var buf []sample
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = parseDump(dump, buf[:0])
+	}
+}
+
+func BenchmarkConvertDevice(b *testing.B) {
+	peers, _ := testDevice(2000)
+	r := &deviceReader{names: make(map[wgtypes.Key]*peerNames)}
+	var buf []sample
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = r.convert(peers, buf[:0])
+	}
+}
+
+// BenchmarkDumpRead times the fallback path end to end: forking wg show wg0
+// dump and parsing its output. It needs wg and a wg0 it may read.
+func BenchmarkDumpRead(b *testing.B) {
+	if _, err := exec.LookPath("wg"); err != nil {
+		b.Skip("wg is not installed")
+	}
+	var r dumpReader
+	buf, err := r.read(nil)
+	if err != nil {
+		b.Skipf("wg show %s dump: %v", models.WGDevice, err)
+	}
+	b.ReportMetric(float64(len(buf)), "peers")
+	b.ReportAllocs()
+	for b.Loop() {
+		if buf, err = r.read(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAccount(b *testing.B) {
+	peers, _ := testDevice(2000)
+	r := &deviceReader{names: make(map[wgtypes.Key]*peerNames)}
+	samples := r.convert(peers, nil)
+	c := NewCollector()
+	now := time.Now()
+	b.ReportAllocs()
+	for b.Loop() {
+		now = now.Add(PollInterval)
+		for i := range samples {
+			samples[i].Rx += 1500
+		}
+		c.mu.Lock()
+		c.account(samples, now)
+		c.mu.Unlock()
+	}
+}
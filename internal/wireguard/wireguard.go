@@ -17,6 +17,9 @@ import (
 var (
 	ErrInterfaceDown = errors.New("WireGuard interface wg0 is not running")
 	ErrRestartNeeded = errors.New("WireGuard requires a restart via Apply Config")
+	// ErrNoPrivateKey means the peer was imported with a key only its device
+	// knows, so there is no client config to hand out.
+	ErrNoPrivateKey = errors.New("peer's private key is not known to wg-busy: its device keeps its own config")
 )
 
 var runCommand = func(name string, args []string, stdin []byte) ([]byte, error) {
@@ -207,6 +210,9 @@ func RenderServerConfig(cfg models.AppConfig, postUpCmds, postDownCmds []string)
 		if len(p.AdvertisedRoutes) > 0 && effective != "0.0.0.0/0, ::/0" {
 			effective = fmt.Sprintf("%s, %s", effective, strings.Join(p.AdvertisedRoutes, ", "))
 		}
+		if p.DelegatedPrefix != "" && effective != "0.0.0.0/0, ::/0" && !slices.Contains(p.AdvertisedRoutes, p.DelegatedPrefix) {
+			effective = fmt.Sprintf("%s, %s", effective, p.DelegatedPrefix)
+		}
 
 		peers = append(peers, peerConfData{
 			Peer:                p,
@@ -238,6 +244,9 @@ type clientConfData struct {
 }
 
 var clientConfTmpl = template.Must(template.New("client").Parse(`[Interface]
+{{- if .Peer.DelegatedPrefix }}
+# Delegated prefix: {{ .Peer.DelegatedPrefix }} (routed to this peer; number the LAN behind it from it)
+{{- end }}
 PrivateKey = {{ .Peer.PrivateKey }}
 Address = {{ .Peer.AllowedIPs }}
 {{- if .DNS }}
@@ -268,6 +277,9 @@ func hookLines(value string) []string {
 
 // RenderClientConfig produces a client .conf file for a specific peer.
 func RenderClientConfig(server models.ServerConfig, peer models.Peer) (string, error) {
+	if peer.KeyHeld || peer.PrivateKey == "" {
+		return "", ErrNoPrivateKey
+	}
 	serverPub, err := PublicKeyFromPrivate(server.PrivateKey)
 	if err != nil {
 		return "", fmt.Errorf("deriving server public key: %w", err)
@@ -183,3 +183,44 @@ func TestRenderServerConfigSplitsMultilineHooks(t *testing.T) {
 		t.Fatalf("rendered hooks:\n%s\nwant contiguous block:\n%s", got, want)
 	}
 }
+
+func TestRenderClientConfigNeedsPrivateKey(t *testing.T) {
+	peer := models.Peer{Name: "imported", PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", AllowedIPs: "10.0.0.2/32"}
+	if _, err := RenderClientConfig(models.ServerConfig{}, peer); !errors.Is(err, ErrNoPrivateKey) {
+		t.Fatalf("err = %v, want ErrNoPrivateKey", err)
+	}
+}
+
+func TestDelegatedPrefixIsRoutedAndNamedInClientConfig(t *testing.T) {
+	server := models.ServerConfig{PrivateKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", ListenPort: 51820, Address: "10.0.0.1/24, fd00::1/64"}
+	peer := models.Peer{
+		Name:             "site",
+		PrivateKey:       "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		PublicKey:        "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		AllowedIPs:       "10.0.0.2/32, fd00::2/128",
+		AdvertisedRoutes: []string{"192.168.1.0/24"},
+		DelegatedPrefix:  "2001:db8:0:100::/56",
+		Enabled:          true,
+	}
+
+	got, err := RenderServerConfig(models.AppConfig{Server: server, Peers: []models.Peer{peer}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "AllowedIPs = 10.0.0.2/32, fd00::2/128, 192.168.1.0/24, 2001:db8:0:100::/56\n") {
+		t.Fatalf("server config:\n%s", got)
+	}
+	// Listing the prefix in AdvertisedRoutes as well does not route it twice.
+	peer.AdvertisedRoutes = append(peer.AdvertisedRoutes, peer.DelegatedPrefix)
+	if got, _ := RenderServerConfig(models.AppConfig{Server: server, Peers: []models.Peer{peer}}, nil, nil); strings.Count(got, peer.DelegatedPrefix) != 1 {
+		t.Fatalf("server config:\n%s", got)
+	}
+
+	got, err = RenderClientConfig(server, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "# Delegated prefix: 2001:db8:0:100::/56") {
+		t.Fatalf("client config:\n%s", got)
+	}
+}
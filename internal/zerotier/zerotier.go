@@ -57,12 +57,12 @@ type Snapshot struct {
 	Hint string
 }
 
-// tunDevice is what ZeroTier needs to create network interfaces. Without it the
+// TUNDevice is what ZeroTier needs to create network interfaces. Without it the
 // daemon starts and answers its API, but every network stays in PORT_ERROR.
-const tunDevice = "/dev/net/tun"
+const TUNDevice = "/dev/net/tun"
 
-// tunHint is the remediation shown when the TUN device is missing.
-const tunHint = "The container cannot access " + tunDevice + ". Add `devices: [/dev/net/tun:/dev/net/tun]` to compose.yml (or `--device /dev/net/tun` to docker run) and restart the container."
+// TUNHint is the remediation shown when the TUN device is missing.
+const TUNHint = "The container cannot access " + TUNDevice + ". Add `devices: [/dev/net/tun:/dev/net/tun]` to compose.yml (or `--device /dev/net/tun` to docker run) and restart the container."
 
 type counter struct {
 	rx, tx int64
@@ -139,7 +139,7 @@ func (l serviceLog) Write(p []byte) (int, error) {
 		l.s.mu.Lock()
 		l.s.serviceErr = line
 		if strings.Contains(strings.ToUpper(line), "TUN/TAP") {
-			l.s.hint = tunHint
+			l.s.hint = TUNHint
 		}
 		l.s.mu.Unlock()
 	}
@@ -405,9 +405,9 @@ func (s *Supervisor) ensureRunning(desired models.ZeroTierConfig) error {
 	// user with a "Running" service that does nothing.
 	s.serviceErr, s.hint = "", ""
 	if runtime.GOOS == "linux" {
-		if _, err := os.Stat(tunDevice); err != nil {
-			s.serviceErr = "ZeroTier cannot create network interfaces: " + tunDevice + " is not available."
-			s.hint = tunHint
+		if _, err := os.Stat(TUNDevice); err != nil {
+			s.serviceErr = "ZeroTier cannot create network interfaces: " + TUNDevice + " is not available."
+			s.hint = TUNHint
 			log.Printf("[ZT] %s %s", s.serviceErr, s.hint)
 		}
 	}
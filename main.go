@@ -4,18 +4,33 @@ import (
 	"embed"
 	"errors"
 	"flag"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
+	// Peer access schedules name IANA timezones; the runtime image may not ship
+	// a zoneinfo database.
+	_ "time/tzdata"
 
+	"github.com/yix/wg-busy/internal/alert"
 	"github.com/yix/wg-busy/internal/bgp"
+	"github.com/yix/wg-busy/internal/cli"
 	"github.com/yix/wg-busy/internal/config"
+	"github.com/yix/wg-busy/internal/connlog"
+	"github.com/yix/wg-busy/internal/drift"
 	"github.com/yix/wg-busy/internal/handlers"
+	"github.com/yix/wg-busy/internal/history"
 	"github.com/yix/wg-busy/internal/models"
+	"github.com/yix/wg-busy/internal/probe"
+	"github.com/yix/wg-busy/internal/quota"
+	"github.com/yix/wg-busy/internal/schedule"
+	"github.com/yix/wg-busy/internal/unixsock"
+	"github.com/yix/wg-busy/internal/webhook"
 	"github.com/yix/wg-busy/internal/wgstats"
 	"github.com/yix/wg-busy/internal/wireguard"
 	"github.com/yix/wg-busy/internal/zerotier"
@@ -27,12 +42,45 @@ var webFS embed.FS
 var version = "dev"
 
 func main() {
-	listen := flag.String("listen", ":8080", "HTTP listen address")
+	listen := flag.String("listen", ":8080", "HTTP listen address; empty serves only the admin socket")
+	socketPath := flag.String("socket", "./data/wg-busy.sock", "Unix socket serving the full API to local tools; empty disables it")
+	socketMode := flag.String("socket-mode", "0600", "File mode of -socket: who may open it may administer wg-busy")
 	configPath := flag.String("config", "./data/config.yaml", "Path to YAML config file")
 	wgConfigPath := flag.String("wg-config", "/etc/wireguard/wg0.conf", "Path to write wg0.conf")
 	ztDataPath := flag.String("zt-data", "./data/zerotier", "ZeroTier home directory (identity, authtoken, joined networks)")
+	historyPath := flag.String("history", "./data/history.jsonl", "Traffic history file (interface and per-peer, up to a month); empty disables it")
+	eventsPath := flag.String("events", "./data/events.jsonl", "Peer connection event log (connects, drops, roaming); empty disables it")
+	statsInterval := flag.Duration("stats-interval", wgstats.PollInterval, "How often to read WireGuard stats while the web UI is open")
+	statsIdleInterval := flag.Duration("stats-idle-interval", wgstats.IdlePollInterval, "How often to read WireGuard stats while no web UI is open; 0 keeps -stats-interval")
+	importPath := flag.String("import", "", "Import peers from a wg0.conf, wg show dump output or wg-easy export into the config, then exit")
+	importServer := flag.Bool("import-server", false, "With -import, also import the server settings (keys, port, addresses, hooks)")
+	apiURL := flag.String("url", os.Getenv("WG_BUSY_URL"), "Base URL of a running wg-busy for the commands to talk to; empty uses -socket. Defaults to $WG_BUSY_URL")
+	offline := flag.Bool("offline", false, "Let the commands edit -config directly, while wg-busy is stopped, instead of talking to a running instance")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: wg-busy [flags] [command]\n\nWithout a command, wg-busy runs the server.\n\n%s\nFlags:\n", cli.Usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		opts := cli.Options{URL: *apiURL, Socket: *socketPath, Offline: *offline, ConfigPath: *configPath, WGConfigPath: *wgConfigPath}
+		if err := cli.Run(opts, flag.Args(), os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "wg-busy:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *listen == "" && *socketPath == "" {
+		log.Fatalf("nothing to serve: -listen and -socket are both empty")
+	}
+	socketFileMode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil || socketFileMode > 0777 {
+		log.Fatalf("invalid -socket-mode %q: want an octal file mode such as 0660", *socketMode)
+	}
+	if *statsInterval <= 0 || *statsIdleInterval < 0 {
+		log.Fatalf("invalid -stats-interval %v / -stats-idle-interval %v: want positive durations", *statsInterval, *statsIdleInterval)
+	}
+
 	store, err := config.Load(*configPath, *wgConfigPath)
 	if err != nil {
 		log.Fatalf("loading config: %v", err)
@@ -57,6 +105,20 @@ func main() {
 			}
 		}
 	}
+	if *importPath != "" {
+		if err := runImport(os.Stdout, store, *importPath, *importServer); err != nil {
+			log.Fatalf("importing %s: %v", *importPath, err)
+		}
+		return
+	}
+
+	// Webhooks hear of every change and failed apply from here on, including
+	// those of bringing wg0 and BGP up below.
+	notifier := webhook.New()
+	store.Read(func(cfg *models.AppConfig) { notifier.ConfigChanged(cfg) })
+	store.OnChange(notifier.ConfigChanged)
+	store.OnApplyError(notifier.ApplyFailed)
+
 	// config.yaml is the source of truth. Always render it before wg-quick so a
 	// recreated container, manual YAML edit, or custom path cannot use stale state.
 	if err := store.RenderWGConfig(); err != nil {
@@ -110,6 +172,21 @@ func main() {
 	})
 	store.Read(func(cfg *models.AppConfig) { zt.Configure(cfg) })
 	zt.Start()
+	notifier.WatchBGP(bgp.GetBGPStats)
+	notifier.WatchZeroTier(zt)
+
+	var hist *history.Store
+	if *historyPath != "" {
+		if hist, err = history.Open(*historyPath); err != nil {
+			log.Printf("warning: %v; starting a new traffic history", err)
+		}
+	}
+	var events *connlog.Store
+	if *eventsPath != "" {
+		if events, err = connlog.Open(*eventsPath); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
 
 	// Go does not run defers on signals, so shut the child down explicitly —
 	// otherwise zerotier-one outlives us and keeps holding its port.
@@ -119,16 +196,89 @@ func main() {
 		sig := <-sigCh
 		log.Printf("received %s, shutting down", sig)
 		zt.Stop()
+		if err := store.FlushUsage(); err != nil {
+			log.Printf("persisting peer traffic usage: %v", err)
+		}
+		if hist != nil {
+			if err := hist.Flush(); err != nil {
+				log.Printf("persisting traffic history: %v", err)
+			}
+		}
 		os.Exit(0)
 	}()
 
 	// Start stats collector.
 	stats := wgstats.NewCollector()
+	stats.SetPollInterval(*statsInterval, *statsIdleInterval)
+	stats.OnEvents(func(changes []wgstats.PeerEvent) {
+		// Runs before OnHandshakes records this poll, so a peer never seen
+		// before still has a zero LastSeen.
+		byKey := make(map[string]models.Peer, len(changes))
+		store.Read(func(cfg *models.AppConfig) {
+			for _, p := range cfg.Peers {
+				byKey[p.PublicKey] = p
+			}
+		})
+		notifier.Notify(webhook.PeerEvents(changes, byKey)...)
+		if events == nil {
+			return
+		}
+		var entries []connlog.Event
+		for _, change := range changes {
+			peer, ok := byKey[change.PublicKey]
+			if !ok {
+				continue
+			}
+			e := connlog.Event{Peer: peer.ID, Time: change.Time, Endpoint: change.Endpoint, From: change.From}
+			switch change.Kind {
+			case wgstats.PeerConnected:
+				e.Kind = connlog.Returned
+				if peer.LastSeen.IsZero() {
+					e.Kind = connlog.FirstHandshake
+				}
+			case wgstats.PeerStale:
+				e.Kind = connlog.Stale
+			case wgstats.PeerRoamed:
+				e.Kind = connlog.EndpointChanged
+			}
+			entries = append(entries, e)
+		}
+		if err := events.Record(entries...); err != nil {
+			log.Printf("persisting connection events: %v", err)
+		}
+	})
 	stats.OnHandshakes(func(seen map[string]time.Time) {
 		if err := store.RecordPeerLastSeen(seen); err != nil {
 			log.Printf("persisting WireGuard peer last-seen times: %v", err)
 		}
 	})
+	stats.OnTransfer(func(transfers map[string]models.Transfer) {
+		now := time.Now()
+		if err := store.RecordPeerTransfer(transfers, now); err != nil {
+			log.Printf("persisting peer traffic usage: %v", err)
+		}
+		if hist == nil {
+			return
+		}
+		// History is kept by peer ID so it survives key regeneration; the
+		// interface total also counts peers config.yaml does not manage.
+		var total models.Transfer
+		for _, t := range transfers {
+			total.Rx += t.Rx
+			total.Tx += t.Tx
+		}
+		byID := make(map[string]models.Transfer, len(transfers))
+		store.Read(func(cfg *models.AppConfig) {
+			for _, p := range cfg.Peers {
+				if t, ok := transfers[p.PublicKey]; ok {
+					byID[p.ID] = t
+				}
+			}
+		})
+		if err := hist.Record(total, byID, now); err != nil {
+			log.Printf("persisting traffic history: %v", err)
+		}
+	})
 	if !wgStartedAt.IsZero() {
 		stats.Start(wgStartedAt)
 	} else {
@@ -136,15 +286,61 @@ func main() {
 		stats.Start(time.Now())
 	}
 
+	// Access schedules and data quotas toggle peers through the store, after
+	// wg0 and BGP have had their first chance to come up.
+	schedule.New(store).Start()
+	quota.New(store).Start()
+
+	// Alert rules read the same live state the UI shows. Firing and resolved
+	// alerts go to the webhooks subscribed to them and to the mail relay.
+	alerts := alert.New(store, alert.Sources{InterfaceUp: stats.IsUp, BGP: bgp.GetBGPStats, ZeroTier: zt.Snapshot}, notifier)
+	store.OnChange(alerts.ConfigChanged)
+	alerts.Start()
+
+	// Reachability probes ping the selected peers through wg0; their results
+	// join the traffic history.
+	probes := probe.New(store, hist)
+	probes.Start()
+
+	// The drift watcher checks that the kernel still holds the installed
+	// routing state, and reinstalls it when the server's RepairRouting is set.
+	drifts := drift.New(store)
+	drifts.Start()
+
 	webContent, err := fs.Sub(webFS, "web")
 	if err != nil {
 		log.Fatalf("embedded filesystem: %v", err)
 	}
 
-	mux := handlers.NewRouter(store, webContent, stats, zt, version)
+	mux := handlers.NewRouter(handlers.Deps{
+		Store:    store,
+		WebFS:    webContent,
+		Stats:    stats,
+		History:  hist,
+		Events:   events,
+		Notifier: notifier,
+		Alerts:   alerts,
+		Probes:   probes,
+		Drifts:   drifts,
+		ZeroTier: zt,
+		Version:  version,
+	})
 
-	log.Printf("wg-busy %s listening on %s", version, *listen)
-	if err := http.ListenAndServe(*listen, mux); err != nil {
-		log.Fatalf("server error: %v", err)
+	// The socket serves the same API as the TCP listener; its file mode is the
+	// only access control, so the UI can be bound to localhost behind a proxy
+	// while scripts on the host still manage everything.
+	serveErr := make(chan error, 2)
+	if *socketPath != "" {
+		ln, err := unixsock.Listen(*socketPath, os.FileMode(socketFileMode))
+		if err != nil {
+			log.Fatalf("admin socket: %v", err)
+		}
+		log.Printf("wg-busy %s admin API on unix socket %s", version, *socketPath)
+		go func() { serveErr <- http.Serve(ln, mux) }()
+	}
+	if *listen != "" {
+		log.Printf("wg-busy %s listening on %s", version, *listen)
+		go func() { serveErr <- http.ListenAndServe(*listen, mux) }()
 	}
+	log.Fatalf("server error: %v", <-serveErr)
 }